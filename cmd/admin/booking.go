@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package admin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"git.rob.mx/nidito/chinampa/pkg/command"
+	"git.rob.mx/nidito/puerta/cmd/cli"
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/booking"
+	"github.com/sirupsen/logrus"
+)
+
+var BookingImportCommand = &command.Command{
+	Path:        []string{"admin", "bookings", "import"},
+	Summary:     "Creates guests from a calendar of bookings",
+	Description: "Reads an ics file or url and creates, updates or disables a guest for every booking in it, printing the credentials of new guests. Importing the same calendar again only applies what changed, bookings previously imported from the same source that are missing from it get cancelled",
+	Arguments: command.Arguments{
+		{
+			Name:        "calendar",
+			Description: "the path or url of an ics file",
+			Required:    true,
+		},
+	},
+	Options: cli.Options(command.Options{
+		"source": {
+			Type:        "string",
+			Default:     "upload",
+			Description: "names the calendar, bookings are tracked per source",
+		},
+	}),
+	Action: func(cmd *command.Command) error {
+		calendar := cmd.Arguments[0].ToString()
+		source := cmd.Options["source"].ToString()
+
+		cfg, err := cli.Config(cmd)
+		if err != nil {
+			return err
+		}
+
+		if err := cfg.Bookings.Validate(); err != nil {
+			return fmt.Errorf("invalid bookings config: %w", err)
+		}
+
+		loc, err := cfg.Location()
+		if err != nil {
+			return err
+		}
+
+		var events []*booking.Event
+		if strings.HasPrefix(calendar, "https://") || strings.HasPrefix(calendar, "http://") {
+			events, err = booking.Fetch(calendar, loc)
+		} else {
+			var f *os.File
+			if f, err = os.Open(calendar); err != nil {
+				return fmt.Errorf("could not open calendar: %w", err)
+			}
+			defer f.Close()
+			events, err = booking.ParseICS(f, loc)
+		}
+		if err != nil {
+			return err
+		}
+
+		sess, err := cfg.OpenDB()
+		if err != nil {
+			return err
+		}
+
+		result, err := booking.Import(sess, cfg.Bookings, source, events, time.Now())
+		// guests created before an error are still worth knowing about
+		audit.RecordAdmin(sess, audit.NewCLI(audit.ActionBookingsImport, source, nil, map[string]string{"result": result.String()}))
+		if err != nil {
+			return err
+		}
+
+		logrus.Infof("Imported %s: %s", source, result)
+		if len(result.Created) == 0 {
+			return nil
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "HANDLE\tPASSWORD\tNAME\tCHECK IN\tCHECK OUT")
+		for _, i := range result.Created {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", i.Handle, i.Password, i.Name, i.CheckIn.Format("2006-01-02 15:04"), i.CheckOut.Format("2006-01-02 15:04"))
+		}
+		return tw.Flush()
+	},
+}
@@ -0,0 +1,51 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package admin
+
+import (
+	"fmt"
+
+	"git.rob.mx/nidito/chinampa/pkg/command"
+	"git.rob.mx/nidito/puerta/cmd/cli"
+	"git.rob.mx/nidito/puerta/internal/push"
+	"git.rob.mx/nidito/puerta/internal/server"
+	"github.com/sirupsen/logrus"
+)
+
+var JobsRunCommand = &command.Command{
+	Path:        []string{"admin", "jobs", "run"},
+	Summary:     "Runs maintenance jobs",
+	Description: "Runs the named job, or every job if none is given. Jobs are: sessions, challenges, users, log and bookings",
+	Arguments: command.Arguments{
+		{
+			Name:        "name",
+			Description: "the job to run",
+		},
+	},
+	Options: cli.Options(nil),
+	Action: func(cmd *command.Command) error {
+		name := cmd.Arguments[0].ToString()
+
+		cfg, sess, err := cli.Open(cmd)
+		if err != nil {
+			return err
+		}
+
+		push.Initialize(cfg.WebPush)
+		scheduler := server.NewScheduler(cfg, sess)
+		names := scheduler.Names()
+		if name != "" {
+			names = []string{name}
+		}
+
+		for _, job := range names {
+			status, err := scheduler.Run(job)
+			if err != nil {
+				return fmt.Errorf("job %s failed: %s", job, err)
+			}
+			logrus.Infof("%s: %s (took %s)", job, status.Result, status.Duration)
+		}
+
+		return nil
+	},
+}
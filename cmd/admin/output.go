@@ -0,0 +1,68 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"git.rob.mx/nidito/chinampa/pkg/command"
+	"git.rob.mx/nidito/puerta/internal/roster"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/upper/db/v4"
+)
+
+// formatOption lets commands print a table for people or json for scripts
+func formatOption() *command.Option {
+	return &command.Option{
+		Type:        "string",
+		Default:     "table",
+		Description: "table or json",
+	}
+}
+
+// outputFormat reads a command's --format, failing for unknown ones
+func outputFormat(cmd *command.Command) (string, error) {
+	format := cmd.Options["format"].ToString()
+	switch format {
+	case "", "table":
+		return "table", nil
+	case "json":
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown format %q, use table or json", format)
+}
+
+func printJSON(data any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(data)
+}
+
+// printResult prints every field an import changes
+func printResult(result *roster.Result) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HANDLE\tACTION\tFIELD\tFROM\tTO")
+	for _, d := range result.Created {
+		for _, c := range d.Changes {
+			fmt.Fprintf(tw, "%s\tcreate\t%s\t%s\t%s\n", d.Handle, c.Field, c.From, c.To)
+		}
+	}
+	for _, d := range result.Updated {
+		for _, c := range d.Changes {
+			fmt.Fprintf(tw, "%s\tupdate\t%s\t%s\t%s\n", d.Handle, c.Field, c.From, c.To)
+		}
+	}
+	return tw.Flush()
+}
+
+// findUser loads the user with handle
+func findUser(sess db.Session, handle string) (*user.User, error) {
+	u := &user.User{}
+	if err := sess.Get(u, db.Cond{"handle": handle}); err != nil {
+		return nil, fmt.Errorf("could not find user named %s: %s", handle, err)
+	}
+	return u, nil
+}
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package admin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"git.rob.mx/nidito/chinampa/pkg/command"
+	"git.rob.mx/nidito/puerta/cmd/cli"
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/sirupsen/logrus"
+)
+
+var RoleListCommand = &command.Command{
+	Path:        []string{"admin", "role", "list"},
+	Summary:     "Lists roles and their permissions",
+	Description: "",
+	Options:     cli.Options(nil),
+	Action: func(cmd *command.Command) error {
+		_, sess, err := cli.Open(cmd)
+		if err != nil {
+			return err
+		}
+
+		roles, err := user.ListRoles(sess)
+		if err != nil {
+			return fmt.Errorf("could not list roles: %s", err)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ROLE\tPERMISSIONS\tDESCRIPTION")
+		for _, r := range roles {
+			permissions := make([]string, len(r.Permissions))
+			for i, p := range r.Permissions {
+				permissions[i] = string(p)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Name, strings.Join(permissions, ","), r.Description)
+		}
+		return tw.Flush()
+	},
+}
+
+var RoleSetCommand = &command.Command{
+	Path:        []string{"admin", "role", "set"},
+	Summary:     "Creates or updates a role",
+	Description: "Replaces the permissions of a role, one of door:open, log:view, users:guests, users:admins or devices:manage",
+	Arguments: command.Arguments{
+		{
+			Name:        "name",
+			Description: "the role to create or update",
+			Required:    true,
+		},
+		{
+			Name:        "permissions",
+			Description: "the permissions to grant this role",
+			Variadic:    true,
+		},
+	},
+	Options: cli.Options(command.Options{
+		"description": {
+			Type:        "string",
+			Description: "what this role is for",
+			Default:     "",
+		},
+	}),
+	Action: func(cmd *command.Command) error {
+		role := &user.Role{
+			Name:        cmd.Arguments[0].ToString(),
+			Description: cmd.Options["description"].ToString(),
+			Permissions: []user.Permission{},
+		}
+
+		permissions, _ := cmd.Arguments[1].ToValue().([]string)
+		for _, name := range permissions {
+			p, err := user.ParsePermission(name)
+			if err != nil {
+				return err
+			}
+			role.Permissions = append(role.Permissions, p)
+		}
+
+		_, sess, err := cli.Open(cmd)
+		if err != nil {
+			return err
+		}
+
+		// new roles have nothing to keep or compare against
+		before, _ := user.FetchRole(sess, role.Name)
+		if role.Description == "" && before != nil {
+			role.Description = before.Description
+		}
+
+		if err := user.SaveRole(sess, role); err != nil {
+			return fmt.Errorf("could not save role %s: %s", role.Name, err)
+		}
+
+		audit.RecordAdmin(sess, audit.NewCLI(audit.ActionRoleSet, role.Name, before, role))
+		logrus.Infof("Saved role %s with permissions %v", role.Name, role.Permissions)
+		return nil
+	},
+}
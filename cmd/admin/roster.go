@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package admin
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"git.rob.mx/nidito/chinampa/pkg/command"
+	"git.rob.mx/nidito/puerta/cmd/cli"
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/roster"
+	"github.com/sirupsen/logrus"
+)
+
+var UserExportCommand = &command.Command{
+	Path:        []string{"admin", "user", "export"},
+	Summary:     "Exports every user",
+	Description: "Writes every user's handle, name, schedule, ttl, expiry, flags and groups as yaml, json or csv, to be edited and imported back with `puerta admin user import`, or into another instance",
+	Options: cli.Options(command.Options{
+		"format": {
+			Type:        "string",
+			Default:     "",
+			Description: "yaml, json or csv. Defaults to the output's extension, or yaml",
+		},
+		"output": {
+			Type:        "string",
+			Default:     "",
+			Description: "the file to write to, instead of stdout",
+		},
+		"passwords": {
+			Type:        "bool",
+			Description: "include password hashes, so users keep their passwords on another instance",
+		},
+	}),
+	Action: func(cmd *command.Command) error {
+		output := cmd.Options["output"].ToString()
+		passwords := cmd.Options["passwords"].ToValue().(bool)
+
+		format, err := rosterFormat(cmd.Options["format"].ToString(), output)
+		if err != nil {
+			return err
+		}
+
+		_, sess, err := cli.Open(cmd)
+		if err != nil {
+			return err
+		}
+
+		records, err := roster.Export(sess, passwords)
+		if err != nil {
+			return fmt.Errorf("could not export users: %w", err)
+		}
+
+		var out io.Writer = os.Stdout
+		if output != "" {
+			f, err := os.Create(output)
+			if err != nil {
+				return fmt.Errorf("could not create %s: %w", output, err)
+			}
+			defer f.Close()
+			out = f
+		}
+
+		if err := roster.Encode(out, format, records); err != nil {
+			return err
+		}
+
+		if output != "" {
+			logrus.Infof("Exported %d users to %s", len(records), output)
+		}
+		return nil
+	},
+}
+
+var UserImportCommand = &command.Command{
+	Path:        []string{"admin", "user", "import"},
+	Summary:     "Creates or updates users from a file",
+	Description: "Reads users as written by `puerta admin user export`, creating those with an unknown handle and replacing every field of the rest, groups included, so fields left out are reset to their defaults. Nothing is written if any user is invalid. Use --dry-run to only print what would change",
+	Arguments: command.Arguments{
+		{
+			Name:        "file",
+			Description: "the yaml, json or csv file to read users from",
+			Required:    true,
+		},
+	},
+	Options: cli.Options(command.Options{
+		"format": {
+			Type:        "string",
+			Default:     "",
+			Description: "yaml, json or csv. Defaults to the file's extension",
+		},
+		"dry-run": {
+			Type:        "bool",
+			Description: "print what would change without changing anything",
+		},
+	}),
+	Action: func(cmd *command.Command) error {
+		file := cmd.Arguments[0].ToString()
+		dryRun := cmd.Options["dry-run"].ToValue().(bool)
+
+		format, err := rosterFormat(cmd.Options["format"].ToString(), file)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return fmt.Errorf("could not open %s: %w", file, err)
+		}
+		defer f.Close()
+
+		records, err := roster.Decode(f, format)
+		if err != nil {
+			return err
+		}
+
+		_, sess, err := cli.Open(cmd)
+		if err != nil {
+			return err
+		}
+
+		result, err := roster.Import(sess, records, dryRun)
+		if err != nil {
+			return err
+		}
+
+		if err := printResult(result); err != nil {
+			return err
+		}
+
+		verb := "Imported"
+		if dryRun {
+			verb = "Would import"
+		} else {
+			result.Record(sess, audit.NewCLI)
+		}
+		logrus.Infof("%s %d users: %d created, %d updated, %d unchanged", verb, len(records), len(result.Created), len(result.Updated), len(result.Unchanged))
+		return nil
+	},
+}
+
+// rosterFormat returns the format named, or the one of path
+func rosterFormat(name, path string) (roster.Format, error) {
+	if name != "" {
+		return roster.ParseFormat(name)
+	}
+
+	if path == "" {
+		return roster.FormatYAML, nil
+	}
+	return roster.FormatOf(path)
+}
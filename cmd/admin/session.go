@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package admin
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"git.rob.mx/nidito/chinampa/pkg/command"
+	"git.rob.mx/nidito/puerta/cmd/cli"
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/auth"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
+)
+
+var UserSessionsCommand = &command.Command{
+	Path:        []string{"admin", "user", "sessions"},
+	Summary:     "Lists a user's active sessions",
+	Description: "",
+	Arguments: command.Arguments{
+		{
+			Name:        "handle",
+			Description: "the username to list sessions for",
+			Required:    true,
+		},
+	},
+	Options: cli.Options(nil),
+	Action: func(cmd *command.Command) error {
+		handle := cmd.Arguments[0].ToString()
+
+		_, sess, err := cli.Open(cmd)
+		if err != nil {
+			return err
+		}
+
+		u := &user.User{}
+		if err := sess.Get(u, db.Cond{"handle": handle}); err != nil {
+			return fmt.Errorf("could not find user named %s: %s", handle, err)
+		}
+
+		sessions, err := auth.ListSessions(sess, u.ID)
+		if err != nil {
+			return fmt.Errorf("could not list sessions for %s: %s", handle, err)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tCREATED\tLAST SEEN\tEXPIRES\tIP\tUSER AGENT")
+		for _, s := range sessions {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.Created.Format(time.RFC3339), s.LastSeen.Format(time.RFC3339), s.Expires.Format(time.RFC3339), s.IpAddress, s.UserAgent)
+		}
+		return tw.Flush()
+	},
+}
+
+var UserRevokeCommand = &command.Command{
+	Path:        []string{"admin", "user", "revoke"},
+	Summary:     "Revokes a user's sessions",
+	Description: "Logs a user out of a single session, or every session if no id is given",
+	Arguments: command.Arguments{
+		{
+			Name:        "handle",
+			Description: "the username to revoke sessions for",
+			Required:    true,
+		},
+		{
+			Name:        "session",
+			Description: "the id of the session to revoke, see `puerta admin user sessions`",
+		},
+	},
+	Options: cli.Options(nil),
+	Action: func(cmd *command.Command) error {
+		handle := cmd.Arguments[0].ToString()
+		id := cmd.Arguments[1].ToString()
+
+		_, sess, err := cli.Open(cmd)
+		if err != nil {
+			return err
+		}
+
+		u := &user.User{}
+		if err := sess.Get(u, db.Cond{"handle": handle}); err != nil {
+			return fmt.Errorf("could not find user named %s: %s", handle, err)
+		}
+
+		if id == "" {
+			if err := auth.RevokeSessions(sess, u.ID); err != nil {
+				return fmt.Errorf("could not revoke sessions for %s: %s", handle, err)
+			}
+			audit.RecordAdmin(sess, audit.NewCLI(audit.ActionUserSessions, u.Handle, map[string]string{"sessions": "all"}, nil))
+			logrus.Infof("Revoked all sessions for user %s", u.Name)
+			return nil
+		}
+
+		if err := auth.RevokeSession(sess, u.ID, id); err != nil {
+			return fmt.Errorf("could not revoke session %s for %s: %s", id, handle, err)
+		}
+		audit.RecordAdmin(sess, audit.NewCLI(audit.ActionUserSessions, u.Handle, map[string]string{"sessions": id}, nil))
+		logrus.Infof("Revoked session %s for user %s", id, u.Name)
+		return nil
+	},
+}
@@ -0,0 +1,195 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package admin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"git.rob.mx/nidito/chinampa/pkg/command"
+	"git.rob.mx/nidito/puerta/cmd/cli"
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/auth"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
+)
+
+var TokenCreateCommand = &command.Command{
+	Path:        []string{"admin", "token", "create"},
+	Summary:     "Creates an api token for a user",
+	Description: "Prints a token to use in `Authorization: Bearer` headers, i.e. from home automation. It is shown only once",
+	Arguments: command.Arguments{
+		{
+			Name:        "handle",
+			Description: "the username the token acts as",
+			Required:    true,
+		},
+		{
+			Name:        "name",
+			Description: "what the token is for",
+			Required:    true,
+		},
+	},
+	Options: cli.Options(command.Options{
+		"scopes": {
+			Type:        "string",
+			Description: "comma separated scopes for the token: rex, log:read or users:write",
+			Default:     string(auth.ScopeRex),
+		},
+		"expires": {
+			Type:        "string",
+			Description: "how long the token lasts, i.e. 720h. Leave empty for tokens that never expire",
+			Default:     "",
+		},
+		"skip-2fa": {
+			Type:        "bool",
+			Description: "exempt requests made with this token from the user's second factor",
+		},
+	}),
+	Action: func(cmd *command.Command) error {
+		handle := cmd.Arguments[0].ToString()
+		skip := cmd.Options["skip-2fa"].ToValue().(bool)
+
+		scopes := []auth.Scope{}
+		for _, name := range strings.Split(cmd.Options["scopes"].ToString(), ",") {
+			scope, err := auth.ParseScope(strings.TrimSpace(name))
+			if err != nil {
+				return err
+			}
+			scopes = append(scopes, scope)
+		}
+
+		var expires *time.Time
+		if lifetime := cmd.Options["expires"].ToString(); lifetime != "" {
+			d, err := time.ParseDuration(lifetime)
+			if err != nil {
+				return fmt.Errorf("could not decode expires %s: %s", lifetime, err)
+			}
+			t := time.Now().Add(d).UTC()
+			expires = &t
+		}
+
+		cfg, err := cli.Config(cmd)
+		if err != nil {
+			return err
+		}
+
+		if err := auth.UseSessionKey(cfg.Auth.SessionKey); err != nil {
+			return err
+		}
+
+		sess, err := cfg.OpenDB()
+		if err != nil {
+			return err
+		}
+
+		u := &user.User{}
+		if err := sess.Get(u, db.Cond{"handle": handle}); err != nil {
+			return fmt.Errorf("could not find user named %s: %s", handle, err)
+		}
+
+		// tokens made from the command line are owned by whoever runs it, so they count as personal
+		token, err := auth.NewAPIToken(sess, u, u, cmd.Arguments[1].ToString(), scopes, expires, skip)
+		if err != nil {
+			return fmt.Errorf("could not create token for %s: %s", handle, err)
+		}
+
+		logged := *token
+		logged.Token = ""
+		audit.RecordAdmin(sess, audit.NewCLI(audit.ActionTokenCreate, u.Handle, nil, &logged))
+		logrus.Infof("Created token %s for user %s with scopes %v, skipping 2fa: %v", token.ID, u.Name, token.Scopes, skip)
+		fmt.Println(token.Token)
+		return nil
+	},
+}
+
+var TokenListCommand = &command.Command{
+	Path:        []string{"admin", "token", "list"},
+	Summary:     "Lists a user's api tokens",
+	Description: "",
+	Arguments: command.Arguments{
+		{
+			Name:        "handle",
+			Description: "the username to list tokens for",
+			Required:    true,
+		},
+	},
+	Options: cli.Options(nil),
+	Action: func(cmd *command.Command) error {
+		handle := cmd.Arguments[0].ToString()
+
+		_, sess, err := cli.Open(cmd)
+		if err != nil {
+			return err
+		}
+
+		u := &user.User{}
+		if err := sess.Get(u, db.Cond{"handle": handle}); err != nil {
+			return fmt.Errorf("could not find user named %s: %s", handle, err)
+		}
+
+		tokens, err := auth.ListAPITokens(sess, u.ID)
+		if err != nil {
+			return fmt.Errorf("could not list tokens for %s: %s", handle, err)
+		}
+
+		formatTime := func(t *time.Time) string {
+			if t == nil {
+				return "never"
+			}
+			return t.Format(time.RFC3339)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tKIND\tSCOPES\tSKIPS 2FA\tCREATED BY\tEXPIRES\tLAST USED")
+		for _, t := range tokens {
+			scopes, _ := t.Scopes.MarshalDB()
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%v\t%s\t%s\t%s\n", t.ID, t.Name, t.Kind, scopes, t.SkipSecondFactor, t.CreatedBy, formatTime(t.Expires), formatTime(t.LastUsed))
+		}
+		return tw.Flush()
+	},
+}
+
+var TokenRevokeCommand = &command.Command{
+	Path:        []string{"admin", "token", "revoke"},
+	Summary:     "Revokes a user's api token",
+	Description: "",
+	Arguments: command.Arguments{
+		{
+			Name:        "handle",
+			Description: "the username to revoke a token for",
+			Required:    true,
+		},
+		{
+			Name:        "token",
+			Description: "the id of the token to revoke, see `puerta admin token list`",
+			Required:    true,
+		},
+	},
+	Options: cli.Options(nil),
+	Action: func(cmd *command.Command) error {
+		handle := cmd.Arguments[0].ToString()
+		id := cmd.Arguments[1].ToString()
+
+		_, sess, err := cli.Open(cmd)
+		if err != nil {
+			return err
+		}
+
+		u := &user.User{}
+		if err := sess.Get(u, db.Cond{"handle": handle}); err != nil {
+			return fmt.Errorf("could not find user named %s: %s", handle, err)
+		}
+
+		if err := auth.RevokeAPIToken(sess, u.ID, id); err != nil {
+			return fmt.Errorf("could not revoke token %s for %s: %s", id, handle, err)
+		}
+		audit.RecordAdmin(sess, audit.NewCLI(audit.ActionTokenRevoke, u.Handle, map[string]string{"id": id}, nil))
+		logrus.Infof("Revoked token %s for user %s", id, u.Name)
+		return nil
+	},
+}
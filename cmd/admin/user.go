@@ -3,17 +3,22 @@
 package admin
 
 import (
+	"bufio"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"git.rob.mx/nidito/chinampa/pkg/command"
-	"git.rob.mx/nidito/puerta/internal/server"
+	"git.rob.mx/nidito/puerta/cmd/cli"
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/auth"
+	"git.rob.mx/nidito/puerta/internal/roster"
 	"git.rob.mx/nidito/puerta/internal/user"
 	"github.com/sirupsen/logrus"
 	"github.com/upper/db/v4"
-	"github.com/upper/db/v4/adapter/sqlite"
-	"golang.org/x/crypto/bcrypt"
-	"gopkg.in/yaml.v3"
 )
 
 var UserReset2faCommand = &command.Command{
@@ -27,37 +32,13 @@ var UserReset2faCommand = &command.Command{
 			Required:    true,
 		},
 	},
-	Options: command.Options{
-		"db": {
-			Type:        "string",
-			Default:     "./puerta.db",
-			Description: "the database to operate on",
-		},
-		"config": {
-			Type:    "string",
-			Default: "./config.joao.yaml",
-		},
-	},
+	Options: cli.Options(nil),
 	Action: func(cmd *command.Command) error {
-		config := cmd.Options["config"].ToValue().(string)
-		dbPath := cmd.Options["db"].ToValue().(string)
-		cfg := server.ConfigDefaults(dbPath)
 		handle := cmd.Arguments[0].ToString()
 
-		data, err := os.ReadFile(config)
+		_, sess, err := cli.Open(cmd)
 		if err != nil {
-			return fmt.Errorf("could not read config file: %w", err)
-		}
-
-		if err := yaml.Unmarshal(data, &cfg); err != nil {
-			return fmt.Errorf("could not unserialize yaml at %s: %w", config, err)
-		}
-
-		sess, err := sqlite.Open(sqlite.ConnectionURL{
-			Database: cfg.DB,
-		})
-		if err != nil {
-			return fmt.Errorf("could not open connection to db: %s", err)
+			return err
 		}
 
 		u := &user.User{}
@@ -70,15 +51,25 @@ var UserReset2faCommand = &command.Command{
 			return fmt.Errorf("could not fetch credentials for user named %s: %s", handle, err)
 		}
 
-		if !u.HasCredentials() {
+		if err := u.FetchTOTP(sess); err != nil {
+			return fmt.Errorf("could not fetch totp for user named %s: %s", handle, err)
+		}
+
+		if !u.HasCredentials() && !u.HasTOTP() {
 			return fmt.Errorf("User %s has no credentials to delete", handle)
 		}
 
+		before := map[string]bool{"passkeys": u.HasCredentials(), "totp": u.HasTOTP()}
 		if err := u.DeleteCredentials(sess); err != nil {
 			return fmt.Errorf("could not delete credentials for user named %s: %s", handle, err)
 		}
 
-		logrus.Infof("Deleted webauthn credentials for user %s", u.Name)
+		if err := u.DeleteTOTP(sess); err != nil {
+			return fmt.Errorf("could not delete totp for user named %s: %s", handle, err)
+		}
+
+		audit.RecordAdmin(sess, audit.NewCLI(audit.ActionUserReset2FA, u.Handle, before, map[string]bool{"passkeys": false, "totp": false}))
+		logrus.Infof("Deleted second factor credentials for user %s", u.Name)
 		return nil
 	},
 }
@@ -104,17 +95,7 @@ var UserAddCommand = &command.Command{
 			Required:    true,
 		},
 	},
-	Options: command.Options{
-		"config": {
-			Type:        "string",
-			Default:     "./config.joao.yaml",
-			Description: "the config to read from",
-		},
-		"db": {
-			Type:        "string",
-			Default:     "./puerta.db",
-			Description: "the database to operate on",
-		},
+	Options: cli.Options(command.Options{
 		"ttl": {
 			Type:        "string",
 			Description: "the ttl to set for the user",
@@ -137,49 +118,109 @@ var UserAddCommand = &command.Command{
 		},
 		"admin": {
 			Type:        "bool",
-			Description: "make this user an admin",
+			Description: "make this user an admin, same as --role admin",
 		},
-	},
+		"role": {
+			Type:        "string",
+			Description: "the role to give this user, see `puerta admin role list`",
+			Default:     user.RoleGuest,
+		},
+		"totp": {
+			Type:        "bool",
+			Description: "allow this user to use totp as a second factor",
+		},
+		"max-sessions": {
+			Type:        "string",
+			Description: "the number of devices this user can be logged in at once, 0 for no limit. Defaults to 1, or 0 for admins",
+			Default:     "",
+		},
+		"max-entries": {
+			Type:        "string",
+			Description: "the number of times this user can open the door, 0 for no limit",
+			Default:     "",
+		},
+		"single-use": {
+			Type:        "bool",
+			Description: "expire this user right after their first entry, i.e. for couriers",
+		},
+		"ask-approval": {
+			Type:        "bool",
+			Description: "let this user ask admins to let them in outside of their schedule",
+		},
+		"timezone": {
+			Type:        "string",
+			Description: "the timezone to evaluate this user's schedule in, i.e. America/Mexico_City. Defaults to the house's",
+			Default:     "",
+		},
+		"locale": {
+			Type:        "string",
+			Description: "the language to show this user messages in, es or en. Defaults to their browser's",
+			Default:     "",
+		},
+	}),
 	Action: func(cmd *command.Command) error {
-		config := cmd.Options["config"].ToValue().(string)
-		db := cmd.Options["db"].ToValue().(string)
-
 		expires := cmd.Options["expires"].ToString()
 		schedule := cmd.Options["schedule"].ToString()
 		ttl := cmd.Options["ttl"].ToString()
 		greeting := cmd.Options["greeting"].ToString()
-		admin := cmd.Options["admin"].ToValue().(bool)
+		role := cmd.Options["role"].ToString()
+		if cmd.Options["admin"].ToValue().(bool) {
+			role = user.RoleAdmin
+		}
+		totp := cmd.Options["totp"].ToValue().(bool)
+		maxSessions := cmd.Options["max-sessions"].ToString()
+		maxEntries := cmd.Options["max-entries"].ToString()
+		singleUse := cmd.Options["single-use"].ToValue().(bool)
+		askApproval := cmd.Options["ask-approval"].ToValue().(bool)
+		timezone := cmd.Options["timezone"].ToString()
+		locale := cmd.Options["locale"].ToString()
 
-		data, err := os.ReadFile(config)
+		_, sess, err := cli.Open(cmd)
 		if err != nil {
-			return fmt.Errorf("could not read config file: %w", err)
+			return err
 		}
 
-		cfg := server.ConfigDefaults(db)
+		if _, err := user.FetchRole(sess, role); err != nil {
+			return err
+		}
 
-		if err := yaml.Unmarshal(data, &cfg); err != nil {
-			return fmt.Errorf("could not unserialize yaml at %s: %w", config, err)
+		u := &user.User{
+			Name:        cmd.Arguments[1].ToString(),
+			Handle:      cmd.Arguments[0].ToString(),
+			Greeting:    greeting,
+			Role:        role,
+			AllowTOTP:   totp,
+			MaxSessions: 1,
+			SingleUse:   singleUse,
+			AskApproval: askApproval,
+			Timezone:    timezone,
+			Locale:      locale,
 		}
 
-		sess, err := sqlite.Open(sqlite.ConnectionURL{
-			Database: cfg.DB,
-			// Options:  {},
-		})
-		if err != nil {
-			return fmt.Errorf("could not open connection to db: %s", err)
+		if err := u.ValidateLocale(); err != nil {
+			return err
 		}
 
-		password, err := bcrypt.GenerateFromPassword([]byte(cmd.Arguments[2].ToString()), bcrypt.DefaultCost)
-		if err != nil {
-			return fmt.Errorf("could not hash password: %s", err)
+		if err := u.SetPassword(cmd.Arguments[2].ToString()); err != nil {
+			return err
 		}
 
-		u := &user.User{
-			Name:     cmd.Arguments[1].ToString(),
-			Password: string(password),
-			Handle:   cmd.Arguments[0].ToString(),
-			Greeting: greeting,
-			IsAdmin:  admin,
+		if role == user.RoleAdmin {
+			u.MaxSessions = 0
+		}
+
+		if maxSessions != "" {
+			u.MaxSessions, err = strconv.Atoi(maxSessions)
+			if err != nil {
+				return fmt.Errorf("could not decode max-sessions %s: %s", maxSessions, err)
+			}
+		}
+
+		if maxEntries != "" {
+			u.MaxEntries, err = strconv.Atoi(maxEntries)
+			if err != nil {
+				return fmt.Errorf("could not decode max-entries %s: %s", maxEntries, err)
+			}
 		}
 
 		if ttl != "" {
@@ -209,8 +250,507 @@ var UserAddCommand = &command.Command{
 			return fmt.Errorf("failed to insert %s", err)
 		}
 
+		audit.RecordAdmin(sess, audit.NewCLI(audit.ActionUserCreate, u.Handle, nil, u))
 		logrus.Infof("Created user %s with ID: %d", u.Name, res.ID())
 		return nil
 
 	},
 }
+
+var UserListCommand = &command.Command{
+	Path:        []string{"admin", "user", "list"},
+	Summary:     "Lists users",
+	Description: "Lists every user, or those with a role, in a group or already expired",
+	Options: cli.Options(command.Options{
+		"role": {
+			Type:        "string",
+			Description: "only list users with this role",
+			Default:     "",
+		},
+		"group": {
+			Type:        "string",
+			Description: "only list members of this group",
+			Default:     "",
+		},
+		"expired": {
+			Type:        "bool",
+			Description: "only list expired users",
+		},
+		"format": formatOption(),
+	}),
+	Action: func(cmd *command.Command) error {
+		role := cmd.Options["role"].ToString()
+		group := cmd.Options["group"].ToString()
+		expired := cmd.Options["expired"].ToValue().(bool)
+		format, err := outputFormat(cmd)
+		if err != nil {
+			return err
+		}
+
+		_, sess, err := cli.Open(cmd)
+		if err != nil {
+			return err
+		}
+
+		records, err := roster.Export(sess, false)
+		if err != nil {
+			return fmt.Errorf("could not list users: %s", err)
+		}
+
+		now := time.Now()
+		matches := []*roster.Record{}
+		for _, r := range records {
+			if role != "" && r.Role != role {
+				continue
+			}
+
+			if group != "" && !inGroup(r, group) {
+				continue
+			}
+
+			if expired {
+				expires, err := time.Parse(time.RFC3339, r.Expires)
+				if err != nil || expires.After(now) {
+					continue
+				}
+			}
+			matches = append(matches, r)
+		}
+
+		if format == "json" {
+			return printJSON(matches)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "HANDLE\tNAME\tROLE\tGROUPS\tSCHEDULE\tEXPIRES")
+		for _, r := range matches {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Handle, r.Name, r.Role, strings.Join(r.Groups, ","), r.Schedule, r.Expires)
+		}
+		return tw.Flush()
+	},
+}
+
+func inGroup(r *roster.Record, group string) bool {
+	for _, g := range r.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// userDetails is everything an admin may want to know about a user
+type userDetails struct {
+	*roster.Record
+	Policy   *user.Policy `json:"policy"`
+	Passkeys int          `json:"passkeys"`
+	TOTP     bool         `json:"totp"`
+	Sessions int          `json:"sessions"`
+}
+
+var UserShowCommand = &command.Command{
+	Path:        []string{"admin", "user", "show"},
+	Summary:     "Shows a user",
+	Description: "Shows a user's settings, the policy their groups hold them to and how many devices they use",
+	Arguments: command.Arguments{
+		{
+			Name:        "handle",
+			Description: "the username to show",
+			Required:    true,
+		},
+	},
+	Options: cli.Options(command.Options{
+		"format": formatOption(),
+	}),
+	Action: func(cmd *command.Command) error {
+		handle := cmd.Arguments[0].ToString()
+		format, err := outputFormat(cmd)
+		if err != nil {
+			return err
+		}
+
+		_, sess, err := cli.Open(cmd)
+		if err != nil {
+			return err
+		}
+
+		u, err := findUser(sess, handle)
+		if err != nil {
+			return err
+		}
+
+		policy, err := u.Policy(sess)
+		if err != nil {
+			return fmt.Errorf("could not find the policy for %s: %s", handle, err)
+		}
+
+		if err := u.FetchCredentials(sess); err != nil {
+			return fmt.Errorf("could not fetch credentials for %s: %s", handle, err)
+		}
+
+		if err := u.FetchTOTP(sess); err != nil {
+			return fmt.Errorf("could not fetch totp for %s: %s", handle, err)
+		}
+
+		sessions, err := auth.ListSessions(sess, u.ID)
+		if err != nil {
+			return fmt.Errorf("could not list sessions for %s: %s", handle, err)
+		}
+
+		details := &userDetails{
+			Record:   roster.FromUser(u, policy.Groups),
+			Policy:   policy,
+			Passkeys: len(u.Passkeys()),
+			TOTP:     u.HasTOTP(),
+			Sessions: len(sessions),
+		}
+
+		if format == "json" {
+			return printJSON(details)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		values := details.Values()
+		for i, column := range roster.Columns() {
+			if values[i] != "" {
+				fmt.Fprintf(tw, "%s\t%s\n", column, values[i])
+			}
+		}
+
+		permissions := make([]string, len(policy.Permissions))
+		for i, p := range policy.Permissions {
+			permissions[i] = string(p)
+		}
+		fmt.Fprintf(tw, "permissions\t%s\n", strings.Join(permissions, ","))
+		if policy.Schedule != nil {
+			fmt.Fprintf(tw, "effective schedule\t%s\n", policy.Schedule)
+		}
+		if policy.Expires != nil && !policy.Expires.Time().IsZero() {
+			fmt.Fprintf(tw, "effective expires\t%s\n", policy.Expires.Time().Format(time.RFC3339))
+		}
+		fmt.Fprintf(tw, "passkeys\t%d\n", details.Passkeys)
+		fmt.Fprintf(tw, "totp\t%v\n", details.TOTP)
+		fmt.Fprintf(tw, "sessions\t%d\n", details.Sessions)
+		return tw.Flush()
+	},
+}
+
+// changeUser applies change to a user's record and saves it the way imports
+// do, printing every field that changed
+func changeUser(sess db.Session, handle string, dryRun bool, change func(r *roster.Record) error) error {
+	u, err := findUser(sess, handle)
+	if err != nil {
+		return err
+	}
+
+	if err := u.FetchGroups(sess); err != nil {
+		return fmt.Errorf("could not fetch groups for %s: %s", handle, err)
+	}
+
+	record := roster.FromUser(u, u.Groups())
+	if err := change(record); err != nil {
+		return err
+	}
+
+	result, err := roster.Import(sess, []*roster.Record{record}, dryRun)
+	if err != nil {
+		return err
+	}
+
+	if len(result.Updated) == 0 {
+		logrus.Infof("Nothing to change for user %s", handle)
+		return nil
+	}
+
+	if !dryRun {
+		result.Record(sess, audit.NewCLI)
+	}
+	return printResult(result)
+}
+
+// updateColumns maps the options of `user update` to the columns they change
+var updateColumns = map[string]string{
+	"name":               "name",
+	"greeting":           "greeting",
+	"role":               "role",
+	"schedule":           "schedule",
+	"ttl":                "max_ttl",
+	"expires":            "expires",
+	"timezone":           "timezone",
+	"locale":             "locale",
+	"second-factor":      "second_factor",
+	"totp":               "allow_totp",
+	"notifications":      "receives_notifications",
+	"single-use":         "single_use",
+	"ask-approval":       "ask_approval",
+	"max-sessions":       "max_sessions",
+	"max-entries":        "max_entries",
+	"max-daily-entries":  "max_daily_entries",
+	"max-window-entries": "max_window_entries",
+	"groups":             "groups",
+}
+
+func updateOptions() command.Options {
+	options := command.Options{
+		"dry-run": {
+			Type:        "bool",
+			Description: "print what would change without changing anything",
+		},
+	}
+
+	for name, column := range updateColumns {
+		options[name] = &command.Option{
+			Type:        "string",
+			Description: fmt.Sprintf("the new %s, use none to clear it", strings.ReplaceAll(column, "_", " ")),
+			Default:     "",
+		}
+	}
+	return cli.Options(options)
+}
+
+var UserUpdateCommand = &command.Command{
+	Path:        []string{"admin", "user", "update"},
+	Summary:     "Updates a user",
+	Description: "Changes only the fields given as options, validating them like `puerta admin user import` does. Flags take true or false, and groups a comma separated list",
+	Arguments: command.Arguments{
+		{
+			Name:        "handle",
+			Description: "the username to update",
+			Required:    true,
+		},
+	},
+	Options: updateOptions(),
+	Action: func(cmd *command.Command) error {
+		handle := cmd.Arguments[0].ToString()
+		dryRun := cmd.Options["dry-run"].ToValue().(bool)
+
+		_, sess, err := cli.Open(cmd)
+		if err != nil {
+			return err
+		}
+
+		return changeUser(sess, handle, dryRun, func(r *roster.Record) error {
+			for name, column := range updateColumns {
+				value := cmd.Options[name].ToString()
+				if value == "" {
+					continue
+				}
+
+				if value == "none" {
+					value = ""
+				}
+
+				if err := r.Set(column, value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	},
+}
+
+var UserDeleteCommand = &command.Command{
+	Path:        []string{"admin", "user", "delete"},
+	Summary:     "Deletes a user",
+	Description: "Deletes a user along with their sessions and group memberships",
+	Arguments: command.Arguments{
+		{
+			Name:        "handle",
+			Description: "the username to delete",
+			Required:    true,
+		},
+	},
+	Options: cli.Options(nil),
+	Action: func(cmd *command.Command) error {
+		handle := cmd.Arguments[0].ToString()
+
+		_, sess, err := cli.Open(cmd)
+		if err != nil {
+			return err
+		}
+
+		u, err := findUser(sess, handle)
+		if err != nil {
+			return err
+		}
+
+		err = sess.Tx(func(tx db.Session) error {
+			if err := auth.RevokeSessions(tx, u.ID); err != nil {
+				return err
+			}
+
+			if err := user.SetGroups(tx, u, nil); err != nil {
+				return err
+			}
+
+			return tx.Collection("user").Find(db.Cond{"id": u.ID}).Delete()
+		})
+		if err != nil {
+			return fmt.Errorf("could not delete user %s: %s", handle, err)
+		}
+
+		audit.RecordAdmin(sess, audit.NewCLI(audit.ActionUserDelete, u.Handle, u, nil))
+		logrus.Infof("Deleted user %s", u.Name)
+		return nil
+	},
+}
+
+var UserExpireCommand = &command.Command{
+	Path:        []string{"admin", "user", "expire"},
+	Summary:     "Expires a user",
+	Description: "Expires a user right away, or at the given time, logging them out of every device once expired",
+	Arguments: command.Arguments{
+		{
+			Name:        "handle",
+			Description: "the username to expire",
+			Required:    true,
+		},
+	},
+	Options: cli.Options(command.Options{
+		"at": {
+			Type:        "string",
+			Description: "when to expire the user, as an RFC3339 timestamp. Defaults to now",
+			Default:     "",
+		},
+	}),
+	Action: func(cmd *command.Command) error {
+		handle := cmd.Arguments[0].ToString()
+		now := time.Now()
+		at := now
+		if value := cmd.Options["at"].ToString(); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return fmt.Errorf("could not decode at %s: %s", value, err)
+			}
+			at = t
+		}
+
+		_, sess, err := cli.Open(cmd)
+		if err != nil {
+			return err
+		}
+
+		err = changeUser(sess, handle, false, func(r *roster.Record) error {
+			r.Expires = at.UTC().Truncate(time.Second).Format(time.RFC3339)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if at.After(now) {
+			return nil
+		}
+
+		u, err := findUser(sess, handle)
+		if err != nil {
+			return err
+		}
+
+		if err := auth.RevokeSessions(sess, u.ID); err != nil {
+			return fmt.Errorf("could not revoke sessions for %s: %s", handle, err)
+		}
+		audit.RecordAdmin(sess, audit.NewCLI(audit.ActionUserSessions, u.Handle, map[string]string{"sessions": "all"}, nil))
+		logrus.Infof("Expired user %s and revoked their sessions", u.Name)
+		return nil
+	},
+}
+
+var UserSetPasswordCommand = &command.Command{
+	Path:        []string{"admin", "user", "set-password"},
+	Summary:     "Sets a user's password",
+	Description: "Sets a new password for a user and logs them out of every device. The password is read from stdin unless given, to keep it out of the shell's history",
+	Arguments: command.Arguments{
+		{
+			Name:        "handle",
+			Description: "the username to set a password for",
+			Required:    true,
+		},
+		{
+			Name:        "password",
+			Description: "the new password",
+		},
+	},
+	Options: cli.Options(nil),
+	Action: func(cmd *command.Command) error {
+		handle := cmd.Arguments[0].ToString()
+		password := cmd.Arguments[1].ToString()
+
+		if password == "" {
+			fmt.Fprintf(os.Stderr, "New password for %s: ", handle)
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				return fmt.Errorf("could not read password: %s", err)
+			}
+			password = strings.TrimRight(line, "\r\n")
+		}
+
+		_, sess, err := cli.Open(cmd)
+		if err != nil {
+			return err
+		}
+
+		u, err := findUser(sess, handle)
+		if err != nil {
+			return err
+		}
+
+		before := *u
+		if err := u.SetPassword(password); err != nil {
+			return err
+		}
+
+		if err := sess.Collection("user").Find(db.Cond{"id": u.ID}).Update(db.Cond{"password": u.Password}); err != nil {
+			return fmt.Errorf("could not set password for %s: %s", handle, err)
+		}
+
+		if err := auth.RevokeSessions(sess, u.ID); err != nil {
+			return fmt.Errorf("could not revoke sessions for %s: %s", handle, err)
+		}
+
+		audit.RecordAdmin(sess, audit.NewCLI(audit.ActionUserPassword, u.Handle, &before, u))
+		logrus.Infof("Set a new password for user %s", u.Name)
+		return nil
+	},
+}
+
+// roleCommand changes a user's role, to defaultRole unless another is given
+func roleCommand(name, summary, defaultRole string) *command.Command {
+	return &command.Command{
+		Path:        []string{"admin", "user", name},
+		Summary:     summary,
+		Description: fmt.Sprintf("Gives a user the %s role, or the one given with --role. See `puerta admin role list`", defaultRole),
+		Arguments: command.Arguments{
+			{
+				Name:        "handle",
+				Description: "the username to change the role of",
+				Required:    true,
+			},
+		},
+		Options: cli.Options(command.Options{
+			"role": {
+				Type:        "string",
+				Description: "the role to give the user",
+				Default:     defaultRole,
+			},
+		}),
+		Action: func(cmd *command.Command) error {
+			handle := cmd.Arguments[0].ToString()
+			role := cmd.Options["role"].ToString()
+
+			_, sess, err := cli.Open(cmd)
+			if err != nil {
+				return err
+			}
+
+			return changeUser(sess, handle, false, func(r *roster.Record) error {
+				r.Role = role
+				return nil
+			})
+		},
+	}
+}
+
+var UserPromoteCommand = roleCommand("promote", "Makes a user an admin", user.RoleAdmin)
+
+var UserDemoteCommand = roleCommand("demote", "Makes a user a guest", user.RoleGuest)
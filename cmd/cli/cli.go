@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+
+// Package cli holds what puerta's commands share to find their config and database
+package cli
+
+import (
+	"fmt"
+
+	"git.rob.mx/nidito/chinampa/pkg/command"
+	"git.rob.mx/nidito/puerta/internal/server"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/upper/db/v4"
+)
+
+// Options returns the options of commands that read the config, along with extra
+func Options(extra command.Options) command.Options {
+	options := command.Options{
+		"config": {
+			Type:        "string",
+			Default:     "./config.joao.yaml",
+			Description: "the config to read from",
+		},
+		"db": {
+			Type:        "string",
+			Default:     "./puerta.db",
+			Description: "the database to operate on",
+		},
+	}
+
+	for name, option := range extra {
+		options[name] = option
+	}
+	return options
+}
+
+// Config reads the config named by a command's options, applying its
+// password policy to the passwords commands set
+func Config(cmd *command.Command) (*server.Config, error) {
+	config := cmd.Options["config"].ToValue().(string)
+	dbPath := cmd.Options["db"].ToValue().(string)
+	cfg, err := server.LoadConfig(config, dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := user.ConfigurePasswords(cfg.Passwords); err != nil {
+		return nil, fmt.Errorf("invalid passwords config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Open reads the config named by a command's options and connects to its database
+func Open(cmd *command.Command) (*server.Config, db.Session, error) {
+	cfg, err := Config(cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sess, err := cfg.OpenDB()
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, sess, nil
+}
@@ -3,16 +3,14 @@ package db
 import (
 	"embed"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
 	"git.rob.mx/nidito/chinampa/pkg/command"
-	"git.rob.mx/nidito/puerta/internal/server"
+	"git.rob.mx/nidito/puerta/cmd/cli"
+	"git.rob.mx/nidito/puerta/internal/auth"
 	"github.com/sirupsen/logrus"
 	"github.com/upper/db/v4"
-	"github.com/upper/db/v4/adapter/sqlite"
-	"gopkg.in/yaml.v3"
 )
 
 //go:embed migrations/*
@@ -44,41 +42,17 @@ var MigrationsCommand = &command.Command{
 	Path:        []string{"db", "migrate"},
 	Summary:     "Runs database migrations",
 	Description: "",
-	Options: command.Options{
-		"config": {
-			Type:    "string",
-			Default: "./config.joao.yaml",
-		},
-		"db": {
-			Type:    "string",
-			Default: "./puerta.db",
-		},
-	},
+	Options:     cli.Options(nil),
 	Action: func(cmd *command.Command) error {
-		config := cmd.Options["config"].ToValue().(string)
-		dbPath := cmd.Options["db"].ToValue().(string)
-
-		data, err := os.ReadFile(config)
+		cfg, err := cli.Config(cmd)
 		if err != nil {
-			return fmt.Errorf("could not read config file: %w", err)
-		}
-
-		cfg := server.ConfigDefaults(dbPath)
-
-		if err := yaml.Unmarshal(data, &cfg); err != nil {
-			return fmt.Errorf("could not unserialize yaml at %s: %w", config, err)
+			return err
 		}
 
 		logger := logrus.New()
 		logger.SetFormatter(&logrus.JSONFormatter{DisableTimestamp: false})
 
-		sess, err := sqlite.Open(sqlite.ConnectionURL{
-			Database: cfg.DB,
-			Options: map[string]string{
-				"_journal":      "WAL",
-				"_busy_timeout": "5000",
-			},
-		})
+		sess, err := cfg.OpenDB()
 		if err != nil {
 			return err
 		}
@@ -131,6 +105,19 @@ var MigrationsCommand = &command.Command{
 			}
 		}
 
+		hashed, err := auth.HashLegacySessions(sess, cfg.Auth.SessionKey)
+		if err != nil {
+			return fmt.Errorf("could not hash legacy session tokens: %w", err)
+		}
+
+		if hashed > 0 {
+			if cfg.Auth.SessionKey == "" {
+				logger.Warnf("Deleted %d legacy sessions since auth.session_key is not set", hashed)
+			} else {
+				logger.Infof("Hashed %d legacy session tokens", hashed)
+			}
+		}
+
 		return nil
 	},
 }
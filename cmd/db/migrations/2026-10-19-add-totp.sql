@@ -0,0 +1,10 @@
+CREATE TABLE totp(
+  user INTEGER NOT NULL UNIQUE,
+  secret TEXT NOT NULL,
+  last_counter INTEGER DEFAULT 0 NOT NULL,
+  FOREIGN KEY(user) REFERENCES user(id) ON DELETE CASCADE
+);
+
+CREATE INDEX totp_user ON totp(user);
+
+ALTER TABLE user ADD COLUMN allow_totp BOOLEAN DEFAULT 0 NOT NULL;
@@ -0,0 +1,9 @@
+CREATE TABLE recovery_code(
+  user INTEGER NOT NULL,
+  hash TEXT NOT NULL,
+  FOREIGN KEY(user) REFERENCES user(id) ON DELETE CASCADE
+);
+
+CREATE INDEX recovery_code_user ON recovery_code(user);
+
+ALTER TABLE log ADD COLUMN event VARCHAR(255) DEFAULT "rex" NOT NULL;
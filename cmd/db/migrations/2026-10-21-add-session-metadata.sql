@@ -0,0 +1,24 @@
+CREATE TABLE session_new(
+  token TEXT PRIMARY KEY,
+  id TEXT NOT NULL UNIQUE,
+  user INTEGER NOT NULL,
+  expires DATETIME NOT NULL,
+  created DATETIME NOT NULL,
+  last_seen DATETIME NOT NULL,
+  ip_address VARCHAR(255) DEFAULT "" NOT NULL,
+  user_agent VARCHAR(255) DEFAULT "" NOT NULL,
+  FOREIGN KEY(user) REFERENCES user(id) ON DELETE CASCADE
+);
+
+INSERT INTO session_new (token, id, user, expires, created, last_seen)
+  SELECT token, lower(hex(randomblob(16))), user, expires, datetime('now'), datetime('now') FROM session;
+
+DROP TABLE session;
+ALTER TABLE session_new RENAME TO session;
+
+CREATE INDEX session_token ON session(token);
+CREATE INDEX session_user ON session(user);
+
+ALTER TABLE user ADD COLUMN max_sessions INTEGER DEFAULT 1 NOT NULL;
+-- admins used to keep every session around
+UPDATE user SET max_sessions = 0 WHERE is_admin;
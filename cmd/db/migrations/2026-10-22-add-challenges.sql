@@ -0,0 +1,7 @@
+CREATE TABLE challenge(
+  token TEXT PRIMARY KEY,
+  data BLOB NOT NULL,
+  expiry DATETIME NOT NULL
+);
+
+CREATE INDEX challenge_expiry ON challenge(expiry);
@@ -0,0 +1,7 @@
+-- sessions are looked up by a keyed hash of their token from now on, plain
+-- text tokens are flagged as legacy and hashed by `puerta db migrate`
+ALTER TABLE session RENAME COLUMN token TO hash;
+ALTER TABLE session ADD COLUMN legacy BOOLEAN DEFAULT 0 NOT NULL;
+UPDATE session SET legacy = 1;
+
+DROP INDEX session_token;
@@ -0,0 +1,31 @@
+CREATE TABLE role(
+  name TEXT PRIMARY KEY,
+  description TEXT DEFAULT "" NOT NULL
+);
+
+CREATE TABLE role_permission(
+  role TEXT NOT NULL,
+  permission TEXT NOT NULL,
+  PRIMARY KEY(role, permission),
+  FOREIGN KEY(role) REFERENCES role(name) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+INSERT INTO role (name, description) VALUES
+  ("admin", "Manages everything"),
+  ("house-sitter", "Manages guests while the house is away"),
+  ("guest", "Opens the door within their schedule");
+
+INSERT INTO role_permission (role, permission) VALUES
+  ("admin", "door:open"),
+  ("admin", "log:view"),
+  ("admin", "users:guests"),
+  ("admin", "users:admins"),
+  ("admin", "devices:manage"),
+  ("house-sitter", "door:open"),
+  ("house-sitter", "log:view"),
+  ("house-sitter", "users:guests"),
+  ("guest", "door:open");
+
+ALTER TABLE user ADD COLUMN role TEXT DEFAULT "guest" NOT NULL;
+UPDATE user SET role = "admin" WHERE is_admin;
+ALTER TABLE user DROP COLUMN is_admin;
@@ -0,0 +1,18 @@
+CREATE TABLE api_token(
+  id TEXT PRIMARY KEY,
+  hash TEXT NOT NULL UNIQUE,
+  user INTEGER NOT NULL,
+  name TEXT DEFAULT "" NOT NULL,
+  kind VARCHAR(16) DEFAULT "personal" NOT NULL, -- personal or service
+  scopes TEXT NOT NULL, -- comma separated, see auth.Scope
+  skip_second_factor BOOLEAN DEFAULT 0 NOT NULL,
+  created_by VARCHAR(255) NOT NULL,
+  created DATETIME NOT NULL,
+  expires DATETIME,
+  last_used DATETIME,
+  FOREIGN KEY(user) REFERENCES user(id) ON DELETE CASCADE
+);
+
+CREATE INDEX api_token_user ON api_token(user);
+
+ALTER TABLE log ADD COLUMN token TEXT DEFAULT "" NOT NULL;
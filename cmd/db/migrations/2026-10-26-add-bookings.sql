@@ -0,0 +1,14 @@
+CREATE TABLE booking(
+  uid TEXT PRIMARY KEY, -- the event's UID in its calendar
+  source VARCHAR(255) NOT NULL, -- the calendar it was imported from
+  user INTEGER NOT NULL,
+  summary TEXT DEFAULT "" NOT NULL,
+  check_in DATETIME NOT NULL,
+  check_out DATETIME NOT NULL,
+  cancelled BOOLEAN DEFAULT 0 NOT NULL,
+  updated DATETIME NOT NULL,
+  FOREIGN KEY(user) REFERENCES user(id) ON DELETE CASCADE
+);
+
+CREATE INDEX booking_user ON booking(user);
+CREATE INDEX booking_source ON booking(source);
@@ -0,0 +1,13 @@
+CREATE TABLE house_event(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  kind VARCHAR(16) NOT NULL, -- blackout or override
+  starts DATETIME NOT NULL,
+  ends DATETIME NOT NULL,
+  reason TEXT DEFAULT "" NOT NULL,
+  handles TEXT DEFAULT "" NOT NULL, -- comma separated, who the event applies to
+  roles TEXT DEFAULT "" NOT NULL, -- comma separated, who the event applies to
+  created_by VARCHAR(255) NOT NULL,
+  created DATETIME NOT NULL
+);
+
+CREATE INDEX house_event_ends ON house_event(ends);
@@ -0,0 +1,6 @@
+ALTER TABLE user ADD COLUMN max_entries INTEGER DEFAULT 0 NOT NULL;
+ALTER TABLE user ADD COLUMN max_daily_entries INTEGER DEFAULT 0 NOT NULL;
+ALTER TABLE user ADD COLUMN max_window_entries INTEGER DEFAULT 0 NOT NULL;
+ALTER TABLE user ADD COLUMN single_use BOOLEAN DEFAULT 0 NOT NULL; -- expires after the first entry
+
+CREATE INDEX log_user_event ON log(user, event, timestamp);
@@ -0,0 +1,15 @@
+ALTER TABLE user ADD COLUMN ask_approval BOOLEAN DEFAULT 0 NOT NULL;
+
+CREATE TABLE approval(
+  id TEXT PRIMARY KEY,
+  user INTEGER NOT NULL,
+  handle VARCHAR(255) NOT NULL,
+  status VARCHAR(16) NOT NULL, -- pending, approved, denied or expired
+  created DATETIME NOT NULL,
+  expires DATETIME NOT NULL,
+  decided_by VARCHAR(255) DEFAULT "" NOT NULL,
+  decided DATETIME,
+  FOREIGN KEY(user) REFERENCES user(id) ON DELETE CASCADE
+);
+
+CREATE INDEX approval_status ON approval(status, expires);
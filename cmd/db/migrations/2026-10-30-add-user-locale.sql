@@ -0,0 +1,2 @@
+ALTER TABLE user ADD COLUMN timezone VARCHAR(64) DEFAULT "" NOT NULL;
+ALTER TABLE user ADD COLUMN locale VARCHAR(16) DEFAULT "" NOT NULL;
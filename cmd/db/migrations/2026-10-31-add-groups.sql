@@ -0,0 +1,25 @@
+CREATE TABLE user_group(
+  name TEXT PRIMARY KEY,
+  description TEXT DEFAULT "" NOT NULL,
+  schedule TEXT, -- golang user.Schedule
+  max_ttl TEXT, -- golang user.TTL
+  expires TEXT, -- datetime
+  receives_notifications BOOLEAN DEFAULT 0 NOT NULL
+);
+
+CREATE TABLE user_group_permission(
+  group_name TEXT NOT NULL,
+  permission TEXT NOT NULL,
+  PRIMARY KEY(group_name, permission),
+  FOREIGN KEY(group_name) REFERENCES user_group(name) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE user_group_member(
+  group_name TEXT NOT NULL,
+  user INTEGER NOT NULL,
+  PRIMARY KEY(group_name, user),
+  FOREIGN KEY(group_name) REFERENCES user_group(name) ON DELETE CASCADE ON UPDATE CASCADE,
+  FOREIGN KEY(user) REFERENCES user(id) ON DELETE CASCADE
+);
+
+CREATE INDEX user_group_member_user ON user_group_member(user);
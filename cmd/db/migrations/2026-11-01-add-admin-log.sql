@@ -0,0 +1,12 @@
+CREATE TABLE admin_log(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  timestamp TEXT NOT NULL,
+  actor TEXT NOT NULL, -- a handle, or cli:<system user>
+  action VARCHAR(64) NOT NULL, -- see audit.Action
+  target TEXT DEFAULT "" NOT NULL,
+  changes TEXT DEFAULT "[]" NOT NULL, -- json list of audit.Change
+  ip_address VARCHAR(255) DEFAULT "" NOT NULL
+);
+
+CREATE INDEX admin_log_timestamp ON admin_log(timestamp);
+CREATE INDEX admin_log_target ON admin_log(target, timestamp);
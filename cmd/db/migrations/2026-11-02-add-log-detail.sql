@@ -0,0 +1,4 @@
+ALTER TABLE log ADD COLUMN detail TEXT DEFAULT "" NOT NULL; -- what a successful event did
+
+UPDATE log SET detail = failure, failure = NULL
+WHERE (error IS NULL OR error = '') AND failure IS NOT NULL AND failure != '';
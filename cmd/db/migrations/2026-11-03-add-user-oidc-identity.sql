@@ -0,0 +1,4 @@
+ALTER TABLE user ADD COLUMN oidc_issuer TEXT DEFAULT "" NOT NULL;
+ALTER TABLE user ADD COLUMN oidc_subject TEXT DEFAULT "" NOT NULL; -- unique per oidc_issuer once set
+
+CREATE UNIQUE INDEX user_oidc ON user(oidc_issuer, oidc_subject) WHERE oidc_subject != "";
@@ -0,0 +1,11 @@
+ALTER TABLE user ADD COLUMN entries INTEGER DEFAULT 0 NOT NULL; -- times the user came in
+ALTER TABLE user ADD COLUMN day_entries INTEGER DEFAULT 0 NOT NULL; -- since day_start
+ALTER TABLE user ADD COLUMN day_start TEXT DEFAULT "" NOT NULL; -- datetime
+ALTER TABLE user ADD COLUMN window_entries INTEGER DEFAULT 0 NOT NULL; -- since window_start
+ALTER TABLE user ADD COLUMN window_start TEXT DEFAULT "" NOT NULL; -- datetime of the schedule window's start
+
+-- entries were counted from the log until now, days and windows start over
+UPDATE user SET entries = (
+  SELECT COUNT(*) FROM log
+  WHERE log.user = user.handle AND log.event = 'rex' AND (log.error IS NULL OR log.error = '')
+);
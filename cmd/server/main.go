@@ -3,43 +3,23 @@
 package server
 
 import (
-	"fmt"
 	"net/http"
-	"os"
 
 	"git.rob.mx/nidito/chinampa/pkg/command"
+	"git.rob.mx/nidito/puerta/cmd/cli"
 	"git.rob.mx/nidito/puerta/internal/server"
 	"github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v3"
 )
 
 var ServerCommand = &command.Command{
 	Path:        []string{"server"},
 	Summary:     "Runs the http server",
 	Description: "",
-	Options: command.Options{
-		"config": {
-			Type:    "string",
-			Default: "./config.joao.yaml",
-		},
-		"db": {
-			Type:    "string",
-			Default: "./puerta.db",
-		},
-	},
+	Options:     cli.Options(nil),
 	Action: func(cmd *command.Command) error {
-		config := cmd.Options["config"].ToValue().(string)
-		db := cmd.Options["db"].ToValue().(string)
-
-		data, err := os.ReadFile(config)
+		cfg, err := cli.Config(cmd)
 		if err != nil {
-			return fmt.Errorf("could not read config file: %w", err)
-		}
-
-		cfg := server.ConfigDefaults(db)
-
-		if err := yaml.Unmarshal(data, &cfg); err != nil {
-			return fmt.Errorf("could not unserialize yaml at %s: %w", config, err)
+			return err
 		}
 
 		logger := logrus.New()
@@ -0,0 +1,266 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	osuser "os/user"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/constants"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
+)
+
+// Action is something admins do, recorded in the admin log
+type Action string
+
+const (
+	// ActionUserCreate is the creation of a user
+	ActionUserCreate Action = "user.create"
+	// ActionUserUpdate is a change to a user's details, roles or groups
+	ActionUserUpdate Action = "user.update"
+	// ActionUserDelete is the deletion of a user
+	ActionUserDelete Action = "user.delete"
+	// ActionUserPassword is an admin setting someone else's password
+	ActionUserPassword Action = "user.password"
+	// ActionUserReset2FA is the deletion of a user's passkeys and TOTP secret
+	ActionUserReset2FA Action = "user.reset-2fa"
+	// ActionUserSessions is the revocation of some or all of a user's sessions
+	ActionUserSessions Action = "user.sessions"
+	// ActionSubscriptionCreate is a user subscribing a device to notifications
+	ActionSubscriptionCreate Action = "subscription.create"
+	// ActionSubscriptionDelete is a user unsubscribing a device from notifications
+	ActionSubscriptionDelete Action = "subscription.delete"
+	// ActionGroupCreate is the creation of a group
+	ActionGroupCreate Action = "group.create"
+	// ActionGroupUpdate is a change to a group's policy
+	ActionGroupUpdate Action = "group.update"
+	// ActionGroupDelete is the deletion of a group
+	ActionGroupDelete Action = "group.delete"
+	// ActionGroupMembers is the addition or removal of a group's members
+	ActionGroupMembers Action = "group.members"
+	// ActionRoleSet is the creation of a role or a change to its permissions
+	ActionRoleSet Action = "role.set"
+	// ActionTokenCreate is the creation of an api token from the command line,
+	// or for someone else
+	ActionTokenCreate Action = "token.create"
+	// ActionTokenRevoke is the revocation of an api token from the command line,
+	// or of someone else's
+	ActionTokenRevoke Action = "token.revoke"
+	// ActionHouseCreate is the creation of a house event
+	ActionHouseCreate Action = "house.create"
+	// ActionHouseDelete is the deletion of a house event
+	ActionHouseDelete Action = "house.delete"
+	// ActionBookingsImport is an import of bookings from a calendar
+	ActionBookingsImport Action = "bookings.import"
+)
+
+// Redacted replaces the values of secret fields
+const Redacted = "(redacted)"
+
+// Change is a field an admin changed, with its values as text
+type Change struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// Changes are stored as a json list
+type Changes []Change
+
+func (c Changes) MarshalDB() (any, error) {
+	if c == nil {
+		c = Changes{}
+	}
+	data, err := json.Marshal(c)
+	return string(data), err
+}
+
+func (c *Changes) Scan(value any) error {
+	*c = Changes{}
+	switch v := value.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	case []byte:
+		return json.Unmarshal(v, c)
+	case nil:
+		return nil
+	}
+	return fmt.Errorf("cannot scan changes from %T", value)
+}
+
+// AdminEntry is a change made by an admin through the api or the command line
+type AdminEntry struct {
+	ID        int64   `db:"id,omitempty" json:"id"`
+	Timestamp string  `db:"timestamp" json:"timestamp"`
+	Actor     string  `db:"actor" json:"actor"`
+	Action    Action  `db:"action" json:"action"`
+	Target    string  `db:"target" json:"target"`
+	Changes   Changes `db:"changes" json:"changes"`
+	IpAddress string  `db:"ip_address" json:"ip_address"`
+}
+
+func (e *AdminEntry) Store(sess db.Session) db.Store {
+	return sess.Collection("admin_log")
+}
+
+// isSecret tells if a field holds a password, hashed or not
+func isSecret(field string) bool {
+	return strings.Contains(strings.ToLower(field), "password")
+}
+
+// Diff compares the json fields of before and after, either of which may be
+// nil when something was created or deleted. Passwords are redacted
+func Diff(before, after any) Changes {
+	from, to := fields(before), fields(after)
+	names := []string{}
+	for name := range from {
+		names = append(names, name)
+	}
+	for name := range to {
+		if _, ok := from[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := Changes{}
+	for _, name := range names {
+		change := Change{Field: name, From: text(from[name]), To: text(to[name])}
+		if change.From == change.To {
+			continue
+		}
+
+		if isSecret(name) {
+			change.From, change.To = redact(change.From), redact(change.To)
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func fields(v any) map[string]any {
+	res := map[string]any{}
+	if v == nil || reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil() {
+		return res
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		logrus.Errorf("could not describe %T for the admin log: %s", v, err)
+		return res
+	}
+
+	if err := json.Unmarshal(data, &res); err != nil {
+		logrus.Errorf("could not describe %T for the admin log: %s", v, err)
+	}
+
+	// users leave their password hash out of their json, but changing it is
+	// worth a redacted change
+	if u, ok := v.(*user.User); ok && u.Password != "" {
+		res["password"] = u.Password
+	}
+	return res
+}
+
+func text(v any) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	return Redacted
+}
+
+// NewAdmin creates an entry for the user in the request's context doing
+// action to target, changing it from before to after
+func NewAdmin(r *http.Request, action Action, target string, before, after any) *AdminEntry {
+	entry := &AdminEntry{
+		Timestamp: time.Now().UTC().Format(TimestampFormat),
+		Action:    action,
+		Target:    target,
+		Changes:   Diff(before, after),
+		IpAddress: ClientIP(r),
+	}
+
+	if u := user.FromContext(r); u != nil {
+		entry.Actor = u.Handle
+	}
+
+	if id, ok := r.Context().Value(constants.ContextAPIToken).(string); ok {
+		entry.Actor += " (token " + id + ")"
+	}
+	return entry
+}
+
+// NewCLI creates an entry for whoever runs a command doing action to target,
+// changing it from before to after
+func NewCLI(action Action, target string, before, after any) *AdminEntry {
+	actor := "cli"
+	if current, err := osuser.Current(); err == nil {
+		actor += ":" + current.Username
+	}
+
+	return &AdminEntry{
+		Timestamp: time.Now().UTC().Format(TimestampFormat),
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		Changes:   Diff(before, after),
+	}
+}
+
+// RecordAdmin stores an admin log entry, logging instead of failing
+func RecordAdmin(sess db.Session, entry *AdminEntry) {
+	if _, err := sess.Collection("admin_log").Insert(entry); err != nil {
+		logrus.Errorf("could not record %s by %s in the admin log: %s", entry.Action, entry.Actor, err)
+	}
+}
+
+// AdminQuery filters the admin log, empty fields match everything
+type AdminQuery struct {
+	Actor  string
+	Action Action
+	Target string
+	Since  time.Time
+	Limit  int
+}
+
+// AdminEntries returns the admin log entries matching q, newest first
+func AdminEntries(sess db.Session, q *AdminQuery) ([]*AdminEntry, error) {
+	cond := db.Cond{}
+	if q.Actor != "" {
+		cond["actor"] = q.Actor
+	}
+	if q.Action != "" {
+		cond["action"] = q.Action
+	}
+	if q.Target != "" {
+		cond["target"] = q.Target
+	}
+	if !q.Since.IsZero() {
+		cond["timestamp >="] = q.Since.UTC().Format(TimestampFormat)
+	}
+
+	entries := []*AdminEntry{}
+	err := sess.Collection("admin_log").Find(cond).OrderBy("-timestamp", "-id").Limit(q.Limit).All(&entries)
+	return entries, err
+}
+
+var _ db.Record = &AdminEntry{}
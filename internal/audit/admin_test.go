@@ -0,0 +1,64 @@
+package audit
+
+import (
+	"reflect"
+	"testing"
+
+	"git.rob.mx/nidito/puerta/internal/user"
+)
+
+func TestDiff(t *testing.T) {
+	before := &user.User{Handle: "abuela", Name: "Abuela", Password: "$argon2id$old", MaxEntries: 2}
+	after := *before
+	after.Name = "Abuelita"
+	after.Password = "$argon2id$new"
+	after.Schedule = &user.Schedule{}
+	if err := after.Schedule.Scan("days=mon-fri"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Changes{
+		{Field: "name", From: "Abuela", To: "Abuelita"},
+		{Field: "password", From: Redacted, To: Redacted},
+		{Field: "schedule", From: "", To: "days=mon-fri"},
+	}
+	if got := Diff(before, &after); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	created := Diff(nil, before)
+	for _, c := range created {
+		if c.Field == "password" && c.To != Redacted {
+			t.Errorf("expected new passwords to be redacted, got %s", c.To)
+		}
+	}
+
+	if len(created) == 0 || len(Diff(before, before)) != 0 {
+		t.Errorf("expected only differences to be listed, got %v", created)
+	}
+
+	if deleted := Diff((*user.User)(nil), nil); len(deleted) != 0 {
+		t.Errorf("expected nil pointers to have no fields, got %v", deleted)
+	}
+}
+
+func TestChangesScan(t *testing.T) {
+	changes := Changes{{Field: "role", From: "guest", To: "admin"}}
+	value, err := changes.MarshalDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanned := Changes{}
+	if err := scanned.Scan(value); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(scanned, changes) {
+		t.Errorf("expected %v, got %v", changes, scanned)
+	}
+
+	if err := scanned.Scan(nil); err != nil || len(scanned) != 0 {
+		t.Errorf("expected NULL to scan as no changes, got %v %v", scanned, err)
+	}
+}
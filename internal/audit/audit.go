@@ -0,0 +1,200 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package audit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/constants"
+	"git.rob.mx/nidito/puerta/internal/door"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
+)
+
+// TimestampFormat has sub-second precision, since timestamps identify entries
+const TimestampFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+const (
+	// EventRex is a request to open the door
+	EventRex = "rex"
+	// EventRecovery is the use of a recovery code
+	EventRecovery = "recovery"
+	// EventLogin is a failed login attempt
+	EventLogin = "login"
+	// EventSkipped2FA is a request an api token exempted from 2FA
+	EventSkipped2FA = "2fa-skipped"
+	// EventToken is the creation or revocation of an api token
+	EventToken = "token"
+	// EventBookings is an import of guests from a booking calendar
+	EventBookings = "bookings"
+	// EventHouse is a change to the house calendar of blackouts and overrides
+	EventHouse = "house"
+	// EventApproval is a step of a request to come in outside of a user's schedule
+	EventApproval = "approval"
+	// EventPassword is a user changing their own password
+	EventPassword = "password"
+	// EventPasskey is a user adding or deleting one of their passkeys
+	EventPasskey = "passkey"
+)
+
+type Entry struct {
+	Timestamp    string `db:"timestamp" json:"timestamp"`
+	Event        string `db:"event" json:"event"`
+	User         string `db:"user" json:"user"`
+	SecondFactor bool   `db:"second_factor" json:"second_factor"`
+	Failure      string `db:"failure" json:"failure"`
+	Err          string `db:"error" json:"error"`
+	IpAddress    string `db:"ip_address" json:"ip_address"`
+	UserAgent    string `db:"user_agent" json:"user_agent"`
+	// Token is the id of the api token used for the request, if any
+	Token string `db:"token" json:"token,omitempty"`
+	// Detail describes what a successful event did, Failure is only set for failed ones
+	Detail string `db:"detail" json:"detail,omitempty"`
+}
+
+func (e *Entry) Store(sess db.Session) db.Store {
+	return sess.Collection("log")
+}
+
+// trustedProxies may tell the address of the clients they forward requests for
+var trustedProxies = mustParseProxies("127.0.0.0/8", "::1/128")
+
+func mustParseProxies(proxies ...string) []*net.IPNet {
+	nets, err := parseProxies(proxies)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+func parseProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s: %w", proxy, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// TrustProxies sets the addresses or CIDR ranges allowed to set X-Forwarded-For
+func TrustProxies(proxies []string) error {
+	nets, err := parseProxies(proxies)
+	if err != nil {
+		return err
+	}
+	trustedProxies = nets
+	return nil
+}
+
+func isTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address a request originated from. X-Forwarded-For is
+// only believed when set by trusted proxies, and read right to left up to the
+// first address that isn't one
+func ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && isTrusted(ip); i-- {
+		if hop := strings.TrimSpace(forwarded[i]); hop != "" {
+			ip = hop
+		}
+	}
+	return ip
+}
+
+// New creates an entry for the user in the request's context
+func New(r *http.Request, event string, err error) *Entry {
+	al := &Entry{
+		Timestamp: time.Now().UTC().Format(TimestampFormat),
+		Event:     event,
+		IpAddress: ClientIP(r),
+		UserAgent: r.Header.Get("user-agent"),
+	}
+
+	if u := user.FromContext(r); u != nil {
+		al.User = u.Handle
+		al.SecondFactor = u.Require2FA
+	}
+
+	if id, ok := r.Context().Value(constants.ContextAPIToken).(string); ok {
+		al.Token = id
+	}
+
+	if skipped, _ := r.Context().Value(constants.ContextSkipped2FA).(bool); skipped {
+		al.SecondFactor = false
+	}
+
+	if err != nil {
+		al.Failure = err.Error()
+		if derr, ok := err.(door.Error); ok {
+			al.Err = derr.Name()
+			al.Failure = derr.Error()
+		} else {
+			al.Err = event + "-failed"
+		}
+	}
+
+	return al
+}
+
+// Record stores an entry, logging instead of failing
+func Record(sess db.Session, entry *Entry) {
+	if _, err := sess.Collection("log").Insert(entry); err != nil {
+		logrus.Errorf("could not record %s audit log: %s", entry.Event, err)
+	}
+}
+
+// Entries returns a user's most recent attempts to open the door, newest first
+func Entries(sess db.Session, handle string, limit int) ([]*Entry, error) {
+	entries := []*Entry{}
+	err := sess.Collection("log").
+		Find(db.Cond{"event": EventRex, "user": handle}).
+		OrderBy("-timestamp").
+		Limit(limit).
+		All(&entries)
+	return entries, err
+}
+
+// Prune deletes entries older than retention
+func Prune(sess db.Session, retention time.Duration) (int64, error) {
+	cutoff := time.Now().UTC().Add(-retention).Format(TimestampFormat)
+	res, err := sess.SQL().DeleteFrom("log").Where(db.Cond{"timestamp <": cutoff}).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+var _ db.Record = &Entry{}
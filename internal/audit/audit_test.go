@@ -0,0 +1,43 @@
+package audit
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	if err := TrustProxies([]string{"127.0.0.0/8", "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer TrustProxies([]string{"127.0.0.0/8", "::1"})
+
+	cases := []struct {
+		remote    string
+		forwarded string
+		expected  string
+	}{
+		{"203.0.113.9:5000", "", "203.0.113.9"},
+		// clients can't pick their own address
+		{"203.0.113.9:5000", "198.51.100.1", "203.0.113.9"},
+		{"127.0.0.1:5000", "198.51.100.1", "198.51.100.1"},
+		// only the hops added by trusted proxies count
+		{"127.0.0.1:5000", "198.51.100.1, 203.0.113.9, 10.0.0.1", "203.0.113.9"},
+		{"127.0.0.1:5000", "", "127.0.0.1"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+
+		if ip := ClientIP(r); ip != c.expected {
+			t.Errorf("expected %s for %s via %q, got %s", c.expected, c.remote, c.forwarded, ip)
+		}
+	}
+
+	if err := TrustProxies([]string{"nope"}); err == nil {
+		t.Errorf("expected invalid proxies to be rejected")
+	}
+}
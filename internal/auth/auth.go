@@ -3,12 +3,15 @@
 package auth
 
 import (
+	"crypto/rand"
 	"fmt"
 	"net/http"
 	"time"
 
-	"git.rob.mx/nidito/puerta/internal/constants"
+	"git.rob.mx/nidito/puerta/internal/audit"
 	"git.rob.mx/nidito/puerta/internal/errors"
+	"git.rob.mx/nidito/puerta/internal/i18n"
+	"git.rob.mx/nidito/puerta/internal/push"
 	"git.rob.mx/nidito/puerta/internal/user"
 	"github.com/alexedwards/scs/v2"
 	"github.com/go-webauthn/webauthn/webauthn"
@@ -20,61 +23,199 @@ import (
 var _db db.Session
 var _wan *webauthn.WebAuthn
 var _sess *scs.SessionManager
+var _cfg *Config
+var _limiter *limiter
+var _sessionKey []byte
+var _cookies *CookieConfig
 
-func Route(wan *webauthn.WebAuthn, db db.Session, router http.Handler) http.Handler {
+type TOTPConfig struct {
+	// Issuer is the name authenticator apps display, defaults to the house name
+	Issuer string `yaml:"issuer"`
+	// Skew is the number of 30 second steps of clock drift to accept
+	Skew int `yaml:"skew"`
+}
+
+type Config struct {
+	// SessionKey is the secret session tokens are hashed with before storing them,
+	// TOTP secrets encrypted and recovery codes hashed with. Changing it signs
+	// everyone out and invalidates every TOTP enrolment and recovery code
+	SessionKey string      `yaml:"session_key"`
+	TOTP       *TOTPConfig `yaml:"totp"`
+	// RecoveryCodes is the number of recovery codes issued on second factor enrolment
+	RecoveryCodes int            `yaml:"recovery_codes"`
+	Lockout       *LockoutConfig `yaml:"lockout"`
+	OIDC          *OIDCConfig    `yaml:"oidc"`
+}
+
+func ConfigDefaults() *Config {
+	return &Config{
+		TOTP: &TOTPConfig{
+			Skew: 1,
+		},
+		RecoveryCodes: 8,
+		Lockout: &LockoutConfig{
+			MaxFailures: 10,
+			Lockout:     15 * time.Minute,
+			Delay:       time.Second,
+			Window:      time.Hour,
+			NotifyAfter: 5,
+		},
+		OIDC: &OIDCConfig{
+			Label:       "SSO",
+			Scopes:      []string{"openid", "profile"},
+			HandleClaim: "preferred_username",
+			GroupsClaim: "groups",
+		},
+	}
+}
+
+func Route(wan *webauthn.WebAuthn, db db.Session, cfg *Config, cookies *CookieConfig, router http.Handler) http.Handler {
 	_db = db
 	_wan = wan
+	_cfg = cfg
+	_cookies = cookies
+	_limiter = newLimiter(cfg.Lockout)
+	_sessionKey = []byte(cfg.SessionKey)
+	user.UseTOTPKey(cfg.SessionKey)
+	if cfg.SessionKey == "" {
+		logrus.Warn("auth.session_key is not set, sessions and recovery codes will not survive restarts")
+		_sessionKey = make([]byte, 32)
+		if _, err := rand.Read(_sessionKey); err != nil {
+			logrus.Fatalf("could not generate session key: %s", err)
+		}
+	}
+	user.UseRecoveryKey(_sessionKey)
+	if cfg.OIDC.Enabled() {
+		_oidc = newOIDCProvider(cfg.OIDC)
+	}
 	_sess = scs.New()
 	_sess.Lifetime = 5 * time.Minute
-	return _sess.LoadAndSave(router)
+	_sess.Store = &challengeStore{db}
+	_sess.Cookie.Name = cookies.Prefix + _sess.Cookie.Name
+	_sess.Cookie.Domain = cookies.Domain
+	_sess.Cookie.Secure = cookies.Secure
+	_sess.Cookie.SameSite = cookies.sameSite()
+	return _sess.LoadAndSave(CSRF(wan.Config.RPOrigins, router))
+}
+
+func requestAuth(w http.ResponseWriter, req *http.Request, status int) {
+	errors.Status(w, user.Language(req), status)
+}
+
+// loginFailed records a failed login and lets admins know once a handle or
+// address reaches the configured number of failures
+func loginFailed(req *http.Request, username string, keys []string, err error) {
+	failures := 0
+	if _, locked := err.(*errors.TooManyAttempts); !locked {
+		failures = _limiter.fail(keys...)
+	}
+
+	entry := audit.New(req, audit.EventLogin, err)
+	entry.User = username
+	if invalidCreds, ok := err.(*errors.InvalidCredentials); ok {
+		entry.Failure = invalidCreds.Reason
+	}
+	if invalidFactor, ok := err.(*errors.InvalidSecondFactor); ok {
+		entry.Failure = invalidFactor.Reason
+	}
+	audit.Record(_db, entry)
+
+	if _cfg.Lockout.NotifyAfter > 0 && failures == _cfg.Lockout.NotifyAfter {
+		go push.NotifyAdmins(_db, i18n.NotifyLoginFailures, failures, username, entry.IpAddress)
+	}
 }
 
-func requestAuth(w http.ResponseWriter, status int) {
-	http.Error(w, http.StatusText(status), status)
+// VerifyPassword checks the password of the user in the request's context,
+// limited like logins are for the same handle and address. It fails with
+// *errors.TooManyAttempts while those are locked out
+func VerifyPassword(req *http.Request, password string) error {
+	u := user.FromContext(req)
+	handleKey := "handle:" + u.Handle
+	keys := []string{"ip:" + audit.ClientIP(req), handleKey}
+	if err := _limiter.check(keys...); err != nil {
+		if locked, ok := err.(*errors.TooManyAttempts); ok {
+			locked.Log()
+		}
+		return err
+	}
+
+	if err := u.Login(_db, password); err != nil {
+		failures := _limiter.fail(keys...)
+		if _cfg.Lockout.NotifyAfter > 0 && failures == _cfg.Lockout.NotifyAfter {
+			go push.NotifyAdmins(_db, i18n.NotifyLoginFailures, failures, u.Handle, audit.ClientIP(req))
+		}
+		return err
+	}
+
+	_limiter.succeed(handleKey)
+	return nil
 }
 
 func LoginHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 
 	err := req.ParseForm()
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		errors.Status(w, user.Language(req), http.StatusBadRequest)
 		return
 	}
 
 	username := req.FormValue("user")
 	password := req.FormValue("password")
+	lang := user.Language(req)
+	handleKey := "handle:" + username
+	keys := []string{"ip:" + audit.ClientIP(req), handleKey}
+
+	if err := _limiter.check(keys...); err != nil {
+		if locked, ok := err.(*errors.TooManyAttempts); ok {
+			locked.Log()
+			w.Header().Set("Retry-After", locked.RetryAfter())
+		}
+		loginFailed(req, username, keys, err)
+		errors.Send(w, lang, http.StatusTooManyRequests, err)
+		return
+	}
 
 	user := &user.User{}
 	if err := _db.Get(user, db.Cond{"handle": username}); err != nil {
 		err := &errors.InvalidCredentials{Status: http.StatusForbidden, Reason: fmt.Sprintf("User not found for name: %s (%s)", username, err)}
 		err.Log()
-		http.Error(w, err.Error(), err.Code())
+		loginFailed(req, username, keys, err)
+		errors.Send(w, lang, err.Code(), err)
+		return
+	}
+
+	user, err = user.Effective(_db)
+	if err != nil {
+		logrus.Errorf("could not apply the groups of %s: %s", username, err)
+		errors.Status(w, lang, http.StatusInternalServerError)
 		return
 	}
 
-	if err := user.Login(password); err != nil {
+	if err := user.Login(_db, password); err != nil {
 		code := http.StatusBadRequest
-		status := http.StatusText(code)
+		var shown error
 		if invalidCreds, ok := err.(*errors.InvalidCredentials); ok {
 			code = invalidCreds.Code()
-			status = invalidCreds.Error()
+			shown = invalidCreds
 			invalidCreds.Log()
 		} else {
 			logrus.Errorf("could not login %s: %s", username, err.Error())
 		}
-		http.Error(w, status, code)
+		loginFailed(req, username, keys, err)
+		errors.Send(w, lang, code, shown)
 		return
 	}
+	_limiter.succeed(handleKey)
 
-	sess, err := NewSession(user, _db.Collection("session"))
+	sess, err := NewSession(req, user, _db.Collection("session"))
 	if err != nil {
 		err = fmt.Errorf("Could not create a session: %s", err)
 		logrus.Error(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		errors.Status(w, lang, http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Add("Set-Cookie", fmt.Sprintf("%s=%s; Max-Age=%d; Path=/;", constants.ContextCookieName, sess.Token, user.TTL.Seconds()))
+	setSessionCookie(w, sess.Token, sess.Expires)
 
 	logrus.Infof("Created session for %s", user.Name)
 
@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/constants"
+)
+
+const (
+	// CookiePrefixHost pins cookies to the exact host that set them, over https
+	CookiePrefixHost = "__Host-"
+	// CookiePrefixSecure requires cookies to be set over https
+	CookiePrefixSecure = "__Secure-"
+)
+
+// CookieConfig is the policy for every cookie puerta sets
+type CookieConfig struct {
+	// Domain to scope cookies to, empty means the current host only
+	Domain string `yaml:"domain"`
+	// Secure cookies are only sent over https
+	Secure bool `yaml:"secure"`
+	// SameSite is one of lax, strict or none
+	SameSite string `yaml:"samesite"`
+	// Prefix is prepended to cookie names, either __Host- or __Secure-
+	Prefix string `yaml:"prefix"`
+}
+
+func CookieDefaults() *CookieConfig {
+	return &CookieConfig{
+		Secure:   true,
+		SameSite: "lax",
+	}
+}
+
+// Validate fails for policies browsers would reject cookies for
+func (c *CookieConfig) Validate() error {
+	switch strings.ToLower(c.SameSite) {
+	case "lax", "strict":
+	case "none":
+		if !c.Secure {
+			return fmt.Errorf("cookies with samesite none must be secure")
+		}
+	default:
+		return fmt.Errorf("unknown samesite %q, expected lax, strict or none", c.SameSite)
+	}
+
+	switch c.Prefix {
+	case "":
+	case CookiePrefixHost:
+		if c.Domain != "" {
+			return fmt.Errorf("cookies prefixed with %s cannot set a domain", c.Prefix)
+		}
+		fallthrough
+	case CookiePrefixSecure:
+		if !c.Secure {
+			return fmt.Errorf("cookies prefixed with %s must be secure", c.Prefix)
+		}
+	default:
+		return fmt.Errorf("unknown cookie prefix %q, expected %s or %s", c.Prefix, CookiePrefixHost, CookiePrefixSecure)
+	}
+
+	return nil
+}
+
+// Name returns the name of the cookie holding session tokens
+func (c *CookieConfig) Name() string {
+	return c.Prefix + string(constants.ContextCookieName)
+}
+
+func (c *CookieConfig) sameSite() http.SameSite {
+	switch strings.ToLower(c.SameSite) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
+
+func (c *CookieConfig) cookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     c.Name(),
+		Value:    value,
+		Path:     "/",
+		Domain:   c.Domain,
+		MaxAge:   maxAge,
+		Secure:   c.Secure,
+		HttpOnly: true,
+		SameSite: c.sameSite(),
+	}
+}
+
+// setSessionCookie sends a session token that lasts until expires, both on login
+// and to refresh the attributes of cookies set under an older policy
+func setSessionCookie(w http.ResponseWriter, token string, expires time.Time) {
+	maxAge := int(time.Until(expires).Seconds())
+	if maxAge <= 0 {
+		ClearSessionCookie(w)
+		return
+	}
+	http.SetCookie(w, _cookies.cookie(token, maxAge))
+}
+
+// ClearSessionCookie tells browsers to forget their session token
+func ClearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, _cookies.cookie("", -1))
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCookieConfigValidate(t *testing.T) {
+	cases := []struct {
+		name  string
+		cfg   CookieConfig
+		valid bool
+	}{
+		{"defaults", *CookieDefaults(), true},
+		{"strict", CookieConfig{SameSite: "Strict"}, true},
+		{"unknown samesite", CookieConfig{SameSite: "sometimes"}, false},
+		{"insecure none", CookieConfig{SameSite: "none"}, false},
+		{"secure none", CookieConfig{SameSite: "none", Secure: true}, true},
+		{"host prefix", CookieConfig{SameSite: "lax", Secure: true, Prefix: CookiePrefixHost}, true},
+		{"insecure host prefix", CookieConfig{SameSite: "lax", Prefix: CookiePrefixHost}, false},
+		{"host prefix with domain", CookieConfig{SameSite: "lax", Secure: true, Prefix: CookiePrefixHost, Domain: "example.com"}, false},
+		{"secure prefix with domain", CookieConfig{SameSite: "lax", Secure: true, Prefix: CookiePrefixSecure, Domain: "example.com"}, true},
+		{"insecure secure prefix", CookieConfig{SameSite: "lax", Prefix: CookiePrefixSecure}, false},
+		{"unknown prefix", CookieConfig{SameSite: "lax", Secure: true, Prefix: "__Mine-"}, false},
+	}
+
+	for _, c := range cases {
+		err := c.cfg.Validate()
+		if c.valid && err != nil {
+			t.Errorf("%s: expected valid config, got %s", c.name, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%s: expected invalid config", c.name)
+		}
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+	_cookies = &CookieConfig{Domain: "", Secure: true, SameSite: "strict", Prefix: CookiePrefixHost}
+
+	set := httptest.NewRecorder()
+	setSessionCookie(set, "token", time.Now().Add(time.Hour))
+	clear := httptest.NewRecorder()
+	ClearSessionCookie(clear)
+	expired := httptest.NewRecorder()
+	setSessionCookie(expired, "token", time.Now().Add(-time.Hour))
+
+	for name, rec := range map[string]*httptest.ResponseRecorder{"set": set, "clear": clear, "expired": expired} {
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("%s: expected one cookie, got %d", name, len(cookies))
+		}
+
+		c := cookies[0]
+		if c.Name != "__Host-_puerta" {
+			t.Errorf("%s: unexpected name %s", name, c.Name)
+		}
+
+		if !c.Secure || !c.HttpOnly || c.SameSite != http.SameSiteStrictMode || c.Path != "/" || c.Domain != "" {
+			t.Errorf("%s: unexpected attributes %s", name, rec.Header().Get("Set-Cookie"))
+		}
+
+		if name == "set" {
+			if c.Value != "token" || c.MaxAge < 3590 || c.MaxAge > 3600 {
+				t.Errorf("%s: unexpected value or max-age %s", name, rec.Header().Get("Set-Cookie"))
+			}
+		} else if c.Value != "" || c.MaxAge >= 0 {
+			t.Errorf("%s: expected cookie to be cleared, got %s", name, rec.Header().Get("Set-Cookie"))
+		}
+	}
+}
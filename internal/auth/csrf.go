@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package auth
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"git.rob.mx/nidito/puerta/internal/errors"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/sirupsen/logrus"
+)
+
+// HeaderNameCSRF carries the csrf token for requests made with javascript
+const HeaderNameCSRF = "csrf-token"
+
+// FormFieldCSRF carries the csrf token for form posts
+const FormFieldCSRF = "csrf"
+
+func (c *CookieConfig) csrfName() string {
+	return c.Name() + "_csrf"
+}
+
+// newCSRFToken returns a random token signed with the session key, so it
+// can't be planted by anyone without it, i.e. a sibling subdomain
+func newCSRFToken() (string, error) {
+	nonce, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+	return nonce + "." + hashToken(nonce), nil
+}
+
+func validCSRFToken(token string) bool {
+	nonce, sig, found := strings.Cut(token, ".")
+	return found && hmac.Equal([]byte(sig), []byte(hashToken(nonce)))
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// checkOrigin makes sure a request comes from one of the allowed origins, looking
+// at the Origin header or, if browsers leave it out, at the Referer
+func checkOrigin(req *http.Request, allowed []string) error {
+	origin := req.Header.Get("origin")
+	if origin == "" {
+		referer := req.Header.Get("referer")
+		if referer == "" {
+			return fmt.Errorf("no origin or referer")
+		}
+
+		ref, err := url.Parse(referer)
+		if err != nil {
+			return fmt.Errorf("unparseable referer %s", referer)
+		}
+		origin = ref.Scheme + "://" + ref.Host
+	}
+
+	for _, o := range allowed {
+		if origin == o {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("origin %s is not one of %v", origin, allowed)
+}
+
+func checkCSRFToken(req *http.Request) error {
+	cookie, err := req.Cookie(_cookies.csrfName())
+	if err != nil {
+		return fmt.Errorf("no csrf cookie")
+	}
+
+	if !validCSRFToken(cookie.Value) {
+		return fmt.Errorf("invalid csrf cookie")
+	}
+
+	token := req.Header.Get(HeaderNameCSRF)
+	if token == "" {
+		token = req.PostFormValue(FormFieldCSRF)
+	}
+
+	if !hmac.Equal([]byte(token), []byte(cookie.Value)) {
+		return fmt.Errorf("csrf token does not match cookie")
+	}
+
+	return nil
+}
+
+// CSRF rejects requests that change anything unless they come from an allowed
+// origin and send back the token in their csrf cookie. Every other request gets
+// a csrf cookie if it has none
+func CSRF(allowed []string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isSafeMethod(req.Method) {
+			if cookie, err := req.Cookie(_cookies.csrfName()); err != nil || !validCSRFToken(cookie.Value) {
+				token, err := newCSRFToken()
+				if err != nil {
+					logrus.Errorf("could not generate csrf token: %s", err)
+					errors.Status(w, user.Language(req), http.StatusInternalServerError)
+					return
+				}
+
+				c := _cookies.cookie(token, 0)
+				c.Name = _cookies.csrfName()
+				// javascript reads this one to send it back as a header
+				c.HttpOnly = false
+				http.SetCookie(w, c)
+			}
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		if bearerToken(req) != "" {
+			// api tokens are never sent by browsers on their own, and requests with one ignore cookies
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		err := checkOrigin(req, allowed)
+		if err == nil {
+			err = checkCSRFToken(req)
+		}
+
+		if err != nil {
+			logrus.Warnf("rejecting cross-site %s %s from %s: %s", req.Method, req.URL.Path, req.RemoteAddr, err)
+			errors.Status(w, user.Language(req), http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	allowed := []string{"https://puerta.example.com"}
+	cases := map[string][2]string{
+		"origin":         {"https://puerta.example.com", ""},
+		"referer":        {"", "https://puerta.example.com/admin?next=/"},
+		"origin wins":    {"https://puerta.example.com", "https://evil.example.com/"},
+		"evil origin":    {"https://evil.example.com", "https://puerta.example.com/"},
+		"evil referer":   {"", "https://evil.example.com/puerta.example.com"},
+		"wrong protocol": {"http://puerta.example.com", ""},
+		"null origin":    {"null", ""},
+		"nothing":        {"", ""},
+	}
+
+	for name, headers := range cases {
+		req := httptest.NewRequest("POST", "/api/rex", nil)
+		if headers[0] != "" {
+			req.Header.Set("origin", headers[0])
+		}
+		if headers[1] != "" {
+			req.Header.Set("referer", headers[1])
+		}
+
+		err := checkOrigin(req, allowed)
+		shouldPass := name == "origin" || name == "referer" || name == "origin wins"
+		if shouldPass && err != nil {
+			t.Errorf("%s: expected request to be allowed, got %s", name, err)
+		} else if !shouldPass && err == nil {
+			t.Errorf("%s: expected request to be rejected", name)
+		}
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	_sessionKey = []byte("key")
+	token, err := newCSRFToken()
+	if err != nil {
+		t.Fatalf("could not generate token: %s", err)
+	}
+
+	if !validCSRFToken(token) {
+		t.Fatalf("expected %s to be valid", token)
+	}
+
+	for _, forged := range []string{"", "nonce", "nonce.", token + "x", "x" + token} {
+		if validCSRFToken(forged) {
+			t.Errorf("expected %q to be invalid", forged)
+		}
+	}
+
+	_sessionKey = []byte("other key")
+	if validCSRFToken(token) {
+		t.Fatalf("expected tokens signed with another key to be invalid")
+	}
+}
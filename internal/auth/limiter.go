@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/errors"
+)
+
+type LockoutConfig struct {
+	// MaxFailures is the number of failed logins before a handle or address is locked out
+	MaxFailures int `yaml:"max_failures"`
+	// Lockout is how long logins are refused after reaching MaxFailures
+	Lockout time.Duration `yaml:"lockout"`
+	// Delay is how much longer clients must wait before trying again, for each previous failure
+	Delay time.Duration `yaml:"delay"`
+	// Window is how long failures are remembered for
+	Window time.Duration `yaml:"window"`
+	// NotifyAfter is the number of failures that trigger an admin notification, 0 disables them
+	NotifyAfter int `yaml:"notify_after"`
+}
+
+type attempts struct {
+	failures    int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// limiter keeps track of failed logins per key, i.e. client address and handle
+type limiter struct {
+	mu      sync.Mutex
+	cfg     *LockoutConfig
+	entries map[string]*attempts
+	now     func() time.Time
+}
+
+func newLimiter(cfg *LockoutConfig) *limiter {
+	return &limiter{
+		cfg:     cfg,
+		entries: map[string]*attempts{},
+		now:     time.Now,
+	}
+}
+
+func (l *limiter) current(key string, now time.Time) *attempts {
+	a, ok := l.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if now.Sub(a.last) > l.cfg.Window && now.After(a.lockedUntil) {
+		delete(l.entries, key)
+		return nil
+	}
+	return a
+}
+
+// check fails if any of keys is locked out, or tries again before waiting
+// Delay for each of its previous failures
+func (l *limiter) check(keys ...string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for _, key := range keys {
+		a := l.current(key, now)
+		if a == nil {
+			continue
+		}
+
+		if now.Before(a.lockedUntil) {
+			return &errors.TooManyAttempts{Until: a.lockedUntil}
+		}
+
+		if wait := a.last.Add(time.Duration(a.failures) * l.cfg.Delay); now.Before(wait) {
+			return &errors.TooManyAttempts{Until: wait}
+		}
+	}
+
+	return nil
+}
+
+// fail records a failed login for keys, returning the highest failure count among them
+func (l *limiter) fail(keys ...string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	// prune stale entries while we're at it
+	for key := range l.entries {
+		l.current(key, now)
+	}
+
+	failures := 0
+	for _, key := range keys {
+		a := l.current(key, now)
+		if a == nil {
+			a = &attempts{}
+			l.entries[key] = a
+		}
+
+		a.failures++
+		a.last = now
+		if a.failures >= l.cfg.MaxFailures {
+			a.lockedUntil = now.Add(l.cfg.Lockout)
+		}
+
+		if a.failures > failures {
+			failures = a.failures
+		}
+	}
+
+	return failures
+}
+
+// succeed forgets previous failures for keys
+func (l *limiter) succeed(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		delete(l.entries, key)
+	}
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/errors"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newLimiter(&LockoutConfig{
+		MaxFailures: 3,
+		Lockout:     10 * time.Minute,
+		Delay:       time.Second,
+		Window:      time.Hour,
+	})
+	l.now = func() time.Time { return now }
+
+	if err := l.check("ip:a", "handle:joao"); err != nil {
+		t.Fatalf("expected no delay for unknown keys, got %v", err)
+	}
+
+	l.fail("ip:a", "handle:joao")
+	l.fail("ip:b", "handle:joao")
+	err := l.check("ip:c", "handle:joao")
+	if locked, ok := err.(*errors.TooManyAttempts); !ok || !locked.Until.Equal(now.Add(2*time.Second)) {
+		t.Fatalf("expected progressive delay per handle, got %v", err)
+	}
+
+	now = now.Add(2 * time.Second)
+	if err := l.check("ip:c", "handle:joao"); err != nil {
+		t.Fatalf("expected attempts after the delay to be allowed, got %v", err)
+	}
+
+	if failures := l.fail("ip:c", "handle:joao"); failures != 3 {
+		t.Fatalf("expected 3 failures, got %d", failures)
+	}
+
+	if err := l.check("ip:d", "handle:joao"); err == nil {
+		t.Fatalf("expected handle to be locked out")
+	}
+
+	if err := l.check("ip:a", "handle:maria"); err != nil {
+		t.Fatalf("unexpected lockout for other handle: %s", err)
+	}
+
+	now = now.Add(11 * time.Minute)
+	if err := l.check("ip:d", "handle:joao"); err != nil {
+		t.Fatalf("expected lockout to expire, got %v", err)
+	}
+
+	l.succeed("handle:joao")
+	now = now.Add(2 * time.Hour)
+	if err := l.check("ip:a", "handle:joao"); err != nil {
+		t.Fatalf("expected failures to be forgotten, got %v", err)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"time"
 
+	"git.rob.mx/nidito/puerta/internal/audit"
 	"git.rob.mx/nidito/puerta/internal/constants"
 	"git.rob.mx/nidito/puerta/internal/errors"
 	"git.rob.mx/nidito/puerta/internal/user"
@@ -23,47 +25,117 @@ func withUser(handler httprouter.Handle) httprouter.Handle {
 			return
 		}
 
+		if bearer := bearerToken(req); bearer != "" {
+			// cookies are ignored when a token is given, so requests exempted
+			// from csrf checks can't ride on a browser's session
+			handler(w, withAPIToken(req, bearer), ps)
+			return
+		}
+
 		req = func() *http.Request {
-			cookie, err := req.Cookie(string(constants.ContextCookieName))
+			cookie, err := req.Cookie(_cookies.Name())
 			if err != nil {
 				logrus.Debugf("no cookie for user found in jar <%s>", req.Cookies())
 				return req
 			}
 
+			hash := hashToken(cookie.Value)
 			session := &SessionUser{}
 			q := _db.SQL().
-				Select("s.token as token, s.expires as expires", "u.*").
+				Select("s.hash as hash", "s.id as session_id", "s.expires as session_expires", "s.last_seen as last_seen", "u.*").
 				From("session as s").
 				Join("user as u").On("s.user = u.id").
-				Where(db.Cond{"s.token": cookie.Value})
+				Where(db.Cond{"s.hash": hash})
 
 			if err := q.One(&session); err != nil {
 				logrus.Debugf("no cookie found in DB for jar <%s>: %s", req.Cookies(), err)
-				w.Header().Add("Set-Cookie", fmt.Sprintf("%s=%s; Max-Age=%d; Secure; Path=/;", constants.ContextCookieName, "", -1))
+				ClearSessionCookie(w)
 				return req
 			}
 
-			if session.Expired() || session.User.Expired() {
+			u, err := session.User.Effective(_db)
+			if err != nil {
+				logrus.Errorf("could not apply the groups of %s: %s", session.User.Handle, err)
+				return req
+			}
+
+			if session.Expired() || u.Expired() {
 				logrus.Debugf("expired cookie found in DB for jar <%s>", req.Cookies())
-				w.Header().Add("Set-Cookie", fmt.Sprintf("%s=%s; Max-Age=%d; Secure; Path=/;", constants.ContextCookieName, "", -1))
-				err := _db.Collection("session").Find(db.Cond{"token": cookie.Value}).Delete()
+				ClearSessionCookie(w)
+				err := _db.Collection("session").Find(db.Cond{"hash": hash}).Delete()
 				if err != nil {
 					logrus.Errorf("could not purge expired session from DB: %s", err)
 				}
 				return req
 			}
 
-			return req.WithContext(context.WithValue(req.Context(), constants.ContextUser, &session.User))
+			if time.Since(session.LastSeen) > time.Minute {
+				_, err := _db.SQL().
+					Update("session").
+					Set("last_seen", time.Now().UTC(), "ip_address", audit.ClientIP(req), "user_agent", req.Header.Get("user-agent")).
+					Where(db.Cond{"hash": hash}).
+					Exec()
+				if err != nil {
+					logrus.Errorf("could not update session last seen: %s", err)
+				}
+				setSessionCookie(w, cookie.Value, session.Expires)
+			}
+
+			ctx := context.WithValue(req.Context(), constants.ContextUser, u)
+			return req.WithContext(context.WithValue(ctx, constants.ContextSession, session.SessionID))
 		}()
 
 		handler(w, req, ps)
 	}
 }
 
+// withAPIToken adds the user and token for an api token to the request's context
+func withAPIToken(req *http.Request, bearer string) *http.Request {
+	t := &APIToken{}
+	if err := _db.Get(t, db.Cond{"hash": hashToken(bearer)}); err != nil {
+		logrus.Debugf("unknown api token: %s", err)
+		return req
+	}
+
+	u := &user.User{}
+	if err := _db.Get(u, db.Cond{"id": t.UserID}); err != nil {
+		logrus.Errorf("could not find user for api token %s: %s", t.ID, err)
+		return req
+	}
+
+	u, err := u.Effective(_db)
+	if err != nil {
+		logrus.Errorf("could not apply the groups for api token %s: %s", t.ID, err)
+		return req
+	}
+
+	if t.Expired() || u.Expired() {
+		logrus.Debugf("expired api token %s for %s", t.ID, u.Handle)
+		return req
+	}
+
+	if t.LastUsed == nil || time.Since(*t.LastUsed) > time.Minute {
+		_, err := _db.SQL().Update("api_token").Set("last_used", time.Now().UTC()).Where(db.Cond{"id": t.ID}).Exec()
+		if err != nil {
+			logrus.Errorf("could not update api token last used: %s", err)
+		}
+	}
+
+	ctx := context.WithValue(req.Context(), constants.ContextUser, u)
+	ctx = context.WithValue(ctx, constants.ContextAPIToken, t.ID)
+	return req.WithContext(context.WithValue(ctx, contextToken, t))
+}
+
 func RequireAuth(handler httprouter.Handle) httprouter.Handle {
 	return withUser(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 		if req.Context().Value(constants.ContextUser) == nil {
-			requestAuth(w, http.StatusUnauthorized)
+			requestAuth(w, req, http.StatusUnauthorized)
+			return
+		}
+
+		if TokenFromContext(req) != nil && req.Context().Value(contextScoped) == nil {
+			logrus.Warnf("refusing api token for %s %s, not covered by any scope", req.Method, req.URL.Path)
+			requestAuth(w, req, http.StatusForbidden)
 			return
 		}
 
@@ -82,9 +154,24 @@ func RequireAuthOrRedirect(handler httprouter.Handle, target string) httprouter.
 	})
 }
 
-func RequireAdminOrRedirect(handler httprouter.Handle, target string) httprouter.Handle {
+// can tells if the request's user has a permission, logging failures to look it up
+func can(req *http.Request, p user.Permission) bool {
+	u := user.FromContext(req)
+	allowed, err := u.Can(_db, p)
+	if err != nil {
+		logrus.Errorf("could not fetch permissions for %s: %s", u.Handle, err)
+		return false
+	}
+
+	if !allowed {
+		logrus.Warnf("%s lacks permission %s for %s %s", u.Handle, p, req.Method, req.URL.Path)
+	}
+	return allowed
+}
+
+func RequirePermissionOrRedirect(p user.Permission, handler httprouter.Handle, target string) httprouter.Handle {
 	return withUser(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-		if req.Context().Value(constants.ContextUser) == nil {
+		if req.Context().Value(constants.ContextUser) == nil || !can(req, p) {
 			http.Redirect(w, req, target, http.StatusTemporaryRedirect)
 			return
 		}
@@ -97,20 +184,90 @@ func RegisterSecondFactor() httprouter.Handle {
 	return RequireAuth(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 		u := user.FromContext(req)
 		if !u.Require2FA {
-			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+			errors.Status(w, user.Language(req), http.StatusConflict)
 			return
 		}
 
 		err := webAuthnFinishRegistration(req)
 		if err != nil {
 			logrus.Errorf("Failed during webauthn flow: %s", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
+			errors.Status(w, user.Language(req), http.StatusInternalServerError)
+			return
+		}
+
+		entry := audit.New(req, audit.EventPasskey, nil)
+		entry.Detail = fmt.Sprintf("registered a passkey for %s", u.Handle)
+		audit.Record(_db, entry)
+
+		respondWithRecoveryCodes(w, u)
+	})
+}
+
+// AddPasskey starts enrolling another passkey for the user once they prove
+// they hold their current second factor, responding with the register
+// challenge clients complete at /api/webauthn/register
+func AddPasskey() httprouter.Handle {
+	return Enforce2FA(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		u := user.FromContext(req)
+		if !u.Require2FA {
+			errors.Status(w, user.Language(req), http.StatusConflict)
+			return
+		}
+
+		challenge, ok := webAuthnBeginRegistration(req).(errors.WebAuthFlowChallenge)
+		if !ok {
+			errors.Status(w, user.Language(req), http.StatusInternalServerError)
 			return
 		}
 
+		w.Header().Add("content-type", "application/json")
+		w.Header().Add(HeaderNameWAN, challenge.Header())
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(challenge.Error()))
 	})
 }
 
+func RegisterTOTP() httprouter.Handle {
+	return RequireAuth(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		u := user.FromContext(req)
+		if !u.Require2FA || !u.AllowTOTP {
+			errors.Status(w, user.Language(req), http.StatusConflict)
+			return
+		}
+
+		err := totpFinishRegistration(req)
+		if err != nil {
+			if authErr, ok := err.(errors.AuthError); ok {
+				authErr.Log()
+				if locked, ok := err.(*errors.TooManyAttempts); ok {
+					w.Header().Set("Retry-After", locked.RetryAfter())
+				}
+				errors.Send(w, user.Language(req), authErr.Code(), authErr)
+				return
+			}
+			logrus.Errorf("Failed during totp flow: %s", err.Error())
+			errors.Status(w, user.Language(req), http.StatusInternalServerError)
+			return
+		}
+
+		respondWithRecoveryCodes(w, u)
+	})
+}
+
+// secondFactorFlow picks the flow for the user's available factor: passkeys
+// unless the client asks for totp and the user is allowed to use it
+func secondFactorFlow(u *user.User, req *http.Request) func(*http.Request) error {
+	switch {
+	case u.HasTOTP() && (prefersTOTP(req) || !u.HasCredentials()):
+		return totpLogin
+	case u.HasCredentials():
+		return webAuthnLogin
+	case u.AllowTOTP && prefersTOTP(req):
+		return totpBeginRegistration
+	}
+	return webAuthnBeginRegistration
+}
+
 func Enforce2FA(handler httprouter.Handle) httprouter.Handle {
 	return RequireAuth(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 		u := user.FromContext(req)
@@ -119,20 +276,30 @@ func Enforce2FA(handler httprouter.Handle) httprouter.Handle {
 			return
 		}
 
+		if t := TokenFromContext(req); t != nil && t.SkipSecondFactor {
+			logrus.Infof("api token %s skips 2fa for %s %s", t.ID, req.Method, req.URL.Path)
+			req = req.WithContext(context.WithValue(req.Context(), constants.ContextSkipped2FA, true))
+			entry := audit.New(req, audit.EventSkipped2FA, nil)
+			entry.Detail = fmt.Sprintf("%s %s with api token %s", req.Method, req.URL.Path, t.Name)
+			audit.Record(_db, entry)
+			handler(w, req, ps)
+			return
+		}
+
 		logrus.Debug("Enforcing 2fa for request")
 		if err := u.FetchCredentials(_db); err != nil {
 			logrus.Errorf("Failed fetching credentials: %s", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
+			errors.Status(w, user.Language(req), http.StatusInternalServerError)
 			return
 		}
 
-		var flow func(*http.Request) error
-		if !u.HasCredentials() {
-			flow = webAuthnBeginRegistration
-		} else {
-			flow = webAuthnLogin
+		if err := u.FetchTOTP(_db); err != nil {
+			logrus.Errorf("Failed fetching totp: %s", err.Error())
+			errors.Status(w, user.Language(req), http.StatusInternalServerError)
+			return
 		}
 
+		flow := secondFactorFlow(u, req)
 		if err := flow(req); err != nil {
 			if wafc, ok := err.(errors.WebAuthFlowChallenge); ok {
 				w.WriteHeader(200)
@@ -141,8 +308,17 @@ func Enforce2FA(handler httprouter.Handle) httprouter.Handle {
 				return
 			}
 
+			if authErr, ok := err.(errors.AuthError); ok {
+				authErr.Log()
+				if locked, ok := err.(*errors.TooManyAttempts); ok {
+					w.Header().Set("Retry-After", locked.RetryAfter())
+				}
+				errors.Send(w, user.Language(req), authErr.Code(), authErr)
+				return
+			}
+
 			logrus.Errorf("Failed during webauthn flow: %s", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
+			errors.Status(w, user.Language(req), http.StatusInternalServerError)
 			return
 		}
 
@@ -155,13 +331,27 @@ func Enforce2FA(handler httprouter.Handle) httprouter.Handle {
 	})
 }
 
-func RequireAdmin(handler httprouter.Handle) httprouter.Handle {
-	return RequireAuth(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-		user := req.Context().Value(constants.ContextUser).(*user.User)
-		if !user.IsAdmin {
-			requestAuth(w, http.StatusUnauthorized)
+func RequirePermission(p user.Permission, handler httprouter.Handle) httprouter.Handle {
+	return withUser(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if req.Context().Value(constants.ContextUser) == nil {
+			requestAuth(w, req, http.StatusUnauthorized)
+			return
+		}
+
+		if !can(req, p) {
+			requestAuth(w, req, http.StatusForbidden)
 			return
 		}
+
+		if t := TokenFromContext(req); t != nil {
+			if !t.Allows(p) {
+				logrus.Warnf("api token %s has no scope for %s", t.ID, p)
+				requestAuth(w, req, http.StatusForbidden)
+				return
+			}
+			req = req.WithContext(context.WithValue(req.Context(), contextScoped, true))
+		}
+
 		handler(w, req, ps)
 	})
 }
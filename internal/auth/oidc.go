@@ -0,0 +1,513 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/errors"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
+)
+
+const SessionNameOIDC = "oidc"
+
+// OIDCConfig configures signing in with an OpenID Connect provider, disabled
+// unless Issuer is set
+type OIDCConfig struct {
+	// Issuer is the provider's url, its configuration is read from /.well-known/openid-configuration
+	Issuer string `yaml:"issuer"`
+	// Label names the provider on the login page
+	Label        string `yaml:"label"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// RedirectURL is where the provider sends users back to, defaults to /login/oidc/callback at the http origin
+	RedirectURL string   `yaml:"redirect_url"`
+	Scopes      []string `yaml:"scopes"`
+	// HandleClaim holds the puerta handle of users signing in for the first time, they are matched by subject after that
+	HandleClaim string `yaml:"handle_claim"`
+	// GroupsClaim holds the groups users belong to
+	GroupsClaim string `yaml:"groups_claim"`
+	// AllowedGroups lets only members of these groups sign in, everyone is allowed if empty
+	AllowedGroups []string `yaml:"allowed_groups"`
+	// Roles maps provider groups to puerta roles, the first group listed in the token that has a role wins
+	// and users in none of them become guests
+	Roles map[string]string `yaml:"roles"`
+	// CreateUsers adds users that sign in for the first time, as long as one of their groups maps to a role
+	CreateUsers bool `yaml:"create_users"`
+}
+
+func (c *OIDCConfig) Enabled() bool {
+	return c != nil && c.Issuer != ""
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// oidcProvider talks to the identity provider, caching its configuration and keys
+type oidcProvider struct {
+	cfg    *OIDCConfig
+	client *http.Client
+	mu     sync.Mutex
+	meta   *oidcDiscovery
+	keys   map[string]*rsa.PublicKey
+}
+
+// oidcFlow is kept in the challenge session between redirecting to the provider and its callback
+type oidcFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Next     string `json:"next"`
+}
+
+// oidcIdentity is what puerta gets out of a verified id token
+type oidcIdentity struct {
+	Issuer  string
+	Subject string
+	Handle  string
+	Name    string
+	Groups  []string
+}
+
+var _oidc *oidcProvider
+
+func newOIDCProvider(cfg *OIDCConfig) *oidcProvider {
+	return &oidcProvider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   map[string]*rsa.PublicKey{},
+	}
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, target string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %d from %s", res.StatusCode, target)
+	}
+	return json.NewDecoder(res.Body).Decode(dst)
+}
+
+// discover fetches the provider's configuration the first time it's needed,
+// so puerta starts even if the provider is down
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	meta := &oidcDiscovery{}
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", meta); err != nil {
+		return nil, fmt.Errorf("could not discover oidc provider: %w", err)
+	}
+
+	if meta.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc provider claims to be %s instead of %s", meta.Issuer, p.cfg.Issuer)
+	}
+
+	p.meta = meta
+	return meta, nil
+}
+
+// key returns the provider's signing key by id, refetching them when it's unknown
+func (p *oidcProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := p.getJSON(ctx, meta.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("could not fetch oidc keys: %w", err)
+	}
+
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode key %s: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode key %s: %w", k.Kid, err)
+		}
+
+		p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown oidc signing key %s", kid)
+	}
+	return key, nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authorizeURL starts a flow, returning where to send users to sign in
+func (p *oidcProvider) authorizeURL(ctx context.Context, flow *oidcFlow) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", flow.State)
+	q.Set("nonce", flow.Nonce)
+	q.Set("code_challenge", pkceChallenge(flow.Verifier))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// exchange trades an authorization code for a verified identity
+func (p *oidcProvider) exchange(ctx context.Context, code string, flow *oidcFlow) (*oidcIdentity, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("code_verifier", flow.Verifier)
+	if p.cfg.ClientSecret != "" {
+		form.Set("client_secret", p.cfg.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	req.Header.Set("accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not exchange oidc code: %w", err)
+	}
+	defer res.Body.Close()
+
+	tokens := struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("could not decode oidc token response: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("oidc provider refused code exchange with status %d: %s", res.StatusCode, tokens.Error)
+	}
+
+	return p.verify(ctx, tokens.IDToken, flow.Nonce)
+}
+
+// verify checks an id token's signature, issuer, audience, expiry and nonce
+func (p *oidcProvider) verify(ctx context.Context, idToken, nonce string) (*oidcIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithIssuer(p.cfg.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+
+	if exp, err := claims.GetExpirationTime(); err != nil || exp == nil {
+		return nil, fmt.Errorf("id token has no expiration")
+	}
+
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, fmt.Errorf("id token nonce does not match")
+	}
+
+	identity := &oidcIdentity{}
+	identity.Issuer, _ = claims.GetIssuer()
+	identity.Subject, _ = claims.GetSubject()
+	identity.Handle, _ = claims[p.cfg.HandleClaim].(string)
+	identity.Name, _ = claims["name"].(string)
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("id token has no subject")
+	}
+
+	if identity.Handle == "" {
+		return nil, fmt.Errorf("id token for %s has no %s claim", identity.Subject, p.cfg.HandleClaim)
+	}
+
+	switch groups := claims[p.cfg.GroupsClaim].(type) {
+	case []any:
+		for _, g := range groups {
+			if name, ok := g.(string); ok {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	case string:
+		identity.Groups = []string{groups}
+	}
+
+	return identity, nil
+}
+
+// role returns the puerta role for an identity, and whether it may sign in at all
+func (p *oidcProvider) role(identity *oidcIdentity) (string, bool) {
+	allowed := len(p.cfg.AllowedGroups) == 0
+	role := ""
+	for _, g := range identity.Groups {
+		for _, a := range p.cfg.AllowedGroups {
+			allowed = allowed || g == a
+		}
+
+		if r, ok := p.cfg.Roles[g]; ok && role == "" {
+			role = r
+		}
+	}
+
+	return role, allowed
+}
+
+// localUser finds or creates the puerta user for an identity, keeping its role in sync with the provider's groups.
+// Users are matched by handle only until they first sign in with the provider, and by issuer and subject after that
+func (p *oidcProvider) localUser(sess db.Session, identity *oidcIdentity) (*user.User, error) {
+	role, allowed := p.role(identity)
+	if !allowed {
+		return nil, &errors.InvalidCredentials{Status: http.StatusForbidden, Reason: fmt.Sprintf("%s is not a member of any allowed oidc group: %v", identity.Handle, identity.Groups)}
+	}
+
+	u := &user.User{}
+	err := sess.Get(u, db.Cond{"oidc_issuer": identity.Issuer, "oidc_subject": identity.Subject})
+	if err == db.ErrNoMoreRows {
+		u, err = p.link(sess, identity, role)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if u, err = u.Effective(sess); err != nil {
+		return nil, err
+	}
+
+	if u.Expired() {
+		return nil, &errors.InvalidCredentials{Status: http.StatusForbidden, Reason: fmt.Sprintf("expired user %s signing in with oidc", u.Handle)}
+	}
+
+	if role == "" {
+		// users no longer in a mapped group lose whatever role they got from one
+		role = user.RoleGuest
+	}
+
+	if role != u.Role {
+		logrus.Infof("updating role of %s from %s to %s, per oidc groups", u.Handle, u.Role, role)
+		u.Role = role
+		if err := sess.Collection("user").Find(db.Cond{"id": u.ID}).Update(map[string]any{"role": role}); err != nil {
+			return nil, err
+		}
+	}
+
+	return u, nil
+}
+
+// link finds the user with an identity's handle that has not signed in with
+// the provider before and records the identity on it, or creates a new user
+func (p *oidcProvider) link(sess db.Session, identity *oidcIdentity, role string) (*user.User, error) {
+	u := &user.User{}
+	err := sess.Get(u, db.Cond{"handle": identity.Handle})
+	if err == db.ErrNoMoreRows {
+		if !p.cfg.CreateUsers || role == "" {
+			return nil, &errors.InvalidCredentials{Status: http.StatusForbidden, Reason: fmt.Sprintf("no user for oidc identity %s", identity.Handle)}
+		}
+
+		name := identity.Name
+		if name == "" {
+			name = identity.Handle
+		}
+
+		u = &user.User{
+			Handle:      identity.Handle,
+			Name:        name,
+			Role:        role,
+			TTL:         &user.DefaultTTL,
+			MaxSessions: 1,
+			OIDCIssuer:  identity.Issuer,
+			OIDCSubject: identity.Subject,
+		}
+		if role == user.RoleAdmin {
+			u.MaxSessions = 0
+		}
+
+		if _, err := sess.Collection("user").Insert(u); err != nil {
+			return nil, fmt.Errorf("could not create user for %s: %w", identity.Handle, err)
+		}
+		logrus.Infof("created %s user %s from oidc", role, identity.Handle)
+		return u, sess.Get(u, db.Cond{"handle": identity.Handle})
+	} else if err != nil {
+		return nil, err
+	}
+
+	if u.OIDCSubject != "" {
+		return nil, &errors.InvalidCredentials{Status: http.StatusForbidden, Reason: fmt.Sprintf("%s is linked to another oidc identity than %s at %s", u.Handle, identity.Subject, identity.Issuer)}
+	}
+
+	logrus.Infof("linking %s to oidc identity %s at %s", u.Handle, identity.Subject, identity.Issuer)
+	u.OIDCIssuer = identity.Issuer
+	u.OIDCSubject = identity.Subject
+	err = sess.Collection("user").Find(db.Cond{"id": u.ID}).Update(map[string]any{"oidc_issuer": u.OIDCIssuer, "oidc_subject": u.OIDCSubject})
+	return u, err
+}
+
+// safeNext only lets users be sent back to local paths after signing in
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// OIDCLogin sends users to the identity provider to sign in
+func OIDCLogin(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	flow := &oidcFlow{Next: safeNext(req.URL.Query().Get("next"))}
+	for _, dst := range []*string{&flow.State, &flow.Nonce, &flow.Verifier} {
+		token, err := NewToken()
+		if err != nil {
+			logrus.Errorf("could not start oidc flow: %s", err)
+			errors.Status(w, user.Language(req), http.StatusInternalServerError)
+			return
+		}
+		*dst = token
+	}
+
+	target, err := _oidc.authorizeURL(req.Context(), flow)
+	if err != nil {
+		logrus.Errorf("could not start oidc flow: %s", err)
+		errors.Status(w, user.Language(req), http.StatusBadGateway)
+		return
+	}
+
+	data, _ := json.Marshal(flow)
+	_sess.Put(req.Context(), SessionNameOIDC, data)
+	http.Redirect(w, req, target, http.StatusSeeOther)
+}
+
+// OIDCCallback finishes signing in once the provider sends users back
+func OIDCCallback(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	data, _ := _sess.Pop(req.Context(), SessionNameOIDC).([]byte)
+	flow := &oidcFlow{}
+	if len(data) == 0 || json.Unmarshal(data, flow) != nil {
+		logrus.Warnf("oidc callback without a flow in progress")
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+
+	q := req.URL.Query()
+	if q.Get("state") == "" || q.Get("state") != flow.State {
+		logrus.Warnf("oidc callback with mismatched state")
+		errors.Status(w, user.Language(req), http.StatusBadRequest)
+		return
+	}
+
+	if providerErr := q.Get("error"); providerErr != "" {
+		logrus.Warnf("oidc provider returned error %s: %s", providerErr, q.Get("error_description"))
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+
+	identity, err := _oidc.exchange(req.Context(), q.Get("code"), flow)
+	if err != nil {
+		err = &errors.InvalidCredentials{Status: http.StatusForbidden, Reason: err.Error()}
+		loginFailed(req, "oidc", nil, err)
+		errors.Send(w, user.Language(req), http.StatusForbidden, err)
+		return
+	}
+
+	u, err := _oidc.localUser(_db, identity)
+	if err != nil {
+		code := http.StatusInternalServerError
+		var shown error
+		if authErr, ok := err.(errors.AuthError); ok {
+			authErr.Log()
+			code = authErr.Code()
+			shown = authErr
+		} else {
+			logrus.Errorf("could not map oidc identity %s: %s", identity.Handle, err)
+		}
+		loginFailed(req, identity.Handle, nil, err)
+		errors.Send(w, user.Language(req), code, shown)
+		return
+	}
+
+	sess, err := NewSession(req, u, _db.Collection("session"))
+	if err != nil {
+		logrus.Errorf("Could not create a session: %s", err)
+		errors.Status(w, user.Language(req), http.StatusInternalServerError)
+		return
+	}
+
+	setSessionCookie(w, sess.Token, sess.Expires)
+	logrus.Infof("Created session for %s with oidc", u.Name)
+	http.Redirect(w, req, flow.Next, http.StatusSeeOther)
+}
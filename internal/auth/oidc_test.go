@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/errors"
+	"git.rob.mx/nidito/puerta/internal/testdb"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/upper/db/v4"
+)
+
+// testProvider stands in for an identity provider, issuing id tokens with
+// claims for whatever code the test hands it
+type testProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	codes  map[string]jwt.MapClaims
+	pkce   map[string]string
+	issuer string
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	p := &testProvider{key: key, codes: map[string]jwt.MapClaims{}, pkce: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.issuer,
+			"authorization_endpoint": p.issuer + "/authorize",
+			"token_endpoint":         p.issuer + "/token",
+			"jwks_uri":               p.issuer + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kid": "test",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		code := r.PostFormValue("code")
+		claims, ok := p.codes[code]
+		if !ok || r.PostFormValue("client_id") != "puerta" || r.PostFormValue("client_secret") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		if pkceChallenge(r.PostFormValue("code_verifier")) != p.pkce[code] {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign(t, claims)})
+	})
+	p.Server = httptest.NewServer(mux)
+	p.issuer = p.URL
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *testProvider) sign(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatalf("could not sign id token: %s", err)
+	}
+	return signed
+}
+
+// authorize pretends the user signed in, returning the code the provider would redirect back with
+func (p *testProvider) authorize(t *testing.T, target string, claims jwt.MapClaims) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatalf("could not parse authorize url: %s", err)
+	}
+
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "puerta" {
+		t.Fatalf("unexpected authorize request %s", target)
+	}
+
+	if _, set := claims["nonce"]; !set {
+		claims["nonce"] = q.Get("nonce")
+	}
+	code := "code-" + q.Get("state")
+	p.codes[code] = claims
+	p.pkce[code] = q.Get("code_challenge")
+	return code
+}
+
+func (p *testProvider) claims(handle string, groups ...any) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":                p.issuer,
+		"aud":                "puerta",
+		"sub":                "sub-" + handle,
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"iat":                time.Now().Unix(),
+		"preferred_username": handle,
+		"name":               strings.ToUpper(handle),
+		"groups":             groups,
+	}
+}
+
+func testOIDC(issuer string) *oidcProvider {
+	cfg := ConfigDefaults().OIDC
+	cfg.Issuer = issuer
+	cfg.ClientID = "puerta"
+	cfg.ClientSecret = "secret"
+	cfg.RedirectURL = "http://puerta.test/login/oidc/callback"
+	cfg.AllowedGroups = []string{"family", "friends"}
+	cfg.Roles = map[string]string{"family": "admin", "friends": "guest"}
+	return newOIDCProvider(cfg)
+}
+
+func TestOIDCExchange(t *testing.T) {
+	idp := newTestProvider(t)
+	rp := testOIDC(idp.issuer)
+	ctx := context.Background()
+
+	flow := &oidcFlow{State: "state", Nonce: "nonce", Verifier: "verifier"}
+	target, err := rp.authorizeURL(ctx, flow)
+	if err != nil {
+		t.Fatalf("could not build authorize url: %s", err)
+	}
+
+	code := idp.authorize(t, target, idp.claims("roberto", "family"))
+	identity, err := rp.exchange(ctx, code, flow)
+	if err != nil {
+		t.Fatalf("could not exchange code: %s", err)
+	}
+
+	if identity.Handle != "roberto" || identity.Name != "ROBERTO" || identity.Subject != "sub-roberto" {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+
+	if role, allowed := rp.role(identity); role != "admin" || !allowed {
+		t.Fatalf("expected roberto to be an allowed admin, got %s, %v", role, allowed)
+	}
+
+	if _, err := rp.exchange(ctx, code, &oidcFlow{Nonce: "nonce", Verifier: "another"}); err == nil {
+		t.Fatal("expected exchange with the wrong pkce verifier to fail")
+	}
+}
+
+func TestOIDCVerifyRejects(t *testing.T) {
+	idp := newTestProvider(t)
+	rp := testOIDC(idp.issuer)
+	ctx := context.Background()
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	for name, mutate := range map[string]func(jwt.MapClaims){
+		"wrong nonce":    func(c jwt.MapClaims) { c["nonce"] = "replayed" },
+		"wrong audience": func(c jwt.MapClaims) { c["aud"] = "someone-else" },
+		"wrong issuer":   func(c jwt.MapClaims) { c["iss"] = "https://evil.test" },
+		"expired":        func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no expiry":      func(c jwt.MapClaims) { delete(c, "exp") },
+		"no handle":      func(c jwt.MapClaims) { delete(c, "preferred_username") },
+	} {
+		claims := idp.claims("roberto", "family")
+		claims["nonce"] = "nonce"
+		mutate(claims)
+		if _, err := rp.verify(ctx, idp.sign(t, claims), "nonce"); err == nil {
+			t.Errorf("expected id token with %s to be rejected", name)
+		}
+	}
+
+	claims := idp.claims("roberto", "family")
+	claims["nonce"] = "nonce"
+	forged := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	forged.Header["kid"] = "test"
+	signed, _ := forged.SignedString(other)
+	if _, err := rp.verify(ctx, signed, "nonce"); err == nil {
+		t.Error("expected id token signed by another key to be rejected")
+	}
+
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if _, err := rp.verify(ctx, unsigned, "nonce"); err == nil {
+		t.Error("expected unsigned id token to be rejected")
+	}
+}
+
+func TestOIDCRole(t *testing.T) {
+	rp := testOIDC("https://idp.test")
+	for name, tc := range map[string]struct {
+		groups  []string
+		role    string
+		allowed bool
+	}{
+		"admin":          {[]string{"family"}, "admin", true},
+		"first wins":     {[]string{"friends", "family"}, "guest", true},
+		"not allowed":    {[]string{"strangers"}, "", false},
+		"no groups":      {nil, "", false},
+		"allowed no map": {[]string{"strangers", "friends"}, "guest", true},
+	} {
+		role, allowed := rp.role(&oidcIdentity{Groups: tc.groups})
+		if role != tc.role || allowed != tc.allowed {
+			t.Errorf("%s: expected %q, %v; got %q, %v", name, tc.role, tc.allowed, role, allowed)
+		}
+	}
+
+	rp.cfg.AllowedGroups = nil
+	if _, allowed := rp.role(&oidcIdentity{}); !allowed {
+		t.Error("expected everyone to be allowed without allowed groups")
+	}
+}
+
+func TestOIDCLocalUser(t *testing.T) {
+	sess := testdb.Open(t)
+	rp := testOIDC("https://idp.test")
+	if _, err := sess.Collection("user").Insert(&user.User{Handle: "rob", Name: "Rob", Role: user.RoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+
+	identity := &oidcIdentity{Issuer: "https://idp.test", Subject: "1234", Handle: "rob", Groups: []string{"family"}}
+	u, err := rp.localUser(sess, identity)
+	if err != nil {
+		t.Fatalf("could not link rob: %s", err)
+	}
+
+	if u.Handle != "rob" || u.Role != user.RoleAdmin || u.OIDCSubject != "1234" || u.OIDCIssuer != "https://idp.test" {
+		t.Fatalf("unexpected user after linking: %+v", u)
+	}
+
+	impostor := &oidcIdentity{Issuer: "https://idp.test", Subject: "5678", Handle: "rob", Groups: []string{"family"}}
+	_, err = rp.localUser(sess, impostor)
+	if authErr, ok := err.(*errors.InvalidCredentials); !ok || authErr.Code() != http.StatusForbidden {
+		t.Fatalf("expected another subject claiming rob's handle to be refused, got %v", err)
+	}
+
+	renamed := &oidcIdentity{Issuer: "https://idp.test", Subject: "1234", Handle: "robert", Groups: []string{"family"}}
+	if u, err = rp.localUser(sess, renamed); err != nil || u.Handle != "rob" {
+		t.Fatalf("expected a new handle at the provider to still sign in as rob, got %v, %v", u, err)
+	}
+
+	rp.cfg.AllowedGroups = nil
+	identity.Groups = []string{"strangers"}
+	if u, err = rp.localUser(sess, identity); err != nil {
+		t.Fatalf("could not sign in rob: %s", err)
+	}
+
+	stored := &user.User{}
+	if err := sess.Get(stored, db.Cond{"handle": "rob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Role != user.RoleGuest || stored.Role != user.RoleGuest {
+		t.Fatalf("expected rob to lose the admin role without a mapped group, got %s and stored %s", u.Role, stored.Role)
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	for next, expected := range map[string]string{
+		"/admin":              "/admin",
+		"":                    "/",
+		"https://evil.test/":  "/",
+		"//evil.test/":        "/",
+		"/\\evil.test":        "/",
+		"javascript:alert(1)": "/",
+	} {
+		if got := safeNext(next); got != expected {
+			t.Errorf("expected %q for %q, got %q", expected, next, got)
+		}
+	}
+}
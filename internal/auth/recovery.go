@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/errors"
+	"git.rob.mx/nidito/puerta/internal/i18n"
+	"git.rob.mx/nidito/puerta/internal/push"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// respondWithRecoveryCodes issues a fresh set of recovery codes after a second factor is enrolled
+func respondWithRecoveryCodes(w http.ResponseWriter, u *user.User) {
+	codes, err := u.GenerateRecoveryCodes(_db, _cfg.RecoveryCodes)
+	if err != nil {
+		logrus.Errorf("could not generate recovery codes for %s: %s", u.Name, err)
+		errors.Status(w, i18n.Negotiate(u.Locale, ""), http.StatusInternalServerError)
+		return
+	}
+
+	res, err := json.Marshal(map[string][]string{"recovery_codes": codes})
+	if err != nil {
+		logrus.Errorf("could not encode recovery codes: %s", err)
+		errors.Status(w, i18n.Negotiate(u.Locale, ""), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(res)
+}
+
+// RecoverSecondFactor exchanges a recovery code for the user's second factor
+// credentials, so the next request that enforces 2FA starts enrolment again
+func RecoverSecondFactor() httprouter.Handle {
+	return RequireAuth(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		u := user.FromContext(req)
+		if !u.Require2FA {
+			errors.Status(w, user.Language(req), http.StatusConflict)
+			return
+		}
+
+		// recovery codes are guessed like passwords, so they're limited like them
+		keys := []string{"ip:" + audit.ClientIP(req), "recovery:" + u.Handle}
+		if err := _limiter.check(keys...); err != nil {
+			if locked, ok := err.(*errors.TooManyAttempts); ok {
+				locked.Log()
+				w.Header().Set("Retry-After", locked.RetryAfter())
+			}
+			audit.Record(_db, audit.New(req, audit.EventRecovery, err))
+			errors.Send(w, user.Language(req), http.StatusTooManyRequests, err)
+			return
+		}
+
+		body := struct {
+			Code string `json:"code"`
+		}{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			errors.Status(w, user.Language(req), http.StatusBadRequest)
+			return
+		}
+
+		if err := u.UseRecoveryCode(_db, body.Code); err != nil {
+			_limiter.fail(keys...)
+			audit.Record(_db, audit.New(req, audit.EventRecovery, err))
+			authErr := &errors.InvalidSecondFactor{Reason: fmt.Sprintf("could not recover second factor for %s: %s", u.Name, err)}
+			authErr.Log()
+			errors.Send(w, user.Language(req), authErr.Code(), authErr)
+			return
+		}
+
+		if err := u.DeleteCredentials(_db); err != nil {
+			logrus.Errorf("could not delete credentials for %s: %s", u.Name, err)
+			errors.Status(w, user.Language(req), http.StatusInternalServerError)
+			return
+		}
+
+		if err := u.DeleteTOTP(_db); err != nil {
+			logrus.Errorf("could not delete totp for %s: %s", u.Name, err)
+			errors.Status(w, user.Language(req), http.StatusInternalServerError)
+			return
+		}
+
+		_limiter.succeed(keys[1])
+		audit.Record(_db, audit.New(req, audit.EventRecovery, nil))
+		logrus.Infof("%s used a recovery code", u.Name)
+		go push.NotifyAdmins(_db, i18n.NotifyRecovery, u.Name)
+
+		w.Header().Add("content-type", "application/json")
+		w.Write([]byte(`{"status": "ok"}`))
+	})
+}
@@ -3,50 +3,56 @@
 package auth
 
 import (
-	"math/rand"
-	"strings"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
 	"time"
 
+	"git.rob.mx/nidito/puerta/internal/audit"
 	"git.rob.mx/nidito/puerta/internal/user"
 	"github.com/upper/db/v4"
 )
 
-var letterSrc = rand.NewSource(time.Now().UnixNano())
+// tokenBytes is the amount of randomness in session tokens
+const tokenBytes = 32
 
-const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-const (
-	// 6 bits to represent a letter index
-	letterIdxBits = 6
-	// All 1-bits, as many as letterIdxBits
-	letterIdxMask = 1<<letterIdxBits - 1
-	// # of letter indices fitting in 63 bits
-	letterIdxMax = 63 / letterIdxBits
-)
-
-func NewToken() string {
-	sb := strings.Builder{}
-	n := 32
-	sb.Grow(n)
-
-	for i, cache, remain := n-1, letterSrc.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = letterSrc.Int63(), letterIdxMax
-		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			sb.WriteByte(letterBytes[idx])
-			i--
-		}
-		cache >>= letterIdxBits
-		remain--
+// NewToken returns a random url-safe token
+func NewToken() (string, error) {
+	buf := make([]byte, tokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("could not generate token: %w", err)
 	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// HashToken returns the keyed hash of a session token, the only form tokens are stored in
+func HashToken(key []byte, token string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
 
-	return sb.String()
+func hashToken(token string) string {
+	return HashToken(_sessionKey, token)
 }
 
 type Session struct {
-	Token   string    `db:"token"`
-	UserID  int       `db:"user"`
-	Expires time.Time `db:"expires"`
+	// ID identifies a session without exposing its token
+	ID string `db:"id" json:"id"`
+	// Token is only known when creating a session, the database keeps its Hash
+	Token     string    `db:"-" json:"-"`
+	Hash      string    `db:"hash" json:"-"`
+	UserID    int       `db:"user" json:"-"`
+	Expires   time.Time `db:"expires" json:"expires"`
+	Created   time.Time `db:"created" json:"created"`
+	LastSeen  time.Time `db:"last_seen" json:"last_seen"`
+	IpAddress string    `db:"ip_address" json:"ip_address"`
+	UserAgent string    `db:"user_agent" json:"user_agent"`
+	Current   bool      `db:"-" json:"current,omitempty"`
 }
 
 func (s *Session) Store(sess db.Session) db.Store {
@@ -54,28 +60,135 @@ func (s *Session) Store(sess db.Session) db.Store {
 }
 
 type SessionUser struct {
-	Token     string    `db:"token"`
-	UserID    int       `db:"user"`
-	Expires   time.Time `db:"expires"`
+	Hash      string    `db:"hash"`
+	SessionID string    `db:"session_id"`
+	Expires   time.Time `db:"session_expires"`
+	LastSeen  time.Time `db:"last_seen"`
 	user.User `db:",inline"`
 }
 
 func (s *SessionUser) Expired() bool {
-	return s.Expires.After(time.Now())
+	return s.Expires.Before(time.Now())
 }
 
-func NewSession(user *user.User, table db.Collection) (*Session, error) {
+func NewSession(req *http.Request, user *user.User, table db.Collection) (*Session, error) {
+	id, err := NewToken()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := NewToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
 	sess := &Session{
-		Token:   NewToken(),
-		UserID:  user.ID,
-		Expires: user.TTL.FromNow(),
+		ID:        id,
+		Token:     token,
+		Hash:      hashToken(token),
+		UserID:    user.ID,
+		Expires:   user.TTL.FromNow().UTC(),
+		Created:   now,
+		LastSeen:  now,
+		IpAddress: audit.ClientIP(req),
+		UserAgent: req.Header.Get("user-agent"),
 	}
 
-	if !user.IsAdmin {
-		// delete previous sessions
-		table.Find(db.Cond{"user": user.ID}).Delete()
+	if user.MaxSessions > 0 {
+		// make room for the new session by deleting the oldest ones
+		existing := []*Session{}
+		if err := table.Find(db.Cond{"user": user.ID}).OrderBy("-last_seen").All(&existing); err != nil {
+			return nil, err
+		}
+
+		if len(existing) >= user.MaxSessions {
+			for _, old := range existing[user.MaxSessions-1:] {
+				if err := table.Find(db.Cond{"hash": old.Hash}).Delete(); err != nil {
+					return nil, err
+				}
+			}
+		}
 	}
 	// insert new one
-	_, err := table.Insert(sess)
+	_, err = table.Insert(sess)
 	return sess, err
 }
+
+// ListSessions returns a user's sessions, most recently seen first
+func ListSessions(sess db.Session, userID int) ([]*Session, error) {
+	sessions := []*Session{}
+	err := sess.Collection("session").Find(db.Cond{"user": userID}).OrderBy("-last_seen").All(&sessions)
+	return sessions, err
+}
+
+// RevokeSession deletes a user's session by its id
+func RevokeSession(sess db.Session, userID int, id string) error {
+	res := sess.Collection("session").Find(db.Cond{"user": userID, "id": id})
+	count, err := res.Count()
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return db.ErrNoMoreRows
+	}
+
+	return res.Delete()
+}
+
+// RevokeSessions deletes every session for a user
+func RevokeSessions(sess db.Session, userID int) error {
+	return sess.Collection("session").Find(db.Cond{"user": userID}).Delete()
+}
+
+// RevokeOtherSessions deletes every session for a user but the one with id
+func RevokeOtherSessions(sess db.Session, userID int, id string) error {
+	return sess.Collection("session").Find(db.Cond{"user": userID, "id !=": id}).Delete()
+}
+
+// PruneSessions deletes expired sessions
+func PruneSessions(sess db.Session) (int64, error) {
+	res, err := sess.SQL().DeleteFrom("session").Where(db.Cond{"expires <": time.Now().UTC()}).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// HashLegacySessions replaces the plain text tokens of sessions created before
+// tokens were hashed, or deletes those sessions if no key is given
+func HashLegacySessions(sess db.Session, key string) (int64, error) {
+	legacy := sess.Collection("session").Find(db.Cond{"legacy": true})
+	if key == "" {
+		count, err := legacy.Count()
+		if err != nil {
+			return 0, err
+		}
+		return int64(count), legacy.Delete()
+	}
+
+	sessions := []*Session{}
+	if err := legacy.All(&sessions); err != nil {
+		return 0, err
+	}
+
+	err := sess.Tx(func(tx db.Session) error {
+		for _, s := range sessions {
+			_, err := tx.SQL().
+				Update("session").
+				Set("hash", HashToken([]byte(key), s.Hash), "legacy", false).
+				Where(db.Cond{"hash": s.Hash}).
+				Exec()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(sessions)), nil
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/testdb"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/upper/db/v4"
+)
+
+func TestNewToken(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		token, err := NewToken()
+		if err != nil {
+			t.Fatalf("could not generate token: %s", err)
+		}
+
+		if len(token) != 43 {
+			t.Fatalf("expected 43 characters, got %d: %s", len(token), token)
+		}
+
+		if seen[token] {
+			t.Fatalf("repeated token %s", token)
+		}
+		seen[token] = true
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	hash := HashToken([]byte("key"), "token")
+	if hash != HashToken([]byte("key"), "token") {
+		t.Fatalf("hash is not stable")
+	}
+
+	if hash == HashToken([]byte("other key"), "token") {
+		t.Fatalf("hash does not depend on key")
+	}
+
+	if hash == HashToken([]byte("key"), "other token") {
+		t.Fatalf("hash does not depend on token")
+	}
+}
+
+// newTestSessions creates count sessions for u, each seen a minute after the previous one
+func newTestSessions(t *testing.T, sess db.Session, u *user.User, count int) []*Session {
+	t.Helper()
+	sessions := []*Session{}
+	for i := 0; i < count; i++ {
+		s, err := NewSession(httptest.NewRequest("POST", "/api/login", nil), u, sess.Collection("session"))
+		if err != nil {
+			t.Fatalf("could not create session: %s", err)
+		}
+
+		s.LastSeen = time.Now().UTC().Add(time.Duration(i-count) * time.Minute)
+		if err := sess.Collection("session").Find(db.Cond{"id": s.ID}).Update(db.Cond{"last_seen": s.LastSeen}); err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func sessionIDs(t *testing.T, sess db.Session, userID int) []string {
+	t.Helper()
+	sessions, err := ListSessions(sess, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for _, s := range sessions {
+		ids = append(ids, s.ID)
+	}
+	return ids
+}
+
+func TestNewSessionEvictsOldest(t *testing.T) {
+	sess := testdb.Open(t)
+	u := &user.User{ID: 1, TTL: &user.DefaultTTL, MaxSessions: 2}
+	other := &user.User{ID: 2, TTL: &user.DefaultTTL, MaxSessions: 1}
+	theirs := newTestSessions(t, sess, other, 1)
+	ours := newTestSessions(t, sess, u, 2)
+
+	newest := newTestSessions(t, sess, u, 1)[0]
+	ids := sessionIDs(t, sess, u.ID)
+	if len(ids) != 2 || ids[1] != ours[1].ID || ids[0] != newest.ID {
+		t.Fatalf("expected the oldest session to make room for the new one, got %v", ids)
+	}
+
+	if ids := sessionIDs(t, sess, other.ID); len(ids) != 1 || ids[0] != theirs[0].ID {
+		t.Fatalf("expected other users' sessions to be left alone, got %v", ids)
+	}
+}
+
+func TestNewSessionUnlimited(t *testing.T) {
+	sess := testdb.Open(t)
+	u := &user.User{ID: 1, TTL: &user.DefaultTTL, MaxSessions: 0}
+	newTestSessions(t, sess, u, 5)
+	if ids := sessionIDs(t, sess, u.ID); len(ids) != 5 {
+		t.Fatalf("expected no limit on sessions, got %d", len(ids))
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	sess := testdb.Open(t)
+	u := &user.User{ID: 1, TTL: &user.DefaultTTL}
+	other := &user.User{ID: 2, TTL: &user.DefaultTTL}
+	ours := newTestSessions(t, sess, u, 2)
+	theirs := newTestSessions(t, sess, other, 1)
+
+	if err := RevokeSession(sess, u.ID, theirs[0].ID); err != db.ErrNoMoreRows {
+		t.Fatalf("expected another user's session not to be found, got %v", err)
+	}
+
+	if err := RevokeSession(sess, u.ID, ours[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := sessionIDs(t, sess, u.ID); len(ids) != 1 || ids[0] != ours[1].ID {
+		t.Fatalf("expected only the revoked session to be gone, got %v", ids)
+	}
+
+	if err := RevokeSessions(sess, u.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := sessionIDs(t, sess, u.ID); len(ids) != 0 {
+		t.Fatalf("expected every session to be revoked, got %v", ids)
+	}
+
+	if ids := sessionIDs(t, sess, other.ID); len(ids) != 1 {
+		t.Fatalf("expected other users' sessions to be left alone, got %v", ids)
+	}
+}
@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package auth
+
+import (
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/upper/db/v4"
+)
+
+// challenge holds short-lived data for second factor flows, like webauthn
+// session data and pending totp secrets
+type challenge struct {
+	Token  string    `db:"token"`
+	Data   []byte    `db:"data"`
+	Expiry time.Time `db:"expiry"`
+}
+
+// challengeStore keeps scs session data in the database, so it survives restarts
+// and can be pruned along with the rest of our expired records
+type challengeStore struct {
+	sess db.Session
+}
+
+func (cs *challengeStore) Delete(token string) error {
+	return cs.sess.Collection("challenge").Find(db.Cond{"token": token}).Delete()
+}
+
+func (cs *challengeStore) Find(token string) ([]byte, bool, error) {
+	c := &challenge{}
+	err := cs.sess.Collection("challenge").Find(db.Cond{"token": token, "expiry >": time.Now().UTC()}).One(c)
+	if err != nil {
+		if err == db.ErrNoMoreRows {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	return c.Data, true, nil
+}
+
+func (cs *challengeStore) Commit(token string, b []byte, expiry time.Time) error {
+	_, err := cs.sess.SQL().Exec(
+		`INSERT INTO challenge (token, data, expiry) VALUES (?, ?, ?)
+		ON CONFLICT(token) DO UPDATE SET data = excluded.data, expiry = excluded.expiry`,
+		token, b, expiry.UTC(),
+	)
+	return err
+}
+
+var _ scs.Store = &challengeStore{}
+
+// PruneChallenges deletes expired second factor flow data
+func PruneChallenges(sess db.Session) (int64, error) {
+	res, err := sess.SQL().DeleteFrom("challenge").Where(db.Cond{"expiry <": time.Now().UTC()}).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,244 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/upper/db/v4"
+)
+
+// Scope limits what an api token can be used for
+type Scope string
+
+const (
+	// ScopeRex lets tokens open the door
+	ScopeRex Scope = "rex"
+	// ScopeLogRead lets tokens read the audit log
+	ScopeLogRead Scope = "log:read"
+	// ScopeUsersWrite lets tokens manage users
+	ScopeUsersWrite Scope = "users:write"
+)
+
+// scopePermissions lists the permissions each scope allows tokens to use, as
+// long as the token's user has them. Everything else is off limits for tokens
+var scopePermissions = map[Scope][]user.Permission{
+	ScopeRex:        {user.PermissionOpenDoor},
+	ScopeLogRead:    {user.PermissionViewLog},
+	ScopeUsersWrite: {user.PermissionManageGuests, user.PermissionManageAdmins},
+}
+
+const (
+	// TokenPersonal is created by users for themselves
+	TokenPersonal = "personal"
+	// TokenService is created by someone that manages users for another user, i.e. a home automation account
+	TokenService = "service"
+)
+
+// TokenPrefix makes api tokens easy to tell apart from session cookies, and to find in leaked secrets
+const TokenPrefix = "puerta_"
+
+func ParseScope(name string) (Scope, error) {
+	scope := Scope(name)
+	if _, known := scopePermissions[scope]; !known {
+		return "", fmt.Errorf("unknown scope %s, expected one of rex, log:read or users:write", name)
+	}
+	return scope, nil
+}
+
+// Scopes is stored as a comma separated list
+type Scopes []Scope
+
+func (s Scopes) MarshalDB() (any, error) {
+	names := make([]string, len(s))
+	for i, scope := range s {
+		names[i] = string(scope)
+	}
+	return strings.Join(names, ","), nil
+}
+
+func (s *Scopes) Scan(value any) error {
+	var str string
+	switch v := value.(type) {
+	case string:
+		str = v
+	case []byte:
+		str = string(v)
+	case nil:
+	default:
+		return fmt.Errorf("cannot scan scopes from %T", value)
+	}
+
+	*s = Scopes{}
+	for _, name := range strings.Split(str, ",") {
+		if name != "" {
+			*s = append(*s, Scope(name))
+		}
+	}
+	return nil
+}
+
+// APIToken lets scripts and integrations authenticate as a user with an
+// `Authorization: Bearer` header. Only a keyed hash of the token is stored
+type APIToken struct {
+	ID     string `db:"id" json:"id"`
+	Token  string `db:"-" json:"token,omitempty"`
+	Hash   string `db:"hash" json:"-"`
+	UserID int    `db:"user" json:"-"`
+	Name   string `db:"name" json:"name"`
+	Kind   string `db:"kind" json:"kind"`
+	Scopes Scopes `db:"scopes" json:"scopes"`
+	// SkipSecondFactor exempts requests made with this token from 2FA, every exempted request is audited
+	SkipSecondFactor bool       `db:"skip_second_factor" json:"skip_second_factor"`
+	CreatedBy        string     `db:"created_by" json:"created_by"`
+	Created          time.Time  `db:"created" json:"created"`
+	Expires          *time.Time `db:"expires" json:"expires,omitempty"`
+	LastUsed         *time.Time `db:"last_used" json:"last_used,omitempty"`
+}
+
+func (t *APIToken) Store(sess db.Session) db.Store {
+	return sess.Collection("api_token")
+}
+
+func (t *APIToken) Expired() bool {
+	return t.Expires != nil && t.Expires.Before(time.Now())
+}
+
+// Allows tells if the token may be used for a permission
+func (t *APIToken) Allows(p user.Permission) bool {
+	for _, scope := range t.Scopes {
+		for _, allowed := range scopePermissions[scope] {
+			if allowed == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewAPIToken creates a token for u, failing if u lacks the permissions behind any of scopes
+func NewAPIToken(sess db.Session, u *user.User, createdBy *user.User, name string, scopes []Scope, expires *time.Time, skipSecondFactor bool) (*APIToken, error) {
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("tokens need at least one scope")
+	}
+
+	for _, scope := range scopes {
+		permitted := false
+		for _, p := range scopePermissions[scope] {
+			can, err := u.Can(sess, p)
+			if err != nil {
+				return nil, err
+			}
+			permitted = permitted || can
+		}
+
+		if !permitted {
+			return nil, fmt.Errorf("%s is not allowed to use scope %s", u.Handle, scope)
+		}
+	}
+
+	id, err := NewToken()
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := NewToken()
+	if err != nil {
+		return nil, err
+	}
+
+	kind := TokenPersonal
+	if createdBy.ID != u.ID {
+		kind = TokenService
+	}
+
+	token := TokenPrefix + secret
+	t := &APIToken{
+		ID:               id[:16],
+		Token:            token,
+		Hash:             hashToken(token),
+		UserID:           u.ID,
+		Name:             name,
+		Kind:             kind,
+		Scopes:           scopes,
+		SkipSecondFactor: skipSecondFactor,
+		CreatedBy:        createdBy.Handle,
+		Created:          time.Now().UTC(),
+		Expires:          expires,
+	}
+
+	if _, err := sess.Collection("api_token").Insert(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// UseSessionKey sets the key tokens are hashed with, for use outside the http server
+func UseSessionKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("auth.session_key must be set to create api tokens")
+	}
+	_sessionKey = []byte(key)
+	return nil
+}
+
+// ListAPITokens returns a user's tokens, newest first
+func ListAPITokens(sess db.Session, userID int) ([]*APIToken, error) {
+	tokens := []*APIToken{}
+	err := sess.Collection("api_token").Find(db.Cond{"user": userID}).OrderBy("-created").All(&tokens)
+	return tokens, err
+}
+
+// RevokeAPIToken deletes a user's token by its id
+func RevokeAPIToken(sess db.Session, userID int, id string) error {
+	res := sess.Collection("api_token").Find(db.Cond{"user": userID, "id": id})
+	count, err := res.Count()
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return db.ErrNoMoreRows
+	}
+
+	return res.Delete()
+}
+
+// PruneAPITokens deletes expired api tokens
+func PruneAPITokens(sess db.Session) (int64, error) {
+	res, err := sess.SQL().DeleteFrom("api_token").Where(db.Cond{"expires <": time.Now().UTC()}).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// bearerToken returns the api token in a request's Authorization header, if any
+func bearerToken(req *http.Request) string {
+	header := req.Header.Get("authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
+
+// TokenFromContext returns the api token a request was authenticated with, if any
+func TokenFromContext(req *http.Request) *APIToken {
+	if t, ok := req.Context().Value(contextToken).(*APIToken); ok {
+		return t
+	}
+	return nil
+}
+
+type tokenContext string
+
+const contextToken tokenContext = "_api_token"
+
+// contextScoped marks requests whose token was checked for the route's permission
+const contextScoped tokenContext = "_api_token_scoped"
+
+var _ db.Record = &APIToken{}
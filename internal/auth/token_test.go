@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"git.rob.mx/nidito/puerta/internal/user"
+)
+
+func TestAPITokenAllows(t *testing.T) {
+	token := &APIToken{Scopes: Scopes{ScopeRex, ScopeUsersWrite}}
+	for p, expected := range map[user.Permission]bool{
+		user.PermissionOpenDoor:      true,
+		user.PermissionManageGuests:  true,
+		user.PermissionManageAdmins:  true,
+		user.PermissionViewLog:       false,
+		user.PermissionManageDevices: false,
+	} {
+		if token.Allows(p) != expected {
+			t.Errorf("expected token allowing %s to be %v", p, expected)
+		}
+	}
+}
+
+func TestScopesRoundTrip(t *testing.T) {
+	stored, err := Scopes{ScopeRex, ScopeLogRead}.MarshalDB()
+	if err != nil || stored != "rex,log:read" {
+		t.Fatalf("unexpected stored scopes %v: %v", stored, err)
+	}
+
+	scanned := Scopes{}
+	if err := scanned.Scan([]byte("rex,log:read")); err != nil {
+		t.Fatalf("could not scan scopes: %s", err)
+	}
+
+	if len(scanned) != 2 || scanned[0] != ScopeRex || scanned[1] != ScopeLogRead {
+		t.Fatalf("unexpected scanned scopes %v", scanned)
+	}
+
+	if err := scanned.Scan(""); err != nil || len(scanned) != 0 {
+		t.Fatalf("expected no scopes from an empty string, got %v: %v", scanned, err)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	for header, expected := range map[string]string{
+		"Bearer puerta_abc":  "puerta_abc",
+		"bearer puerta_abc":  "puerta_abc",
+		"Basic YWJjOmRlZg==": "",
+		"Bearer":             "",
+		"":                   "",
+	} {
+		req := httptest.NewRequest("POST", "/api/rex", nil)
+		req.Header.Set("authorization", header)
+		if got := bearerToken(req); got != expected {
+			t.Errorf("expected %q from %q, got %q", expected, header, got)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/errors"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/sirupsen/logrus"
+	"github.com/skip2/go-qrcode"
+)
+
+const SessionNameTOTPRegister = "totp-register"
+const SessionNameTOTPVerified = "totp-verified"
+const HeaderNameTOTP = "totp"
+
+// HeaderNameFactor lets clients that can't do webauthn ask for totp instead
+const HeaderNameFactor = "second-factor"
+
+func prefersTOTP(req *http.Request) bool {
+	return req.Header.Get(HeaderNameFactor) == "totp"
+}
+
+// limitTOTP runs validate for the user in the request, limited like logins
+// are for the same handle and address, since codes are just as guessable.
+// It fails with *errors.TooManyAttempts while those are locked out
+func limitTOTP(req *http.Request, validate func() error) error {
+	u := user.FromContext(req)
+	handleKey := "handle:" + u.Handle
+	keys := []string{"ip:" + audit.ClientIP(req), handleKey}
+	if err := _limiter.check(keys...); err != nil {
+		loginFailed(req, u.Handle, keys, err)
+		return err
+	}
+
+	if err := validate(); err != nil {
+		loginFailed(req, u.Handle, keys, err)
+		return err
+	}
+
+	_limiter.succeed(handleKey)
+	return nil
+}
+
+func totpBeginRegistration(req *http.Request) error {
+	u := user.FromContext(req)
+	logrus.Infof("Starting totp registration for %s", u.Name)
+	if _cfg.SessionKey == "" {
+		return fmt.Errorf("auth.session_key must be set to encrypt totp secrets")
+	}
+
+	totp, err := user.NewTOTP(u)
+	if err != nil {
+		return err
+	}
+
+	uri := totp.URI(_cfg.TOTP.Issuer, u.Handle)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return fmt.Errorf("could not encode totp qr code: %s", err)
+	}
+
+	_sess.Put(req.Context(), SessionNameTOTPRegister, string(totp.Secret))
+	return errors.WebAuthFlowChallenge{Flow: "totp-register", Data: map[string]string{
+		"uri": uri,
+		"qr":  "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	}}
+}
+
+func totpFinishRegistration(req *http.Request) error {
+	u := user.FromContext(req)
+	secret := _sess.PopString(req.Context(), SessionNameTOTPRegister)
+	if secret == "" {
+		return fmt.Errorf("error finishing totp registration: no session found for user")
+	}
+
+	body := struct {
+		Code string `json:"code"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return fmt.Errorf("could not decode totp registration: %s", err)
+	}
+
+	totp := &user.TOTP{UserID: u.ID, Secret: user.TOTPSecret(secret)}
+	err := limitTOTP(req, func() error {
+		counter, err := totp.Validate(body.Code, time.Now(), _cfg.TOTP.Skew)
+		if err != nil {
+			return &errors.InvalidSecondFactor{Reason: fmt.Sprintf("could not confirm totp for %s: %s", u.Name, err)}
+		}
+		totp.LastCounter = counter
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := _db.Collection("totp").Insert(totp); err != nil {
+		return err
+	}
+
+	// the code was just used to confirm enrolment, let the original request through
+	_sess.Put(req.Context(), SessionNameTOTPVerified, true)
+	return nil
+}
+
+func totpLogin(req *http.Request) error {
+	u := user.FromContext(req)
+	if _sess.PopBool(req.Context(), SessionNameTOTPVerified) {
+		logrus.Infof("Accepting freshly enrolled totp for %s", u.Name)
+		return nil
+	}
+
+	code := req.Header.Get(HeaderNameTOTP)
+	if code == "" {
+		logrus.Infof("Starting totp login flow for %s", u.Name)
+		return errors.WebAuthFlowChallenge{Flow: "totp", Data: map[string]int{"digits": user.TOTPDigits}}
+	}
+
+	return limitTOTP(req, func() error {
+		if err := u.ValidateTOTP(_db, code, time.Now(), _cfg.TOTP.Skew); err != nil {
+			return &errors.InvalidSecondFactor{Reason: fmt.Sprintf("could not validate totp for %s: %s", u.Name, err)}
+		}
+		return nil
+	})
+}
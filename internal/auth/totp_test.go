@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/constants"
+	"git.rob.mx/nidito/puerta/internal/errors"
+	"git.rob.mx/nidito/puerta/internal/testdb"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/upper/db/v4"
+)
+
+func TestLimitTOTP(t *testing.T) {
+	_db = testdb.Open(t)
+	_cfg = &Config{Lockout: &LockoutConfig{MaxFailures: 3, Lockout: time.Hour, Window: time.Hour}}
+	_limiter = newLimiter(_cfg.Lockout)
+
+	req := httptest.NewRequest("POST", "/api/rex", nil)
+	req = req.WithContext(context.WithValue(req.Context(), constants.ContextUser, &user.User{ID: 1, Handle: "joao"}))
+	wrong := func() error { return &errors.InvalidSecondFactor{Reason: "wrong code"} }
+	right := func() error { return nil }
+
+	if err := limitTOTP(req, right); err != nil {
+		t.Fatalf("expected a valid code to be accepted: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := limitTOTP(req, wrong); err == nil {
+			t.Fatalf("expected a wrong code to be rejected")
+		}
+	}
+
+	if err := limitTOTP(req, right); err == nil {
+		t.Fatalf("expected codes to be refused once locked out")
+	} else if _, ok := err.(*errors.TooManyAttempts); !ok {
+		t.Fatalf("expected too many attempts, got %v", err)
+	}
+
+	// codes and passwords share the same attempts
+	if err := _limiter.check("handle:joao"); err == nil {
+		t.Fatalf("expected logins for the handle to be locked out too")
+	}
+
+	failures, err := _db.Collection("log").Find(db.Cond{"event": "login", "user": "joao", "failure": "wrong code"}).Count()
+	if err != nil || failures != 3 {
+		t.Fatalf("expected 3 failures to be logged, got %d %v", failures, err)
+	}
+}
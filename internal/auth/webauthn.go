@@ -8,14 +8,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"time"
 
 	"git.rob.mx/nidito/puerta/internal/errors"
 	"git.rob.mx/nidito/puerta/internal/user"
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/sirupsen/logrus"
-	"github.com/upper/db/v4"
 )
 
 const SessionNameWANAuth = "wan-auth"
@@ -25,7 +23,12 @@ const HeaderNameWAN = "webauthn"
 func webAuthnBeginRegistration(req *http.Request) error {
 	user := user.FromContext(req)
 	logrus.Infof("Starting webauthn registration for %s", user.Name)
-	options, sessionData, err := _wan.BeginRegistration(user)
+	exclusions := []protocol.CredentialDescriptor{}
+	for _, c := range user.WebAuthnCredentials() {
+		exclusions = append(exclusions, c.Descriptor())
+	}
+
+	options, sessionData, err := _wan.BeginRegistration(user, webauthn.WithExclusions(exclusions))
 	if err != nil {
 		err = fmt.Errorf("error starting webauthn: %s", err)
 		logrus.Error(err)
@@ -117,7 +120,3 @@ func webAuthnLogin(req *http.Request) error {
 	_, err = _wan.ValidateLogin(user, sessionData, response)
 	return err
 }
-
-func Cleanup() error {
-	return _db.Collection("session").Find(db.Cond{"Expires": db.Before(time.Now())}).Delete()
-}
@@ -0,0 +1,380 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package booking
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/i18n"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
+)
+
+// Config tells how bookings turn into guests
+type Config struct {
+	// Calendars maps names to ics urls, fetched by the bookings job
+	Calendars map[string]string `yaml:"calendars"`
+	// CheckIn is the time guests may come in on their first day, for calendars that only list dates
+	CheckIn string `yaml:"check_in"`
+	// CheckOut is the time guests must leave by on their last day, for calendars that only list dates
+	CheckOut string `yaml:"check_out"`
+	// Grace keeps guests enabled for a while after checking out
+	Grace time.Duration `yaml:"grace"`
+	// Role is given to guests created from bookings
+	Role string `yaml:"role"`
+	// HandlePrefix starts the handle of every guest created from bookings
+	HandlePrefix string `yaml:"handle_prefix"`
+	// MaxSessions is how many devices each guest can sign in with
+	MaxSessions int `yaml:"max_sessions"`
+}
+
+func ConfigDefaults() *Config {
+	return &Config{
+		Calendars:    map[string]string{},
+		CheckIn:      "15:00",
+		CheckOut:     "11:00",
+		Role:         user.RoleGuest,
+		HandlePrefix: "huesped-",
+		MaxSessions:  4,
+	}
+}
+
+func parseClock(src string) (int, int, error) {
+	t, err := time.Parse("15:04", src)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time %q, expected hh:mm", src)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+func (c *Config) Validate() error {
+	if _, _, err := parseClock(c.CheckIn); err != nil {
+		return fmt.Errorf("invalid check_in: %w", err)
+	}
+
+	if _, _, err := parseClock(c.CheckOut); err != nil {
+		return fmt.Errorf("invalid check_out: %w", err)
+	}
+	return nil
+}
+
+// Stay returns when a guest may come in and must leave by
+func (c *Config) Stay(e *Event) (time.Time, time.Time) {
+	if !e.AllDay {
+		return e.Start, e.End
+	}
+
+	at := func(day time.Time, clock string) time.Time {
+		h, m, _ := parseClock(clock)
+		return time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, day.Location())
+	}
+	// all day events end the day after their last, which is when guests check out
+	return at(e.Start, c.CheckIn), at(e.End, c.CheckOut)
+}
+
+// Booking ties an event in a calendar to the guest created for it
+type Booking struct {
+	UID       string    `db:"uid" json:"uid"`
+	Source    string    `db:"source" json:"source"`
+	UserID    int       `db:"user" json:"-"`
+	Summary   string    `db:"summary" json:"summary"`
+	CheckIn   time.Time `db:"check_in" json:"check_in"`
+	CheckOut  time.Time `db:"check_out" json:"check_out"`
+	Cancelled bool      `db:"cancelled" json:"cancelled"`
+	Updated   time.Time `db:"updated" json:"updated"`
+}
+
+func (b *Booking) Store(sess db.Session) db.Store {
+	return sess.Collection("booking")
+}
+
+// Invite holds the credentials of a newly created guest, only available right after importing
+type Invite struct {
+	Handle   string    `json:"handle"`
+	Name     string    `json:"name"`
+	Password string    `json:"password"`
+	CheckIn  time.Time `json:"check_in"`
+	CheckOut time.Time `json:"check_out"`
+}
+
+func (i *Invite) Localize(lang string) string {
+	return i18n.T(lang, i18n.NotifyInvite, i.Name, i.CheckIn.Format("2006-01-02 15:04"), i.CheckOut.Format("2006-01-02 15:04"), i.Handle, i.Password)
+}
+
+func (i *Invite) String() string {
+	return i.Localize(i18n.Default)
+}
+
+// Result summarizes an import
+type Result struct {
+	Created    []*Invite `json:"created"`
+	Updated    []string  `json:"updated"`
+	Reinstated []string  `json:"reinstated"`
+	Cancelled  []string  `json:"cancelled"`
+	// Failed lists the bookings that could not be imported, and why
+	Failed    []string `json:"failed"`
+	Unchanged int      `json:"unchanged"`
+	Skipped   int      `json:"skipped"`
+}
+
+func (r *Result) String() string {
+	return fmt.Sprintf("created %d guests, updated %d, reinstated %d, cancelled %d, %d failed, %d unchanged and %d skipped", len(r.Created), len(r.Updated), len(r.Reinstated), len(r.Cancelled), len(r.Failed), r.Unchanged, r.Skipped)
+}
+
+// handleFor derives a stable handle from an event's UID
+func (c *Config) handleFor(uid string) string {
+	sum := sha256.Sum256([]byte(uid))
+	return c.HandlePrefix + hex.EncodeToString(sum[:])[:12]
+}
+
+// uniqueHandle returns the handle for an event's UID, numbered if another user
+// already has it
+func (c *Config) uniqueHandle(tx db.Session, uid string) (string, error) {
+	base := c.handleFor(uid)
+	handle := base
+	for i := 2; ; i++ {
+		taken, err := tx.Collection("user").Find(db.Cond{"handle": handle}).Exists()
+		if err != nil || !taken {
+			return handle, err
+		}
+		handle = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// passwordAlphabet leaves out characters that are easy to mistake for others
+const passwordAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+func newPassword() (string, error) {
+	password := make([]byte, 12)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(passwordAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		password[i] = passwordAlphabet[n.Int64()]
+	}
+	return string(password), nil
+}
+
+// schedule only lets guests in during their stay, written in UTC so it holds
+// regardless of the timezone the guest's schedule is evaluated in
+func schedule(checkIn, checkOut time.Time) (*user.Schedule, error) {
+	const layout = "20060102T150405Z"
+	return user.ParseSchedule(fmt.Sprintf("DTSTART:%s DTEND:%s", checkIn.UTC().Format(layout), checkOut.UTC().Format(layout)))
+}
+
+// Import creates, updates or disables guests for the events read from source.
+// Events are matched to guests by their UID, so importing a calendar again only
+// applies what changed. Bookings missing from a source's calendar before they
+// end are cancelled, disabling their guests, and reinstated if they show up
+// again. Events that fail to import are listed in the result's Failed
+func Import(sess db.Session, cfg *Config, source string, events []*Event, now time.Time) (*Result, error) {
+	result := &Result{Created: []*Invite{}, Updated: []string{}, Reinstated: []string{}, Cancelled: []string{}, Failed: []string{}}
+	seen := map[string]bool{}
+
+	for _, e := range events {
+		seen[e.UID] = true
+		err := sess.Tx(func(tx db.Session) error {
+			return importEvent(tx, cfg, source, e, now, result)
+		})
+		if err != nil {
+			logrus.Errorf("could not import booking %s: %s", e.UID, err)
+			result.Failed = append(result.Failed, fmt.Sprintf("%s: %s", e.UID, err))
+		}
+	}
+
+	upcoming := []*Booking{}
+	err := sess.Collection("booking").Find(db.Cond{"source": source, "cancelled": false, "check_out >": now.UTC()}).All(&upcoming)
+	if err != nil {
+		return result, err
+	}
+
+	for _, b := range upcoming {
+		if seen[b.UID] {
+			continue
+		}
+
+		err := sess.Tx(func(tx db.Session) error {
+			return cancel(tx, b, now, result)
+		})
+		if err != nil {
+			return result, fmt.Errorf("could not cancel booking %s: %w", b.UID, err)
+		}
+	}
+
+	return result, nil
+}
+
+func importEvent(tx db.Session, cfg *Config, source string, e *Event, now time.Time, result *Result) error {
+	checkIn, checkOut := cfg.Stay(e)
+	name := e.Summary
+	if name == "" {
+		name = i18n.T(i18n.Default, i18n.GuestName)
+	}
+
+	existing := &Booking{}
+	err := tx.Get(existing, db.Cond{"uid": e.UID})
+	if err != nil && err != db.ErrNoMoreRows {
+		return err
+	}
+
+	if err == db.ErrNoMoreRows {
+		if e.Cancelled || !checkOut.After(now) {
+			result.Skipped++
+			return nil
+		}
+		return create(tx, cfg, source, e, name, checkIn, checkOut, now, result)
+	}
+
+	reinstated := false
+	if existing.Cancelled {
+		if e.Cancelled || !checkOut.After(now) {
+			result.Unchanged++
+			return nil
+		}
+		existing.Cancelled = false
+		reinstated = true
+	} else if e.Cancelled {
+		return cancel(tx, existing, now, result)
+	} else if existing.CheckIn.Equal(checkIn) && existing.CheckOut.Equal(checkOut) && existing.Summary == e.Summary {
+		result.Unchanged++
+		return nil
+	}
+
+	sch, err := schedule(checkIn, checkOut)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Collection("user").Find(db.Cond{"id": existing.UserID}).Update(map[string]any{
+		"name":     name,
+		"schedule": sch,
+		"expires":  user.NewUTCTime(checkOut.Add(cfg.Grace)),
+	})
+	if err != nil {
+		return err
+	}
+
+	existing.Summary = e.Summary
+	existing.CheckIn = checkIn.UTC()
+	existing.CheckOut = checkOut.UTC()
+	existing.Updated = now.UTC()
+	if err := tx.Collection("booking").Find(db.Cond{"uid": e.UID}).Update(existing); err != nil {
+		return err
+	}
+
+	if reinstated {
+		logrus.Infof("reinstated booking %s from %s to %s", e.UID, checkIn, checkOut)
+		result.Reinstated = append(result.Reinstated, e.UID)
+		return nil
+	}
+
+	logrus.Infof("updated booking %s, now from %s to %s", e.UID, checkIn, checkOut)
+	result.Updated = append(result.Updated, e.UID)
+	return nil
+}
+
+func create(tx db.Session, cfg *Config, source string, e *Event, name string, checkIn, checkOut time.Time, now time.Time, result *Result) error {
+	password, err := newPassword()
+	if err != nil {
+		return err
+	}
+
+	hash, err := user.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	sch, err := schedule(checkIn, checkOut)
+	if err != nil {
+		return err
+	}
+
+	handle, err := cfg.uniqueHandle(tx, e.UID)
+	if err != nil {
+		return err
+	}
+
+	guest := &user.User{
+		Handle:      handle,
+		Name:        name,
+		Password:    hash,
+		Greeting:    i18n.T(i18n.Default, i18n.GuestGreeting),
+		Role:        cfg.Role,
+		Schedule:    sch,
+		Expires:     user.NewUTCTime(checkOut.Add(cfg.Grace)),
+		TTL:         &user.DefaultTTL,
+		MaxSessions: cfg.MaxSessions,
+	}
+
+	res, err := tx.Collection("user").Insert(guest)
+	if err != nil {
+		return fmt.Errorf("could not create guest %s: %w", guest.Handle, err)
+	}
+
+	b := &Booking{
+		UID:      e.UID,
+		Source:   source,
+		UserID:   int(res.ID().(int64)),
+		Summary:  e.Summary,
+		CheckIn:  checkIn.UTC(),
+		CheckOut: checkOut.UTC(),
+		Updated:  now.UTC(),
+	}
+	if _, err := tx.Collection("booking").Insert(b); err != nil {
+		return err
+	}
+
+	logrus.Infof("created guest %s for booking %s from %s to %s", guest.Handle, e.UID, checkIn, checkOut)
+	result.Created = append(result.Created, &Invite{
+		Handle:   guest.Handle,
+		Name:     name,
+		Password: password,
+		CheckIn:  checkIn,
+		CheckOut: checkOut,
+	})
+	return nil
+}
+
+// cancel disables a booking's guest right away
+func cancel(tx db.Session, b *Booking, now time.Time, result *Result) error {
+	err := tx.Collection("user").Find(db.Cond{"id": b.UserID}).Update(map[string]any{"expires": user.NewUTCTime(now)})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Collection("booking").Find(db.Cond{"uid": b.UID}).Update(map[string]any{"cancelled": true, "updated": now.UTC()})
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("cancelled booking %s", b.UID)
+	result.Cancelled = append(result.Cancelled, b.UID)
+	return nil
+}
+
+// Fetch downloads and parses a calendar
+func Fetch(url string, loc *time.Location) ([]*Event, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch calendar: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch calendar, got status %d", res.StatusCode)
+	}
+
+	return ParseICS(io.LimitReader(res.Body, 10*1024*1024), loc)
+}
+
+var _ db.Record = &Booking{}
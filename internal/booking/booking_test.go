@@ -0,0 +1,150 @@
+package booking
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/testdb"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/upper/db/v4"
+)
+
+func TestStay(t *testing.T) {
+	cfg := ConfigDefaults()
+	house := time.FixedZone("house", -6*3600)
+
+	checkIn, checkOut := cfg.Stay(&Event{
+		Start:  time.Date(2026, 10, 23, 0, 0, 0, 0, house),
+		End:    time.Date(2026, 10, 26, 0, 0, 0, 0, house),
+		AllDay: true,
+	})
+	if !checkIn.Equal(time.Date(2026, 10, 23, 15, 0, 0, 0, house)) || !checkOut.Equal(time.Date(2026, 10, 26, 11, 0, 0, 0, house)) {
+		t.Errorf("unexpected stay for all day event: %s - %s", checkIn, checkOut)
+	}
+
+	start := time.Date(2026, 10, 23, 18, 30, 0, 0, house)
+	end := time.Date(2026, 10, 24, 10, 0, 0, 0, house)
+	checkIn, checkOut = cfg.Stay(&Event{Start: start, End: end})
+	if !checkIn.Equal(start) || !checkOut.Equal(end) {
+		t.Errorf("expected timed events to keep their times, got %s - %s", checkIn, checkOut)
+	}
+}
+
+func TestStaySchedule(t *testing.T) {
+	house := time.FixedZone("house", -6*3600)
+	checkIn := time.Date(2026, 10, 23, 15, 0, 0, 0, house)
+	checkOut := time.Date(2026, 10, 26, 11, 0, 0, 0, house)
+
+	sch, err := schedule(checkIn, checkOut)
+	if err != nil {
+		t.Fatalf("could not build schedule: %s", err)
+	}
+
+	for when, expected := range map[time.Time]bool{
+		checkIn:                     true,
+		checkIn.Add(-time.Minute):   false,
+		checkIn.Add(48 * time.Hour): true,
+		checkOut.Add(-time.Minute):  true,
+		checkOut:                    false,
+		checkIn.AddDate(0, 0, 7):    false,
+	} {
+		if got := sch.AllowedAt(when.In(house)); got != expected {
+			t.Errorf("expected access at %s to be %v", when, expected)
+		}
+	}
+}
+
+func TestHandleFor(t *testing.T) {
+	cfg := ConfigDefaults()
+	handle := cfg.handleFor("1418fb94e984-aa1b@airbnb.com")
+	if handle != cfg.handleFor("1418fb94e984-aa1b@airbnb.com") {
+		t.Fatal("expected handles to be stable")
+	}
+
+	if !strings.HasPrefix(handle, "huesped-") || len(handle) != len("huesped-")+12 {
+		t.Fatalf("unexpected handle %s", handle)
+	}
+
+	if handle == cfg.handleFor("another@airbnb.com") {
+		t.Fatal("expected different bookings to get different handles")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := ConfigDefaults()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected defaults to be valid: %s", err)
+	}
+
+	cfg.CheckOut = "11am"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected invalid check out time to fail")
+	}
+}
+
+func TestImportTakenHandle(t *testing.T) {
+	sess := testdb.Open(t)
+	cfg := ConfigDefaults()
+	now := time.Now().UTC().Truncate(time.Minute)
+	taken := cfg.handleFor("taken@airbnb.com")
+	if _, err := sess.Collection("user").Insert(&user.User{Handle: taken, Name: "someone"}); err != nil {
+		t.Fatal(err)
+	}
+
+	events := []*Event{
+		{UID: "taken@airbnb.com", Summary: "Ana", Start: now.Add(24 * time.Hour), End: now.Add(48 * time.Hour)},
+		{UID: "free@airbnb.com", Summary: "Beto", Start: now.Add(24 * time.Hour), End: now.Add(48 * time.Hour)},
+	}
+	result, err := Import(sess, cfg, "airbnb", events, now)
+	if err != nil {
+		t.Fatalf("could not import: %s", err)
+	}
+
+	if len(result.Created) != 2 || len(result.Failed) != 0 {
+		t.Fatalf("expected both guests to be created, got %s: %v", result, result.Failed)
+	}
+
+	if result.Created[0].Handle != taken+"-2" {
+		t.Fatalf("expected a numbered handle, got %s", result.Created[0].Handle)
+	}
+}
+
+func TestImportReinstates(t *testing.T) {
+	sess := testdb.Open(t)
+	cfg := ConfigDefaults()
+	now := time.Now().UTC().Truncate(time.Minute)
+	event := &Event{UID: "stay@airbnb.com", Summary: "Ana", Start: now.Add(24 * time.Hour), End: now.Add(48 * time.Hour)}
+
+	if _, err := Import(sess, cfg, "airbnb", []*Event{event}, now); err != nil {
+		t.Fatalf("could not import: %s", err)
+	}
+
+	result, err := Import(sess, cfg, "airbnb", []*Event{}, now)
+	if err != nil || len(result.Cancelled) != 1 {
+		t.Fatalf("expected the missing booking to be cancelled, got %v, %v", result, err)
+	}
+
+	result, err = Import(sess, cfg, "airbnb", []*Event{event}, now)
+	if err != nil {
+		t.Fatalf("could not import: %s", err)
+	}
+
+	if len(result.Reinstated) != 1 || len(result.Created) != 0 {
+		t.Fatalf("expected the booking to be reinstated, got %s", result)
+	}
+
+	b := &Booking{}
+	if err := sess.Get(b, db.Cond{"uid": event.UID}); err != nil {
+		t.Fatal(err)
+	}
+
+	guest := &user.User{}
+	if err := sess.Get(guest, db.Cond{"id": b.UserID}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Cancelled || guest.Expired() {
+		t.Fatalf("expected booking and guest to be active again, cancelled: %v, expires: %v", b.Cancelled, guest.Expires)
+	}
+}
@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package booking
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Event is a booking read from a calendar
+type Event struct {
+	UID     string
+	Summary string
+	Start   time.Time
+	End     time.Time
+	// AllDay events only tell the dates of check-in and check-out
+	AllDay    bool
+	Cancelled bool
+}
+
+// unfold joins lines continued with leading whitespace, per RFC 5545
+func unfold(r io.Reader) ([]string, error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+func unescape(value string) string {
+	return strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+// parseTime reads DATE and DATE-TIME values, placing floating times in loc
+func parseTime(value string, params map[string]string, loc *time.Location) (time.Time, bool, error) {
+	if tzid, ok := params["TZID"]; ok {
+		zone, err := time.LoadLocation(tzid)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("unknown timezone %s", tzid)
+		}
+		loc = zone
+	}
+
+	if params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.ParseInLocation("20060102", value, loc)
+		return t, true, err
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+// ParseICS reads the events in an iCalendar file, with floating times in loc
+func ParseICS(r io.Reader, loc *time.Location) ([]*Event, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read calendar: %w", err)
+	}
+
+	events := []*Event{}
+	var current *Event
+	sawCalendar := false
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+
+		nameAndParams, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("line %d is not a calendar property: %q", i+1, line)
+		}
+
+		parts := strings.Split(nameAndParams, ";")
+		name := strings.ToUpper(parts[0])
+		params := map[string]string{}
+		for _, p := range parts[1:] {
+			k, v, _ := strings.Cut(p, "=")
+			params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+		}
+
+		switch {
+		case name == "BEGIN" && value == "VCALENDAR":
+			sawCalendar = true
+		case name == "BEGIN" && value == "VEVENT":
+			current = &Event{}
+		case name == "END" && value == "VEVENT":
+			if current == nil {
+				return nil, fmt.Errorf("line %d ends an event that never began", i+1)
+			}
+
+			if current.UID == "" || current.Start.IsZero() {
+				return nil, fmt.Errorf("event ending at line %d needs a UID and DTSTART", i+1)
+			}
+
+			if current.End.IsZero() {
+				current.End = current.Start.AddDate(0, 0, 1)
+			}
+
+			if !current.End.After(current.Start) {
+				return nil, fmt.Errorf("event %s ends before it starts", current.UID)
+			}
+
+			events = append(events, current)
+			current = nil
+		case current == nil:
+			// calendar properties and other components are of no use
+		case name == "UID":
+			current.UID = value
+		case name == "SUMMARY":
+			current.Summary = unescape(value)
+		case name == "STATUS":
+			current.Cancelled = strings.EqualFold(value, "CANCELLED")
+		case name == "DTSTART", name == "DTEND":
+			t, allDay, err := parseTime(value, params, loc)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s at line %d: %w", name, i+1, err)
+			}
+
+			if name == "DTSTART" {
+				current.Start = t
+				current.AllDay = allDay
+			} else {
+				current.End = t
+			}
+		}
+	}
+
+	if !sawCalendar {
+		return nil, fmt.Errorf("not an iCalendar file, it has no BEGIN:VCALENDAR")
+	}
+
+	if current != nil {
+		return nil, fmt.Errorf("event %s never ends", current.UID)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,75 @@
+package booking
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const calendar = `BEGIN:VCALENDAR
+PRODID:-//Airbnb Inc//Hosting Calendar 0.8.8//EN
+VERSION:2.0
+BEGIN:VEVENT
+DTSTAMP:20261019T120000Z
+DTSTART;VALUE=DATE:20261023
+DTEND;VALUE=DATE:20261026
+SUMMARY:Reserved
+UID:1418fb94e984-aa1b@airbnb.com
+DESCRIPTION:Reservation URL: https://www.airbnb.com/hosting/reservations/d
+ etails/HM12345\nPhone Number (Last 4 Digits): 1234
+END:VEVENT
+BEGIN:VEVENT
+DTSTART;TZID=America/Mexico_City:20261101T160000
+DTEND:20261103T170000Z
+SUMMARY:Ana\, familia
+UID:booking-2
+STATUS:CANCELLED
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestParseICS(t *testing.T) {
+	events, err := ParseICS(strings.NewReader(strings.ReplaceAll(calendar, "\n", "\r\n")), time.UTC)
+	if err != nil {
+		t.Fatalf("could not parse calendar: %s", err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+
+	stay := events[0]
+	if stay.UID != "1418fb94e984-aa1b@airbnb.com" || stay.Summary != "Reserved" || !stay.AllDay || stay.Cancelled {
+		t.Errorf("unexpected first event %+v", stay)
+	}
+
+	if !stay.Start.Equal(time.Date(2026, 10, 23, 0, 0, 0, 0, time.UTC)) || !stay.End.Equal(time.Date(2026, 10, 26, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected dates for first event: %s - %s", stay.Start, stay.End)
+	}
+
+	cancelled := events[1]
+	if cancelled.Summary != "Ana, familia" || !cancelled.Cancelled || cancelled.AllDay {
+		t.Errorf("unexpected second event %+v", cancelled)
+	}
+
+	if !cancelled.Start.Equal(time.Date(2026, 11, 1, 22, 0, 0, 0, time.UTC)) || !cancelled.End.Equal(time.Date(2026, 11, 3, 17, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected times for second event: %s - %s", cancelled.Start, cancelled.End)
+	}
+}
+
+func TestParseICSErrors(t *testing.T) {
+	for name, src := range map[string]string{
+		"not a calendar": "hello",
+		"no uid":         "BEGIN:VCALENDAR\nBEGIN:VEVENT\nDTSTART:20261023T150000\nEND:VEVENT\nEND:VCALENDAR",
+		"no start":       "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:a\nEND:VEVENT\nEND:VCALENDAR",
+		"bad date":       "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:a\nDTSTART:2026-10-23\nEND:VEVENT\nEND:VCALENDAR",
+		"backwards":      "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:a\nDTSTART:20261023T150000\nDTEND:20261022T150000\nEND:VEVENT\nEND:VCALENDAR",
+		"never ends":     "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:a\nDTSTART:20261023T150000\n",
+		"no vcalendar":   "BEGIN:VEVENT\nUID:a\nDTSTART:20261023T150000\nEND:VEVENT",
+		"bad timezone":   "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:a\nDTSTART;TZID=Mars/Olympus:20261023T150000\nEND:VEVENT\nEND:VCALENDAR",
+	} {
+		if _, err := ParseICS(strings.NewReader(src), time.UTC); err == nil {
+			t.Errorf("expected calendar with %s to fail", name)
+		}
+	}
+}
@@ -7,4 +7,9 @@ type AuthContext string
 const (
 	ContextCookieName AuthContext = "_puerta"
 	ContextUser       AuthContext = "_user"
+	ContextSession    AuthContext = "_session"
+	// ContextAPIToken holds the id of the api token a request authenticated with
+	ContextAPIToken AuthContext = "_api_token_id"
+	// ContextSkipped2FA is set when an api token exempts a request from 2FA
+	ContextSkipped2FA AuthContext = "_skipped_2fa"
 )
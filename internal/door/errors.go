@@ -5,6 +5,8 @@ package door
 import (
 	"fmt"
 	"net/http"
+
+	"git.rob.mx/nidito/puerta/internal/i18n"
 )
 
 type ErrorCommunication struct {
@@ -24,6 +26,14 @@ func (err *ErrorCommunication) Name() string {
 	return "communication-error"
 }
 
+func (err *ErrorCommunication) Localize(lang string) string {
+	return i18n.T(lang, i18n.DoorUnavailable)
+}
+
+func (err *ErrorCommunication) MessageKey() i18n.Key {
+	return i18n.DoorUnavailable
+}
+
 type ErrorAlreadyOpen struct{}
 
 func (err *ErrorAlreadyOpen) Error() string {
@@ -38,6 +48,14 @@ func (err *ErrorAlreadyOpen) Name() string {
 	return "already-open"
 }
 
+func (err *ErrorAlreadyOpen) Localize(lang string) string {
+	return i18n.T(lang, i18n.DoorAlreadyOpen)
+}
+
+func (err *ErrorAlreadyOpen) MessageKey() i18n.Key {
+	return i18n.DoorAlreadyOpen
+}
+
 type Error interface {
 	Error() string
 	Code() int
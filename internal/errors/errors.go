@@ -5,7 +5,11 @@ package errors
 import (
 	"encoding/base64"
 	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
 
+	"git.rob.mx/nidito/puerta/internal/i18n"
 	"github.com/sirupsen/logrus"
 )
 
@@ -15,12 +19,65 @@ type HTTPError interface {
 }
 
 func ToHTTP(err error) (string, int) {
-	if err := err.(HTTPError); err != nil {
+	if err, ok := err.(HTTPError); ok {
 		return err.Error(), err.Code()
 	}
 	return err.Error(), 500
 }
 
+// Response is the body of API errors. Code is stable for clients to act on,
+// while Message is meant for people and shown in their language
+type Response struct {
+	Code    i18n.Key `json:"code"`
+	Message string   `json:"message"`
+}
+
+var statusKeys = map[int]i18n.Key{
+	http.StatusBadRequest:      i18n.ErrBadRequest,
+	http.StatusUnauthorized:    i18n.ErrUnauthorized,
+	http.StatusForbidden:       i18n.ErrForbidden,
+	http.StatusNotFound:        i18n.ErrNotFound,
+	http.StatusConflict:        i18n.ErrConflict,
+	http.StatusTooManyRequests: i18n.ErrTooManyRequests,
+}
+
+// ResponseFor describes err in lang. Errors without a message in the catalog
+// get their status' code, and keep their text only when caused by the client
+func ResponseFor(lang string, status int, err error) *Response {
+	if key, ok := i18n.KeyOf(err); ok {
+		return &Response{Code: key, Message: i18n.Localize(err, lang)}
+	}
+
+	key, ok := statusKeys[status]
+	if !ok {
+		key = i18n.ErrInternal
+		if status < http.StatusInternalServerError {
+			key = i18n.ErrBadRequest
+		}
+	}
+
+	res := &Response{Code: key, Message: i18n.T(lang, key)}
+	if err != nil && status < http.StatusInternalServerError {
+		res.Message = err.Error()
+	}
+	return res
+}
+
+// Send responds with status and err as a Response in lang
+func Send(w http.ResponseWriter, lang string, status int, err error) {
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("x-content-type-options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(ResponseFor(lang, status, err)); err != nil {
+		logrus.Errorf("could not write error response: %s", err)
+	}
+}
+
+// Status responds with status and its own message in lang
+func Status(w http.ResponseWriter, lang string, status int) {
+	Send(w, lang, status, nil)
+}
+
 type AuthError interface {
 	Error() string
 	Code() int
@@ -33,7 +90,15 @@ type InvalidCredentials struct {
 }
 
 func (err InvalidCredentials) Error() string {
-	return "Usuario o contraseña desconocidos"
+	return i18n.T(i18n.Default, i18n.InvalidCredentials)
+}
+
+func (err InvalidCredentials) Localize(lang string) string {
+	return i18n.T(lang, i18n.InvalidCredentials)
+}
+
+func (err InvalidCredentials) MessageKey() i18n.Key {
+	return i18n.InvalidCredentials
 }
 
 func (err InvalidCredentials) Log() {
@@ -44,6 +109,59 @@ func (err InvalidCredentials) Code() int {
 	return err.Status
 }
 
+type InvalidSecondFactor struct {
+	Reason string
+}
+
+func (err InvalidSecondFactor) Error() string {
+	return i18n.T(i18n.Default, i18n.InvalidSecondFactor)
+}
+
+func (err InvalidSecondFactor) Localize(lang string) string {
+	return i18n.T(lang, i18n.InvalidSecondFactor)
+}
+
+func (err InvalidSecondFactor) MessageKey() i18n.Key {
+	return i18n.InvalidSecondFactor
+}
+
+func (err InvalidSecondFactor) Log() {
+	logrus.Error(err.Reason)
+}
+
+func (err InvalidSecondFactor) Code() int {
+	return http.StatusForbidden
+}
+
+type TooManyAttempts struct {
+	Until time.Time
+}
+
+func (err TooManyAttempts) Error() string {
+	return i18n.T(i18n.Default, i18n.TooManyAttempts)
+}
+
+func (err TooManyAttempts) Localize(lang string) string {
+	return i18n.T(lang, i18n.TooManyAttempts)
+}
+
+func (err TooManyAttempts) MessageKey() i18n.Key {
+	return i18n.TooManyAttempts
+}
+
+func (err TooManyAttempts) Log() {
+	logrus.Errorf("refusing login attempt until %s", err.Until.Format(time.RFC3339))
+}
+
+func (err TooManyAttempts) Code() int {
+	return http.StatusTooManyRequests
+}
+
+// RetryAfter returns the value for a Retry-After header, in seconds
+func (err TooManyAttempts) RetryAfter() string {
+	return strconv.Itoa(int(time.Until(err.Until).Seconds()) + 1)
+}
+
 type WebAuthFlowChallenge struct {
 	Flow string
 	Data any
@@ -0,0 +1,31 @@
+package errors
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"git.rob.mx/nidito/puerta/internal/i18n"
+)
+
+func TestResponseFor(t *testing.T) {
+	for _, c := range []struct {
+		status   int
+		err      error
+		code     i18n.Key
+		message  string
+		language string
+	}{
+		{http.StatusForbidden, fmt.Errorf("denied: %w", i18n.Errorf(i18n.OutsideSchedule)), i18n.OutsideSchedule, "Access denied, try again some other time", i18n.English},
+		{http.StatusForbidden, &InvalidCredentials{Status: http.StatusForbidden, Reason: "secret"}, i18n.InvalidCredentials, "Usuario o contraseña desconocidos", i18n.Spanish},
+		{http.StatusNotFound, nil, i18n.ErrNotFound, "We could not find what you are looking for", i18n.English},
+		{http.StatusBadRequest, fmt.Errorf("count must be a number"), i18n.ErrBadRequest, "count must be a number", i18n.English},
+		{http.StatusUnprocessableEntity, nil, i18n.ErrBadRequest, "We could not understand what you sent", i18n.English},
+		{http.StatusInternalServerError, fmt.Errorf("database is locked"), i18n.ErrInternal, "Something went wrong, try again", i18n.English},
+	} {
+		res := ResponseFor(c.language, c.status, c.err)
+		if res.Code != c.code || res.Message != c.message {
+			t.Errorf("expected %d %v to be %s %q, got %s %q", c.status, c.err, c.code, c.message, res.Code, res.Message)
+		}
+	}
+}
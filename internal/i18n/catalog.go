@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package i18n
+
+const (
+	InvalidCredentials  Key = "auth.invalid-credentials"
+	InvalidSecondFactor Key = "auth.invalid-second-factor"
+	TooManyAttempts     Key = "auth.too-many-attempts"
+
+	UserExpired      Key = "rex.expired"
+	OutsideSchedule  Key = "rex.outside-schedule"
+	CalendarFailed   Key = "rex.calendar-failed"
+	HouseClosed      Key = "rex.house-closed"
+	HouseClosedUntil Key = "rex.house-closed-reason"
+	NoEntriesLeft    Key = "rex.no-entries-left"
+	NoEntriesToday   Key = "rex.no-entries-today"
+	NoEntriesWindow  Key = "rex.no-entries-window"
+	ApprovalPending  Key = "rex.approval-pending"
+
+	NotifyOpened        Key = "notify.opened"
+	NotifyOpenedFor     Key = "notify.opened-for"
+	NotifyRecovery      Key = "notify.recovery"
+	NotifyLoginFailures Key = "notify.login-failures"
+	NotifyApproval      Key = "notify.approval"
+	NotifyApprovalBody  Key = "notify.approval-body"
+	NotifyApprove       Key = "notify.approve"
+	NotifyDeny          Key = "notify.deny"
+	NotifyInvite        Key = "notify.invite"
+
+	GuestName     Key = "booking.name"
+	GuestGreeting Key = "booking.greeting"
+
+	ApprovalSettled Key = "approval.settled"
+
+	PasswordTooShort Key = "password.too-short"
+	PasswordIsHandle Key = "password.is-handle"
+	PasswordBreached Key = "password.breached"
+	LastPasskey      Key = "passkey.last"
+
+	ErrBadRequest      Key = "error.bad-request"
+	ErrUnauthorized    Key = "error.unauthorized"
+	ErrForbidden       Key = "error.forbidden"
+	ErrNotFound        Key = "error.not-found"
+	ErrConflict        Key = "error.conflict"
+	ErrTooManyRequests Key = "error.too-many-requests"
+	ErrInternal        Key = "error.internal"
+
+	DoorUnavailable Key = "door.communication-error"
+	DoorAlreadyOpen Key = "door.already-open"
+)
+
+var catalog = map[string]map[Key]string{
+	Spanish: {
+		InvalidCredentials:  "Usuario o contraseña desconocidos",
+		InvalidSecondFactor: "Código de verificación inválido",
+		TooManyAttempts:     "Demasiados intentos, intenta de nuevo más tarde",
+
+		UserExpired:      "Tu usuario expiró, avísale a quien te invitó",
+		OutsideSchedule:  "Acceso denegado, intenta nuevamente en otro momento",
+		CalendarFailed:   "No se pudo consultar el calendario de la casa, intenta nuevamente",
+		HouseClosed:      "La casa está cerrada hasta el %s",
+		HouseClosedUntil: "La casa está cerrada hasta el %s: %s",
+		NoEntriesLeft:    "Ya no te quedan entradas, avísale a quien te invitó",
+		NoEntriesToday:   "Ya no te quedan entradas por hoy, intenta mañana",
+		NoEntriesWindow:  "Ya no te quedan entradas en este horario, intenta en el siguiente",
+		ApprovalPending:  "Estás fuera de tu horario, le pedimos a alguien que te abra",
+
+		NotifyOpened:        "%s abrió la puerta",
+		NotifyOpenedFor:     "%s le abrió la puerta a %s",
+		NotifyRecovery:      "%s usó un código de recuperación",
+		NotifyLoginFailures: "%d intentos fallidos de iniciar sesión como %s desde %s",
+		NotifyApproval:      "%s quiere entrar",
+		NotifyApprovalBody:  "Fuera de su horario, la solicitud expira a las %s",
+		NotifyApprove:       "Abrir",
+		NotifyDeny:          "Rechazar",
+		NotifyInvite:        "Reserva de %s del %s al %s: usuario %s, contraseña %s",
+
+		GuestName:     "Huésped",
+		GuestGreeting: "¡Bienvenido!",
+
+		ApprovalSettled: "La solicitud ya no está pendiente: %s",
+
+		PasswordTooShort: "La contraseña debe tener al menos %d caracteres",
+		PasswordIsHandle: "La contraseña no puede ser tu usuario",
+		PasswordBreached: "Esa contraseña apareció en una filtración, elige otra",
+		LastPasskey:      "No puedes borrar tu única llave de acceso",
+
+		ErrBadRequest:      "No entendimos lo que enviaste",
+		ErrUnauthorized:    "Inicia sesión para continuar",
+		ErrForbidden:       "No tienes permiso para hacer eso",
+		ErrNotFound:        "No encontramos lo que buscas",
+		ErrConflict:        "Alguien más hizo un cambio, intenta nuevamente",
+		ErrTooManyRequests: "Demasiados intentos, intenta de nuevo más tarde",
+		ErrInternal:        "Algo salió mal, intenta nuevamente",
+
+		DoorUnavailable: "La puerta no responde, intenta nuevamente",
+		DoorAlreadyOpen: "La puerta ya está abierta",
+	},
+	English: {
+		InvalidCredentials:  "Unknown user or password",
+		InvalidSecondFactor: "Invalid verification code",
+		TooManyAttempts:     "Too many attempts, try again later",
+
+		UserExpired:      "Your user expired, let whoever invited you know",
+		OutsideSchedule:  "Access denied, try again some other time",
+		CalendarFailed:   "Could not check the house's calendar, try again",
+		HouseClosed:      "The house is closed until %s",
+		HouseClosedUntil: "The house is closed until %s: %s",
+		NoEntriesLeft:    "You have no entries left, let whoever invited you know",
+		NoEntriesToday:   "You have no entries left for today, try again tomorrow",
+		NoEntriesWindow:  "You have no entries left for this window, try again in the next one",
+		ApprovalPending:  "You are outside your schedule, we asked someone to let you in",
+
+		NotifyOpened:        "%s opened the door",
+		NotifyOpenedFor:     "%s let %s in",
+		NotifyRecovery:      "%s used a recovery code",
+		NotifyLoginFailures: "%d failed attempts to sign in as %s from %s",
+		NotifyApproval:      "%s wants to come in",
+		NotifyApprovalBody:  "Outside their schedule, the request expires at %s",
+		NotifyApprove:       "Open",
+		NotifyDeny:          "Deny",
+		NotifyInvite:        "Booking for %s from %s to %s: user %s, password %s",
+
+		GuestName:     "Guest",
+		GuestGreeting: "Welcome!",
+
+		ApprovalSettled: "The request is no longer pending: %s",
+
+		PasswordTooShort: "Passwords must be at least %d characters long",
+		PasswordIsHandle: "Your password cannot be your user name",
+		PasswordBreached: "That password showed up in a data breach, pick another one",
+		LastPasskey:      "You cannot delete your only passkey",
+
+		ErrBadRequest:      "We could not understand what you sent",
+		ErrUnauthorized:    "Sign in to continue",
+		ErrForbidden:       "You are not allowed to do that",
+		ErrNotFound:        "We could not find what you are looking for",
+		ErrConflict:        "Someone else made a change, try again",
+		ErrTooManyRequests: "Too many attempts, try again later",
+		ErrInternal:        "Something went wrong, try again",
+
+		DoorUnavailable: "The door is not responding, try again",
+		DoorAlreadyOpen: "The door is already open",
+	},
+}
@@ -0,0 +1,149 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package i18n
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	Spanish = "es"
+	English = "en"
+)
+
+// Languages lists every language in the catalog
+var Languages = []string{Spanish, English}
+
+// Default is the language used for users without a locale, and for logs
+var Default = Spanish
+
+// Key names a message in the catalog
+type Key string
+
+// Supported tells if the catalog has a language
+func Supported(lang string) bool {
+	_, ok := catalog[lang]
+	return ok
+}
+
+// Parse returns the language a locale such as es-MX belongs to, failing
+// for languages missing from the catalog
+func Parse(locale string) (string, error) {
+	lang, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(locale)), "-")
+	lang, _, _ = strings.Cut(lang, "_")
+	if !Supported(lang) {
+		return "", fmt.Errorf("unsupported locale %q, expected one of %v", locale, Languages)
+	}
+	return lang, nil
+}
+
+// Negotiate picks the first supported language out of a preferred locale and
+// an Accept-Language header, falling back to Default
+func Negotiate(preferred string, acceptLanguage string) string {
+	if lang, err := Parse(preferred); err == nil {
+		return lang
+	}
+
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if _, err := fmt.Sscanf(v, "%g", &q); err != nil {
+				continue
+			}
+		}
+
+		if lang, err := Parse(tag); err == nil && q > bestQ {
+			best, bestQ = lang, q
+		}
+	}
+
+	if best == "" {
+		return Default
+	}
+	return best
+}
+
+// T renders a message in lang, falling back to Default for missing translations
+func T(lang string, key Key, args ...any) string {
+	format, ok := catalog[lang][key]
+	if !ok {
+		if format, ok = catalog[Default][key]; !ok {
+			return string(key)
+		}
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// Message is an error with a message from the catalog, rendered in Default
+// unless localized
+type Message struct {
+	Key  Key
+	Args []any
+}
+
+// Errorf returns an error rendering key with args
+func Errorf(key Key, args ...any) error {
+	return &Message{Key: key, Args: args}
+}
+
+func (m *Message) Error() string {
+	return T(Default, m.Key, m.Args...)
+}
+
+func (m *Message) Localize(lang string) string {
+	return T(lang, m.Key, m.Args...)
+}
+
+func (m *Message) MessageKey() Key {
+	return m.Key
+}
+
+// Localizer is implemented by errors that can be shown in any language
+type Localizer interface {
+	Localize(lang string) string
+}
+
+// Keyed is implemented by errors shown with a message from the catalog, its
+// key doubles as a stable code for API clients
+type Keyed interface {
+	MessageKey() Key
+}
+
+// Localize renders err in lang when it knows how to, and as is otherwise
+func Localize(err error, lang string) string {
+	var l Localizer
+	if errors.As(err, &l) {
+		return l.Localize(lang)
+	}
+	return err.Error()
+}
+
+// KeyOf returns the key of the message err is shown with, if any
+func KeyOf(err error) (Key, bool) {
+	var k Keyed
+	if errors.As(err, &k) {
+		return k.MessageKey(), true
+	}
+	return "", false
+}
+
+// Strings returns the formats in lang whose keys start with prefix, for
+// scripts that render them on their own
+func Strings(lang string, prefix string) map[string]string {
+	messages := map[string]string{}
+	for key, format := range catalog[Default] {
+		if !strings.HasPrefix(string(key), prefix) {
+			continue
+		}
+
+		if translated, ok := catalog[lang][key]; ok {
+			format = translated
+		}
+		messages[string(key)] = format
+	}
+	return messages
+}
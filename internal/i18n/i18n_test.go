@@ -0,0 +1,79 @@
+package i18n
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for locale, expected := range map[string]string{
+		"es":    Spanish,
+		"es-MX": Spanish,
+		"EN_us": English,
+		" en ":  English,
+	} {
+		got, err := Parse(locale)
+		if err != nil {
+			t.Fatalf("could not parse %q: %s", locale, err)
+		}
+		if got != expected {
+			t.Errorf("expected %q to be %s, got %s", locale, expected, got)
+		}
+	}
+
+	for _, locale := range []string{"", "fr", "pt-BR"} {
+		if _, err := Parse(locale); err == nil {
+			t.Errorf("expected %q to be unsupported", locale)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, c := range []struct {
+		preferred string
+		header    string
+		expected  string
+	}{
+		{"", "", Default},
+		{"", "en-US,en;q=0.9", English},
+		{"es", "en-US,en;q=0.9", Spanish},
+		{"fr", "en", English},
+		{"", "fr-FR,fr;q=0.9,en;q=0.5,es;q=0.8", Spanish},
+		{"", "de, pt", Default},
+		{"", "en;q=nope", Default},
+	} {
+		if got := Negotiate(c.preferred, c.header); got != c.expected {
+			t.Errorf("expected %q and %q to negotiate %s, got %s", c.preferred, c.header, c.expected, got)
+		}
+	}
+}
+
+func TestCatalogIsComplete(t *testing.T) {
+	for key := range catalog[Default] {
+		for _, lang := range Languages {
+			if _, ok := catalog[lang][key]; !ok {
+				t.Errorf("%s is missing a %s translation", key, lang)
+			}
+		}
+	}
+}
+
+func TestLocalize(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", Errorf(HouseClosed, "2026-10-20 08:00"))
+
+	if got := Localize(err, English); got != "The house is closed until 2026-10-20 08:00" {
+		t.Errorf("unexpected english message: %s", got)
+	}
+
+	if got := err.Error(); got != "wrapped: La casa está cerrada hasta el 2026-10-20 08:00" {
+		t.Errorf("expected errors to render in the default language, got %s", got)
+	}
+
+	if got := Localize(fmt.Errorf("plain"), English); got != "plain" {
+		t.Errorf("expected other errors as is, got %s", got)
+	}
+
+	if got := T(English, Key("missing")); got != "missing" {
+		t.Errorf("expected missing keys to render as themselves, got %s", got)
+	}
+}
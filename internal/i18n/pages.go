@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package i18n
+
+// pages holds the text of server rendered pages, keys starting with js. are
+// handed to their scripts
+var pages = map[string]map[Key]string{
+	Spanish: {
+		"page.tagline": "Ábrete sésamo",
+
+		"login.user":     "Usuario",
+		"login.password": "Contraseña",
+		"login.submit":   "Iniciar sesión",
+		"login.oidc":     "Entrar con %s",
+
+		"index.open":        "Abrir",
+		"index.lost-device": "Perdí mi dispositivo",
+
+		"admin.guests":             "Invitades",
+		"admin.create":             "Crear invitade",
+		"admin.log":                "Registro",
+		"admin.recent-entries":     "Entradas recientes",
+		"admin.handle":             "Handle",
+		"admin.name":               "Nombre",
+		"admin.greeting":           "Saludo",
+		"admin.password":           "Contraseña",
+		"admin.schedule":           "Horarios",
+		"admin.expires":            "Expira",
+		"admin.ttl":                "Duración de la sesión",
+		"admin.max-sessions":       "Dispositivos",
+		"admin.max-entries":        "Entradas en total",
+		"admin.max-daily-entries":  "Entradas por día",
+		"admin.max-window-entries": "Entradas por horario",
+		"admin.no-limit":           "(0 para no limitar)",
+		"admin.timezone":           "Zona horaria",
+		"admin.timezone-hint":      "(vacía para usar la de la casa)",
+		"admin.locale":             "Idioma",
+		"admin.locale-browser":     "El de su navegador",
+		"admin.role":               "Rol",
+		"admin.second-factor":      "¿Requiere 2FA?",
+		"admin.allow-totp":         "¿Permite TOTP?",
+		"admin.notifications":      "¿Recibe notificaciones?",
+		"admin.single-use":         "¿Pase de una sola entrada?",
+		"admin.ask-approval":       "¿Puede pedir permiso fuera de horario?",
+		"admin.delete":             "Eliminar",
+		"admin.save":               "Guardar cambios",
+		"admin.submit":             "Crear",
+		"admin.log-timestamp":      "fecha",
+		"admin.log-user":           "nombre",
+		"admin.log-status":         "estado",
+		"admin.push-notifications": "Notificaciones",
+
+		"js.approval-failed":         "No pudimos consultar tu solicitud",
+		"js.approval-approved":       "¡Te abrieron!",
+		"js.approval-denied":         "Rechazaron tu solicitud",
+		"js.approval-expired":        "Nadie respondió a tiempo, intenta nuevamente",
+		"js.recovery-prompt":         "Ingresa uno de tus códigos de recuperación",
+		"js.recovery-done":           "Listo, la próxima vez que abras la puerta podrás registrar un nuevo dispositivo",
+		"js.recovery-codes":          "Guarda estos códigos de recuperación, sirven una sola vez si pierdes tu dispositivo:",
+		"js.totp-enroll":             "Escanea el código con tu app de autenticación e ingresa el código que muestra",
+		"js.totp-code":               "Ingresa el código de tu app de autenticación",
+		"js.delete-user":             "¿Seguro que borramos a %s?",
+		"js.load-failed":             "No pudimos cargar la página, intenta nuevamente",
+		"js.approval-not-found":      "No encontramos esa solicitud",
+		"js.approval-settled":        "La solicitud de %s ya no está pendiente: %s",
+		"js.approval-confirm":        "¿Le abrimos a %s?",
+		"js.approval-done-approve":   "Le abrimos a %s",
+		"js.approval-done-deny":      "Rechazamos la solicitud de %s",
+		"js.approval-decision-error": "No pudimos responder a la solicitud: %s",
+	},
+	English: {
+		"page.tagline": "Open sesame",
+
+		"login.user":     "User",
+		"login.password": "Password",
+		"login.submit":   "Sign in",
+		"login.oidc":     "Sign in with %s",
+
+		"index.open":        "Open",
+		"index.lost-device": "I lost my device",
+
+		"admin.guests":             "Guests",
+		"admin.create":             "New guest",
+		"admin.log":                "Log",
+		"admin.recent-entries":     "Recent entries",
+		"admin.handle":             "Handle",
+		"admin.name":               "Name",
+		"admin.greeting":           "Greeting",
+		"admin.password":           "Password",
+		"admin.schedule":           "Schedule",
+		"admin.expires":            "Expires",
+		"admin.ttl":                "Session length",
+		"admin.max-sessions":       "Devices",
+		"admin.max-entries":        "Total entries",
+		"admin.max-daily-entries":  "Entries per day",
+		"admin.max-window-entries": "Entries per window",
+		"admin.no-limit":           "(0 for no limit)",
+		"admin.timezone":           "Timezone",
+		"admin.timezone-hint":      "(leave empty for the house's)",
+		"admin.locale":             "Language",
+		"admin.locale-browser":     "Their browser's",
+		"admin.role":               "Role",
+		"admin.second-factor":      "Requires 2FA?",
+		"admin.allow-totp":         "Allows TOTP?",
+		"admin.notifications":      "Receives notifications?",
+		"admin.single-use":         "Single use pass?",
+		"admin.ask-approval":       "Can ask to come in outside their schedule?",
+		"admin.delete":             "Delete",
+		"admin.save":               "Save changes",
+		"admin.submit":             "Create",
+		"admin.log-timestamp":      "date",
+		"admin.log-user":           "name",
+		"admin.log-status":         "status",
+		"admin.push-notifications": "Notifications",
+
+		"js.approval-failed":         "We could not check on your request",
+		"js.approval-approved":       "You're in!",
+		"js.approval-denied":         "Your request was denied",
+		"js.approval-expired":        "Nobody answered in time, try again",
+		"js.recovery-prompt":         "Enter one of your recovery codes",
+		"js.recovery-done":           "Done, you'll be able to register a new device the next time you open the door",
+		"js.recovery-codes":          "Keep these recovery codes, each works once if you lose your device:",
+		"js.totp-enroll":             "Scan the code with your authenticator app and enter the code it shows",
+		"js.totp-code":               "Enter the code from your authenticator app",
+		"js.delete-user":             "Are you sure you want to delete %s?",
+		"js.load-failed":             "We could not load the page, try again",
+		"js.approval-not-found":      "We could not find that request",
+		"js.approval-settled":        "%s's request is no longer pending: %s",
+		"js.approval-confirm":        "Let %s in?",
+		"js.approval-done-approve":   "We let %s in",
+		"js.approval-done-deny":      "We denied %s's request",
+		"js.approval-decision-error": "We could not answer the request: %s",
+	},
+}
+
+func init() {
+	for lang, messages := range pages {
+		for key, message := range messages {
+			catalog[lang][key] = message
+		}
+	}
+}
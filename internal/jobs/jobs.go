@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package jobs
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
+)
+
+// Func does the work for a job, returning a short summary of what it did
+type Func func(sess db.Session) (string, error)
+
+// Status describes a job and the outcome of its last run
+type Status struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Interval    time.Duration `json:"interval"`
+	Running     bool          `json:"running"`
+	Runs        int           `json:"runs"`
+	LastRun     *time.Time    `json:"last_run,omitempty"`
+	Duration    time.Duration `json:"duration"`
+	Result      string        `json:"result,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+type job struct {
+	// running is held while the job runs
+	running sync.Mutex
+	mu      sync.Mutex
+	run     Func
+	status  Status
+}
+
+// Scheduler runs jobs in the background at a fixed interval
+type Scheduler struct {
+	sess db.Session
+	jobs map[string]*job
+	stop chan struct{}
+}
+
+func New(sess db.Session) *Scheduler {
+	return &Scheduler{
+		sess: sess,
+		jobs: map[string]*job{},
+	}
+}
+
+// Register adds a job to run every interval, and never in the background if interval is 0 or less
+func (s *Scheduler) Register(name, description string, interval time.Duration, run Func) {
+	s.jobs[name] = &job{
+		run: run,
+		status: Status{
+			Name:        name,
+			Description: description,
+			Interval:    interval,
+		},
+	}
+}
+
+// Names returns the registered job names, sorted
+func (s *Scheduler) Names() []string {
+	names := make([]string, 0, len(s.jobs))
+	for name := range s.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Start runs every job once, then at its interval until Stop is called
+func (s *Scheduler) Start() {
+	s.stop = make(chan struct{})
+	for _, name := range s.Names() {
+		j := s.jobs[name]
+		if j.status.Interval <= 0 {
+			continue
+		}
+
+		go func(name string, j *job) {
+			ticker := time.NewTicker(j.status.Interval)
+			defer ticker.Stop()
+			for {
+				if _, err := s.Run(name); err != nil {
+					logrus.Errorf("job %s failed: %s", name, err)
+				}
+
+				select {
+				case <-ticker.C:
+				case <-s.stop:
+					return
+				}
+			}
+		}(name, j)
+	}
+	logrus.Infof("started %d background jobs", len(s.jobs))
+}
+
+func (s *Scheduler) Stop() {
+	if s.stop != nil {
+		close(s.stop)
+	}
+}
+
+// Run executes a job right away, and fails if it is already running
+func (s *Scheduler) Run(name string) (Status, error) {
+	j, exists := s.jobs[name]
+	if !exists {
+		return Status{}, fmt.Errorf("unknown job %s, not one of %v", name, s.Names())
+	}
+
+	if !j.running.TryLock() {
+		return j.snapshot(), fmt.Errorf("job %s is already running", name)
+	}
+	defer j.running.Unlock()
+
+	j.setStatus(func(st *Status) { st.Running = true })
+	start := time.Now()
+	result, err := j.run(s.sess)
+
+	j.setStatus(func(st *Status) {
+		st.Running = false
+		st.Runs++
+		st.LastRun = &start
+		st.Duration = time.Since(start)
+		st.Result = result
+		st.Error = ""
+		if err != nil {
+			st.Error = err.Error()
+		}
+	})
+
+	if err == nil {
+		logrus.Infof("job %s: %s", name, result)
+	}
+	return j.snapshot(), err
+}
+
+// Status returns the state of every job, sorted by name
+func (s *Scheduler) Status() []Status {
+	res := []Status{}
+	for _, name := range s.Names() {
+		res = append(res, s.jobs[name].snapshot())
+	}
+	return res
+}
+
+func (j *job) setStatus(update func(*Status)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	update(&j.status)
+}
+
+func (j *job) snapshot() Status {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
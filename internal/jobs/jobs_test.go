@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package jobs
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/upper/db/v4"
+)
+
+func TestRegister(t *testing.T) {
+	s := New(nil)
+	s.Register("b", "second", time.Hour, func(db.Session) (string, error) { return "", nil })
+	s.Register("a", "first", 0, func(db.Session) (string, error) { return "", nil })
+
+	if names := s.Names(); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Fatalf("unexpected names %v", names)
+	}
+
+	status := s.Status()
+	if len(status) != 2 {
+		t.Fatalf("expected 2 statuses, got %d", len(status))
+	}
+
+	if status[0].Name != "a" || status[0].Description != "first" || status[0].Interval != 0 {
+		t.Fatalf("unexpected status for a: %+v", status[0])
+	}
+
+	if status[1].Name != "b" || status[1].Interval != time.Hour || status[1].Runs != 0 || status[1].LastRun != nil {
+		t.Fatalf("unexpected status for b: %+v", status[1])
+	}
+}
+
+func TestRun(t *testing.T) {
+	s := New(nil)
+	fail := false
+	s.Register("job", "", 0, func(db.Session) (string, error) {
+		if fail {
+			return "", fmt.Errorf("broken")
+		}
+		return "did things", nil
+	})
+
+	status, err := s.Run("job")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if status.Runs != 1 || status.Result != "did things" || status.Error != "" || status.LastRun == nil || status.Running {
+		t.Fatalf("unexpected status after run: %+v", status)
+	}
+
+	fail = true
+	status, err = s.Run("job")
+	if err == nil {
+		t.Fatal("expected the job's error")
+	}
+
+	if status.Runs != 2 || status.Error != "broken" {
+		t.Fatalf("unexpected status after failure: %+v", status)
+	}
+
+	if got := s.Status()[0]; got.Runs != 2 || got.Error != "broken" {
+		t.Fatalf("Status does not reflect the last run: %+v", got)
+	}
+
+	if _, err := s.Run("missing"); err == nil {
+		t.Fatal("expected an error running an unknown job")
+	}
+}
+
+func TestRunAlreadyRunning(t *testing.T) {
+	s := New(nil)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s.Register("slow", "", 0, func(db.Session) (string, error) {
+		close(started)
+		<-release
+		return "done", nil
+	})
+
+	done := make(chan error)
+	go func() {
+		_, err := s.Run("slow")
+		done <- err
+	}()
+	<-started
+
+	if status := s.Status()[0]; !status.Running {
+		t.Fatalf("expected job to be running: %+v", status)
+	}
+
+	if _, err := s.Run("slow"); err == nil {
+		t.Fatal("expected an error running a job twice at once")
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if status := s.Status()[0]; status.Running || status.Runs != 1 {
+		t.Fatalf("unexpected status after run: %+v", status)
+	}
+}
+
+func TestStart(t *testing.T) {
+	s := New(nil)
+	var scheduled, disabled, negative atomic.Int32
+	s.Register("scheduled", "", 10*time.Millisecond, func(db.Session) (string, error) {
+		scheduled.Add(1)
+		return "", nil
+	})
+	s.Register("disabled", "", 0, func(db.Session) (string, error) {
+		disabled.Add(1)
+		return "", nil
+	})
+	s.Register("negative", "", -time.Second, func(db.Session) (string, error) {
+		negative.Add(1)
+		return "", nil
+	})
+
+	s.Start()
+	deadline := time.Now().Add(time.Second)
+	for scheduled.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.Stop()
+
+	if scheduled.Load() < 2 {
+		t.Fatalf("expected scheduled job to run at least twice, ran %d times", scheduled.Load())
+	}
+
+	if disabled.Load() != 0 || negative.Load() != 0 {
+		t.Fatalf("jobs without a positive interval ran in the background: %d, %d", disabled.Load(), negative.Load())
+	}
+}
@@ -1,8 +1,13 @@
 package push
 
 import (
+	"encoding/json"
+
+	"git.rob.mx/nidito/puerta/internal/i18n"
 	"git.rob.mx/nidito/puerta/internal/user"
 	webpush "github.com/SherClockHolmes/webpush-go"
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
 )
 
 type VAPIDKey struct {
@@ -20,8 +25,27 @@ type Notifier struct {
 
 var self *Notifier
 
+// Action is a button shown along a notification
+type Action struct {
+	Action string `json:"action"`
+	Title  string `json:"title"`
+}
+
+// Notification is shown by admin-serviceworker.js, along with its actions
+type Notification struct {
+	Title   string            `json:"title"`
+	Body    string            `json:"body,omitempty"`
+	Tag     string            `json:"tag,omitempty"`
+	Actions []Action          `json:"actions,omitempty"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
 func Notify(message string, subscriber *user.Subscription) error {
-	resp, err := webpush.SendNotification([]byte(message), subscriber.AsWebPush(), &webpush.Options{
+	return send([]byte(message), subscriber)
+}
+
+func send(payload []byte, subscriber *user.Subscription) error {
+	resp, err := webpush.SendNotification(payload, subscriber.AsWebPush(), &webpush.Options{
 		Subscriber:      subscriber.ID(),
 		VAPIDPublicKey:  self.cfg.Key.Public,
 		VAPIDPrivateKey: self.cfg.Key.Private,
@@ -35,6 +59,112 @@ func Notify(message string, subscriber *user.Subscription) error {
 	return nil
 }
 
+// NotifyAdmins sends a message from the catalog to every subscription of users
+// that receive notifications and are allowed to view the log, in their language
+func NotifyAdmins(sess db.Session, key i18n.Key, args ...any) {
+	notify(sess, user.PermissionViewLog, func(lang string) ([]byte, error) {
+		return []byte(i18n.T(lang, key, args...)), nil
+	})
+}
+
+// NotifyAdminsWith sends a message that renders itself in every language to the
+// same subscriptions as NotifyAdmins
+func NotifyAdminsWith(sess db.Session, message i18n.Localizer) {
+	NotifyPermittedWith(sess, user.PermissionViewLog, message)
+}
+
+// NotifyPermittedWith sends a message that renders itself in every language to
+// the subscriptions of users that receive notifications and have permission
+func NotifyPermittedWith(sess db.Session, permission user.Permission, message i18n.Localizer) {
+	notify(sess, permission, func(lang string) ([]byte, error) {
+		return []byte(message.Localize(lang)), nil
+	})
+}
+
+// NotifyAdminsOf sends a notification with actions to the same subscriptions
+// as NotifyAdmins, built for each of their languages
+func NotifyAdminsOf(sess db.Session, build func(lang string) *Notification) {
+	notify(sess, user.PermissionViewLog, func(lang string) ([]byte, error) {
+		return json.Marshal(build(lang))
+	})
+}
+
+// adminSubscription carries the language of the subscription's user
+type adminSubscription struct {
+	user.Subscription `db:",inline"`
+	Locale            string `db:"-"`
+}
+
+// subscribers returns the subscriptions of users that receive notifications and
+// have permission, either on their own or through their groups
+func subscribers(sess db.Session, permission user.Permission) ([]*adminSubscription, error) {
+	subs := []*adminSubscription{}
+	err := sess.Collection("subscription").Find().All(&subs)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := map[int]*user.User{}
+	res := []*adminSubscription{}
+	for _, sub := range subs {
+		u, seen := allowed[sub.UserID]
+		if !seen {
+			u = &user.User{}
+			if err := sess.Get(u, db.Cond{"id": sub.UserID}); err != nil {
+				logrus.Errorf("could not find user for subscription %s: %s", sub.ID(), err)
+				allowed[sub.UserID] = nil
+				continue
+			}
+
+			if u, err = u.Effective(sess); err != nil {
+				return nil, err
+			}
+
+			permitted, err := u.Can(sess, permission)
+			if err != nil {
+				return nil, err
+			}
+
+			if !u.IsNotified || !permitted {
+				u = nil
+			}
+			allowed[sub.UserID] = u
+		}
+
+		if u != nil {
+			sub.Locale = u.Locale
+			res = append(res, sub)
+		}
+	}
+	return res, nil
+}
+
+func notify(sess db.Session, permission user.Permission, render func(lang string) ([]byte, error)) {
+	subs, err := subscribers(sess, permission)
+	if err != nil {
+		logrus.Errorf("could not fetch subscriptions: %s", err)
+	}
+
+	logrus.Infof("notifying %v admins", len(subs))
+
+	payloads := map[string][]byte{}
+	for _, sub := range subs {
+		lang := i18n.Negotiate(sub.Locale, "")
+		payload, rendered := payloads[lang]
+		if !rendered {
+			if payload, err = render(lang); err != nil {
+				logrus.Errorf("could not render notification: %s", err)
+				return
+			}
+			payloads[lang] = payload
+		}
+
+		if err := send(payload, &sub.Subscription); err != nil {
+			logrus.Errorf("could not push notification to subscription %s: %s", sub.ID(), err)
+		}
+	}
+}
+
 func Initialize(cfg *Config) {
 	self = &Notifier{cfg}
 }
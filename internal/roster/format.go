@@ -0,0 +1,121 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package roster
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Format is how records are written
+type Format string
+
+const (
+	FormatYAML Format = "yaml"
+	FormatJSON Format = "json"
+	FormatCSV  Format = "csv"
+)
+
+// ContentType is the mime type of a format
+var ContentType = map[Format]string{
+	FormatYAML: "application/yaml",
+	FormatJSON: "application/json",
+	FormatCSV:  "text/csv",
+}
+
+// ParseFormat returns the named format
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(strings.ToLower(name)); f {
+	case FormatYAML, FormatJSON, FormatCSV:
+		return f, nil
+	case "yml":
+		return FormatYAML, nil
+	}
+	return "", fmt.Errorf("unknown format %q, use one of yaml, json or csv", name)
+}
+
+// FormatOf returns the format of a file, by its extension
+func FormatOf(path string) (Format, error) {
+	return ParseFormat(strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// Encode writes records to w
+func Encode(w io.Writer, format Format, records []*Record) error {
+	switch format {
+	case FormatYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(records); err != nil {
+			return err
+		}
+		return enc.Close()
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	case FormatCSV:
+		enc := csv.NewWriter(w)
+		if err := enc.Write(Columns()); err != nil {
+			return err
+		}
+		for _, r := range records {
+			if err := enc.Write(r.Values()); err != nil {
+				return err
+			}
+		}
+		enc.Flush()
+		return enc.Error()
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// Decode reads records from r. CSV files need a header row naming their
+// columns, which may come in any order
+func Decode(r io.Reader, format Format) ([]*Record, error) {
+	records := []*Record{}
+	switch format {
+	case FormatYAML:
+		if err := yaml.NewDecoder(r).Decode(&records); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("could not decode yaml: %w", err)
+		}
+	case FormatJSON:
+		if err := json.NewDecoder(r).Decode(&records); err != nil {
+			return nil, fmt.Errorf("could not decode json: %w", err)
+		}
+	case FormatCSV:
+		rows, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("could not decode csv: %w", err)
+		}
+
+		if len(rows) == 0 {
+			return records, nil
+		}
+
+		header := rows[0]
+		for i, row := range rows[1:] {
+			record := &Record{}
+			for col, value := range row {
+				if err := record.Set(strings.TrimSpace(header[col]), value); err != nil {
+					return nil, fmt.Errorf("row %d: %w", i+2, err)
+				}
+			}
+			records = append(records, record)
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	for i, record := range records {
+		if record == nil {
+			return nil, fmt.Errorf("record %d is empty", i+1)
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,511 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+
+// Package roster moves users in and out of puerta in bulk, i.e. to migrate
+// between instances or to keep them in a spreadsheet
+package roster
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/upper/db/v4"
+)
+
+// Record is a user as exported and imported, with every field written as text
+// so spreadsheets can hold them. Schedule, TTL and expiry are validated by the
+// same parsers the api uses
+type Record struct {
+	Handle           string   `json:"handle" yaml:"handle"`
+	Name             string   `json:"name" yaml:"name"`
+	Greeting         string   `json:"greeting" yaml:"greeting"`
+	Role             string   `json:"role" yaml:"role"`
+	Schedule         string   `json:"schedule" yaml:"schedule"`
+	TTL              string   `json:"max_ttl" yaml:"max_ttl"`
+	Expires          string   `json:"expires" yaml:"expires"`
+	Timezone         string   `json:"timezone" yaml:"timezone"`
+	Locale           string   `json:"locale" yaml:"locale"`
+	SecondFactor     bool     `json:"second_factor" yaml:"second_factor"`
+	AllowTOTP        bool     `json:"allow_totp" yaml:"allow_totp"`
+	IsNotified       bool     `json:"receives_notifications" yaml:"receives_notifications"`
+	SingleUse        bool     `json:"single_use" yaml:"single_use"`
+	AskApproval      bool     `json:"ask_approval" yaml:"ask_approval"`
+	MaxSessions      int      `json:"max_sessions" yaml:"max_sessions"`
+	MaxEntries       int      `json:"max_entries" yaml:"max_entries"`
+	MaxDailyEntries  int      `json:"max_daily_entries" yaml:"max_daily_entries"`
+	MaxWindowEntries int      `json:"max_window_entries" yaml:"max_window_entries"`
+	Groups           []string `json:"groups" yaml:"groups"`
+	// Password is only read, to set a new password for the user
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+	// PasswordHash is only exported on request, and imported as is
+	PasswordHash string `json:"password_hash,omitempty" yaml:"password_hash,omitempty"`
+}
+
+// secret columns never show up in diffs
+var secret = map[string]bool{"password": true, "password_hash": true}
+
+// FromUser describes a user and the groups they belong to
+func FromUser(u *user.User, groups []string) *Record {
+	r := &Record{
+		Handle:           u.Handle,
+		Name:             u.Name,
+		Greeting:         u.Greeting,
+		Role:             u.Role,
+		Timezone:         u.Timezone,
+		Locale:           u.Locale,
+		SecondFactor:     u.Require2FA,
+		AllowTOTP:        u.AllowTOTP,
+		IsNotified:       u.IsNotified,
+		SingleUse:        u.SingleUse,
+		AskApproval:      u.AskApproval,
+		MaxSessions:      u.MaxSessions,
+		MaxEntries:       u.MaxEntries,
+		MaxDailyEntries:  u.MaxDailyEntries,
+		MaxWindowEntries: u.MaxWindowEntries,
+		Groups:           append([]string{}, groups...),
+	}
+	sort.Strings(r.Groups)
+
+	if u.Schedule != nil {
+		r.Schedule = u.Schedule.String()
+	}
+
+	if u.TTL != nil {
+		ttl, _ := u.TTL.MarshalJSON()
+		r.TTL, _ = strconv.Unquote(string(ttl))
+	}
+
+	if u.Expires != nil && !u.Expires.Time().IsZero() {
+		r.Expires = u.Expires.Time().UTC().Format(time.RFC3339)
+	}
+
+	return r
+}
+
+// Apply validates the record and sets its fields on u
+func (r *Record) Apply(u *user.User) error {
+	if strings.TrimSpace(r.Handle) == "" {
+		return fmt.Errorf("handle is required")
+	}
+
+	if strings.TrimSpace(r.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	u.Handle = r.Handle
+	u.Name = r.Name
+	u.Greeting = r.Greeting
+	u.Role = r.Role
+	if u.Role == "" {
+		u.Role = user.RoleGuest
+	}
+	u.Timezone = r.Timezone
+	u.Locale = r.Locale
+	u.Require2FA = r.SecondFactor
+	u.AllowTOTP = r.AllowTOTP
+	u.IsNotified = r.IsNotified
+	u.SingleUse = r.SingleUse
+	u.AskApproval = r.AskApproval
+	u.MaxSessions = r.MaxSessions
+	u.MaxEntries = r.MaxEntries
+	u.MaxDailyEntries = r.MaxDailyEntries
+	u.MaxWindowEntries = r.MaxWindowEntries
+
+	if err := u.ValidateLocale(); err != nil {
+		return err
+	}
+
+	u.Schedule = nil
+	if strings.TrimSpace(r.Schedule) != "" {
+		schedule, err := user.ParseSchedule(r.Schedule)
+		if err != nil {
+			return err
+		}
+		u.Schedule = schedule
+	}
+
+	u.TTL = &user.DefaultTTL
+	if r.TTL != "" {
+		u.TTL = &user.TTL{}
+		if err := u.TTL.Scan(r.TTL); err != nil {
+			return fmt.Errorf("invalid max_ttl %q: %s", r.TTL, err)
+		}
+	}
+
+	u.Expires = nil
+	if r.Expires != "" {
+		u.Expires = &user.UTCTime{}
+		if err := u.Expires.Scan(r.Expires); err != nil {
+			return fmt.Errorf("invalid expires %q: %s", r.Expires, err)
+		}
+	}
+
+	switch {
+	case r.Password != "":
+		// hashing again would change the user on every import
+		if u.MatchesPassword(r.Password) {
+			break
+		}
+		if err := u.SetPassword(r.Password); err != nil {
+			return err
+		}
+	case r.PasswordHash != "":
+		u.Password = r.PasswordHash
+	}
+
+	return nil
+}
+
+// Columns lists the fields of a record as named in every format
+func Columns() []string {
+	t := reflect.TypeOf(Record{})
+	columns := make([]string, t.NumField())
+	for i := range columns {
+		columns[i], _, _ = strings.Cut(t.Field(i).Tag.Get("json"), ",")
+	}
+	return columns
+}
+
+// Values returns the record's fields as text, in the order of Columns
+func (r *Record) Values() []string {
+	v := reflect.ValueOf(r).Elem()
+	values := make([]string, v.NumField())
+	for i := range values {
+		switch field := v.Field(i).Interface().(type) {
+		case string:
+			values[i] = field
+		case bool:
+			values[i] = strconv.FormatBool(field)
+		case int:
+			values[i] = strconv.Itoa(field)
+		case []string:
+			values[i] = strings.Join(field, ",")
+		}
+	}
+	return values
+}
+
+// Set parses value into the field named column
+func (r *Record) Set(column, value string) error {
+	v := reflect.ValueOf(r).Elem()
+	for i, name := range Columns() {
+		if name != column {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			b := false
+			if value != "" {
+				var err error
+				if b, err = strconv.ParseBool(value); err != nil {
+					return fmt.Errorf("%s must be true or false, got %q", column, value)
+				}
+			}
+			field.SetBool(b)
+		case reflect.Int:
+			n := 0
+			if value != "" {
+				var err error
+				if n, err = strconv.Atoi(value); err != nil {
+					return fmt.Errorf("%s must be a number, got %q", column, value)
+				}
+			}
+			field.SetInt(int64(n))
+		case reflect.Slice:
+			list := []string{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown column %s", column)
+}
+
+// Change is a field that an import sets to a different value, recorded as is
+// in the admin log
+type Change = audit.Change
+
+// Diff lists what an import changes for a user
+type Diff struct {
+	Handle  string   `json:"handle"`
+	Changes []Change `json:"changes,omitempty"`
+	// Roles has the user's role before and after the import
+	Roles []string `json:"-"`
+	// Groups the user joins or leaves
+	Groups []string `json:"-"`
+}
+
+// diff compares records field by field, leaving secrets out
+func diff(from, to *Record) []Change {
+	changes := []Change{}
+	before := from.Values()
+	after := to.Values()
+	for i, column := range Columns() {
+		if secret[column] || before[i] == after[i] {
+			continue
+		}
+		changes = append(changes, Change{Field: column, From: before[i], To: after[i]})
+	}
+	return changes
+}
+
+// Result tells what an import did, or would do during a dry run
+type Result struct {
+	DryRun    bool     `json:"dry_run"`
+	Created   []*Diff  `json:"created"`
+	Updated   []*Diff  `json:"updated"`
+	Unchanged []string `json:"unchanged"`
+}
+
+// Record stores an admin log entry, made by newEntry, for every user an
+// import created or updated
+func (res *Result) Record(sess db.Session, newEntry func(action audit.Action, target string, before, after any) *audit.AdminEntry) {
+	for _, d := range res.Created {
+		entry := newEntry(audit.ActionUserCreate, d.Handle, nil, nil)
+		entry.Changes = d.Changes
+		audit.RecordAdmin(sess, entry)
+	}
+
+	for _, d := range res.Updated {
+		entry := newEntry(audit.ActionUserUpdate, d.Handle, nil, nil)
+		entry.Changes = d.Changes
+		audit.RecordAdmin(sess, entry)
+	}
+}
+
+// InvalidError lists every problem found with the records of an import
+type InvalidError struct {
+	Problems []string
+}
+
+func (e *InvalidError) Error() string {
+	return "invalid records: " + strings.Join(e.Problems, "; ")
+}
+
+// Export describes every user, sorted by handle. Password hashes are only
+// included when asked for
+func Export(sess db.Session, passwords bool) ([]*Record, error) {
+	users := []*user.User{}
+	if err := sess.Collection("user").Find().OrderBy("handle").All(&users); err != nil {
+		return nil, err
+	}
+
+	memberships, err := user.Memberships(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*Record, len(users))
+	for i, u := range users {
+		records[i] = FromUser(u, memberships[u.ID])
+		if passwords {
+			records[i].PasswordHash = u.Password
+		}
+	}
+	return records, nil
+}
+
+// planned is a user an import creates or updates
+type planned struct {
+	user   *user.User
+	groups []string
+	isNew  bool
+}
+
+// Import creates users whose handle is unknown and updates the rest with
+// every field in their record, including their groups. Nothing is written
+// during a dry run, or when any record is invalid
+func Import(sess db.Session, records []*Record, dryRun bool) (*Result, error) {
+	res := &Result{DryRun: dryRun, Created: []*Diff{}, Updated: []*Diff{}, Unchanged: []string{}}
+
+	handles := []string{}
+	for _, r := range records {
+		handles = append(handles, r.Handle)
+	}
+
+	existing := []*user.User{}
+	if len(handles) > 0 {
+		if err := sess.Collection("user").Find(db.Cond{"handle IN": handles}).All(&existing); err != nil {
+			return nil, err
+		}
+	}
+
+	byHandle := map[string]*user.User{}
+	for _, u := range existing {
+		byHandle[u.Handle] = u
+	}
+
+	memberships, err := user.Memberships(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	roles, err := user.ListRoles(sess)
+	if err != nil {
+		return nil, err
+	}
+	knownRoles := map[string]bool{}
+	for _, r := range roles {
+		knownRoles[r.Name] = true
+	}
+
+	groups, err := user.ListGroups(sess)
+	if err != nil {
+		return nil, err
+	}
+	knownGroups := map[string]bool{}
+	for _, g := range groups {
+		knownGroups[g.Name] = true
+	}
+
+	problems := []string{}
+	seen := map[string]bool{}
+	plan := []*planned{}
+	for i, r := range records {
+		invalid := func(format string, args ...any) {
+			problems = append(problems, fmt.Sprintf("record %d (%s): %s", i+1, r.Handle, fmt.Sprintf(format, args...)))
+		}
+
+		if seen[r.Handle] {
+			invalid("handle appears more than once")
+			continue
+		}
+		seen[r.Handle] = true
+
+		before := &user.User{}
+		previous := &Record{}
+		current, isNew := byHandle[r.Handle], true
+		if current != nil {
+			isNew = false
+			*before = *current
+			previous = FromUser(current, memberships[current.ID])
+		}
+
+		u := &user.User{MaxSessions: 1}
+		if !isNew {
+			*u = *before
+		}
+
+		if err := r.Apply(u); err != nil {
+			invalid("%s", err)
+			continue
+		}
+
+		if !knownRoles[u.Role] {
+			invalid("unknown role %s", u.Role)
+			continue
+		}
+
+		for _, g := range r.Groups {
+			if !knownGroups[g] {
+				invalid("unknown group %s", g)
+			}
+		}
+
+		after := FromUser(u, r.Groups)
+		d := &Diff{Handle: r.Handle, Changes: diff(previous, after), Roles: []string{u.Role}, Groups: changedGroups(previous.Groups, after.Groups)}
+		if !isNew {
+			d.Roles = append(d.Roles, before.Role)
+		}
+
+		passwordChanged := u.Password != before.Password
+		if passwordChanged {
+			d.Changes = append(d.Changes, Change{Field: "password", From: audit.Redacted, To: audit.Redacted})
+		}
+
+		switch {
+		case isNew:
+			res.Created = append(res.Created, d)
+		case len(d.Changes) > 0:
+			res.Updated = append(res.Updated, d)
+		default:
+			res.Unchanged = append(res.Unchanged, r.Handle)
+			continue
+		}
+		plan = append(plan, &planned{user: u, groups: after.Groups, isNew: isNew})
+	}
+
+	if len(problems) > 0 {
+		return nil, &InvalidError{Problems: problems}
+	}
+
+	if dryRun {
+		return res, nil
+	}
+
+	return res, sess.Tx(func(tx db.Session) error {
+		for _, p := range plan {
+			if err := save(tx, p); err != nil {
+				return fmt.Errorf("could not import %s: %w", p.user.Handle, err)
+			}
+		}
+		return nil
+	})
+}
+
+func save(tx db.Session, p *planned) error {
+	if p.isNew {
+		if _, err := tx.Collection("user").Insert(p.user); err != nil {
+			return err
+		}
+
+		if err := tx.Get(p.user, db.Cond{"handle": p.user.Handle}); err != nil {
+			return err
+		}
+	} else {
+		if err := tx.Collection("user").Find(db.Cond{"id": p.user.ID}).Update(p.user); err != nil {
+			return err
+		}
+
+		// updates leave alone what the user no longer has
+		cleared := map[string]any{}
+		if p.user.Schedule == nil {
+			cleared["schedule"] = nil
+		}
+		if p.user.Expires == nil {
+			cleared["expires"] = nil
+		}
+		if len(cleared) > 0 {
+			if err := tx.Collection("user").Find(db.Cond{"id": p.user.ID}).Update(cleared); err != nil {
+				return err
+			}
+		}
+	}
+
+	return user.SetGroups(tx, p.user, p.groups)
+}
+
+// changedGroups lists the groups in either from or to, but not both
+func changedGroups(from, to []string) []string {
+	count := map[string]int{}
+	for _, g := range from {
+		count[g]++
+	}
+	for _, g := range to {
+		count[g]--
+	}
+
+	res := []string{}
+	for g, n := range count {
+		if n != 0 {
+			res = append(res, g)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
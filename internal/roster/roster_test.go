@@ -0,0 +1,82 @@
+package roster
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"git.rob.mx/nidito/puerta/internal/user"
+)
+
+func TestCSVRoundTrip(t *testing.T) {
+	records := []*Record{
+		{
+			Handle:       "cousin",
+			Name:         "Primo",
+			Role:         "guest",
+			Schedule:     "days=sat,sun hours=10-18",
+			TTL:          "7d",
+			Expires:      "2027-01-01T00:00:00Z",
+			SecondFactor: true,
+			MaxEntries:   3,
+			Groups:       []string{"family", "weekend"},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, FormatCSV, records); err != nil {
+		t.Fatalf("could not encode: %s", err)
+	}
+
+	decoded, err := Decode(buf, FormatCSV)
+	if err != nil {
+		t.Fatalf("could not decode: %s", err)
+	}
+
+	if !reflect.DeepEqual(records, decoded) {
+		t.Fatalf("expected %+v, got %+v", records[0], decoded[0])
+	}
+}
+
+func TestDecodeCSV(t *testing.T) {
+	src := "name,handle,single_use\nPrimo,cousin,yes\n"
+	if _, err := Decode(strings.NewReader(src), FormatCSV); err == nil {
+		t.Fatal("expected an error for a bool column holding yes")
+	}
+
+	src = "handle,nickname\ncousin,primo\n"
+	if _, err := Decode(strings.NewReader(src), FormatCSV); err == nil {
+		t.Fatal("expected an error for an unknown column")
+	}
+}
+
+func TestApply(t *testing.T) {
+	cases := map[string]*Record{
+		"handle":   {Name: "Primo"},
+		"schedule": {Handle: "cousin", Name: "Primo", Schedule: "days=someday"},
+		"max_ttl":  {Handle: "cousin", Name: "Primo", TTL: "forever"},
+		"expires":  {Handle: "cousin", Name: "Primo", Expires: "tomorrow"},
+		"password": {Handle: "cousin", Name: "Primo", Password: "short"},
+	}
+
+	for field, r := range cases {
+		if err := r.Apply(&user.User{}); err == nil {
+			t.Errorf("expected an invalid %s to fail", field)
+		}
+	}
+
+	u := &user.User{}
+	r := &Record{Handle: "cousin", Name: "Primo", TTL: "12h", Expires: "2027-01-01T00:00:00Z"}
+	if err := r.Apply(u); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if u.Role != user.RoleGuest || u.Schedule != nil || u.Expires.Time().Year() != 2027 {
+		t.Fatalf("unexpected user %+v", u)
+	}
+
+	if changes := diff(r, FromUser(u, nil)); len(changes) != 1 || changes[0].Field != "role" {
+		t.Fatalf("expected only the default role to change, got %+v", changes)
+	}
+}
@@ -6,18 +6,36 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/errors"
 	"git.rob.mx/nidito/puerta/internal/user"
 	"github.com/SherClockHolmes/webpush-go"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 	"github.com/upper/db/v4"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func sendError(w http.ResponseWriter, err error) {
+// badRequest is an error caused by what the client sent, so it's shown back to them
+type badRequest struct {
+	error
+}
+
+func sendError(w http.ResponseWriter, r *http.Request, err error) {
 	logrus.Error(err)
-	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	if invalid, ok := err.(badRequest); ok {
+		sendStatus(w, r, http.StatusBadRequest, invalid.error)
+		return
+	}
+	sendStatus(w, r, http.StatusInternalServerError, nil)
+}
+
+// sendStatus responds with status and a code clients can rely on, along with
+// err's message in the request's language when the client caused it
+func sendStatus(w http.ResponseWriter, r *http.Request, status int, err error) {
+	errors.Send(w, user.Language(r), status, err)
 }
 
 func writeJSON(w http.ResponseWriter, data any) error {
@@ -35,7 +53,7 @@ func writeJSON(w http.ResponseWriter, data any) error {
 func listUsers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	users := []*user.User{}
 	if err := _db.Collection("user").Find().All(&users); err != nil {
-		sendError(w, err)
+		sendError(w, r, err)
 		return
 	}
 
@@ -46,7 +64,7 @@ func userFromRequest(r *http.Request, u *user.User) (*user.User, error) {
 	dec := json.NewDecoder(r.Body)
 	res := &user.User{}
 	if err := dec.Decode(&res); err != nil {
-		return nil, err
+		return nil, badRequest{err}
 	}
 	logrus.Debugf("Unserialized user data: %v", res)
 
@@ -59,36 +77,101 @@ func userFromRequest(r *http.Request, u *user.User) (*user.User, error) {
 	u.Name = res.Name
 	u.Expires = res.Expires
 	u.Greeting = res.Greeting
-	u.IsAdmin = res.IsAdmin
+	u.Role = res.Role
 	u.IsNotified = res.IsNotified
 	u.Require2FA = res.Require2FA
+	u.AllowTOTP = res.AllowTOTP
+	u.MaxSessions = res.MaxSessions
+	u.MaxEntries = res.MaxEntries
+	u.MaxDailyEntries = res.MaxDailyEntries
+	u.MaxWindowEntries = res.MaxWindowEntries
+	u.SingleUse = res.SingleUse
+	u.AskApproval = res.AskApproval
 	u.Schedule = res.Schedule
 	u.TTL = res.TTL
+	u.Timezone = res.Timezone
+	u.Locale = res.Locale
+
+	if err := u.ValidateLocale(); err != nil {
+		return nil, badRequest{err}
+	}
 
 	if res.Password != "" {
-		password, err := bcrypt.GenerateFromPassword([]byte(res.Password), bcrypt.DefaultCost)
-		if err != nil {
-			return nil, err
+		if err := u.SetPassword(res.Password); err != nil {
+			return nil, badRequest{err}
 		}
-		u.Password = string(password)
 	}
 
 	return u, nil
 
 }
 
+// canManage responds with a 403 unless the request's user can manage users with every one of roles
+func canManage(w http.ResponseWriter, r *http.Request, roles ...string) bool {
+	actor := user.FromContext(r)
+	for _, role := range roles {
+		allowed, err := actor.CanManage(_db, role)
+		if err != nil {
+			logrus.Errorf("could not check if %s can manage %s users: %s", actor.Handle, role, err)
+			sendStatus(w, r, http.StatusBadRequest, fmt.Errorf("Unknown role %s", role))
+			return false
+		}
+
+		if !allowed {
+			logrus.Warnf("%s is not allowed to manage %s users", actor.Handle, role)
+			sendStatus(w, r, http.StatusForbidden, nil)
+			return false
+		}
+	}
+	return true
+}
+
+// canManageUser responds with a 403 unless the request's user can manage
+// target, along with whatever their groups grant them
+func canManageUser(w http.ResponseWriter, r *http.Request, target *user.User) bool {
+	actor := user.FromContext(r)
+	allowed, err := actor.CanManageUser(_db, target)
+	if err != nil {
+		logrus.Errorf("could not check if %s can manage %s: %s", actor.Handle, target.Handle, err)
+		sendError(w, r, err)
+		return false
+	}
+
+	if !allowed {
+		logrus.Warnf("%s is not allowed to manage %s", actor.Handle, target.Handle)
+		sendStatus(w, r, http.StatusForbidden, nil)
+		return false
+	}
+	return true
+}
+
+func listRoles(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	roles, err := user.ListRoles(_db)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	writeJSON(w, roles)
+}
+
 func createUser(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	user, err := userFromRequest(r, nil)
 	if err != nil {
-		sendError(w, err)
+		sendError(w, r, err)
+		return
+	}
+
+	if !canManage(w, r, user.Role) {
 		return
 	}
 
 	if _, err := _db.Collection("user").Insert(user); err != nil {
-		sendError(w, err)
+		sendError(w, r, err)
 		return
 	}
 
+	audit.RecordAdmin(_db, audit.NewAdmin(r, audit.ActionUserCreate, user.Handle, nil, user))
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -97,7 +180,7 @@ func getUser(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	idString := params.ByName("id")
 
 	if err := _db.Get(&this, db.Cond{"handle": idString}); err != nil {
-		sendError(w, err)
+		sendError(w, r, err)
 		return
 	}
 
@@ -109,31 +192,48 @@ func updateUser(w http.ResponseWriter, r *http.Request, params httprouter.Params
 	user := user.User{}
 	if err := _db.Get(&user, db.Cond{"handle": params.ByName("id")}); err != nil {
 		logrus.Error(err)
-		http.NotFound(w, r)
+		sendStatus(w, r, http.StatusNotFound, nil)
 		return
 	}
 
+	before := user
 	modified, err := userFromRequest(r, &user)
 	if err != nil {
-		sendError(w, err)
+		sendError(w, r, err)
+		return
+	}
+
+	if !canManageUser(w, r, &before) || !canManage(w, r, modified.Role) {
 		return
 	}
 
 	if err := _db.Collection("user").UpdateReturning(modified); err != nil {
-		sendError(w, err)
+		sendError(w, r, err)
 		return
 	}
 
+	audit.RecordAdmin(_db, audit.NewAdmin(r, audit.ActionUserUpdate, modified.Handle, &before, modified))
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func deleteUser(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	err := _db.Collection("user").Find(db.Cond{"handle": params.ByName("id")}).Delete()
+	target := user.User{}
+	if err := _db.Get(&target, db.Cond{"handle": params.ByName("id")}); err != nil {
+		sendStatus(w, r, http.StatusNotFound, nil)
+		return
+	}
+
+	if !canManageUser(w, r, &target) {
+		return
+	}
+
+	err := _db.Collection("user").Find(db.Cond{"id": target.ID}).Delete()
 	if err != nil {
-		sendError(w, err)
+		sendError(w, r, err)
 		return
 	}
 
+	audit.RecordAdmin(_db, audit.NewAdmin(r, audit.ActionUserDelete, target.Handle, &target, nil))
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -142,7 +242,7 @@ func createSubscription(w http.ResponseWriter, r *http.Request, params httproute
 	dec := json.NewDecoder(r.Body)
 	res := &webpush.Subscription{}
 	if err := dec.Decode(&res); err != nil {
-		sendError(w, err)
+		sendError(w, r, err)
 		return
 	}
 	logrus.Infof("Unserialized subscription data: %v", res)
@@ -154,11 +254,12 @@ func createSubscription(w http.ResponseWriter, r *http.Request, params httproute
 
 	ins, err := _db.Collection("subscription").Insert(sub)
 	if err != nil {
-		sendError(w, err)
+		sendError(w, r, err)
 		return
 	}
 
 	logrus.Infof("Created subscription for: %s (%v)", u.Handle, ins)
+	audit.RecordAdmin(_db, audit.NewAdmin(r, audit.ActionSubscriptionCreate, u.Handle, nil, map[string]string{"endpoint": res.Endpoint}))
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte(`{"status": "ok"}`))
 }
@@ -169,34 +270,76 @@ func deleteSubscription(w http.ResponseWriter, r *http.Request, params httproute
 	dec := json.NewDecoder(r.Body)
 	res := &webpush.Subscription{}
 	if err := dec.Decode(&res); err != nil {
-		sendError(w, err)
+		sendError(w, r, err)
 		return
 	}
 	encoded, err := json.Marshal(res)
 
 	if err != nil {
-		sendError(w, err)
+		sendError(w, r, err)
 		return
 	}
 
 	err = _db.Collection("subscription").Find(db.Cond{"user": u.ID, "data": db.Like(fmt.Sprintf("%%%s%%", encoded))}).Delete()
 	if err != nil {
-		sendError(w, fmt.Errorf("could not delete subscription: %s", err))
+		sendError(w, r, fmt.Errorf("could not delete subscription: %s", err))
 		return
 	}
 
 	logrus.Infof("Deleted subscription for: %s (%s)", u.Handle, encoded)
+	audit.RecordAdmin(_db, audit.NewAdmin(r, audit.ActionSubscriptionDelete, u.Handle, map[string]string{"endpoint": res.Endpoint}, nil))
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte(`{"status": "ok"}`))
 }
 
 func rexRecords(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	records := []*auditLog{}
+	records := []*audit.Entry{}
 	err := _db.Collection("log").Find().OrderBy("-timestamp").Limit(20).All(&records)
 	if err != nil {
-		sendError(w, err)
+		sendError(w, r, err)
 		return
 	}
 
 	writeJSON(w, records)
 }
+
+// maxAdminLog caps how many admin log entries may be asked for at once
+const maxAdminLog = 500
+
+// adminRecords lists what admins changed, filtered by actor, action, target
+// and an RFC3339 since, newest first
+func adminRecords(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query()
+	q := &audit.AdminQuery{
+		Actor:  query.Get("actor"),
+		Action: audit.Action(query.Get("action")),
+		Target: query.Get("target"),
+		Limit:  50,
+	}
+
+	if param := query.Get("count"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 || n > maxAdminLog {
+			sendStatus(w, r, http.StatusBadRequest, fmt.Errorf("count must be a number from 1 to %d", maxAdminLog))
+			return
+		}
+		q.Limit = n
+	}
+
+	if param := query.Get("since"); param != "" {
+		since, err := time.Parse(time.RFC3339, param)
+		if err != nil {
+			sendStatus(w, r, http.StatusBadRequest, fmt.Errorf("since must be an RFC3339 timestamp: %s", err))
+			return
+		}
+		q.Since = since
+	}
+
+	entries, err := audit.AdminEntries(_db, q)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	writeJSON(w, entries)
+}
@@ -0,0 +1,221 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/door"
+	"git.rob.mx/nidito/puerta/internal/errors"
+	"git.rob.mx/nidito/puerta/internal/i18n"
+	"git.rob.mx/nidito/puerta/internal/push"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
+)
+
+type ApprovalsConfig struct {
+	// Timeout is how long admins have to approve a request before it expires
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+var _approvals *ApprovalsConfig
+
+func recordApproval(r *http.Request, description string, err error) {
+	entry := audit.New(r, audit.EventApproval, err)
+	entry.Detail = description
+	audit.Record(_db, entry)
+}
+
+// requestApproval asks admins to let a user in outside their schedule, they
+// get a push notification with actions to approve or deny it. Users asking
+// again while still waiting get the same approval, and admins no new notification
+func requestApproval(w http.ResponseWriter, r *http.Request, u *user.User, now time.Time) {
+	approval, created, err := user.RequestApproval(_db, u, now, _approvals.Timeout)
+	if err != nil {
+		recordApproval(r, "", err)
+		sendError(w, r, err)
+		return
+	}
+
+	if created {
+		recordApproval(r, fmt.Sprintf("requested approval %s, expires at %s", approval.ID, approval.Expires.Format(time.RFC3339)), nil)
+		notifyApproval(u, approval)
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	err = json.NewEncoder(w).Encode(map[string]any{
+		"status":   approval.Status,
+		"approval": approval,
+		"message":  i18n.T(user.Language(r), i18n.ApprovalPending),
+	})
+	if err != nil {
+		logrus.Errorf("could not write approval: %s", err)
+	}
+}
+
+// notifyApproval asks admins to approve or deny an approval for u
+func notifyApproval(u *user.User, approval *user.Approval) {
+	go push.NotifyAdminsOf(_db, func(lang string) *push.Notification {
+		return &push.Notification{
+			Title: i18n.T(lang, i18n.NotifyApproval, u.Name),
+			Body:  i18n.T(lang, i18n.NotifyApprovalBody, approval.Expires.In(TZ).Format("15:04")),
+			Tag:   "approval-" + approval.ID,
+			Actions: []push.Action{
+				{Action: "approve", Title: i18n.T(lang, i18n.NotifyApprove)},
+				{Action: "deny", Title: i18n.T(lang, i18n.NotifyDeny)},
+			},
+			Data: map[string]string{"approval": approval.ID},
+		}
+	})
+}
+
+// currentApproval finds the approval in the request's path, expiring it if its
+// time is up
+func currentApproval(w http.ResponseWriter, r *http.Request, params httprouter.Params) *user.Approval {
+	approval, err := user.FetchApproval(_db, params.ByName("id"))
+	if err != nil {
+		sendStatus(w, r, http.StatusNotFound, nil)
+		return nil
+	}
+
+	expired, err := approval.Expire(_db, time.Now())
+	if err != nil {
+		sendError(w, r, err)
+		return nil
+	}
+
+	if expired {
+		entry := audit.New(r, audit.EventApproval, nil)
+		entry.User = approval.Handle
+		entry.Detail = fmt.Sprintf("approval %s expired", approval.ID)
+		audit.Record(_db, entry)
+	}
+	return approval
+}
+
+// getApproval lets users follow their own approvals
+func getApproval(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	approval := currentApproval(w, r, params)
+	if approval == nil {
+		return
+	}
+
+	u := user.FromContext(r)
+	if approval.UserID != u.ID {
+		if allowed, err := u.Can(_db, user.PermissionManageGuests); err != nil || !allowed {
+			sendStatus(w, r, http.StatusNotFound, nil)
+			return
+		}
+	}
+
+	writeJSON(w, approval)
+}
+
+func listApprovals(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	approvals, err := user.ListApprovals(_db, time.Now())
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	writeJSON(w, approvals)
+}
+
+type approvalDecision struct {
+	Approve bool `json:"approve"`
+}
+
+// decideApproval approves or denies a pending approval, opening the door right
+// away for approved ones
+func decideApproval(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	decision := &approvalDecision{}
+	if err := json.NewDecoder(r.Body).Decode(decision); err != nil {
+		sendStatus(w, r, http.StatusBadRequest, fmt.Errorf("could not decode decision: %s", err))
+		return
+	}
+
+	approval := currentApproval(w, r, params)
+	if approval == nil {
+		return
+	}
+
+	guest := &user.User{}
+	if err := _db.Get(guest, db.Cond{"id": approval.UserID}); err != nil {
+		sendStatus(w, r, http.StatusNotFound, nil)
+		return
+	}
+
+	// the guest is held to their groups' policy just like when they ask to come in
+	guest, err := guest.Effective(_db)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	if !canManageUser(w, r, guest) {
+		return
+	}
+
+	actor := user.FromContext(r)
+	decided, err := approval.Decide(_db, actor, decision.Approve, time.Now())
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	if !decided {
+		sendStatus(w, r, http.StatusConflict, i18n.Errorf(i18n.ApprovalSettled, approval.StatusAt(time.Now())))
+		return
+	}
+
+	recordApproval(r, fmt.Sprintf("%s approval %s for %s", approval.Status, approval.ID, guest.Handle), nil)
+	if !decision.Approve {
+		writeJSON(w, approval)
+		return
+	}
+
+	// only the guest's schedule is waived, and they may have expired or the
+	// house closed since they asked
+	now := time.Now().In(guest.Location(TZ))
+	code := http.StatusForbidden
+	if err = guest.IsAllowed(_db, now); err == user.ErrOutsideSchedule {
+		err = nil
+	}
+
+	// the entry belongs to the guest, so it counts towards their quotas
+	if err == nil {
+		err = guest.ReserveEntry(_db, now)
+	}
+
+	if err == nil {
+		if err = door.RequestToEnter(guest.Name); err != nil {
+			releaseEntry(guest, now)
+			_, code = errors.ToHTTP(err)
+		}
+	}
+
+	entry := audit.New(r, audit.EventRex, err)
+	entry.User = guest.Handle
+	entry.SecondFactor = guest.Require2FA
+	entry.Token = ""
+	if err == nil {
+		entry.Detail = fmt.Sprintf("approved by %s", actor.Handle)
+	}
+	audit.Record(_db, entry)
+
+	if err != nil {
+		sendStatus(w, r, code, err)
+		return
+	}
+
+	spendSingleUse(guest, now)
+	go push.NotifyAdmins(_db, i18n.NotifyOpenedFor, actor.Name, guest.Name)
+	writeJSON(w, approval)
+}
@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/booking"
+	"git.rob.mx/nidito/puerta/internal/push"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/julienschmidt/httprouter"
+	"github.com/upper/db/v4"
+)
+
+// maxCalendarSize limits uploaded calendars
+const maxCalendarSize = 10 * 1024 * 1024
+
+// notifyInvites lets admins that manage guests know the credentials of new
+// ones, so they can pass them along
+func notifyInvites(sess db.Session, result *booking.Result) {
+	for _, invite := range result.Created {
+		go push.NotifyPermittedWith(sess, user.PermissionManageGuests, invite)
+	}
+}
+
+func listBookings(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	bookings := []*booking.Booking{}
+	if err := _db.Collection("booking").Find().OrderBy("-check_in").All(&bookings); err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	writeJSON(w, bookings)
+}
+
+// importBookings creates guests from an uploaded calendar. Bookings previously
+// imported with the same source that are missing from it get cancelled
+func importBookings(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !canManage(w, r, _bookings.Role) {
+		return
+	}
+
+	source := r.URL.Query().Get("source")
+	if source == "" {
+		source = "upload"
+	}
+
+	if _, configured := _bookings.Calendars[source]; configured {
+		sendStatus(w, r, http.StatusConflict, fmt.Errorf("source belongs to a calendar in bookings.calendars, pick another"))
+		return
+	}
+
+	events, err := booking.ParseICS(io.LimitReader(r.Body, maxCalendarSize), TZ)
+	if err != nil {
+		sendStatus(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	result, err := booking.Import(_db, _bookings, source, events, time.Now())
+	// guests created before an error still need their invites
+	notifyInvites(_db, result)
+	entry := audit.New(r, audit.EventBookings, err)
+	entry.Detail = "imported " + source + ": " + result.String()
+	audit.Record(_db, entry)
+	// invites carry passwords, so only what the import did is kept
+	audit.RecordAdmin(_db, audit.NewAdmin(r, audit.ActionBookingsImport, source, nil, map[string]string{"result": result.String()}))
+
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	writeJSON(w, result)
+}
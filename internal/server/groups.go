@@ -0,0 +1,261 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
+)
+
+// membershipRequest changes who belongs to a group, by handle
+type membershipRequest struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+func groupFromRequest(r *http.Request) (*user.Group, error) {
+	g := &user.Group{}
+	if err := json.NewDecoder(r.Body).Decode(g); err != nil {
+		return nil, badRequest{err}
+	}
+
+	for _, p := range g.Permissions {
+		if _, err := user.ParsePermission(string(p)); err != nil {
+			return nil, badRequest{err}
+		}
+	}
+
+	if g.Schedule != nil && strings.TrimSpace(g.Schedule.String()) == "" {
+		g.Schedule = nil
+	}
+
+	return g, nil
+}
+
+// canManageGroups responds with a 403 unless the request's user can manage
+// every one of groups, privileged ones being reserved to those that manage admins
+func canManageGroups(w http.ResponseWriter, r *http.Request, groups ...*user.Group) bool {
+	for _, g := range groups {
+		if g.IsPrivileged() {
+			return canManage(w, r, user.RoleAdmin)
+		}
+	}
+	return true
+}
+
+// managedGroup finds the group in the request's path, responding with an error
+// unless the request's user can manage it
+func managedGroup(w http.ResponseWriter, r *http.Request, params httprouter.Params) *user.Group {
+	g, err := user.FetchGroup(_db, params.ByName("name"))
+	if err != nil {
+		sendStatus(w, r, http.StatusNotFound, nil)
+		return nil
+	}
+
+	if !canManageGroups(w, r, g) {
+		return nil
+	}
+	return g
+}
+
+func listGroups(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	groups, err := user.ListGroups(_db)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	writeJSON(w, groups)
+}
+
+func getGroup(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	g, err := user.FetchGroup(_db, params.ByName("name"))
+	if err != nil {
+		sendStatus(w, r, http.StatusNotFound, nil)
+		return
+	}
+
+	writeJSON(w, g)
+}
+
+func createGroup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	g, err := groupFromRequest(r)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	if g.Name == "" {
+		sendStatus(w, r, http.StatusBadRequest, fmt.Errorf("groups need a name"))
+		return
+	}
+
+	if !canManageGroups(w, r, g) {
+		return
+	}
+
+	exists, err := _db.Collection("user_group").Find(db.Cond{"name": g.Name}).Exists()
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	if exists {
+		sendStatus(w, r, http.StatusConflict, fmt.Errorf("group %s already exists", g.Name))
+		return
+	}
+
+	if err := user.SaveGroup(_db, g); err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	audit.RecordAdmin(_db, audit.NewAdmin(r, audit.ActionGroupCreate, g.Name, nil, g))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func updateGroup(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	existing := managedGroup(w, r, params)
+	if existing == nil {
+		return
+	}
+
+	g, err := groupFromRequest(r)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	g.Name = existing.Name
+	g.Members = existing.Members
+
+	if !canManageGroups(w, r, g) {
+		return
+	}
+
+	if err := user.SaveGroup(_db, g); err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	audit.RecordAdmin(_db, audit.NewAdmin(r, audit.ActionGroupUpdate, g.Name, existing, g))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteGroup(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	g := managedGroup(w, r, params)
+	if g == nil {
+		return
+	}
+
+	if err := user.DeleteGroup(_db, g.Name); err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	audit.RecordAdmin(_db, audit.NewAdmin(r, audit.ActionGroupDelete, g.Name, g, nil))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// usersByHandle finds users by handle, failing with the ones that don't exist
+func usersByHandle(handles []string) ([]*user.User, error) {
+	users := []*user.User{}
+	if len(handles) == 0 {
+		return users, nil
+	}
+
+	if err := _db.Collection("user").Find(db.Cond{"handle IN": handles}).All(&users); err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	for _, u := range users {
+		found[u.Handle] = true
+	}
+
+	missing := []string{}
+	for _, handle := range handles {
+		if !found[handle] {
+			missing = append(missing, handle)
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, badRequest{fmt.Errorf("unknown users: %s", strings.Join(missing, ", "))}
+	}
+	return users, nil
+}
+
+func updateMembers(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	g := managedGroup(w, r, params)
+	if g == nil {
+		return
+	}
+
+	req := &membershipRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		sendStatus(w, r, http.StatusBadRequest, fmt.Errorf("could not decode membership request: %s", err))
+		return
+	}
+
+	add, err := usersByHandle(req.Add)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	remove, err := usersByHandle(req.Remove)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	roles := []string{}
+	seen := map[string]bool{}
+	for _, u := range append(add, remove...) {
+		if !seen[u.Role] {
+			seen[u.Role] = true
+			roles = append(roles, u.Role)
+		}
+	}
+
+	if !canManage(w, r, roles...) {
+		return
+	}
+
+	if err := user.SetMembership(_db, g.Name, add, remove); err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	logrus.Infof("updated members of group %s: +%v -%v", g.Name, req.Add, req.Remove)
+	before := g
+	if g, err = user.FetchGroup(_db, g.Name); err != nil {
+		sendError(w, r, err)
+		return
+	}
+	audit.RecordAdmin(_db, audit.NewAdmin(r, audit.ActionGroupMembers, g.Name, before, g))
+	writeJSON(w, g)
+}
+
+func getUserPolicy(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	u := managedUser(w, r, params)
+	if u == nil {
+		return
+	}
+
+	policy, err := u.Policy(_db)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	writeJSON(w, policy)
+}
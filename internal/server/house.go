@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
+)
+
+// houseEventRoles lists the roles an event affects, so only those who can
+// manage all of them get to create or delete it. Unknown handles fail when
+// strict, and are otherwise left out, i.e. for users deleted since
+func houseEventRoles(e *user.HouseEvent, strict bool) ([]string, error) {
+	if len(e.Handles) == 0 && len(e.Roles) == 0 {
+		roles, err := user.ListRoles(_db)
+		if err != nil {
+			return nil, err
+		}
+
+		names := make([]string, len(roles))
+		for i, role := range roles {
+			names[i] = role.Name
+		}
+		return names, nil
+	}
+
+	names := append([]string{}, e.Roles...)
+	for _, handle := range e.Handles {
+		u := &user.User{}
+		if err := _db.Get(u, db.Cond{"handle": handle}); err != nil {
+			if !strict {
+				continue
+			}
+			return nil, badRequest{fmt.Errorf("unknown user %s", handle)}
+		}
+		names = append(names, u.Role)
+	}
+	return names, nil
+}
+
+// listHouseEvents returns the blackouts and overrides that have not ended
+func listHouseEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	events, err := user.ListHouseEvents(_db, time.Now())
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	writeJSON(w, events)
+}
+
+func createHouseEvent(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	event := &user.HouseEvent{}
+	if err := json.NewDecoder(r.Body).Decode(event); err != nil {
+		sendStatus(w, r, http.StatusBadRequest, fmt.Errorf("could not decode house event: %s", err))
+		return
+	}
+
+	if err := event.Validate(); err != nil {
+		sendStatus(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	roles, err := houseEventRoles(event, true)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	if !canManage(w, r, roles...) {
+		return
+	}
+
+	event.ID = 0
+	event.Starts = event.Starts.UTC()
+	event.Ends = event.Ends.UTC()
+	event.CreatedBy = user.FromContext(r).Handle
+	event.Created = time.Now().UTC()
+	res, err := _db.Collection("house_event").Insert(event)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	event.ID = int(res.ID().(int64))
+
+	entry := audit.New(r, audit.EventHouse, nil)
+	entry.Detail = fmt.Sprintf("created %s %d from %s to %s: %s", event.Kind, event.ID, event.Starts.Format(time.RFC3339), event.Ends.Format(time.RFC3339), event.Reason)
+	audit.Record(_db, entry)
+	audit.RecordAdmin(_db, audit.NewAdmin(r, audit.ActionHouseCreate, strconv.Itoa(event.ID), nil, event))
+
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(event); err != nil {
+		logrus.Errorf("could not write house event: %s", err)
+	}
+}
+
+func deleteHouseEvent(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil {
+		sendStatus(w, r, http.StatusNotFound, nil)
+		return
+	}
+
+	event := &user.HouseEvent{}
+	if err := _db.Get(event, db.Cond{"id": id}); err != nil {
+		sendStatus(w, r, http.StatusNotFound, nil)
+		return
+	}
+
+	roles, err := houseEventRoles(event, false)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	if !canManage(w, r, roles...) {
+		return
+	}
+
+	if err := _db.Collection("house_event").Find(db.Cond{"id": id}).Delete(); err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	entry := audit.New(r, audit.EventHouse, nil)
+	entry.Detail = fmt.Sprintf("deleted %s %d from %s to %s: %s", event.Kind, event.ID, event.Starts.Format(time.RFC3339), event.Ends.Format(time.RFC3339), event.Reason)
+	audit.Record(_db, entry)
+	audit.RecordAdmin(_db, audit.NewAdmin(r, audit.ActionHouseDelete, strconv.Itoa(event.ID), event, nil))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/auth"
+	"git.rob.mx/nidito/puerta/internal/booking"
+	"git.rob.mx/nidito/puerta/internal/jobs"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/julienschmidt/httprouter"
+	"github.com/upper/db/v4"
+)
+
+type JobsConfig struct {
+	// Interval is how often background jobs run
+	Interval time.Duration `yaml:"interval"`
+	// LogRetention is how long entries are kept in the audit log, 0 keeps them forever
+	LogRetention time.Duration `yaml:"log_retention"`
+	// ExpiredUsers is how long users are kept after they expire, 0 keeps them forever
+	ExpiredUsers time.Duration `yaml:"expired_users"`
+}
+
+// Validate rejects negative durations, 0 turns each setting off
+func (c *JobsConfig) Validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("interval must not be negative, use 0 to disable background jobs")
+	}
+
+	if c.LogRetention < 0 {
+		return fmt.Errorf("log_retention must not be negative, use 0 to keep entries forever")
+	}
+
+	if c.ExpiredUsers < 0 {
+		return fmt.Errorf("expired_users must not be negative, use 0 to keep users forever")
+	}
+	return nil
+}
+
+var scheduler *jobs.Scheduler
+
+// NewScheduler registers puerta's maintenance jobs
+func NewScheduler(config *Config, sess db.Session) *jobs.Scheduler {
+	cfg := config.Jobs
+	s := jobs.New(sess)
+
+	s.Register("sessions", "deletes expired sessions and api tokens", cfg.Interval, func(sess db.Session) (string, error) {
+		count, err := auth.PruneSessions(sess)
+		if err != nil {
+			return "", err
+		}
+
+		tokens, err := auth.PruneAPITokens(sess)
+		return fmt.Sprintf("deleted %d expired sessions and %d api tokens", count, tokens), err
+	})
+
+	s.Register("challenges", "deletes stale webauthn and totp flow data", cfg.Interval, func(sess db.Session) (string, error) {
+		count, err := auth.PruneChallenges(sess)
+		return fmt.Sprintf("deleted %d stale challenges", count), err
+	})
+
+	s.Register("users", "deletes users once they've been expired for longer than jobs.expired_users", cfg.Interval, func(sess db.Session) (string, error) {
+		if cfg.ExpiredUsers == 0 {
+			return "keeping expired users", nil
+		}
+		count, err := user.PruneExpired(sess, cfg.ExpiredUsers)
+		return fmt.Sprintf("deleted %d expired users", count), err
+	})
+
+	s.Register("log", "deletes audit log entries older than jobs.log_retention", cfg.Interval, func(sess db.Session) (string, error) {
+		if cfg.LogRetention == 0 {
+			return "keeping every log entry", nil
+		}
+		count, err := audit.Prune(sess, cfg.LogRetention)
+		return fmt.Sprintf("deleted %d log entries", count), err
+	})
+
+	s.Register("bookings", "imports guests from the calendars in bookings.calendars", cfg.Interval, func(sess db.Session) (string, error) {
+		if len(config.Bookings.Calendars) == 0 {
+			return "no calendars to import", nil
+		}
+
+		loc, err := config.Location()
+		if err != nil {
+			return "", err
+		}
+
+		results := []string{}
+		for name, url := range config.Bookings.Calendars {
+			events, err := booking.Fetch(url, loc)
+			if err != nil {
+				return strings.Join(results, ", "), fmt.Errorf("could not fetch %s: %w", name, err)
+			}
+
+			result, err := booking.Import(sess, config.Bookings, name, events, time.Now())
+			notifyInvites(sess, result)
+			if err != nil {
+				return strings.Join(results, ", "), fmt.Errorf("could not import %s: %w", name, err)
+			}
+
+			results = append(results, fmt.Sprintf("%s: %s", name, result))
+		}
+		return strings.Join(results, ", "), nil
+	})
+
+	return s
+}
+
+func listJobs(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeJSON(w, scheduler.Status())
+}
+
+func runJob(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	status, err := scheduler.Run(params.ByName("name"))
+	if err != nil && status.Name == "" {
+		sendStatus(w, r, http.StatusNotFound, nil)
+		return
+	}
+
+	writeJSON(w, status)
+}
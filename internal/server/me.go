@@ -0,0 +1,186 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/auth"
+	"git.rob.mx/nidito/puerta/internal/constants"
+	"git.rob.mx/nidito/puerta/internal/errors"
+	"git.rob.mx/nidito/puerta/internal/i18n"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
+)
+
+// maxHistory caps how many entries users may ask for at once
+const maxHistory = 100
+
+// profile is what users get to see about themselves
+type profile struct {
+	Handle       string         `json:"handle"`
+	Name         string         `json:"name"`
+	Greeting     string         `json:"greeting"`
+	Role         string         `json:"role"`
+	Groups       []string       `json:"groups"`
+	Expires      *user.UTCTime  `json:"expires,omitempty"`
+	Schedule     *user.Schedule `json:"schedule,omitempty"`
+	Windows      []user.Window  `json:"windows"`
+	Timezone     string         `json:"timezone,omitempty"`
+	Locale       string         `json:"locale,omitempty"`
+	SecondFactor bool           `json:"second_factor"`
+	AllowTOTP    bool           `json:"allow_totp"`
+	SingleUse    bool           `json:"single_use"`
+	// RemainingEntries is how many more times the user may come in, omitted
+	// when they have no limit
+	RemainingEntries *int `json:"remaining_entries,omitempty"`
+}
+
+func getProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	u := user.FromContext(r)
+	now := time.Now().In(u.Location(TZ))
+
+	remaining, err := u.RemainingEntries(_db, now)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	writeJSON(w, &profile{
+		Handle:           u.Handle,
+		Name:             u.Name,
+		Greeting:         u.Greeting,
+		Role:             u.Role,
+		Groups:           u.Groups(),
+		Expires:          u.Expires,
+		Schedule:         u.Schedule,
+		Windows:          u.NextWindows(now, 5),
+		Timezone:         u.Timezone,
+		Locale:           u.Locale,
+		SecondFactor:     u.Require2FA,
+		AllowTOTP:        u.AllowTOTP,
+		SingleUse:        u.SingleUse,
+		RemainingEntries: remaining,
+	})
+}
+
+type passwordRequest struct {
+	Current  string `json:"current"`
+	Password string `json:"password"`
+}
+
+func changePassword(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if auth.TokenFromContext(r) != nil {
+		sendStatus(w, r, http.StatusForbidden, fmt.Errorf("api tokens cannot change passwords"))
+		return
+	}
+
+	req := &passwordRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		sendStatus(w, r, http.StatusBadRequest, fmt.Errorf("could not decode password request: %s", err))
+		return
+	}
+
+	u := user.FromContext(r)
+	if err := auth.VerifyPassword(r, req.Current); err != nil {
+		audit.Record(_db, audit.New(r, audit.EventPassword, err))
+		if locked, ok := err.(*errors.TooManyAttempts); ok {
+			w.Header().Set("Retry-After", locked.RetryAfter())
+			sendStatus(w, r, http.StatusTooManyRequests, err)
+			return
+		}
+		sendStatus(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	if err := u.SetPassword(req.Password); err != nil {
+		sendStatus(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := _db.Collection("user").Find(db.Cond{"id": u.ID}).Update(db.Cond{"password": u.Password}); err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	current, _ := r.Context().Value(constants.ContextSession).(string)
+	if err := auth.RevokeOtherSessions(_db, u.ID, current); err != nil {
+		logrus.Errorf("could not revoke sessions for %s after a password change: %s", u.Handle, err)
+	}
+
+	entry := audit.New(r, audit.EventPassword, nil)
+	entry.Detail = fmt.Sprintf("%s changed their password", u.Handle)
+	audit.Record(_db, entry)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listOwnPasskeys(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	u := user.FromContext(r)
+	if err := u.FetchCredentials(_db); err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	writeJSON(w, u.Passkeys())
+}
+
+func deleteOwnPasskey(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	u := user.FromContext(r)
+	if err := u.FetchCredentials(_db); err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	if err := u.FetchTOTP(_db); err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	// users who need a second factor would have to enroll again with just their password
+	if u.Require2FA && len(u.Passkeys()) == 1 && !u.HasTOTP() {
+		sendStatus(w, r, http.StatusConflict, i18n.Errorf(i18n.LastPasskey))
+		return
+	}
+
+	id := params.ByName("passkey")
+	if err := u.DeleteCredential(_db, id); err != nil {
+		if err == db.ErrNoMoreRows {
+			sendStatus(w, r, http.StatusNotFound, nil)
+			return
+		}
+		sendError(w, r, err)
+		return
+	}
+
+	entry := audit.New(r, audit.EventPasskey, nil)
+	entry.Detail = fmt.Sprintf("deleted passkey %s for %s", id, u.Handle)
+	audit.Record(_db, entry)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listOwnEntries(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	count := 20
+	if param := r.URL.Query().Get("count"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 || n > maxHistory {
+			sendStatus(w, r, http.StatusBadRequest, fmt.Errorf("count must be a number from 1 to %d", maxHistory))
+			return
+		}
+		count = n
+	}
+
+	entries, err := audit.Entries(_db, user.FromContext(r).Handle, count)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	writeJSON(w, entries)
+}
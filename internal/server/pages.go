@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package server
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"net/http"
+
+	"git.rob.mx/nidito/puerta/internal/i18n"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed login.html index.html admin.html
+var pageFiles embed.FS
+
+var pages = template.Must(template.ParseFS(pageFiles, "*.html"))
+
+// page is what server rendered pages get to show, in the language of whoever
+// requested them
+type page struct {
+	Lang string
+	// Name is the house's
+	Name    string
+	PushKey string
+	// OIDC is the label of the identity provider, if enabled
+	OIDC string
+}
+
+// _site holds what every page shows regardless of language
+var _site = &page{}
+
+// T renders a message from the catalog in the page's language
+func (p *page) T(key string, args ...any) string {
+	return i18n.T(p.Lang, i18n.Key(key), args...)
+}
+
+// Strings returns the messages the page's scripts show on their own
+func (p *page) Strings() map[string]string {
+	return i18n.Strings(p.Lang, "js.")
+}
+
+func renderTemplate(name string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		p := *_site
+		p.Lang = user.Language(r)
+
+		buf := &bytes.Buffer{}
+		if err := pages.ExecuteTemplate(buf, name, &p); err != nil {
+			logrus.Errorf("could not render %s: %s", name, err)
+			sendStatus(w, r, http.StatusInternalServerError, nil)
+			return
+		}
+
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		w.Header().Set("content-language", p.Lang)
+		w.Header().Add("vary", "Accept-Language")
+		w.Write(buf.Bytes())
+	}
+}
@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/roster"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// rosterFormat reads the format of a roster from the request, defaulting to json
+func rosterFormat(r *http.Request) (roster.Format, error) {
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		return roster.FormatJSON, nil
+	}
+
+	format, err := roster.ParseFormat(name)
+	if err != nil {
+		return "", badRequest{err}
+	}
+	return format, nil
+}
+
+func exportRoster(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	format, err := rosterFormat(r)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	records, err := roster.Export(_db, false)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	w.Header().Add("content-type", roster.ContentType[format])
+	w.Header().Add("content-disposition", "attachment; filename=users."+string(format))
+	w.WriteHeader(http.StatusOK)
+	if err := roster.Encode(w, format, records); err != nil {
+		logrus.Errorf("could not export users: %s", err)
+	}
+}
+
+// canImport responds with a 403 unless the request's user can manage every
+// user and group changed by an import
+func canImport(w http.ResponseWriter, r *http.Request, res *roster.Result) bool {
+	groups, err := user.ListGroups(_db)
+	if err != nil {
+		sendError(w, r, err)
+		return false
+	}
+
+	byName := map[string]*user.Group{}
+	for _, g := range groups {
+		byName[g.Name] = g
+	}
+
+	roles := []string{}
+	touched := []*user.Group{}
+	seen := map[string]bool{}
+	for _, d := range append(res.Created, res.Updated...) {
+		for _, role := range d.Roles {
+			if !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+
+		for _, name := range d.Groups {
+			touched = append(touched, byName[name])
+		}
+	}
+
+	return canManage(w, r, roles...) && canManageGroups(w, r, touched...)
+}
+
+func importRoster(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	format, err := rosterFormat(r)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	dryRun := false
+	if param := r.URL.Query().Get("dry_run"); param != "" {
+		if dryRun, err = strconv.ParseBool(param); err != nil {
+			sendError(w, r, badRequest{err})
+			return
+		}
+	}
+
+	records, err := roster.Decode(r.Body, format)
+	if err != nil {
+		sendError(w, r, badRequest{err})
+		return
+	}
+
+	// find out what changes before checking who may change it
+	res, err := roster.Import(_db, records, true)
+	if err != nil {
+		if invalid, ok := err.(*roster.InvalidError); ok {
+			sendError(w, r, badRequest{invalid})
+			return
+		}
+		sendError(w, r, err)
+		return
+	}
+
+	if !canImport(w, r, res) {
+		return
+	}
+
+	if !dryRun {
+		if res, err = roster.Import(_db, records, false); err != nil {
+			sendError(w, r, err)
+			return
+		}
+		logrus.Infof("%s imported users: %d created, %d updated", user.FromContext(r).Handle, len(res.Created), len(res.Updated))
+		res.Record(_db, func(action audit.Action, target string, before, after any) *audit.AdminEntry {
+			return audit.NewAdmin(r, action, target, before, after)
+		})
+	}
+
+	writeJSON(w, res)
+}
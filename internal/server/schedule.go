@@ -0,0 +1,40 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxWindows caps how many windows clients may ask for at once
+const maxWindows = 50
+
+func writeWindows(w http.ResponseWriter, r *http.Request, u *user.User) {
+	count := 5
+	if param := r.URL.Query().Get("count"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 || n > maxWindows {
+			sendStatus(w, r, http.StatusBadRequest, fmt.Errorf("count must be a number from 1 to 50"))
+			return
+		}
+		count = n
+	}
+
+	writeJSON(w, u.NextWindows(time.Now().In(u.Location(TZ)), count))
+}
+
+func listOwnWindows(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeWindows(w, r, user.FromContext(r))
+}
+
+func listUserWindows(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if u := managedUser(w, r, params); u != nil {
+		writeWindows(w, r, u)
+	}
+}
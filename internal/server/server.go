@@ -3,7 +3,6 @@
 package server
 
 import (
-	"bytes"
 	"embed"
 	"fmt"
 	"io"
@@ -15,9 +14,12 @@ import (
 	"strings"
 	"time"
 
+	"git.rob.mx/nidito/puerta/internal/audit"
 	"git.rob.mx/nidito/puerta/internal/auth"
+	"git.rob.mx/nidito/puerta/internal/booking"
 	"git.rob.mx/nidito/puerta/internal/door"
 	"git.rob.mx/nidito/puerta/internal/errors"
+	"git.rob.mx/nidito/puerta/internal/i18n"
 	"git.rob.mx/nidito/puerta/internal/push"
 	"git.rob.mx/nidito/puerta/internal/user"
 	"github.com/go-webauthn/webauthn/webauthn"
@@ -25,17 +27,9 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/upper/db/v4"
 	"github.com/upper/db/v4/adapter/sqlite"
+	"gopkg.in/yaml.v3"
 )
 
-//go:embed login.html
-var loginTemplate []byte
-
-//go:embed index.html
-var indexTemplate []byte
-
-//go:embed admin.html
-var adminTemplate []byte
-
 //go:embed static/*
 var staticFiles embed.FS
 
@@ -46,64 +40,101 @@ type HTTPConfig struct {
 	Origin string `yaml:"origin"`
 	// Protocol specifies the protocol for the webauthn origin
 	Protocol string `yaml:"protocol"`
+	// Cookie is the policy for session cookies
+	Cookie *auth.CookieConfig `yaml:"cookie"`
+	// TrustedProxies are the addresses or CIDR ranges allowed to tell the
+	// client's address with X-Forwarded-For
+	TrustedProxies []string `yaml:"trusted_proxies"`
 }
 
 type Config struct {
-	Name     string         `yaml:"name"`
-	Adapter  map[string]any `yaml:"adapter"`
-	HTTP     *HTTPConfig    `yaml:"http"`
-	WebPush  *push.Config   `yaml:"push"`
-	Timezone string         `yaml:"timezone"`
-	DB       string         `yaml:"db"`
+	Name      string               `yaml:"name"`
+	Adapter   map[string]any       `yaml:"adapter"`
+	HTTP      *HTTPConfig          `yaml:"http"`
+	WebPush   *push.Config         `yaml:"push"`
+	Timezone  string               `yaml:"timezone"`
+	Language  string               `yaml:"language"`
+	DB        string               `yaml:"db"`
+	Auth      *auth.Config         `yaml:"auth"`
+	Jobs      *JobsConfig          `yaml:"jobs"`
+	Bookings  *booking.Config      `yaml:"bookings"`
+	Approvals *ApprovalsConfig     `yaml:"approvals"`
+	Passwords *user.PasswordConfig `yaml:"passwords"`
 }
 
 func ConfigDefaults(dbPath string) *Config {
 	return &Config{
-		DB: dbPath,
+		DB:       dbPath,
+		Language: i18n.Spanish,
 		HTTP: &HTTPConfig{
 			Listen:   "localhost:8000",
 			Origin:   "localhost",
 			Protocol: "http",
+			Cookie:   auth.CookieDefaults(),
+			// reverse proxies usually run on the same host
+			TrustedProxies: []string{"127.0.0.0/8", "::1"},
+		},
+		Auth: auth.ConfigDefaults(),
+		Jobs: &JobsConfig{
+			Interval:     time.Hour,
+			LogRetention: 365 * 24 * time.Hour,
+			ExpiredUsers: 0,
+		},
+		Bookings: booking.ConfigDefaults(),
+		Approvals: &ApprovalsConfig{
+			Timeout: 2 * time.Minute,
 		},
+		Passwords: user.PasswordDefaults(),
 	}
 }
 
-type auditLog struct {
-	Timestamp    string `db:"timestamp" json:"timestamp"`
-	User         string `db:"user" json:"user"`
-	SecondFactor bool   `db:"second_factor" json:"second_factor"`
-	Failure      string `db:"failure" json:"failure"`
-	Err          string `db:"error" json:"error"`
-	IpAddress    string `db:"ip_address" json:"ip_address"`
-	UserAgent    string `db:"user_agent" json:"user_agent"`
-}
+// LoadConfig reads the yaml config at path on top of the defaults, using the
+// database at dbPath unless the config names one
+func LoadConfig(path, dbPath string) (*Config, error) {
+	cfg := ConfigDefaults(dbPath)
 
-func newAuditLog(r *http.Request, err error) *auditLog {
-	u := user.FromContext(r)
-	ip := r.RemoteAddr
-	xforward := r.Header.Get("X-Forwarded-For")
-	if xforward != "" {
-		ip = xforward
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("could not unserialize yaml at %s: %w", path, err)
 	}
-	ua := r.Header.Get("user-agent")
-
-	al := &auditLog{
-		Timestamp:    time.Now().UTC().Format(time.RFC3339),
-		User:         u.Handle,
-		SecondFactor: u.Require2FA,
-		IpAddress:    ip,
-		UserAgent:    ua,
+
+	if err := cfg.Jobs.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid jobs config: %w", err)
 	}
 
+	return cfg, nil
+}
+
+// OpenDB connects to the config's database
+func (c *Config) OpenDB() (db.Session, error) {
+	sess, err := sqlite.Open(sqlite.ConnectionURL{
+		Database: c.DB,
+		Options: map[string]string{
+			"_journal":      "WAL",
+			"_busy_timeout": "5000",
+		},
+	})
 	if err != nil {
-		al.Failure = err.Error()
-		if derr, ok := err.(door.Error); ok {
-			al.Err = derr.Name()
-			al.Failure = derr.Error()
-		}
+		return nil, fmt.Errorf("could not open connection to db: %w", err)
 	}
+	return sess, nil
+}
 
-	return al
+// Location returns the house's timezone
+func (c *Config) Location() (*time.Location, error) {
+	if c.Timezone == "" {
+		return time.UTC, nil
+	}
+
+	tz, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown timezone %s", c.Timezone)
+	}
+	return tz, nil
 }
 
 func allowCORS(handler httprouter.Handle) httprouter.Handle {
@@ -112,10 +143,23 @@ func allowCORS(handler httprouter.Handle) httprouter.Handle {
 		input := r.Header
 
 		if input.Get("Access-Control-Request-Method") != "" {
+			origin := input.Get("Origin")
+			allowed := false
+			for _, o := range _origins {
+				allowed = allowed || origin == o
+			}
+
+			if !allowed {
+				logrus.Warnf("refusing cors request from %s", origin)
+				sendStatus(w, r, http.StatusForbidden, nil)
+				return
+			}
+
 			output.Set("Access-Control-Allow-Methods", input.Get("Allow"))
-			output.Set("Access-Control-Allow-Origin", r.Host)
+			output.Set("Access-Control-Allow-Origin", origin)
+			output.Set("Vary", "Origin")
 			output.Set("Access-Control-Allow-Credentials", "true")
-			output.Set("Access-Control-Allow-Headers", "content-type,webauthn")
+			output.Set("Access-Control-Allow-Headers", "authorization,content-type,webauthn,totp,second-factor,csrf-token")
 			output.Set("Access-Control-Expose-Headers", "webauthn")
 			if r.Method == http.MethodOptions {
 				// Set CORS headers
@@ -131,24 +175,27 @@ func allowCORS(handler httprouter.Handle) httprouter.Handle {
 	}
 }
 
-func notifyAdmins(message string) {
-	subs := []*user.Subscription{}
-	err := _db.SQL().
-		SelectFrom("subscription as s").
-		Join("user as u").
-		On(`u.id = s.user and u.receives_notifications and u.is_admin`).
-		All(&subs)
-	if err != nil {
-		logrus.Errorf("could not fetch subscriptions: %s", err)
+// denyEntry tells guests why they cannot come in, i.e. the house being closed
+func denyEntry(w http.ResponseWriter, r *http.Request, u *user.User, err error) {
+	logrus.Errorf("Denying rex to %s: %s", u.Name, err)
+	sendStatus(w, r, http.StatusForbidden, err)
+}
+
+// releaseEntry gives back an entry reserved for a user the door did not open for
+func releaseEntry(u *user.User, now time.Time) {
+	if err := u.ReleaseEntry(_db, now); err != nil {
+		logrus.Errorf("could not release entry for %s: %s", u.Handle, err)
 	}
+}
 
-	logrus.Infof("notifying %v admins", len(subs))
+// spendSingleUse expires single use users once they came in
+func spendSingleUse(u *user.User, now time.Time) {
+	if !u.SingleUse {
+		return
+	}
 
-	for _, sub := range subs {
-		err := push.Notify(message, sub)
-		if err != nil {
-			logrus.Errorf("could not push notification to subscription %s: %s", sub.ID(), err)
-		}
+	if err := _db.Collection("user").Find(db.Cond{"id": u.ID}).Update(map[string]any{"expires": user.NewUTCTime(now)}); err != nil {
+		logrus.Errorf("could not expire single use user %s: %s", u.Handle, err)
 	}
 }
 
@@ -156,33 +203,55 @@ func rex(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	var err error
 	u := user.FromContext(r)
 
-	defer func(req *http.Request, err error) {
-		_, sqlErr := _db.Collection("log").Insert(newAuditLog(req, err))
-		if sqlErr != nil {
-			logrus.Errorf("could not record error log: %s", sqlErr)
+	defer func() {
+		audit.Record(_db, audit.New(r, audit.EventRex, err))
+	}()
+
+	now := time.Now().In(u.Location(TZ))
+	err = u.IsAllowed(_db, now)
+	askApproval := err == user.ErrOutsideSchedule && u.AskApproval
+	if err != nil && !askApproval {
+		denyEntry(w, r, u, err)
+		return
+	}
+
+	if askApproval {
+		// asking uses up no entry, the approval itself does
+		if quotaErr := u.CheckQuota(_db, now); quotaErr != nil {
+			err = quotaErr
+			denyEntry(w, r, u, err)
+			return
 		}
-	}(r, err)
 
-	err = u.IsAllowed(time.Now().In(TZ))
-	if err != nil {
-		logrus.Errorf("Denying rex to %s: %s", u.Name, err)
-		http.Error(w, "Access denied", http.StatusForbidden)
+		// err stays, so the attempt is not counted as an entry
+		requestApproval(w, r, u, now)
+		return
+	}
+
+	// the entry is counted before opening, so concurrent requests can't both
+	// use up the last one
+	if err = u.ReserveEntry(_db, now); err != nil {
+		denyEntry(w, r, u, err)
 		return
 	}
 
 	err = door.RequestToEnter(u.Name)
 
 	if err != nil {
-		message, code := errors.ToHTTP(err)
-		http.Error(w, message, code)
+		releaseEntry(u, now)
+		_, code := errors.ToHTTP(err)
+		sendStatus(w, r, code, err)
 		return
 	}
-	go notifyAdmins(fmt.Sprintf("%s abrió la puerta", u.Name))
+	go push.NotifyAdmins(_db, i18n.NotifyOpened, u.Name)
 
+	spendSingleUse(u, now)
 	fmt.Fprintf(w, `{"status": "ok"}`)
 }
 
 var _db db.Session
+var _origins []string
+var _bookings *booking.Config
 var TZ *time.Location = time.UTC
 
 func Initialize(config *Config) (http.Handler, error) {
@@ -192,23 +261,37 @@ func Initialize(config *Config) (http.Handler, error) {
 		allowCORS(nil)(w, r, nil)
 	})
 
-	if config.Timezone != "" {
-		mtz, err := time.LoadLocation(config.Timezone)
-		if err != nil {
-			return nil, fmt.Errorf("Unknown timezone %s", config.Timezone)
-		}
-		TZ = mtz
+	mtz, err := config.Location()
+	if err != nil {
+		return nil, err
 	}
+	TZ = mtz
 
-	db := sqlite.ConnectionURL{
-		Database: config.DB,
-		Options: map[string]string{
-			"_journal":      "WAL",
-			"_busy_timeout": "5000",
-		},
+	lang, err := i18n.Parse(config.Language)
+	if err != nil {
+		return nil, fmt.Errorf("invalid language: %w", err)
 	}
-	var err error
-	_db, err = sqlite.Open(db)
+	i18n.Default = lang
+
+	if err := config.Bookings.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid bookings config: %w", err)
+	}
+	_bookings = config.Bookings
+
+	if config.Approvals.Timeout <= 0 {
+		return nil, fmt.Errorf("approvals.timeout must be positive")
+	}
+	_approvals = config.Approvals
+
+	if err := user.ConfigurePasswords(config.Passwords); err != nil {
+		return nil, fmt.Errorf("invalid passwords config: %w", err)
+	}
+
+	if err := audit.TrustProxies(config.HTTP.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid http.trusted_proxies: %w", err)
+	}
+
+	_db, err = config.OpenDB()
 	if err != nil {
 		return nil, err
 	}
@@ -217,15 +300,15 @@ func Initialize(config *Config) (http.Handler, error) {
 		return nil, err
 	}
 
-	origins := []string{config.HTTP.Protocol + "://" + config.HTTP.Origin}
+	_origins = []string{config.HTTP.Protocol + "://" + config.HTTP.Origin}
 	if devMode {
-		origins = []string{config.HTTP.Protocol + "://" + config.HTTP.Listen}
+		_origins = []string{config.HTTP.Protocol + "://" + config.HTTP.Listen}
 	}
 
 	wan, err := webauthn.New(&webauthn.Config{
 		RPDisplayName: config.Name,
 		RPID:          strings.Split(config.HTTP.Origin, ":")[0],
-		RPOrigins:     origins,
+		RPOrigins:     _origins,
 	})
 	if err != nil {
 		return nil, err
@@ -233,6 +316,28 @@ func Initialize(config *Config) (http.Handler, error) {
 
 	push.Initialize(config.WebPush)
 
+	if err := config.HTTP.Cookie.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid http.cookie config: %w", err)
+	}
+
+	if config.Auth.TOTP.Issuer == "" {
+		config.Auth.TOTP.Issuer = config.Name
+	}
+
+	_site = &page{Name: config.Name, PushKey: config.WebPush.Key.Public}
+	if _site.Name == "" {
+		_site.Name = "Puerta"
+	}
+
+	if config.Auth.OIDC.Enabled() {
+		if config.Auth.OIDC.RedirectURL == "" {
+			config.Auth.OIDC.RedirectURL = _origins[0] + "/login/oidc/callback"
+		}
+		_site.OIDC = config.Auth.OIDC.Label
+		router.GET("/login/oidc", auth.OIDCLogin)
+		router.GET("/login/oidc/callback", auth.OIDCCallback)
+	}
+
 	var assetRoot http.FileSystem
 	if devMode {
 		pwd, _ := os.Getwd()
@@ -249,18 +354,18 @@ func Initialize(config *Config) (http.Handler, error) {
 
 	mime.AddExtensionType(".webmanifest", "application/manifest+json")
 	router.ServeFiles("/static/*filepath", assetRoot)
-	router.GET("/login", renderTemplate(loginTemplate))
-	router.GET("/", auth.RequireAuthOrRedirect(renderTemplate(indexTemplate), "/login"))
+	router.GET("/login", renderTemplate("login.html"))
+	router.GET("/", auth.RequireAuthOrRedirect(renderTemplate("index.html"), "/login"))
 	router.GET("/admin-serviceworker.js", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		f, err := assetRoot.Open("/admin-serviceworker.js")
 		if err != nil {
-			sendError(w, err)
+			sendError(w, r, err)
 			return
 		}
 
 		buf, err := io.ReadAll(f)
 		if err != nil {
-			sendError(w, err)
+			sendError(w, r, err)
 			return
 		}
 
@@ -268,28 +373,69 @@ func Initialize(config *Config) (http.Handler, error) {
 		w.WriteHeader(200)
 		w.Write(buf)
 	})
-	router.GET("/admin", auth.RequireAdminOrRedirect(renderTemplate(bytes.ReplaceAll(adminTemplate, []byte("$PUSH_KEY$"), []byte(config.WebPush.Key.Public))), "/login?next=/admin"))
+	router.GET("/admin", auth.RequirePermissionOrRedirect(user.PermissionManageGuests, renderTemplate("admin.html"), "/login?next=/admin"))
 
 	// regular api
 	router.POST("/api/login", auth.LoginHandler)
 	router.POST("/api/webauthn/register", auth.RequireAuth(auth.RegisterSecondFactor()))
-	router.POST("/api/rex", allowCORS(auth.Enforce2FA(rex)))
+	router.POST("/api/totp/register", allowCORS(auth.RequireAuth(auth.RegisterTOTP())))
+	router.POST("/api/recovery", allowCORS(auth.RequireAuth(auth.RecoverSecondFactor())))
+	router.POST("/api/rex", allowCORS(auth.RequirePermission(user.PermissionOpenDoor, auth.Enforce2FA(rex))))
+	router.GET("/api/session", allowCORS(auth.RequireAuth(listOwnSessions)))
+	router.DELETE("/api/session", allowCORS(auth.RequireAuth(deleteOwnSessions)))
+	router.DELETE("/api/session/:session", allowCORS(auth.RequireAuth(deleteOwnSessions)))
+	router.GET("/api/schedule", allowCORS(auth.RequireAuth(listOwnWindows)))
+	router.GET("/api/token", allowCORS(auth.RequireAuth(listOwnTokens)))
+	router.POST("/api/token", allowCORS(auth.Enforce2FA(createOwnToken)))
+	router.DELETE("/api/token/:token", allowCORS(auth.RequireAuth(deleteOwnToken)))
+	router.GET("/api/me", allowCORS(auth.RequireAuth(getProfile)))
+	router.POST("/api/me/password", allowCORS(auth.Enforce2FA(changePassword)))
+	router.GET("/api/me/passkeys", allowCORS(auth.RequireAuth(listOwnPasskeys)))
+	router.POST("/api/me/passkeys", allowCORS(auth.AddPasskey()))
+	router.DELETE("/api/me/passkeys/:passkey", allowCORS(auth.Enforce2FA(deleteOwnPasskey)))
+	router.GET("/api/me/history", allowCORS(auth.RequireAuth(listOwnEntries)))
 
 	// admin api
-	router.GET("/api/log", allowCORS(auth.RequireAdmin(rexRecords)))
-	router.GET("/api/user", allowCORS(auth.RequireAdmin(listUsers)))
-	router.GET("/api/user/:id", allowCORS(auth.RequireAdmin(getUser)))
-	router.POST("/api/user", allowCORS(auth.RequireAdmin(auth.Enforce2FA(createUser))))
-	router.POST("/api/user/:id", allowCORS(auth.RequireAdmin(auth.Enforce2FA(updateUser))))
-	router.DELETE("/api/user/:id", allowCORS(auth.RequireAdmin(auth.Enforce2FA(deleteUser))))
-	router.POST("/api/push/subscribe", allowCORS(auth.RequireAdmin(auth.Enforce2FA(createSubscription))))
-	router.POST("/api/push/unsubscribe", allowCORS(auth.RequireAdmin(auth.Enforce2FA(deleteSubscription))))
-
-	return auth.Route(wan, _db, router), nil
-}
-
-func renderTemplate(template []byte) httprouter.Handle {
-	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		w.Write(template)
-	}
+	router.GET("/api/log", allowCORS(auth.RequirePermission(user.PermissionViewLog, rexRecords)))
+	router.GET("/api/audit", allowCORS(auth.RequirePermission(user.PermissionViewLog, adminRecords)))
+	router.GET("/api/user", allowCORS(auth.RequirePermission(user.PermissionManageGuests, listUsers)))
+	router.GET("/api/user/:id", allowCORS(auth.RequirePermission(user.PermissionManageGuests, getUser)))
+	router.POST("/api/user", allowCORS(auth.RequirePermission(user.PermissionManageGuests, auth.Enforce2FA(createUser))))
+	router.POST("/api/user/:id", allowCORS(auth.RequirePermission(user.PermissionManageGuests, auth.Enforce2FA(updateUser))))
+	router.DELETE("/api/user/:id", allowCORS(auth.RequirePermission(user.PermissionManageGuests, auth.Enforce2FA(deleteUser))))
+	router.GET("/api/role", allowCORS(auth.RequirePermission(user.PermissionManageGuests, listRoles)))
+	router.GET("/api/roster", allowCORS(auth.RequirePermission(user.PermissionManageGuests, exportRoster)))
+	router.POST("/api/roster", allowCORS(auth.RequirePermission(user.PermissionManageGuests, auth.Enforce2FA(importRoster))))
+	router.GET("/api/user/:id/policy", allowCORS(auth.RequirePermission(user.PermissionManageGuests, getUserPolicy)))
+	router.GET("/api/group", allowCORS(auth.RequirePermission(user.PermissionManageGuests, listGroups)))
+	router.GET("/api/group/:name", allowCORS(auth.RequirePermission(user.PermissionManageGuests, getGroup)))
+	router.POST("/api/group", allowCORS(auth.RequirePermission(user.PermissionManageGuests, auth.Enforce2FA(createGroup))))
+	router.POST("/api/group/:name", allowCORS(auth.RequirePermission(user.PermissionManageGuests, auth.Enforce2FA(updateGroup))))
+	router.DELETE("/api/group/:name", allowCORS(auth.RequirePermission(user.PermissionManageGuests, auth.Enforce2FA(deleteGroup))))
+	router.POST("/api/group/:name/members", allowCORS(auth.RequirePermission(user.PermissionManageGuests, auth.Enforce2FA(updateMembers))))
+	router.GET("/api/user/:id/sessions", allowCORS(auth.RequirePermission(user.PermissionManageDevices, listUserSessions)))
+	router.DELETE("/api/user/:id/sessions", allowCORS(auth.RequirePermission(user.PermissionManageDevices, auth.Enforce2FA(deleteUserSessions))))
+	router.DELETE("/api/user/:id/sessions/:session", allowCORS(auth.RequirePermission(user.PermissionManageDevices, auth.Enforce2FA(deleteUserSessions))))
+	router.GET("/api/user/:id/schedule", allowCORS(auth.RequirePermission(user.PermissionManageGuests, listUserWindows)))
+	router.GET("/api/user/:id/tokens", allowCORS(auth.RequirePermission(user.PermissionManageGuests, listUserTokens)))
+	router.POST("/api/user/:id/tokens", allowCORS(auth.RequirePermission(user.PermissionManageGuests, auth.Enforce2FA(createUserToken))))
+	router.DELETE("/api/user/:id/tokens/:token", allowCORS(auth.RequirePermission(user.PermissionManageGuests, auth.Enforce2FA(deleteUserToken))))
+	router.GET("/api/bookings", allowCORS(auth.RequirePermission(user.PermissionManageGuests, listBookings)))
+	router.POST("/api/bookings", allowCORS(auth.RequirePermission(user.PermissionManageGuests, auth.Enforce2FA(importBookings))))
+	router.GET("/api/house", allowCORS(auth.RequirePermission(user.PermissionManageGuests, listHouseEvents)))
+	router.POST("/api/house", allowCORS(auth.RequirePermission(user.PermissionManageGuests, auth.Enforce2FA(createHouseEvent))))
+	router.DELETE("/api/house/:id", allowCORS(auth.RequirePermission(user.PermissionManageGuests, auth.Enforce2FA(deleteHouseEvent))))
+	router.GET("/api/approval", allowCORS(auth.RequirePermission(user.PermissionManageGuests, listApprovals)))
+	router.GET("/api/approval/:id", allowCORS(auth.RequireAuth(getApproval)))
+	router.POST("/api/approval/:id", allowCORS(auth.RequirePermission(user.PermissionManageGuests, auth.Enforce2FA(decideApproval))))
+	router.GET("/api/jobs", allowCORS(auth.RequirePermission(user.PermissionManageDevices, listJobs)))
+	router.POST("/api/jobs/:name", allowCORS(auth.RequirePermission(user.PermissionManageDevices, auth.Enforce2FA(runJob))))
+	router.POST("/api/push/subscribe", allowCORS(auth.RequirePermission(user.PermissionViewLog, auth.Enforce2FA(createSubscription))))
+	router.POST("/api/push/unsubscribe", allowCORS(auth.RequirePermission(user.PermissionViewLog, auth.Enforce2FA(deleteSubscription))))
+
+	// start jobs last, so they don't keep running if anything above fails
+	scheduler = NewScheduler(config, _db)
+	scheduler.Start()
+
+	return auth.Route(wan, _db, config.Auth, config.HTTP.Cookie, router), nil
 }
@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package server
+
+import (
+	"net/http"
+
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/auth"
+	"git.rob.mx/nidito/puerta/internal/constants"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
+)
+
+func writeSessions(w http.ResponseWriter, r *http.Request, u *user.User) {
+	sessions, err := auth.ListSessions(_db, u.ID)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	current, _ := r.Context().Value(constants.ContextSession).(string)
+	for _, s := range sessions {
+		s.Current = s.ID == current
+	}
+
+	writeJSON(w, sessions)
+}
+
+func revokeSessions(w http.ResponseWriter, r *http.Request, u *user.User, id string) {
+	var err error
+	if id == "" {
+		err = auth.RevokeSessions(_db, u.ID)
+	} else {
+		err = auth.RevokeSession(_db, u.ID, id)
+	}
+
+	if err != nil {
+		if err == db.ErrNoMoreRows {
+			sendStatus(w, r, http.StatusNotFound, nil)
+			return
+		}
+		sendError(w, r, err)
+		return
+	}
+
+	logrus.Infof("Revoked sessions for %s (%s)", u.Handle, id)
+	revoked := id
+	if revoked == "" {
+		revoked = "all"
+	}
+	audit.RecordAdmin(_db, audit.NewAdmin(r, audit.ActionUserSessions, u.Handle, map[string]string{"sessions": revoked}, nil))
+	current, _ := r.Context().Value(constants.ContextSession).(string)
+	if self := user.FromContext(r); self != nil && self.ID == u.ID && (id == "" || id == current) {
+		auth.ClearSessionCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listOwnSessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeSessions(w, r, user.FromContext(r))
+}
+
+func deleteOwnSessions(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	revokeSessions(w, r, user.FromContext(r), params.ByName("session"))
+}
+
+func listUserSessions(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	u := &user.User{}
+	if err := _db.Get(u, db.Cond{"handle": params.ByName("id")}); err != nil {
+		sendStatus(w, r, http.StatusNotFound, nil)
+		return
+	}
+
+	writeSessions(w, r, u)
+}
+
+func deleteUserSessions(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	u := &user.User{}
+	if err := _db.Get(u, db.Cond{"handle": params.ByName("id")}); err != nil {
+		sendStatus(w, r, http.StatusNotFound, nil)
+		return
+	}
+
+	revokeSessions(w, r, u, params.ByName("session"))
+}
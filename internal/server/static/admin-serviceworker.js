@@ -7,5 +7,37 @@ self.addEventListener('push', (event) => {
   let notification = event.data.text();
   console.log(`got notification: ${notification}`)
   console.log(`evt: `, event)
-  self.registration.showNotification(notification);
+
+  let title = notification
+  let options = {}
+  try {
+    const payload = JSON.parse(notification)
+    if (payload && payload.title) {
+      title = payload.title
+      options = {
+        body: payload.body,
+        tag: payload.tag,
+        actions: payload.actions || [],
+        data: payload.data || {},
+        requireInteraction: !!payload.actions,
+      }
+    }
+  } catch {}
+
+  event.waitUntil(self.registration.showNotification(title, options));
+});
+
+self.addEventListener('notificationclick', (event) => {
+  event.notification.close()
+  const approval = (event.notification.data || {}).approval
+  if (!approval) {
+    return
+  }
+
+  // the admin page decides, since it can go through 2FA
+  let url = `/admin?approval=${encodeURIComponent(approval)}`
+  if (event.action == "approve" || event.action == "deny") {
+    url += `&decision=${event.action}`
+  }
+  event.waitUntil(self.clients.openWindow(url))
 });
@@ -1,6 +1,7 @@
 // SPDX-License-Identifier: Apache-2.0
 // Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
 import * as webauthn from "./webauthn.js"
+import { t, errorMessage } from "./i18n.js"
 
 const host = document.location.protocol + "//" + document.location.host
 // const host = "http://localhost:8081"
@@ -35,15 +36,25 @@ class UserInfoPanel extends HTMLElement {
     if (this.hasAttribute('expires')){
       panel.querySelector('input[name=expires]').value = localDate(this.getAttribute("expires"))
     }
-    if (this.hasAttribute("is_admin")) {
-      const adminSpan = document.createElement("span")
-      adminSpan.innerText = "🔑"
-      panel.querySelector(".user-info-meta").prepend(adminSpan)
+    if (this.getAttribute("role") != "guest") {
+      const roleSpan = document.createElement("span")
+      roleSpan.innerText = this.getAttribute("role") == "admin" ? "🔑" : "🗝️"
+      roleSpan.title = this.getAttribute("role")
+      panel.querySelector(".user-info-meta").prepend(roleSpan)
     }
     panel.querySelector('input[name=max_ttl]').value = this.getAttribute("max_ttl")
-    panel.querySelector('input[name=is_admin]').checked = this.hasAttribute("is_admin")
+    panel.querySelector('input[name=max_sessions]').value = this.getAttribute("max_sessions") || 0
+    panel.querySelector('input[name=max_entries]').value = this.getAttribute("max_entries") || 0
+    panel.querySelector('input[name=max_daily_entries]').value = this.getAttribute("max_daily_entries") || 0
+    panel.querySelector('input[name=max_window_entries]').value = this.getAttribute("max_window_entries") || 0
+    panel.querySelector('input[name=timezone]').value = this.getAttribute("timezone") || ""
+    panel.querySelector('select[name=locale]').value = this.getAttribute("locale") || ""
+    panel.querySelector('select[name=role]').value = this.getAttribute("role")
     panel.querySelector('input[name=second_factor]').checked = this.hasAttribute("second_factor")
+    panel.querySelector('input[name=allow_totp]').checked = this.hasAttribute("allow_totp")
     panel.querySelector('input[name=receives_notifications]').checked = this.hasAttribute("receives_notifications")
+    panel.querySelector('input[name=single_use]').checked = this.hasAttribute("single_use")
+    panel.querySelector('input[name=ask_approval]').checked = this.hasAttribute("ask_approval")
     panel.querySelector("button.user-edit").addEventListener('click', evt => {
       form.classList.toggle("hidden")
       this.classList.toggle("editing")
@@ -51,19 +62,24 @@ class UserInfoPanel extends HTMLElement {
 
     form.addEventListener("submit", async (evt) => {
       evt.preventDefault()
-      await UpdateUser(form)
+      try {
+        await UpdateUser(form)
+      } catch(err) {
+        alert(err.message)
+      }
     })
 
     panel.querySelector("button.user-delete").addEventListener('click', async evt => {
       evt.preventDefault()
-      if (confirm(`Seguro que borramos a ${handle}?`)) {
+      if (confirm(t("js.delete-user", handle))) {
         let response = await webauthn.withAuth(`${host}/api/user/${handle}`, {
           credentials: "include",
           method: "DELETE"
         })
 
         if (!response.ok) {
-          throw new Error("Could not delete user:", response)
+          alert(await errorMessage(response))
+          return
         }
 
         window.location.reload()
@@ -83,7 +99,7 @@ class REXRow extends HTMLElement {
 
     row.querySelector('.log-record-timestamp').innerText = localDate(rex.timestamp)
     row.querySelector('.log-record-user').innerText = rex.user
-    row.querySelector('.log-record-status').innerHTML = !rex.error ? "ok" : `<strong>${rex.error}</strong> ${rex.failure}`
+    row.querySelector('.log-record-status').innerHTML = !rex.error ? `ok ${rex.detail || ""}` : `<strong>${rex.error}</strong> ${rex.failure}`
     row.querySelector('.log-record-second_factor').innerText = rex.second_factor ? "✓" : ""
     row.querySelector('.log-record-ip_address').innerText = rex.ip_address
     row.querySelector('.log-record-user_agent').innerText = rex.user_agent
@@ -93,12 +109,38 @@ class REXRow extends HTMLElement {
 }
 customElements.define("rex-record", REXRow, {extends: "tr"})
 
+async function fetchRoles() {
+  console.debug("fetching roles")
+  let response = await window.fetch(`${host}/api/role`, {credentials: "include"})
+
+  if (!response.ok) {
+    alert(t("js.load-failed"))
+    return
+  }
+
+  let roles = await response.json()
+  const selects = [
+    document.querySelector("#create-user select[name=role]"),
+    document.getElementById("user-info-panel").content.querySelector("select[name=role]"),
+  ]
+  selects.forEach(select => {
+    select.replaceChildren(...roles.map(role => {
+      const option = document.createElement("option")
+      option.value = role.name
+      option.innerText = role.name
+      option.title = role.description
+      option.selected = role.name == "guest"
+      return option
+    }))
+  })
+}
+
 async function fetchUsers() {
   console.debug("fetching users")
   let response = await window.fetch(`${host}/api/user`, {credentials: "include"})
 
   if (!response.ok) {
-    alert("Could not load users")
+    alert(t("js.load-failed"))
     return
   }
 
@@ -127,7 +169,7 @@ async function fetchLog() {
   let response = await window.fetch(`${host}/api/log?last=20`, {credentials: "include"})
 
   if (!response.ok) {
-    alert("Could not load log")
+    alert(t("js.load-failed"))
     return
   }
 
@@ -144,7 +186,10 @@ async function fetchLog() {
     tr.classList.add("rex-staus-" + (!rex.error ? "ok" : "failure"))
     tr.classList.add("rex-record")
 
-    const status = !rex.error ? "ok" : `<strong>${rex.error}</strong> ${rex.failure}`
+    let status = !rex.error ? `ok ${rex.detail || ""}` : `<strong>${rex.error}</strong> ${rex.failure}`
+    if (rex.event && rex.event != "rex") {
+      status = `<em>${rex.event}</em> ${status}`
+    }
     tr.innerHTML = `<th class="log-record-timestamp">${localDate(rex.timestamp)}</th>
     <td class="log-record-user">${rex.user}</td>
     <td class="log-record-status">${status}</td>
@@ -171,13 +216,25 @@ function userFromForm(form) {
     delete(user.max_ttl)
   }
 
+  if (user.max_sessions == "") {
+    delete(user.max_sessions)
+  } else {
+    user.max_sessions = parseInt(user.max_sessions, 10)
+  }
+
+  for (const quota of ["max_entries", "max_daily_entries", "max_window_entries"]) {
+    user[quota] = parseInt(user[quota] || "0", 10)
+  }
+
   if (user.schedule == "") {
     delete(user.schedule)
   }
 
-  user.is_admin = user.is_admin == "on"
   user.second_factor = user.second_factor == "on"
+  user.allow_totp = user.allow_totp == "on"
   user.receives_notifications = user.receives_notifications == "on"
+  user.single_use = user.single_use == "on"
+  user.ask_approval = user.ask_approval == "on"
   return user
 }
 
@@ -194,7 +251,7 @@ async function UpdateUser(form) {
   })
 
   if (!response.ok) {
-    throw new Error("Could not update user:", response)
+    throw new Error(await errorMessage(response))
   }
 
   window.location.reload()
@@ -213,7 +270,7 @@ async function CreateUser(form) {
   })
 
   if (!response.ok) {
-    throw new Error("Could not create user:", response)
+    throw new Error(await errorMessage(response))
   }
   form.reset()
   window.location.hash = "#invitades"
@@ -230,7 +287,7 @@ async function CreateSubscription(subData) {
   })
 
   if (!response.ok) {
-    throw new Error("Could not create subscription:", response)
+    throw new Error(await errorMessage(response))
   }
 }
 
@@ -245,10 +302,65 @@ async function DeleteSubscription(subData) {
   })
 
   if (!response.ok) {
-    throw new Error("Could not delete subscription:", response)
+    throw new Error(await errorMessage(response))
+  }
+}
+
+async function DecideApproval(id, approve) {
+  let response = await webauthn.withAuth(`${host}/api/approval/${encodeURIComponent(id)}`, {
+    credentials: "include",
+    method: "POST",
+    body: JSON.stringify({approve}),
+    headers: {
+      'Content-Type': 'application/json'
+    }
+  })
+
+  if (!response.ok) {
+    throw new Error(await errorMessage(response))
   }
 }
 
+// handleApproval decides on the approval linked from a push notification
+async function handleApproval() {
+  const params = new URLSearchParams(window.location.search)
+  const id = params.get("approval")
+  if (!id) {
+    return
+  }
+  window.history.replaceState(null, "", window.location.pathname + window.location.hash)
+
+  let response = await window.fetch(`${host}/api/approval/${encodeURIComponent(id)}`, {credentials: "include"})
+  if (!response.ok) {
+    alert(t("js.approval-not-found"))
+    return
+  }
+
+  const approval = await response.json()
+  if (approval.status != "pending") {
+    alert(t("js.approval-settled", approval.handle, approval.status))
+    return
+  }
+
+  let approve
+  switch (params.get("decision")) {
+    case "approve":
+      approve = true
+      break
+    case "deny":
+      approve = false
+      break
+    default:
+      approve = confirm(t("js.approval-confirm", approval.handle))
+  }
+
+  try {
+    await DecideApproval(id, approve)
+    alert(t(approve ? "js.approval-done-approve" : "js.approval-done-deny", approval.handle))
+  } catch(err) {
+    alert(t("js.approval-decision-error", err.message))
+  }
+}
 
 async function switchTab() {
   let tabName = window.location.hash.toLowerCase().replace("#", "")
@@ -286,10 +398,16 @@ window.addEventListener("load", async function() {
   const form = document.querySelector("#create-user")
   form.addEventListener("submit", async (evt) => {
     evt.preventDefault()
-    await CreateUser(form)
+    try {
+      await CreateUser(form)
+    } catch(err) {
+      alert(err.message)
+    }
   })
 
+  await fetchRoles()
   switchTab()
+  handleApproval()
 
   const pnb = document.querySelector("#push-notifications")
 
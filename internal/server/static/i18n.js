@@ -0,0 +1,22 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+
+// t renders one of the messages the server hands pages, in the user's language
+export function t(key, ...args) {
+  let message = (window._strings || {})[key] || key
+  for (const arg of args) {
+    message = message.replace(/%[sd]/, () => arg)
+  }
+  return message
+}
+
+// errorMessage reads the message out of an api error, falling back to its status
+export async function errorMessage(response) {
+  try {
+    const json = await response.json()
+    if (json.message) {
+      return json.message
+    }
+  } catch {}
+  return response.statusText
+}
@@ -3,6 +3,7 @@
 const button = document.querySelector("#open button")
 const form = document.querySelector("#open")
 import * as webauthn from "./webauthn.js"
+import { t, errorMessage } from "./i18n.js"
 
 const host = document.location.protocol + "//" + document.location.host
 // const host = "http://localhost:8081"
@@ -15,15 +16,7 @@ async function RequestToEnter() {
   })
 
   if (!response.ok) {
-    let message = response.statusText
-    try {
-      let json = await response.json()
-      if (json.message) {
-        message = `${message}: ${json.message}`
-      }
-    } catch {}
-
-    throw new Error(message);
+    throw new Error(await errorMessage(response));
   }
 
   let json = {}
@@ -35,9 +28,46 @@ async function RequestToEnter() {
     console.debug("Door opened")
   }
 
+  if (json.status == "pending") {
+    form.classList.add("requested")
+    showStatus(json.message)
+    await waitForApproval(json.approval)
+  }
+
   return response.status
 }
 
+const sleep = (ms) => new Promise(resolve => setTimeout(resolve, ms))
+
+// waitForApproval follows an approval until someone decides on it or it expires
+async function waitForApproval(approval) {
+  while (approval.status == "pending") {
+    await sleep(3000)
+    let response = await window.fetch(`${host}/api/approval/${approval.id}`, {credentials: "include"})
+    if (!response.ok) {
+      throw new Error(t("js.approval-failed"))
+    }
+    approval = await response.json()
+  }
+
+  switch (approval.status) {
+    case "approved":
+      showStatus(t("js.approval-approved"))
+      return
+    case "denied":
+      throw new Error(t("js.approval-denied"))
+    default:
+      throw new Error(t("js.approval-expired"))
+  }
+}
+
+
+const status = document.querySelector("#status")
+
+function showStatus(message) {
+  status.innerText = message
+  status.classList.remove("hidden")
+}
 
 function clearStatus() {
   form.classList.remove("failed")
@@ -49,11 +79,13 @@ button.addEventListener("click", function(evt){
   button.disabled = true
 
   clearStatus()
+  status.classList.add("hidden")
 
   RequestToEnter().then(() => {
     form.classList.add("success")
   }).catch((err) => {
     form.classList.add("failed")
+    showStatus(err.message)
     console.error(`Error: ${err}`)
   }).finally(() => {
     form.classList.remove("requested")
@@ -63,3 +95,18 @@ button.addEventListener("click", function(evt){
 
   return false
 })
+
+document.querySelector("#recover").addEventListener("click", async function(evt){
+  evt.preventDefault()
+  const code = prompt(t("js.recovery-prompt"))
+  if (!code) {
+    return
+  }
+
+  try {
+    await webauthn.recover(code)
+    alert(t("js.recovery-done"))
+  } catch(err) {
+    alert(err.message)
+  }
+})
@@ -3,16 +3,27 @@
 const button = document.querySelector("#auth")
 const form = document.querySelector("#login")
 
+function csrfToken() {
+  const cookie = document.cookie.split("; ").find((c) => c.split("=")[0].endsWith("_puerta_csrf"))
+  return cookie ? cookie.split("=")[1] : ""
+}
+
 async function Login() {
   const response = await window.fetch(`/api/login`, {
     method: 'POST',
     body: new URLSearchParams(new FormData(form)),
+    headers: {
+      'csrf-token': csrfToken()
+    }
   })
 
   if (!response.ok) {
     let message = response.statusText
     try {
-      message = await response.text()
+      const json = await response.json()
+      if (json.message) {
+        message = json.message
+      }
     } catch {}
 
     throw new Error(message);
@@ -60,3 +71,8 @@ function submit(evt){
 
 button.addEventListener("click", submit)
 form.addEventListener("submit", submit)
+
+const oidc = document.querySelector("#oidc")
+if (oidc && window.location.search != "") {
+  oidc.href += window.location.search
+}
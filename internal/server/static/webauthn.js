@@ -1,6 +1,7 @@
 // SPDX-License-Identifier: Apache-2.0
 // Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
 import * as webauthnJSON from 'https://unpkg.com/@github/webauthn-json@2.0.2/dist/esm/webauthn-json.browser-ponyfill.js'
+import { t, errorMessage } from "./i18n.js"
 const charsToEncode = /[\u007f-\uffff]/g;
 function JSONtob64(data) {
   return btoa(JSON.stringify(data).replace(charsToEncode, (c) => '\\u'+('000'+c.charCodeAt(0).toString(16)).slice(-4)))
@@ -10,7 +11,25 @@ function b64ToJSON(encoded) {
   return JSON.parse(decodeURIComponent(atob(encoded).split('').map((c) => '%' + ('00' + c.charCodeAt(0).toString(16)).slice(-2)).join('')))
 }
 
+// csrfToken returns the token the server sets in a cookie, to send it back as a header
+export function csrfToken() {
+  const cookie = document.cookie.split("; ").find((c) => c.split("=")[0].endsWith("_puerta_csrf"))
+  return cookie ? cookie.split("=")[1] : ""
+}
+
+function withCSRF(config) {
+  config.headers = config.headers || {}
+  config.headers["csrf-token"] = csrfToken()
+  return config
+}
+
 export async function withAuth(target, config) {
+  withCSRF(config)
+  if (!window.PublicKeyCredential) {
+    // no passkeys here, ask the server for totp instead
+    config.headers = config.headers || {}
+    config.headers["second-factor"] = "totp"
+  }
   console.log(`webauthn: issuing api request: ${target}`)
   const response = await window.fetch(target, config)
   console.debug(`webauthn: issued api request: ${target}`)
@@ -56,6 +75,13 @@ export async function withAuth(target, config) {
     return await new Promise((res,rej) => {
       return login(challenge, target, config).then(res).catch(rej)
     })
+  } else if (step == "totp-register") {
+    // server told us to enroll an authenticator app
+    await registerTOTP(challenge)
+    return await withAuth(target, config)
+  } else if (step == "totp") {
+    // server told us to send a code from the authenticator app
+    return await loginTOTP(target, config)
   }
 
   throw `Unknown webauthn step: <${step}>`
@@ -80,28 +106,21 @@ async function register(challenge) {
   }
   console.debug(`webauthn: registering credentials with server: ${JSON.stringify(credential)}`)
 
-  let response = await window.fetch("/api/webauthn/register", {
+  let response = await window.fetch("/api/webauthn/register", withCSRF({
     credentials: "include",
     method: "POST",
     body: JSON.stringify(credential),
     headers: {
       'Content-type': 'application/json'
     }
-  })
+  }))
 
   if (!response.ok) {
-    let message = response.statusText
-    try {
-      let json = await response.json()
-      if (json.message) {
-        message = `${message}: ${json.message}`
-      }
-    } catch {}
-
-    throw new Error(`webauthn: failed to register credentials: ${message}`);
+    throw new Error(await errorMessage(response));
   }
 
   console.info("webauthn: created credentials")
+  await showRecoveryCodes(response)
 }
 
 async function login(challenge, target, config) {
@@ -129,17 +148,102 @@ async function login(challenge, target, config) {
   let response = await window.fetch(target, config)
 
   if (!response.ok) {
-    let message = response.statusText
-    try {
-      let json = await response.json()
-      if (json.message) {
-        message = `${message}: ${json.message}`
+    throw new Error(await errorMessage(response));
+  }
+
+  console.info("webauthn: sucessfully sent authenticated request")
+  return response
+}
+
+function askForCode(message, qr) {
+  return new Promise((res, rej) => {
+    const dialog = document.createElement("dialog")
+    dialog.innerHTML = `<form method="dialog">
+      <p></p>
+      <input name="code" inputmode="numeric" autocomplete="one-time-code" pattern="[0-9]*" required />
+      <button type="submit">OK</button>
+    </form>`
+    dialog.querySelector("p").innerText = message
+    if (qr) {
+      const img = document.createElement("img")
+      img.src = qr
+      dialog.querySelector("form").prepend(img)
+    }
+
+    dialog.addEventListener("close", () => {
+      const code = dialog.querySelector("input").value
+      dialog.remove()
+      if (code == "") {
+        rej(new Error("totp: no code entered"))
+        return
       }
-    } catch {}
+      res(code)
+    })
+    document.body.appendChild(dialog)
+    dialog.showModal()
+  })
+}
+
+async function registerTOTP(challenge) {
+  console.info("totp: enrolling authenticator app")
+  const code = await askForCode(t("js.totp-enroll"), challenge.qr)
+
+  let response = await window.fetch("/api/totp/register", withCSRF({
+    credentials: "include",
+    method: "POST",
+    body: JSON.stringify({code}),
+    headers: {
+      'Content-type': 'application/json'
+    }
+  }))
 
-    throw new Error(`webauthn: got error from authenticated request: ${message}`);
+  if (!response.ok) {
+    throw new Error(await errorMessage(response));
+  }
+
+  console.info("totp: registered authenticator")
+  await showRecoveryCodes(response)
+}
+
+async function showRecoveryCodes(response) {
+  try {
+    const json = await response.json()
+    if (json.recovery_codes) {
+      alert(`${t("js.recovery-codes")}\n\n${json.recovery_codes.join("\n")}`)
+    }
+  } catch(err) {
+    console.error(`could not read recovery codes: ${err}`)
+  }
+}
+
+export async function recover(code) {
+  const response = await window.fetch("/api/recovery", withCSRF({
+    credentials: "include",
+    method: "POST",
+    body: JSON.stringify({code}),
+    headers: {
+      'Content-type': 'application/json'
+    }
+  }))
+
+  if (!response.ok) {
+    throw new Error(await errorMessage(response))
+  }
+}
+
+async function loginTOTP(target, config) {
+  const code = await askForCode(t("js.totp-code"))
+
+  config.credentials = "include"
+  config.headers = config.headers || {}
+  config.headers.totp = code
+
+  console.info(`totp: issuing authenticated request to ${target}`)
+  let response = await window.fetch(target, config)
+
+  if (!response.ok) {
+    throw new Error(await errorMessage(response));
   }
 
-  console.info("webauthn: sucessfully sent authenticated request")
   return response
 }
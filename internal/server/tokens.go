@@ -0,0 +1,151 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/audit"
+	"git.rob.mx/nidito/puerta/internal/auth"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
+)
+
+type tokenRequest struct {
+	Name             string     `json:"name"`
+	Scopes           []string   `json:"scopes"`
+	Expires          *time.Time `json:"expires"`
+	SkipSecondFactor bool       `json:"skip_second_factor"`
+}
+
+func createToken(w http.ResponseWriter, r *http.Request, u *user.User) {
+	if auth.TokenFromContext(r) != nil {
+		sendStatus(w, r, http.StatusForbidden, fmt.Errorf("api tokens cannot create other tokens"))
+		return
+	}
+
+	req := &tokenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		sendStatus(w, r, http.StatusBadRequest, fmt.Errorf("could not decode token request: %s", err))
+		return
+	}
+
+	scopes := []auth.Scope{}
+	for _, name := range req.Scopes {
+		scope, err := auth.ParseScope(name)
+		if err != nil {
+			sendStatus(w, r, http.StatusBadRequest, err)
+			return
+		}
+		scopes = append(scopes, scope)
+	}
+
+	if req.Expires != nil && req.Expires.Before(time.Now()) {
+		sendStatus(w, r, http.StatusBadRequest, fmt.Errorf("expires must be in the future"))
+		return
+	}
+
+	creator := user.FromContext(r)
+	token, err := auth.NewAPIToken(_db, u, creator, req.Name, scopes, req.Expires, req.SkipSecondFactor)
+	if err != nil {
+		logrus.Errorf("could not create token for %s: %s", u.Handle, err)
+		sendStatus(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	entry := audit.New(r, audit.EventToken, nil)
+	entry.Detail = fmt.Sprintf("created %s token %s (%s) for %s with scopes %v, skipping 2fa: %v", token.Kind, token.ID, token.Name, u.Handle, token.Scopes, token.SkipSecondFactor)
+	audit.Record(_db, entry)
+
+	if u.ID != creator.ID {
+		logged := *token
+		logged.Token = ""
+		audit.RecordAdmin(_db, audit.NewAdmin(r, audit.ActionTokenCreate, u.Handle, nil, &logged))
+	}
+
+	// the only time the token is ever shown
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(token); err != nil {
+		logrus.Errorf("could not write token: %s", err)
+	}
+}
+
+func revokeToken(w http.ResponseWriter, r *http.Request, u *user.User, id string) {
+	if err := auth.RevokeAPIToken(_db, u.ID, id); err != nil {
+		if err == db.ErrNoMoreRows {
+			sendStatus(w, r, http.StatusNotFound, nil)
+			return
+		}
+		sendError(w, r, err)
+		return
+	}
+
+	entry := audit.New(r, audit.EventToken, nil)
+	entry.Detail = fmt.Sprintf("revoked token %s for %s", id, u.Handle)
+	audit.Record(_db, entry)
+
+	if u.ID != user.FromContext(r).ID {
+		audit.RecordAdmin(_db, audit.NewAdmin(r, audit.ActionTokenRevoke, u.Handle, map[string]string{"id": id}, nil))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeTokens(w http.ResponseWriter, r *http.Request, u *user.User) {
+	tokens, err := auth.ListAPITokens(_db, u.ID)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	writeJSON(w, tokens)
+}
+
+func listOwnTokens(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeTokens(w, r, user.FromContext(r))
+}
+
+func createOwnToken(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	createToken(w, r, user.FromContext(r))
+}
+
+func deleteOwnToken(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	revokeToken(w, r, user.FromContext(r), params.ByName("token"))
+}
+
+// managedUser finds the user in the request's path, responding with an error
+// unless the request's user can manage them
+func managedUser(w http.ResponseWriter, r *http.Request, params httprouter.Params) *user.User {
+	u := &user.User{}
+	if err := _db.Get(u, db.Cond{"handle": params.ByName("id")}); err != nil {
+		sendStatus(w, r, http.StatusNotFound, nil)
+		return nil
+	}
+
+	if !canManageUser(w, r, u) {
+		return nil
+	}
+	return u
+}
+
+func listUserTokens(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if u := managedUser(w, r, params); u != nil {
+		writeTokens(w, r, u)
+	}
+}
+
+func createUserToken(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if u := managedUser(w, r, params); u != nil {
+		createToken(w, r, u)
+	}
+}
+
+func deleteUserToken(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if u := managedUser(w, r, params); u != nil {
+		revokeToken(w, r, u, params.ByName("token"))
+	}
+}
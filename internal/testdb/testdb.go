@@ -0,0 +1,47 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+
+// Package testdb opens throwaway databases for tests
+package testdb
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/upper/db/v4"
+	"github.com/upper/db/v4/adapter/sqlite"
+)
+
+// Open returns an empty database with the current schema, removed once the test is done
+func Open(t testing.TB) db.Session {
+	t.Helper()
+	_, file, _, _ := runtime.Caller(0)
+	schema, err := os.ReadFile(filepath.Join(filepath.Dir(file), "..", "..", "schema.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := sqlite.Open(sqlite.ConnectionURL{
+		Database: t.TempDir() + "/puerta.db",
+		// tests write from several goroutines at once
+		Options: map[string]string{"_busy_timeout": "5000"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sess.Close() })
+
+	for _, stmt := range strings.Split(string(schema), ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+
+		if _, err := sess.SQL().Exec(stmt); err != nil {
+			t.Fatalf("could not apply schema: %s\n%s", err, stmt)
+		}
+	}
+	return sess
+}
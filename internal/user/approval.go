@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package user
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/i18n"
+	"github.com/upper/db/v4"
+)
+
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalDenied   = "denied"
+	ApprovalExpired  = "expired"
+)
+
+// ErrOutsideSchedule is returned by IsAllowed when the user's schedule keeps them out
+var ErrOutsideSchedule = i18n.Errorf(i18n.OutsideSchedule)
+
+// Approval is a request to come in outside of a user's schedule, waiting for
+// someone that manages them to approve or deny it before it expires
+type Approval struct {
+	ID        string     `db:"id" json:"id"`
+	UserID    int        `db:"user" json:"-"`
+	Handle    string     `db:"handle" json:"handle"`
+	Status    string     `db:"status" json:"status"`
+	Created   time.Time  `db:"created" json:"created"`
+	Expires   time.Time  `db:"expires" json:"expires"`
+	DecidedBy string     `db:"decided_by" json:"decided_by,omitempty"`
+	Decided   *time.Time `db:"decided" json:"decided,omitempty"`
+}
+
+func (a *Approval) Store(sess db.Session) db.Store {
+	return sess.Collection("approval")
+}
+
+// StatusAt returns the approval's status at t, pending approvals expire on their own
+func (a *Approval) StatusAt(t time.Time) string {
+	if a.Status == ApprovalPending && !t.Before(a.Expires) {
+		return ApprovalExpired
+	}
+	return a.Status
+}
+
+// NewApproval stores a pending approval for a user, expiring after timeout
+func NewApproval(sess db.Session, u *User, now time.Time, timeout time.Duration) (*Approval, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	a := &Approval{
+		ID:      hex.EncodeToString(id),
+		UserID:  u.ID,
+		Handle:  u.Handle,
+		Status:  ApprovalPending,
+		Created: now.UTC(),
+		Expires: now.Add(timeout).UTC(),
+	}
+
+	if _, err := sess.Collection("approval").Insert(a); err != nil {
+		return nil, fmt.Errorf("could not store approval for %s: %w", u.Handle, err)
+	}
+	return a, nil
+}
+
+// RequestApproval returns the user's approval still pending at now, or stores a
+// new one if there is none, telling if it did
+func RequestApproval(sess db.Session, u *User, now time.Time, timeout time.Duration) (*Approval, bool, error) {
+	pending := &Approval{}
+	err := sess.Collection("approval").
+		Find(db.Cond{"user": u.ID, "status": ApprovalPending, "expires >": now.UTC()}).
+		OrderBy("-expires").
+		One(pending)
+	if err == nil {
+		return pending, false, nil
+	} else if err != db.ErrNoMoreRows {
+		return nil, false, err
+	}
+
+	a, err := NewApproval(sess, u, now, timeout)
+	return a, err == nil, err
+}
+
+// FetchApproval finds an approval by id
+func FetchApproval(sess db.Session, id string) (*Approval, error) {
+	a := &Approval{}
+	if err := sess.Get(a, db.Cond{"id": id}); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ListApprovals returns the approvals still pending at t, oldest first
+func ListApprovals(sess db.Session, t time.Time) ([]*Approval, error) {
+	approvals := []*Approval{}
+	err := sess.Collection("approval").Find(db.Cond{"status": ApprovalPending, "expires >": t.UTC()}).OrderBy("created").All(&approvals)
+	return approvals, err
+}
+
+// settle moves a pending approval to status, telling if it was still pending
+func (a *Approval) settle(sess db.Session, status string, cond db.Cond, fields map[string]any) (bool, error) {
+	fields["status"] = status
+	cond["id"] = a.ID
+	cond["status"] = ApprovalPending
+	res, err := sess.SQL().Update("approval").Set(fields).Where(cond).Exec()
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil || affected == 0 {
+		return false, err
+	}
+	a.Status = status
+	return true, nil
+}
+
+// Decide approves or denies a pending approval on behalf of actor, telling
+// if it was still pending and unexpired
+func (a *Approval) Decide(sess db.Session, actor *User, approve bool, now time.Time) (bool, error) {
+	status := ApprovalDenied
+	if approve {
+		status = ApprovalApproved
+	}
+
+	decided := now.UTC()
+	ok, err := a.settle(sess, status, db.Cond{"expires >": decided}, map[string]any{"decided_by": actor.Handle, "decided": decided})
+	if ok {
+		a.DecidedBy = actor.Handle
+		a.Decided = &decided
+	}
+	return ok, err
+}
+
+// Expire marks a pending approval past its expiration as expired, telling if
+// it just did, so it's only recorded once
+func (a *Approval) Expire(sess db.Session, now time.Time) (bool, error) {
+	return a.settle(sess, ApprovalExpired, db.Cond{"expires <=": now.UTC()}, map[string]any{})
+}
+
+var _ db.Record = &Approval{}
@@ -0,0 +1,134 @@
+package user_test
+
+import (
+	"testing"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/testdb"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/upper/db/v4"
+)
+
+func TestApprovalStatusAt(t *testing.T) {
+	approval := &user.Approval{Status: user.ApprovalPending, Created: at(21, "18:00"), Expires: at(21, "18:02")}
+	if status := approval.StatusAt(at(21, "18:01")); status != user.ApprovalPending {
+		t.Fatalf("expected approval to be pending, got %s", status)
+	}
+
+	if status := approval.StatusAt(at(21, "18:02")); status != user.ApprovalExpired {
+		t.Fatalf("expected approval to expire, got %s", status)
+	}
+
+	approval.Status = user.ApprovalApproved
+	if status := approval.StatusAt(at(21, "18:05")); status != user.ApprovalApproved {
+		t.Fatalf("expected decided approvals to never expire, got %s", status)
+	}
+}
+
+// approvalFixture stores a guest asking for approval at 18:00 on the 21st,
+// with two minutes to decide, and an admin to decide it
+func approvalFixture(t *testing.T) (db.Session, *user.User, *user.Approval) {
+	t.Helper()
+	sess := testdb.Open(t)
+	guest := withEntries(t, sess, &user.User{Handle: "guest", Name: "Guest", AskApproval: true})
+	admin := withEntries(t, sess, &user.User{Handle: "admin", Name: "Admin", Role: user.RoleAdmin})
+
+	approval, created, err := user.RequestApproval(sess, guest, at(21, "18:00"), 2*time.Minute)
+	if err != nil || !created {
+		t.Fatalf("could not request approval: %v, %v", created, err)
+	}
+	return sess, admin, approval
+}
+
+func fetchApproval(t *testing.T, sess db.Session, id string) *user.Approval {
+	t.Helper()
+	stored, err := user.FetchApproval(sess, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestRequestApprovalReusesPending(t *testing.T) {
+	sess, _, approval := approvalFixture(t)
+	guest := &user.User{}
+	if err := sess.Get(guest, db.Cond{"handle": "guest"}); err != nil {
+		t.Fatal(err)
+	}
+
+	again, created, err := user.RequestApproval(sess, guest, at(21, "18:01"), 2*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if created || again.ID != approval.ID {
+		t.Fatalf("expected the pending approval to be reused, got %s (created: %v)", again.ID, created)
+	}
+
+	later, created, err := user.RequestApproval(sess, guest, at(21, "18:02"), 2*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !created || later.ID == approval.ID {
+		t.Fatal("expected a new approval once the pending one expired")
+	}
+}
+
+func TestApprovalDecide(t *testing.T) {
+	sess, admin, approval := approvalFixture(t)
+	decided, err := approval.Decide(sess, admin, true, at(21, "18:01"))
+	if err != nil || !decided {
+		t.Fatalf("could not approve: %v, %v", decided, err)
+	}
+
+	second := fetchApproval(t, sess, approval.ID)
+	decided, err = second.Decide(sess, admin, false, at(21, "18:01"))
+	if err != nil || decided {
+		t.Fatalf("expected deciding twice to do nothing, got %v, %v", decided, err)
+	}
+
+	if stored := fetchApproval(t, sess, approval.ID); stored.Status != user.ApprovalApproved || stored.DecidedBy != "admin" {
+		t.Fatalf("expected the first decision to stick, got %s by %s", stored.Status, stored.DecidedBy)
+	}
+}
+
+func TestApprovalDecideExpired(t *testing.T) {
+	sess, admin, approval := approvalFixture(t)
+	decided, err := approval.Decide(sess, admin, true, at(21, "18:02"))
+	if err != nil || decided {
+		t.Fatalf("expected deciding an expired approval to do nothing, got %v, %v", decided, err)
+	}
+
+	if stored := fetchApproval(t, sess, approval.ID); stored.Status != user.ApprovalPending || stored.Decided != nil {
+		t.Fatalf("expected the approval to stay undecided, got %s", stored.Status)
+	}
+}
+
+func TestApprovalExpire(t *testing.T) {
+	sess, admin, approval := approvalFixture(t)
+	expired, err := approval.Expire(sess, at(21, "18:01"))
+	if err != nil || expired {
+		t.Fatalf("expected an approval to not expire early, got %v, %v", expired, err)
+	}
+
+	expired, err = approval.Expire(sess, at(21, "18:02"))
+	if err != nil || !expired {
+		t.Fatalf("could not expire approval: %v, %v", expired, err)
+	}
+
+	again := fetchApproval(t, sess, approval.ID)
+	if again.Status != user.ApprovalExpired {
+		t.Fatalf("expected approval to be stored as expired, got %s", again.Status)
+	}
+
+	expired, err = again.Expire(sess, at(21, "18:03"))
+	if err != nil || expired {
+		t.Fatalf("expected an approval to only expire once, got %v, %v", expired, err)
+	}
+
+	decided, err := again.Decide(sess, admin, true, at(21, "18:01"))
+	if err != nil || decided {
+		t.Fatalf("expected deciding an expired approval to do nothing, got %v, %v", decided, err)
+	}
+}
@@ -3,6 +3,7 @@
 package user
 
 import (
+	"encoding/base64"
 	"encoding/json"
 
 	"github.com/go-webauthn/webauthn/webauthn"
@@ -28,3 +29,30 @@ func (c *Credential) AsWebAuthn() webauthn.Credential {
 func (c *Credential) Store(sess db.Session) db.Store {
 	return sess.Collection("credential")
 }
+
+// Passkey describes a credential to its owner, leaving out its key material
+type Passkey struct {
+	ID         string   `json:"id"`
+	Attachment string   `json:"attachment,omitempty"`
+	Transport  []string `json:"transport,omitempty"`
+	SignCount  uint32   `json:"sign_count"`
+}
+
+// ID identifies the credential the same way browsers do, as url-safe base64
+func (c *Credential) ID() string {
+	return base64.RawURLEncoding.EncodeToString(c.AsWebAuthn().ID)
+}
+
+func (c *Credential) Passkey() *Passkey {
+	wan := c.AsWebAuthn()
+	pk := &Passkey{
+		ID:         c.ID(),
+		Attachment: string(wan.Authenticator.Attachment),
+		SignCount:  wan.Authenticator.SignCount,
+		Transport:  []string{},
+	}
+	for _, t := range wan.Transport {
+		pk.Transport = append(pk.Transport, string(t))
+	}
+	return pk
+}
@@ -0,0 +1,369 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package user
+
+import (
+	"fmt"
+
+	"github.com/upper/db/v4"
+)
+
+// Group shares a policy among its members, so they don't have to be set up
+// one by one. See User.Effective for how it combines with the members' own
+type Group struct {
+	Name        string    `db:"name" json:"name"`
+	Description string    `db:"description" json:"description"`
+	Schedule    *Schedule `db:"schedule,omitempty" json:"schedule,omitempty"`
+	TTL         *TTL      `db:"max_ttl,omitempty" json:"max_ttl,omitempty"`
+	Expires     *UTCTime  `db:"expires,omitempty" json:"expires,omitempty"`
+	IsNotified  bool      `db:"receives_notifications" json:"receives_notifications"`
+	// Permissions are granted to members on top of those of their role
+	Permissions []Permission `db:"-" json:"permissions"`
+	// Members are the handles of the users in the group
+	Members []string `db:"-" json:"members"`
+}
+
+// GroupPermission is a permission granted to a group's members
+type GroupPermission struct {
+	Group      string     `db:"group_name"`
+	Permission Permission `db:"permission"`
+}
+
+func (g *Group) Store(sess db.Session) db.Store {
+	return sess.Collection("user_group")
+}
+
+// Has tells if a group grants a permission
+func (g *Group) Has(p Permission) bool {
+	for _, granted := range g.Permissions {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPrivileged tells if a group grants anything beyond opening the door, so
+// only users that can manage admins get to change it
+func (g *Group) IsPrivileged() bool {
+	return (&Role{Permissions: g.Permissions}).IsPrivileged()
+}
+
+// FetchGroup returns a group along with its permissions and members
+func FetchGroup(sess db.Session, name string) (*Group, error) {
+	g := &Group{}
+	if err := sess.Get(g, db.Cond{"name": name}); err != nil {
+		return nil, fmt.Errorf("could not find group %s: %w", name, err)
+	}
+
+	if err := fetchGroupDetails(sess, []*Group{g}); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// ListGroups returns every group along with its permissions and members, sorted by name
+func ListGroups(sess db.Session) ([]*Group, error) {
+	groups := []*Group{}
+	if err := sess.Collection("user_group").Find().OrderBy("name").All(&groups); err != nil {
+		return nil, err
+	}
+
+	if err := fetchGroupDetails(sess, groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func fetchGroupDetails(sess db.Session, groups []*Group) error {
+	if err := fetchGroupPermissions(sess, groups); err != nil {
+		return err
+	}
+
+	byName := map[string]*Group{}
+	names := []string{}
+	for _, g := range groups {
+		g.Members = []string{}
+		byName[g.Name] = g
+		names = append(names, g.Name)
+	}
+
+	if len(groups) == 0 {
+		return nil
+	}
+
+	members := []struct {
+		Group  string `db:"group_name"`
+		Handle string `db:"handle"`
+	}{}
+	err := sess.SQL().
+		Select("m.group_name", "u.handle").
+		From("user_group_member as m").
+		Join("user as u").On("u.id = m.user").
+		Where(db.Cond{"m.group_name IN": names}).
+		OrderBy("u.handle").
+		All(&members)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range members {
+		byName[m.Group].Members = append(byName[m.Group].Members, m.Handle)
+	}
+	return nil
+}
+
+func fetchGroupPermissions(sess db.Session, groups []*Group) error {
+	byName := map[string]*Group{}
+	names := []string{}
+	for _, g := range groups {
+		g.Permissions = []Permission{}
+		byName[g.Name] = g
+		names = append(names, g.Name)
+	}
+
+	if len(groups) == 0 {
+		return nil
+	}
+
+	grants := []*GroupPermission{}
+	err := sess.Collection("user_group_permission").Find(db.Cond{"group_name IN": names}).OrderBy("permission").All(&grants)
+	if err != nil {
+		return err
+	}
+
+	for _, grant := range grants {
+		byName[grant.Group].Permissions = append(byName[grant.Group].Permissions, grant.Permission)
+	}
+	return nil
+}
+
+// SaveGroup creates or replaces a group and its permissions, leaving its members alone
+func SaveGroup(sess db.Session, g *Group) error {
+	return sess.Tx(func(tx db.Session) error {
+		exists, err := tx.Collection("user_group").Find(db.Cond{"name": g.Name}).Exists()
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			// clear whatever the group no longer sets
+			fields := map[string]any{
+				"description":            g.Description,
+				"receives_notifications": g.IsNotified,
+				"schedule":               nil,
+				"max_ttl":                nil,
+				"expires":                nil,
+			}
+			if g.Schedule != nil {
+				fields["schedule"] = g.Schedule
+			}
+			if g.TTL != nil {
+				fields["max_ttl"] = g.TTL
+			}
+			if g.Expires != nil {
+				fields["expires"] = g.Expires
+			}
+			err = tx.Collection("user_group").Find(db.Cond{"name": g.Name}).Update(fields)
+		} else {
+			_, err = tx.Collection("user_group").Insert(g)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Collection("user_group_permission").Find(db.Cond{"group_name": g.Name}).Delete(); err != nil {
+			return err
+		}
+
+		for _, p := range g.Permissions {
+			if _, err := tx.Collection("user_group_permission").Insert(&GroupPermission{Group: g.Name, Permission: p}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteGroup deletes a group, its permissions and memberships
+func DeleteGroup(sess db.Session, name string) error {
+	return sess.Tx(func(tx db.Session) error {
+		for _, table := range []string{"user_group_member", "user_group_permission"} {
+			if err := tx.Collection(table).Find(db.Cond{"group_name": name}).Delete(); err != nil {
+				return err
+			}
+		}
+		return tx.Collection("user_group").Find(db.Cond{"name": name}).Delete()
+	})
+}
+
+// SetMembership adds users to a group and removes others from it, all at once
+func SetMembership(sess db.Session, group string, add []*User, remove []*User) error {
+	return sess.Tx(func(tx db.Session) error {
+		for _, u := range add {
+			_, err := tx.SQL().Exec(`INSERT INTO user_group_member (group_name, user) VALUES (?, ?) ON CONFLICT DO NOTHING`, group, u.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, u := range remove {
+			if err := tx.Collection("user_group_member").Find(db.Cond{"group_name": group, "user": u.ID}).Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Memberships maps the id of every user in a group to the names of their groups, sorted
+func Memberships(sess db.Session) (map[int][]string, error) {
+	members := []struct {
+		Group  string `db:"group_name"`
+		UserID int    `db:"user"`
+	}{}
+	if err := sess.Collection("user_group_member").Find().OrderBy("group_name").All(&members); err != nil {
+		return nil, err
+	}
+
+	res := map[int][]string{}
+	for _, m := range members {
+		res[m.UserID] = append(res[m.UserID], m.Group)
+	}
+	return res, nil
+}
+
+// SetGroups makes a user a member of exactly groups, run it within a
+// transaction to change them all at once
+func SetGroups(sess db.Session, u *User, groups []string) error {
+	if err := sess.Collection("user_group_member").Find(db.Cond{"user": u.ID}).Delete(); err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		if _, err := sess.SQL().Exec(`INSERT INTO user_group_member (group_name, user) VALUES (?, ?)`, g, u.ID); err != nil {
+			return err
+		}
+	}
+	u.groups = nil
+	return nil
+}
+
+// FetchGroups loads the groups the user belongs to, sorted by name
+func (u *User) FetchGroups(sess db.Session) error {
+	if u.groups != nil {
+		return nil
+	}
+
+	groups := []*Group{}
+	err := sess.SQL().
+		Select("g.*").
+		From("user_group as g").
+		Join("user_group_member as m").On("m.group_name = g.name").
+		Where(db.Cond{"m.user": u.ID}).
+		OrderBy("g.name").
+		All(&groups)
+	if err != nil {
+		return err
+	}
+
+	if err := fetchGroupPermissions(sess, groups); err != nil {
+		return err
+	}
+
+	u.groups = groups
+	return nil
+}
+
+// Groups returns the names of the groups fetched for the user
+func (u *User) Groups() []string {
+	names := make([]string, len(u.groups))
+	for i, g := range u.groups {
+		names[i] = g.Name
+	}
+	return names
+}
+
+// Effective returns a copy of the user with the policy of their groups
+// applied, which is what they are held to:
+//
+//   - their own schedule, or the first one set by their groups, by name
+//   - the shortest of their own and their groups' session TTL
+//   - the earliest of their own and their groups' expiry
+//   - notifications if they or any of their groups receive them
+//
+// Permissions granted by groups are checked by Can
+func (u *User) Effective(sess db.Session) (*User, error) {
+	if err := u.FetchGroups(sess); err != nil {
+		return nil, err
+	}
+
+	return u.WithGroups(u.groups...), nil
+}
+
+// WithGroups returns a copy of the user as a member of groups, with their
+// policy applied as described by Effective
+func (u *User) WithGroups(groups ...*Group) *User {
+	eff := *u
+	eff.groups = groups
+	for _, g := range groups {
+		eff.applyGroup(g)
+	}
+	return &eff
+}
+
+func (u *User) applyGroup(g *Group) {
+	if u.Schedule == nil && g.Schedule != nil {
+		u.Schedule = g.Schedule
+	}
+
+	if g.TTL != nil && (u.TTL == nil || g.TTL.duration < u.TTL.duration) {
+		u.TTL = g.TTL
+	}
+
+	if g.Expires != nil && !g.Expires.Time().IsZero() {
+		if u.Expires == nil || u.Expires.Time().IsZero() || g.Expires.Before(u.Expires.Time()) {
+			u.Expires = g.Expires
+		}
+	}
+
+	u.IsNotified = u.IsNotified || g.IsNotified
+}
+
+// Policy is a user's effective settings, along with where they come from
+type Policy struct {
+	Groups      []string     `json:"groups"`
+	Schedule    *Schedule    `json:"schedule,omitempty"`
+	TTL         *TTL         `json:"max_ttl,omitempty"`
+	Expires     *UTCTime     `json:"expires,omitempty"`
+	IsNotified  bool         `json:"receives_notifications"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// Policy describes what the user is held to once their groups are applied
+func (u *User) Policy(sess db.Session) (*Policy, error) {
+	eff, err := u.Effective(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := []Permission{}
+	for _, p := range Permissions {
+		allowed, err := eff.Can(sess, p)
+		if err != nil {
+			return nil, err
+		}
+		if allowed {
+			permissions = append(permissions, p)
+		}
+	}
+
+	return &Policy{
+		Groups:      eff.Groups(),
+		Schedule:    eff.Schedule,
+		TTL:         eff.TTL,
+		Expires:     eff.Expires,
+		IsNotified:  eff.IsNotified,
+		Permissions: permissions,
+	}, nil
+}
@@ -0,0 +1,57 @@
+package user_test
+
+import (
+	"testing"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/user"
+)
+
+func ttl(src string) *user.TTL {
+	t := &user.TTL{}
+	if err := t.Scan(src); err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestWithGroups(t *testing.T) {
+	soon := user.NewUTCTime(time.Now().Add(time.Hour))
+	later := user.NewUTCTime(time.Now().Add(48 * time.Hour))
+
+	family := &user.Group{Name: "family", Schedule: sched("days=sat,sun"), TTL: ttl("7d"), Expires: later}
+	party := &user.Group{Name: "party", Schedule: sched("hours=20-23"), TTL: ttl("12h"), Expires: soon, IsNotified: true}
+
+	u := &user.User{Handle: "cousin", TTL: ttl("30d")}
+	eff := u.WithGroups(family, party)
+
+	if eff.Schedule.String() != "days=sat,sun" {
+		t.Errorf("expected the first group's schedule, got %s", eff.Schedule)
+	}
+
+	if !eff.TTL.FromNow().Before(time.Now().Add(13 * time.Hour)) {
+		t.Errorf("expected the shortest ttl, got %s", eff.TTL.FromNow())
+	}
+
+	if eff.Expires != soon {
+		t.Errorf("expected the earliest expiry, got %s", eff.Expires.Time())
+	}
+
+	if !eff.IsNotified {
+		t.Errorf("expected notifications from a group to apply")
+	}
+
+	if groups := eff.Groups(); len(groups) != 2 || groups[0] != "family" {
+		t.Errorf("unexpected groups: %v", groups)
+	}
+
+	if u.Schedule != nil || u.IsNotified || u.Expires != nil {
+		t.Errorf("expected the user to be left alone")
+	}
+
+	own := &user.User{Schedule: sched("hours=9-18"), Expires: soon, TTL: ttl("1d")}
+	eff = own.WithGroups(family)
+	if eff.Schedule.String() != "hours=9-18" || eff.Expires != soon {
+		t.Errorf("expected the user's own schedule and earlier expiry to win, got %s and %s", eff.Schedule, eff.Expires.Time())
+	}
+}
@@ -0,0 +1,156 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package user
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/i18n"
+	"github.com/upper/db/v4"
+)
+
+const (
+	// HouseBlackout keeps everyone it applies to out, except admins
+	HouseBlackout = "blackout"
+	// HouseOverride lets everyone it applies to in, regardless of blackouts and their schedule
+	HouseOverride = "override"
+)
+
+// Names is stored as a comma separated list
+type Names []string
+
+func (n Names) MarshalDB() (any, error) {
+	return strings.Join(n, ","), nil
+}
+
+func (n *Names) Scan(value any) error {
+	var str string
+	switch v := value.(type) {
+	case string:
+		str = v
+	case []byte:
+		str = string(v)
+	case nil:
+	default:
+		return fmt.Errorf("cannot scan names from %T", value)
+	}
+
+	*n = Names{}
+	for _, name := range strings.Split(str, ",") {
+		if name != "" {
+			*n = append(*n, name)
+		}
+	}
+	return nil
+}
+
+func (n Names) has(name string) bool {
+	for _, candidate := range n {
+		if candidate == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HouseEvent is a blackout or override in the house's calendar, checked before
+// every user's schedule. It applies to the users and roles listed, or to
+// everyone when both lists are empty
+type HouseEvent struct {
+	ID        int       `db:"id,omitempty" json:"id"`
+	Kind      string    `db:"kind" json:"kind"`
+	Starts    time.Time `db:"starts" json:"starts"`
+	Ends      time.Time `db:"ends" json:"ends"`
+	Reason    string    `db:"reason" json:"reason"`
+	Handles   Names     `db:"handles" json:"handles"`
+	Roles     Names     `db:"roles" json:"roles"`
+	CreatedBy string    `db:"created_by" json:"created_by"`
+	Created   time.Time `db:"created" json:"created"`
+}
+
+func (e *HouseEvent) Store(sess db.Session) db.Store {
+	return sess.Collection("house_event")
+}
+
+func (e *HouseEvent) Validate() error {
+	if e.Kind != HouseBlackout && e.Kind != HouseOverride {
+		return fmt.Errorf("unknown kind %q, expected %s or %s", e.Kind, HouseBlackout, HouseOverride)
+	}
+
+	if e.Starts.IsZero() || e.Ends.IsZero() {
+		return fmt.Errorf("starts and ends are required")
+	}
+
+	if !e.Ends.After(e.Starts) {
+		return fmt.Errorf("ends must come after starts")
+	}
+
+	if e.Kind == HouseOverride && len(e.Handles) == 0 && len(e.Roles) == 0 {
+		return fmt.Errorf("overrides need the handles or roles they let in")
+	}
+	return nil
+}
+
+// AppliesTo tells if the event concerns a user
+func (e *HouseEvent) AppliesTo(u *User) bool {
+	if len(e.Handles) == 0 && len(e.Roles) == 0 {
+		return true
+	}
+	return e.Handles.has(u.Handle) || e.Roles.has(u.Role)
+}
+
+// ActiveAt tells if the event is in effect at t
+func (e *HouseEvent) ActiveAt(t time.Time) bool {
+	return !t.Before(e.Starts) && t.Before(e.Ends)
+}
+
+// HouseCalendar holds blackouts and overrides
+type HouseCalendar []*HouseEvent
+
+// Check tells if the calendar decides on a user's access at t, before their
+// schedule is looked at. Overrides let users in, otherwise blackouts keep out
+// everyone they apply to unless exempt, with an error telling why
+func (c HouseCalendar) Check(u *User, exempt bool, t time.Time) (overridden bool, err error) {
+	var blackout *HouseEvent
+	for _, e := range c {
+		if !e.ActiveAt(t) || !e.AppliesTo(u) {
+			continue
+		}
+
+		if e.Kind == HouseOverride {
+			return true, nil
+		}
+
+		if blackout == nil || e.Ends.After(blackout.Ends) {
+			blackout = e
+		}
+	}
+
+	if blackout == nil || exempt {
+		return false, nil
+	}
+
+	until := blackout.Ends.In(t.Location()).Format("2006-01-02 15:04")
+	if blackout.Reason == "" {
+		return false, i18n.Errorf(i18n.HouseClosed, until)
+	}
+	return false, i18n.Errorf(i18n.HouseClosedUntil, until, blackout.Reason)
+}
+
+// HouseCalendarAt returns the events in effect at t
+func HouseCalendarAt(sess db.Session, t time.Time) (HouseCalendar, error) {
+	events := HouseCalendar{}
+	err := sess.Collection("house_event").Find(db.Cond{"starts <=": t.UTC(), "ends >": t.UTC()}).All(&events)
+	return events, err
+}
+
+// ListHouseEvents returns the events that end after from, soonest first
+func ListHouseEvents(sess db.Session, from time.Time) (HouseCalendar, error) {
+	events := HouseCalendar{}
+	err := sess.Collection("house_event").Find(db.Cond{"ends >": from.UTC()}).OrderBy("starts").All(&events)
+	return events, err
+}
+
+var _ db.Record = &HouseEvent{}
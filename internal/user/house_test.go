@@ -0,0 +1,98 @@
+package user_test
+
+import (
+	"strings"
+	"testing"
+
+	"git.rob.mx/nidito/puerta/internal/user"
+)
+
+func TestHouseCalendarCheck(t *testing.T) {
+	trip := &user.HouseEvent{
+		Kind:   user.HouseBlackout,
+		Starts: at(20, "00:00"),
+		Ends:   at(27, "00:00"),
+		Reason: "nos fuimos de viaje",
+	}
+	cleaning := &user.HouseEvent{
+		Kind:   user.HouseOverride,
+		Starts: at(22, "09:00"),
+		Ends:   at(22, "13:00"),
+		Roles:  user.Names{"cleaning"},
+	}
+	calendar := user.HouseCalendar{trip, cleaning}
+
+	guest := &user.User{Handle: "ana", Role: user.RoleGuest}
+	crew := &user.User{Handle: "maria", Role: "cleaning"}
+
+	if overridden, err := calendar.Check(guest, false, at(19, "12:00")); overridden || err != nil {
+		t.Fatalf("expected calendar to stay out of the way before the trip, got %v, %v", overridden, err)
+	}
+
+	_, err := calendar.Check(guest, false, at(22, "10:00"))
+	if err == nil || !strings.Contains(err.Error(), "nos fuimos de viaje") || !strings.Contains(err.Error(), "2026-10-27 00:00") {
+		t.Fatalf("expected guests to be told about the trip, got %v", err)
+	}
+
+	if overridden, err := calendar.Check(guest, true, at(22, "10:00")); overridden || err != nil {
+		t.Fatalf("expected exempt users to be left to their schedule, got %v, %v", overridden, err)
+	}
+
+	if overridden, err := calendar.Check(crew, false, at(22, "10:00")); !overridden || err != nil {
+		t.Fatalf("expected the cleaning crew to be let in, got %v, %v", overridden, err)
+	}
+
+	if _, err := calendar.Check(crew, false, at(22, "13:00")); err == nil {
+		t.Fatal("expected the cleaning crew to be kept out after their override")
+	}
+}
+
+func TestHouseEventAppliesTo(t *testing.T) {
+	guest := &user.User{Handle: "ana", Role: user.RoleGuest}
+	for name, tc := range map[string]struct {
+		event    *user.HouseEvent
+		expected bool
+	}{
+		"everyone":  {&user.HouseEvent{}, true},
+		"by handle": {&user.HouseEvent{Handles: user.Names{"ana"}}, true},
+		"by role":   {&user.HouseEvent{Roles: user.Names{user.RoleGuest}}, true},
+		"others":    {&user.HouseEvent{Handles: user.Names{"maria"}, Roles: user.Names{"cleaning"}}, false},
+	} {
+		if got := tc.event.AppliesTo(guest); got != tc.expected {
+			t.Errorf("expected %s event to apply: %v", name, tc.expected)
+		}
+	}
+}
+
+func TestHouseEventValidate(t *testing.T) {
+	valid := &user.HouseEvent{Kind: user.HouseBlackout, Starts: at(20, "00:00"), Ends: at(21, "00:00")}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("expected blackout to be valid: %s", err)
+	}
+
+	for name, event := range map[string]*user.HouseEvent{
+		"unknown kind":   {Kind: "party", Starts: at(20, "00:00"), Ends: at(21, "00:00")},
+		"no dates":       {Kind: user.HouseBlackout},
+		"backwards":      {Kind: user.HouseBlackout, Starts: at(21, "00:00"), Ends: at(20, "00:00")},
+		"empty override": {Kind: user.HouseOverride, Starts: at(20, "00:00"), Ends: at(21, "00:00")},
+	} {
+		if err := event.Validate(); err == nil {
+			t.Errorf("expected %s to fail", name)
+		}
+	}
+}
+
+func TestNamesScan(t *testing.T) {
+	names := user.Names{}
+	if err := names.Scan("ana,,maria"); err != nil || len(names) != 2 || names[1] != "maria" {
+		t.Fatalf("unexpected names %v: %v", names, err)
+	}
+
+	if value, _ := names.MarshalDB(); value != "ana,maria" {
+		t.Fatalf("unexpected serialization %v", value)
+	}
+
+	if err := names.Scan(42); err == nil {
+		t.Fatal("expected numbers to fail")
+	}
+}
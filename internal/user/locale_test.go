@@ -0,0 +1,46 @@
+package user_test
+
+import (
+	"testing"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/user"
+)
+
+func TestValidateLocale(t *testing.T) {
+	u := &user.User{Timezone: "Europe/Lisbon", Locale: "en-GB"}
+	if err := u.ValidateLocale(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if u.Locale != "en" {
+		t.Errorf("expected locale to be normalized to en, got %s", u.Locale)
+	}
+
+	for _, u := range []*user.User{
+		{Timezone: "Mars/Olympus_Mons"},
+		{Locale: "fr"},
+	} {
+		if err := u.ValidateLocale(); err == nil {
+			t.Errorf("expected %q/%q to be invalid", u.Timezone, u.Locale)
+		}
+	}
+}
+
+func TestScheduleInUserTimezone(t *testing.T) {
+	house := time.FixedZone("house", -6*3600)
+	u := &user.User{Timezone: "Europe/Lisbon", Schedule: sched("hours=9-18")}
+
+	// 8:00 at the house is already 15:00 in Lisbon
+	now := time.Date(2026, 10, 20, 8, 0, 0, 0, house)
+	if u.Schedule.AllowedAt(now) {
+		t.Errorf("expected the house's 8:00 to be outside the schedule")
+	}
+
+	if !u.Schedule.AllowedAt(now.In(u.Location(house))) {
+		t.Errorf("expected the user's 15:00 to be inside the schedule")
+	}
+
+	if loc := (&user.User{}).Location(house); loc != house {
+		t.Errorf("expected users without a timezone to use the fallback, got %s", loc)
+	}
+}
@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package user
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"git.rob.mx/nidito/puerta/internal/i18n"
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MinPasswordLength is the shortest password users may pick unless configured otherwise
+const MinPasswordLength = 10
+
+// Argon2Params tune how costly password hashes are to compute, see
+// https://www.rfc-editor.org/rfc/rfc9106#section-4
+type Argon2Params struct {
+	// Time is the number of passes over memory
+	Time uint32 `yaml:"time"`
+	// Memory is in KiB
+	Memory     uint32 `yaml:"memory"`
+	Threads    uint8  `yaml:"threads"`
+	KeyLength  uint32 `yaml:"key_length"`
+	SaltLength uint32 `yaml:"salt_length"`
+}
+
+// PasswordConfig is the policy for passwords users pick, and how they are hashed
+type PasswordConfig struct {
+	MinLength int `yaml:"min_length"`
+	// Breached is a file listing leaked passwords, one per line, that users may not pick
+	Breached string `yaml:"breached"`
+	// AllowHandle lets users pick their handle as their password
+	AllowHandle bool          `yaml:"allow_handle"`
+	Argon2      *Argon2Params `yaml:"argon2"`
+	breached    map[string]bool
+}
+
+// PasswordDefaults follow OWASP's minimum for argon2id, cheap enough for the
+// small computers that run door openers
+func PasswordDefaults() *PasswordConfig {
+	return &PasswordConfig{
+		MinLength: MinPasswordLength,
+		Argon2: &Argon2Params{
+			Time:       2,
+			Memory:     19 * 1024,
+			Threads:    1,
+			KeyLength:  32,
+			SaltLength: 16,
+		},
+	}
+}
+
+var passwords = PasswordDefaults()
+
+// ConfigurePasswords validates cfg, loading its list of breached passwords,
+// and applies it to every password set or checked from then on
+func ConfigurePasswords(cfg *PasswordConfig) error {
+	if cfg.MinLength < 1 {
+		return fmt.Errorf("passwords.min_length must be positive")
+	}
+
+	p := cfg.Argon2
+	if p == nil || p.Time < 1 || p.Memory < 8*uint32(p.Threads) || p.Threads < 1 || p.KeyLength < 16 || p.SaltLength < 8 {
+		return fmt.Errorf("passwords.argon2 needs a time and threads of at least 1, 8KiB of memory per thread, a key_length of at least 16 and a salt_length of at least 8")
+	}
+
+	cfg.breached = map[string]bool{}
+	if cfg.Breached != "" {
+		f, err := os.Open(cfg.Breached)
+		if err != nil {
+			return fmt.Errorf("could not open passwords.breached: %w", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				cfg.breached[strings.ToLower(line)] = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("could not read passwords.breached: %w", err)
+		}
+		logrus.Debugf("loaded %d breached passwords", len(cfg.breached))
+	}
+
+	passwords = cfg
+	return nil
+}
+
+// ValidatePassword fails for passwords that are too weak for the user
+func (user *User) ValidatePassword(password string) error {
+	if utf8.RuneCountInString(password) < passwords.MinLength {
+		return i18n.Errorf(i18n.PasswordTooShort, passwords.MinLength)
+	}
+
+	if !passwords.AllowHandle && strings.EqualFold(strings.TrimSpace(password), user.Handle) {
+		return i18n.Errorf(i18n.PasswordIsHandle)
+	}
+
+	if passwords.breached[strings.ToLower(password)] {
+		return i18n.Errorf(i18n.PasswordBreached)
+	}
+
+	return nil
+}
+
+// HashPassword hashes a password with argon2id, encoded like
+// $argon2id$v=19$m=19456,t=2,p=1$salt$key
+func HashPassword(password string) (string, error) {
+	p := passwords.Argon2
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// decodeArgon2 reads the parameters, salt and key of an argon2id hash
+func decodeArgon2(hash string) (*Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2 version %s", parts[2])
+	}
+
+	p := &Argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2 parameters %s: %w", parts[3], err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2 key: %w", err)
+	}
+
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
+
+// MatchesPassword tells if password is the user's current one, hashed with
+// argon2id or bcrypt
+func (user *User) MatchesPassword(password string) bool {
+	if !strings.HasPrefix(user.Password, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil
+	}
+
+	p, salt, key, err := decodeArgon2(user.Password)
+	if err != nil {
+		logrus.Errorf("could not decode the password hash of %s: %s", user.Handle, err)
+		return false
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLength)
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// NeedsRehash tells if the user's password was hashed with something other
+// than argon2id with the configured parameters
+func (user *User) NeedsRehash() bool {
+	p, _, _, err := decodeArgon2(user.Password)
+	return err != nil || *p != *passwords.Argon2
+}
+
+// rehash stores the user's password hashed with the current parameters,
+// once they proved they know it
+func (user *User) rehash(sess db.Session, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	if err := sess.Collection("user").Find(db.Cond{"id": user.ID}).Update(db.Cond{"password": hash}); err != nil {
+		return err
+	}
+
+	user.Password = hash
+	logrus.Infof("rehashed the password of %s", user.Handle)
+	return nil
+}
+
+// SetPassword validates and hashes a new password for the user, it is up to
+// callers to store it
+func (user *User) SetPassword(password string) error {
+	if err := user.ValidatePassword(password); err != nil {
+		return err
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	user.Password = hash
+	return nil
+}
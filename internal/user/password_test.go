@@ -0,0 +1,92 @@
+package user_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.rob.mx/nidito/puerta/internal/user"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSetPassword(t *testing.T) {
+	u := &user.User{Handle: "alguien-largo"}
+	for _, password := range []string{"", "short", "ALGUIEN-LARGO"} {
+		if err := u.SetPassword(password); err == nil {
+			t.Errorf("expected %q to be rejected", password)
+		}
+	}
+
+	if u.Password != "" {
+		t.Fatalf("expected rejected passwords to leave the hash alone")
+	}
+
+	if err := u.SetPassword("correct horse battery"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !strings.HasPrefix(u.Password, "$argon2id$v=19$m=19456,t=2,p=1$") {
+		t.Errorf("expected an argon2id hash, got %s", u.Password)
+	}
+
+	if !u.MatchesPassword("correct horse battery") || u.MatchesPassword("correct horse battery!") {
+		t.Errorf("expected only the password to match its hash")
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(list, []byte("123456\nPassword1234\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := user.PasswordDefaults()
+	cfg.MinLength = 4
+	cfg.Breached = list
+	cfg.AllowHandle = true
+	if err := user.ConfigurePasswords(cfg); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer user.ConfigurePasswords(user.PasswordDefaults())
+
+	u := &user.User{Handle: "abuela"}
+	for password, allowed := range map[string]bool{"abc": false, "abcd": true, "abuela": true, "123456": false, "password1234": false} {
+		if err := u.ValidatePassword(password); (err == nil) != allowed {
+			t.Errorf("expected %q allowed to be %v, got %v", password, allowed, err)
+		}
+	}
+
+	cfg = user.PasswordDefaults()
+	cfg.Argon2.SaltLength = 2
+	if err := user.ConfigurePasswords(cfg); err == nil {
+		t.Errorf("expected a short salt to be rejected")
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	legacy, _ := bcrypt.GenerateFromPassword([]byte("correct horse battery"), bcrypt.MinCost)
+	u := &user.User{Password: string(legacy)}
+	if !u.MatchesPassword("correct horse battery") || !u.NeedsRehash() {
+		t.Fatalf("expected bcrypt hashes to match and need a rehash")
+	}
+
+	if err := u.SetPassword("correct horse battery"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if u.NeedsRehash() {
+		t.Fatalf("expected a fresh hash to be current")
+	}
+
+	cfg := user.PasswordDefaults()
+	cfg.Argon2.Time = 3
+	if err := user.ConfigurePasswords(cfg); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer user.ConfigurePasswords(user.PasswordDefaults())
+
+	if !u.NeedsRehash() || !u.MatchesPassword("correct horse battery") {
+		t.Fatalf("expected hashes with old parameters to still match and need a rehash")
+	}
+}
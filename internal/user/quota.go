@@ -0,0 +1,227 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package user
+
+import (
+	"fmt"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/i18n"
+	"github.com/upper/db/v4"
+)
+
+// reserveAttempts is how many times ReserveEntry retries when another entry
+// changes the counts between reading and updating them
+const reserveAttempts = 10
+
+// entryCount is how many times a user came in, kept with the user so limits
+// outlive the audit log's retention. Day and Window only count entries since
+// DayStart and WindowStart, and start over once t falls in another day or window
+type entryCount struct {
+	Total       int    `db:"entries"`
+	Day         int    `db:"day_entries"`
+	DayStart    string `db:"day_start"`
+	Window      int    `db:"window_entries"`
+	WindowStart string `db:"window_start"`
+}
+
+// HasQuota tells if the user's entries are limited at all
+func (user *User) HasQuota() bool {
+	return user.SingleUse || user.MaxEntries > 0 || user.MaxDailyEntries > 0 || user.MaxWindowEntries > 0
+}
+
+// limit is how many entries a user may have, and used how many they had so
+// far, err is what they get once they have used them up
+type limit struct {
+	used int
+	max  int
+	err  i18n.Key
+}
+
+// starts returns when the day and the schedule window t falls in started, as
+// they are stored. window is empty outside of a window or without a schedule
+func (user *User) starts(t time.Time) (day, window string) {
+	y, m, d := t.Date()
+	day = time.Date(y, m, d, 0, 0, 0, 0, t.Location()).UTC().Format(time.RFC3339)
+	if user.Schedule != nil {
+		if start, ok := user.Schedule.WindowStart(t); ok {
+			window = start.UTC().Format(time.RFC3339)
+		}
+	}
+	return day, window
+}
+
+// at returns the counts as of t, starting over the day or window if t falls in another one
+func (c entryCount) at(user *User, t time.Time) entryCount {
+	day, window := user.starts(t)
+	if c.DayStart != day {
+		c.Day, c.DayStart = 0, day
+	}
+	if c.WindowStart != window {
+		c.Window, c.WindowStart = 0, window
+	}
+	return c
+}
+
+// limits returns the entry limits that apply to the user given their counts.
+// Window limits only apply to users with a schedule, while they are within it
+func (user *User) limits(c entryCount) []limit {
+	limits := []limit{}
+
+	total := user.MaxEntries
+	if user.SingleUse && (total == 0 || total > 1) {
+		total = 1
+	}
+	if total > 0 {
+		limits = append(limits, limit{c.Total, total, i18n.NoEntriesLeft})
+	}
+
+	if user.MaxDailyEntries > 0 {
+		limits = append(limits, limit{c.Day, user.MaxDailyEntries, i18n.NoEntriesToday})
+	}
+
+	if user.MaxWindowEntries > 0 && c.WindowStart != "" {
+		limits = append(limits, limit{c.Window, user.MaxWindowEntries, i18n.NoEntriesWindow})
+	}
+
+	return limits
+}
+
+func (user *User) entryCount(sess db.Session) (entryCount, error) {
+	c := entryCount{}
+	err := sess.SQL().
+		Select("entries", "day_entries", "day_start", "window_entries", "window_start").
+		From("user").
+		Where(db.Cond{"id": user.ID}).
+		One(&c)
+	return c, err
+}
+
+// checkQuota fails once the user used up any of their entry limits
+func (user *User) checkQuota(c entryCount) error {
+	for _, l := range user.limits(c) {
+		if l.used >= l.max {
+			return i18n.Errorf(l.err)
+		}
+	}
+	return nil
+}
+
+// CheckQuota fails once the user used up any of their entry limits by t
+func (user *User) CheckQuota(sess db.Session, t time.Time) error {
+	c, err := user.entryCount(sess)
+	if err != nil {
+		return err
+	}
+	return user.checkQuota(c.at(user, t))
+}
+
+// swapCount replaces the user's counts with next, as long as they are still
+// current, telling if they were
+func (user *User) swapCount(sess db.Session, current, next entryCount) (bool, error) {
+	res, err := sess.SQL().
+		Update("user").
+		Set(
+			"entries", next.Total,
+			"day_entries", next.Day,
+			"day_start", next.DayStart,
+			"window_entries", next.Window,
+			"window_start", next.WindowStart,
+		).
+		Where(db.Cond{
+			"id":             user.ID,
+			"entries":        current.Total,
+			"day_entries":    current.Day,
+			"day_start":      current.DayStart,
+			"window_entries": current.Window,
+			"window_start":   current.WindowStart,
+		}).
+		Exec()
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := res.RowsAffected()
+	return rows == 1, err
+}
+
+// ReserveEntry counts an entry at t, failing if the user used up any of
+// their limits. Counting and checking happen at once, so concurrent entries
+// can't use up the same one
+func (user *User) ReserveEntry(sess db.Session, t time.Time) error {
+	for attempt := 0; attempt < reserveAttempts; attempt++ {
+		current, err := user.entryCount(sess)
+		if err != nil {
+			return err
+		}
+
+		next := current.at(user, t)
+		if err := user.checkQuota(next); err != nil {
+			return err
+		}
+
+		next.Total++
+		next.Day++
+		if next.WindowStart != "" {
+			next.Window++
+		}
+
+		swapped, err := user.swapCount(sess, current, next)
+		if err != nil || swapped {
+			return err
+		}
+	}
+
+	return fmt.Errorf("could not reserve an entry for %s, too many at once", user.Handle)
+}
+
+// ReleaseEntry gives back an entry reserved at t, for when the door did not open
+func (user *User) ReleaseEntry(sess db.Session, t time.Time) error {
+	for attempt := 0; attempt < reserveAttempts; attempt++ {
+		current, err := user.entryCount(sess)
+		if err != nil {
+			return err
+		}
+
+		next := current
+		day, window := user.starts(t)
+		if next.Total > 0 {
+			next.Total--
+		}
+		if next.DayStart == day && next.Day > 0 {
+			next.Day--
+		}
+		if window != "" && next.WindowStart == window && next.Window > 0 {
+			next.Window--
+		}
+
+		swapped, err := user.swapCount(sess, current, next)
+		if err != nil || swapped {
+			return err
+		}
+	}
+
+	return fmt.Errorf("could not release an entry for %s, too many at once", user.Handle)
+}
+
+// RemainingEntries tells how many more times the user may come in at t, nil
+// meaning there is no limit
+func (user *User) RemainingEntries(sess db.Session, t time.Time) (*int, error) {
+	c, err := user.entryCount(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	var remaining *int
+	for _, l := range user.limits(c.at(user, t)) {
+		left := l.max - l.used
+		if left < 0 {
+			left = 0
+		}
+		if remaining == nil || left < *remaining {
+			remaining = &left
+		}
+	}
+
+	return remaining, nil
+}
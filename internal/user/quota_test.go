@@ -0,0 +1,174 @@
+package user_test
+
+import (
+	"testing"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/testdb"
+	"git.rob.mx/nidito/puerta/internal/user"
+	"github.com/upper/db/v4"
+)
+
+// withEntries stores u and reserves an entry for them at each of times
+func withEntries(t *testing.T, sess db.Session, u *user.User, times ...time.Time) *user.User {
+	t.Helper()
+	res, err := sess.Collection("user").Insert(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.ID = int(res.ID().(int64))
+
+	for _, when := range times {
+		if err := u.ReserveEntry(sess, when); err != nil {
+			t.Fatalf("could not reserve entry at %s: %s", when, err)
+		}
+	}
+	return u
+}
+
+func sched(src string) *user.Schedule {
+	sch, err := user.ParseSchedule(src)
+	if err != nil {
+		panic(err)
+	}
+	return sch
+}
+
+func TestReserveEntry(t *testing.T) {
+	sess := testdb.Open(t)
+	now := at(21, "18:00")
+	yesterday := at(20, "10:00")
+	morning := at(21, "09:30")
+
+	for name, tc := range map[string]struct {
+		user    *user.User
+		entries []time.Time
+		allowed bool
+	}{
+		"no limits":           {&user.User{}, []time.Time{yesterday, morning}, true},
+		"total left":          {&user.User{MaxEntries: 3}, []time.Time{yesterday, morning}, true},
+		"total used up":       {&user.User{MaxEntries: 2}, []time.Time{yesterday, morning}, false},
+		"single use":          {&user.User{SingleUse: true}, nil, true},
+		"single use, used":    {&user.User{SingleUse: true}, []time.Time{yesterday}, false},
+		"single use wins":     {&user.User{SingleUse: true, MaxEntries: 5}, []time.Time{yesterday}, false},
+		"daily left":          {&user.User{MaxDailyEntries: 2}, []time.Time{yesterday, yesterday, morning}, true},
+		"daily used up":       {&user.User{MaxDailyEntries: 1}, []time.Time{morning}, false},
+		"window without sch":  {&user.User{MaxWindowEntries: 1}, []time.Time{morning}, true},
+		"window left":         {&user.User{MaxWindowEntries: 1, Schedule: sched("hours=8-12; hours=17-20")}, []time.Time{morning}, true},
+		"window used up":      {&user.User{MaxWindowEntries: 1, Schedule: sched("hours=8-12; hours=17-20")}, []time.Time{at(21, "17:05")}, false},
+		"outside of a window": {&user.User{MaxWindowEntries: 1, Schedule: sched("hours=8-12")}, []time.Time{morning}, true},
+	} {
+		tc.user.Handle = name
+		tc.user.Name = name
+		u := withEntries(t, sess, tc.user, tc.entries...)
+
+		if err := u.CheckQuota(sess, now); (err == nil) != tc.allowed {
+			t.Errorf("%s: expected CheckQuota to allow %v, got %v", name, tc.allowed, err)
+		}
+
+		err := u.ReserveEntry(sess, now)
+		if allowed := err == nil; allowed != tc.allowed {
+			t.Errorf("%s: expected allowed to be %v, got %v", name, tc.allowed, err)
+		}
+	}
+}
+
+func TestReserveEntryConcurrently(t *testing.T) {
+	sess := testdb.Open(t)
+	u := withEntries(t, sess, &user.User{Handle: "once", Name: "once", SingleUse: true})
+
+	results := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			results <- u.ReserveEntry(sess, at(21, "18:00"))
+		}()
+	}
+
+	reserved := 0
+	for i := 0; i < 10; i++ {
+		if err := <-results; err == nil {
+			reserved++
+		}
+	}
+
+	if reserved != 1 {
+		t.Fatalf("expected a single use user to get exactly one entry, got %d", reserved)
+	}
+}
+
+func TestReleaseEntry(t *testing.T) {
+	sess := testdb.Open(t)
+	now := at(21, "18:00")
+	u := withEntries(t, sess, &user.User{Handle: "twice", Name: "twice", MaxEntries: 2, MaxDailyEntries: 1}, now)
+
+	if err := u.ReleaseEntry(sess, now); err != nil {
+		t.Fatalf("could not release entry: %s", err)
+	}
+
+	remaining, err := u.RemainingEntries(sess, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if remaining == nil || *remaining != 1 {
+		t.Fatalf("expected the released entry to be available again, got %v", remaining)
+	}
+
+	if err := u.ReserveEntry(sess, now); err != nil {
+		t.Fatalf("could not reserve the released entry: %s", err)
+	}
+}
+
+func TestWindowStart(t *testing.T) {
+	for name, tc := range map[string]struct {
+		src      string
+		when     time.Time
+		expected time.Time
+		found    bool
+	}{
+		"hours":     {"hours=17-20", at(21, "18:00"), at(21, "17:00"), true},
+		"overnight": {"hours=22-6", at(21, "02:00"), at(20, "22:00"), true},
+		"days":      {"days=mon-fri", at(21, "18:00"), at(19, "00:00"), true},
+		"outside":   {"hours=8-12", at(21, "18:00"), time.Time{}, false},
+		"ical":      {"DTSTART:20261019T170000 DURATION:PT3H RRULE:FREQ=DAILY", at(21, "18:00"), at(21, "17:00"), true},
+	} {
+		start, found := sched(tc.src).WindowStart(tc.when)
+		if found != tc.found || !start.Equal(tc.expected) {
+			t.Errorf("%s: expected window to start at %s (%v), got %s (%v)", name, tc.expected, tc.found, start, found)
+		}
+	}
+}
+
+func TestRemainingEntries(t *testing.T) {
+	now := at(21, "18:00")
+	yesterday := at(20, "10:00")
+	morning := at(21, "09:30")
+
+	sess := testdb.Open(t)
+	for name, tc := range map[string]struct {
+		user     *user.User
+		entries  []time.Time
+		expected int
+	}{
+		"no limits":       {&user.User{}, []time.Time{yesterday}, -1},
+		"total":           {&user.User{MaxEntries: 5}, []time.Time{yesterday, morning}, 3},
+		"daily is lower":  {&user.User{MaxEntries: 5, MaxDailyEntries: 2}, []time.Time{yesterday, morning}, 1},
+		"single use":      {&user.User{SingleUse: true}, nil, 1},
+		"single use used": {&user.User{SingleUse: true}, []time.Time{yesterday}, 0},
+	} {
+		tc.user.Handle = name
+		tc.user.Name = name
+		remaining, err := withEntries(t, sess, tc.user, tc.entries...).RemainingEntries(sess, now)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err)
+		}
+
+		got := -1
+		if remaining != nil {
+			got = *remaining
+		}
+		if got != tc.expected {
+			t.Errorf("%s: expected %d entries left, got %d", name, tc.expected, got)
+		}
+	}
+}
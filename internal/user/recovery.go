@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/upper/db/v4"
+)
+
+// no vowels or lookalikes, so codes are easy to read back and never spell anything
+const recoveryAlphabet = "bcdfghjkmnpqrstvwxz23456789"
+const recoveryCodeLength = 10
+
+var recoveryKey []byte
+
+// UseRecoveryKey derives the key recovery codes are hashed with from
+// auth.session_key
+func UseRecoveryKey(sessionKey []byte) {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("puerta recovery code"))
+	recoveryKey = mac.Sum(nil)
+}
+
+// RecoveryCode is a single-use code that lets users re-enroll a second factor.
+// Only a keyed hash of the code is stored
+type RecoveryCode struct {
+	UserID int    `db:"user"`
+	Hash   string `db:"hash"`
+}
+
+func (rc *RecoveryCode) Store(sess db.Session) db.Store {
+	return sess.Collection("recovery_code")
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// hashRecoveryCode hashes a code along with its user, so the same code hashes
+// differently for everyone
+func hashRecoveryCode(userID int, code string) string {
+	mac := hmac.New(sha256.New, recoveryKey)
+	mac.Write([]byte(strconv.Itoa(userID) + ":" + normalizeRecoveryCode(code)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newRecoveryCode() (string, error) {
+	sb := strings.Builder{}
+	// discard bytes past the last multiple of the alphabet size to avoid modulo bias
+	limit := 256 - 256%len(recoveryAlphabet)
+	buf := make([]byte, 1)
+	for n := 0; n < recoveryCodeLength; {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+
+		if int(buf[0]) >= limit {
+			continue
+		}
+
+		if n == recoveryCodeLength/2 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(recoveryAlphabet[int(buf[0])%len(recoveryAlphabet)])
+		n++
+	}
+	return sb.String(), nil
+}
+
+// GenerateRecoveryCodes replaces a user's recovery codes with count new ones,
+// returning them in plain text so they can be shown exactly once
+func (u *User) GenerateRecoveryCodes(sess db.Session, count int) ([]string, error) {
+	codes := make([]string, count)
+	err := sess.Tx(func(tx db.Session) error {
+		if err := tx.Collection("recovery_code").Find(db.Cond{"user": u.ID}).Delete(); err != nil {
+			return err
+		}
+
+		for i := range codes {
+			code, err := newRecoveryCode()
+			if err != nil {
+				return fmt.Errorf("could not generate recovery code: %w", err)
+			}
+
+			if _, err := tx.Collection("recovery_code").Insert(&RecoveryCode{UserID: u.ID, Hash: hashRecoveryCode(u.ID, code)}); err != nil {
+				return err
+			}
+			codes[i] = code
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Debugf("generated %d recovery codes for %d", count, u.ID)
+	return codes, nil
+}
+
+// UseRecoveryCode consumes one of the user's recovery codes
+func (u *User) UseRecoveryCode(sess db.Session, code string) error {
+	if normalizeRecoveryCode(code) == "" {
+		return fmt.Errorf("unknown recovery code")
+	}
+
+	res, err := sess.SQL().
+		DeleteFrom("recovery_code").
+		Where(db.Cond{"user": u.ID, "hash": hashRecoveryCode(u.ID, code)}).
+		Exec()
+	if err != nil {
+		return err
+	}
+
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return fmt.Errorf("unknown recovery code")
+	}
+
+	return nil
+}
+
+var _ db.Record = &RecoveryCode{}
@@ -0,0 +1,108 @@
+package user_test
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"git.rob.mx/nidito/puerta/internal/testdb"
+	"git.rob.mx/nidito/puerta/internal/user"
+)
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	sess := testdb.Open(t)
+	u := &user.User{ID: 1}
+	codes, err := u.GenerateRecoveryCodes(sess, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	format := regexp.MustCompile(`^[b-df-hj-np-tv-xz2-9]{5}-[b-df-hj-np-tv-xz2-9]{5}$`)
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("unexpected code format: %s", code)
+		}
+
+		if seen[code] {
+			t.Errorf("repeated code %s", code)
+		}
+		seen[code] = true
+	}
+
+	var stored []struct {
+		Hash string `db:"hash"`
+	}
+	if err := sess.SQL().Select("hash").From("recovery_code").All(&stored); err != nil || len(stored) != 8 {
+		t.Fatalf("expected 8 stored codes, got %d %v", len(stored), err)
+	}
+
+	for _, row := range stored {
+		if seen[row.Hash] || len(row.Hash) != 64 {
+			t.Errorf("expected only hashes to be stored, got %s", row.Hash)
+		}
+	}
+}
+
+func TestUseRecoveryCode(t *testing.T) {
+	sess := testdb.Open(t)
+	u := &user.User{ID: 1}
+	other := &user.User{ID: 2}
+	codes, err := u.GenerateRecoveryCodes(sess, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.UseRecoveryCode(sess, codes[0]); err == nil {
+		t.Fatalf("expected codes to only work for their user")
+	}
+
+	if err := u.UseRecoveryCode(sess, ""); err == nil {
+		t.Fatalf("expected an empty code to be rejected")
+	}
+
+	// codes are read back from paper, so case, spaces and dashes don't matter
+	typed := " " + strings.ToUpper(strings.ReplaceAll(codes[0], "-", " ")) + " "
+	if err := u.UseRecoveryCode(sess, typed); err != nil {
+		t.Fatalf("expected a normalized code to be accepted: %s", err)
+	}
+
+	if err := u.UseRecoveryCode(sess, codes[0]); err == nil {
+		t.Fatalf("expected codes to be single use")
+	}
+
+	fresh, err := u.GenerateRecoveryCodes(sess, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := u.UseRecoveryCode(sess, codes[1]); err == nil {
+		t.Fatalf("expected regenerating codes to invalidate the previous ones")
+	}
+
+	if err := u.UseRecoveryCode(sess, fresh[1]); err != nil {
+		t.Fatalf("expected a new code to be accepted: %s", err)
+	}
+}
+
+func TestRecoveryCodesAreKeyed(t *testing.T) {
+	sess := testdb.Open(t)
+	u := &user.User{ID: 1}
+	user.UseRecoveryKey([]byte("key"))
+	defer user.UseRecoveryKey([]byte(""))
+
+	codes, err := u.GenerateRecoveryCodes(sess, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.UseRecoveryKey([]byte("other key"))
+	if err := u.UseRecoveryCode(sess, codes[0]); err == nil {
+		t.Fatalf("expected codes hashed with another key to be rejected")
+	}
+
+	user.UseRecoveryKey([]byte("key"))
+	if err := u.UseRecoveryCode(sess, codes[0]); err != nil {
+		t.Fatalf("expected the code to be accepted with its key: %s", err)
+	}
+}
@@ -0,0 +1,236 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package user
+
+import (
+	"fmt"
+
+	"github.com/upper/db/v4"
+)
+
+// Permission allows users to do something, through the roles that grant it
+type Permission string
+
+const (
+	// PermissionOpenDoor lets users buzz the door in, within their schedule
+	PermissionOpenDoor Permission = "door:open"
+	// PermissionViewLog lets users read the audit log and subscribe to admin notifications
+	PermissionViewLog Permission = "log:view"
+	// PermissionManageGuests lets users create, update and delete unprivileged users
+	PermissionManageGuests Permission = "users:guests"
+	// PermissionManageAdmins lets users manage users with any role, including their own
+	PermissionManageAdmins Permission = "users:admins"
+	// PermissionManageDevices lets users sign other users out of their devices and run maintenance jobs
+	PermissionManageDevices Permission = "devices:manage"
+)
+
+// Permissions lists every known permission
+var Permissions = []Permission{
+	PermissionOpenDoor,
+	PermissionViewLog,
+	PermissionManageGuests,
+	PermissionManageAdmins,
+	PermissionManageDevices,
+}
+
+const (
+	RoleAdmin       = "admin"
+	RoleHouseSitter = "house-sitter"
+	RoleGuest       = "guest"
+)
+
+// Role groups permissions granted to users
+type Role struct {
+	Name        string       `db:"name" json:"name"`
+	Description string       `db:"description" json:"description"`
+	Permissions []Permission `db:"-" json:"permissions"`
+}
+
+// RolePermission is a permission granted to a role
+type RolePermission struct {
+	Role       string     `db:"role"`
+	Permission Permission `db:"permission"`
+}
+
+func (r *Role) Store(sess db.Session) db.Store {
+	return sess.Collection("role")
+}
+
+// Has tells if a role grants a permission
+func (r *Role) Has(p Permission) bool {
+	for _, granted := range r.Permissions {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPrivileged tells if a role grants anything beyond opening the door, so
+// only users that can manage admins get to hand it out
+func (r *Role) IsPrivileged() bool {
+	for _, granted := range r.Permissions {
+		if granted != PermissionOpenDoor {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePermission fails for unknown permissions
+func ParsePermission(name string) (Permission, error) {
+	for _, p := range Permissions {
+		if string(p) == name {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown permission %s, not one of %v", name, Permissions)
+}
+
+// FetchRole returns a role along with its permissions
+func FetchRole(sess db.Session, name string) (*Role, error) {
+	role := &Role{}
+	if err := sess.Get(role, db.Cond{"name": name}); err != nil {
+		return nil, fmt.Errorf("could not find role %s: %w", name, err)
+	}
+
+	grants := []*RolePermission{}
+	if err := sess.Collection("role_permission").Find(db.Cond{"role": name}).All(&grants); err != nil {
+		return nil, err
+	}
+
+	role.Permissions = make([]Permission, len(grants))
+	for i, g := range grants {
+		role.Permissions[i] = g.Permission
+	}
+	return role, nil
+}
+
+// ListRoles returns every role along with its permissions, sorted by name
+func ListRoles(sess db.Session) ([]*Role, error) {
+	roles := []*Role{}
+	if err := sess.Collection("role").Find().OrderBy("name").All(&roles); err != nil {
+		return nil, err
+	}
+
+	grants := []*RolePermission{}
+	if err := sess.Collection("role_permission").Find().OrderBy("permission").All(&grants); err != nil {
+		return nil, err
+	}
+
+	byName := map[string]*Role{}
+	for _, r := range roles {
+		r.Permissions = []Permission{}
+		byName[r.Name] = r
+	}
+
+	for _, g := range grants {
+		if r, ok := byName[g.Role]; ok {
+			r.Permissions = append(r.Permissions, g.Permission)
+		}
+	}
+	return roles, nil
+}
+
+// SaveRole creates or replaces a role and its permissions
+func SaveRole(sess db.Session, role *Role) error {
+	return sess.Tx(func(tx db.Session) error {
+		_, err := tx.SQL().Exec(
+			`INSERT INTO role (name, description) VALUES (?, ?)
+			ON CONFLICT(name) DO UPDATE SET description = excluded.description`,
+			role.Name, role.Description,
+		)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Collection("role_permission").Find(db.Cond{"role": role.Name}).Delete(); err != nil {
+			return err
+		}
+
+		for _, p := range role.Permissions {
+			if _, err := tx.Collection("role_permission").Insert(&RolePermission{Role: role.Name, Permission: p}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FetchRole loads the user's role and permissions
+func (u *User) FetchRole(sess db.Session) error {
+	if u.role != nil {
+		return nil
+	}
+
+	role, err := FetchRole(sess, u.Role)
+	if err != nil {
+		return err
+	}
+	u.role = role
+	return nil
+}
+
+// Can tells if the user's role or any of their groups grants a permission
+func (u *User) Can(sess db.Session, p Permission) (bool, error) {
+	if err := u.FetchRole(sess); err != nil {
+		return false, err
+	}
+
+	if u.role.Has(p) {
+		return true, nil
+	}
+
+	if err := u.FetchGroups(sess); err != nil {
+		return false, err
+	}
+
+	for _, g := range u.groups {
+		if g.Has(p) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CanManage tells if the user can create, update or delete users with a role
+func (u *User) CanManage(sess db.Session, role string) (bool, error) {
+	if admins, err := u.Can(sess, PermissionManageAdmins); err != nil || admins {
+		return admins, err
+	}
+
+	if guests, err := u.Can(sess, PermissionManageGuests); err != nil || !guests {
+		return false, err
+	}
+
+	target, err := FetchRole(sess, role)
+	if err != nil {
+		return false, err
+	}
+	return !target.IsPrivileged(), nil
+}
+
+// CanManageUser tells if the user can update or delete target, which also
+// takes managing every permission target's groups grant them
+func (u *User) CanManageUser(sess db.Session, target *User) (bool, error) {
+	if allowed, err := u.CanManage(sess, target.Role); err != nil || !allowed {
+		return false, err
+	}
+
+	if admins, err := u.Can(sess, PermissionManageAdmins); err != nil || admins {
+		return admins, err
+	}
+
+	if err := target.FetchGroups(sess); err != nil {
+		return false, err
+	}
+
+	for _, g := range target.groups {
+		if g.IsPrivileged() {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+var _ db.Record = &Role{}
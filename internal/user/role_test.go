@@ -0,0 +1,86 @@
+package user_test
+
+import (
+	"testing"
+
+	"git.rob.mx/nidito/puerta/internal/testdb"
+	"git.rob.mx/nidito/puerta/internal/user"
+)
+
+func TestRolePrivileges(t *testing.T) {
+	guest := &user.Role{Name: user.RoleGuest, Permissions: []user.Permission{user.PermissionOpenDoor}}
+	sitter := &user.Role{Name: user.RoleHouseSitter, Permissions: []user.Permission{user.PermissionOpenDoor, user.PermissionManageGuests}}
+	empty := &user.Role{Name: "nobody"}
+
+	if !guest.Has(user.PermissionOpenDoor) || guest.Has(user.PermissionViewLog) {
+		t.Fatalf("unexpected permissions for guest: %v", guest.Permissions)
+	}
+
+	if guest.IsPrivileged() || empty.IsPrivileged() {
+		t.Fatalf("expected guests and empty roles to be unprivileged")
+	}
+
+	if !sitter.IsPrivileged() {
+		t.Fatalf("expected house sitters to be privileged")
+	}
+}
+
+func TestCanManageUser(t *testing.T) {
+	sess := testdb.Open(t)
+	admin := withEntries(t, sess, &user.User{Handle: "admin", Role: user.RoleAdmin})
+	sitter := withEntries(t, sess, &user.User{Handle: "sitter", Role: user.RoleHouseSitter})
+	guest := withEntries(t, sess, &user.User{Handle: "guest", Role: user.RoleGuest})
+	friend := withEntries(t, sess, &user.User{Handle: "friend", Role: user.RoleGuest})
+	keyholder := withEntries(t, sess, &user.User{Handle: "keyholder", Role: user.RoleGuest})
+
+	for name, permissions := range map[string][]user.Permission{
+		"friends": {user.PermissionOpenDoor},
+		"keys":    {user.PermissionOpenDoor, user.PermissionManageAdmins},
+	} {
+		if err := user.SaveGroup(sess, &user.Group{Name: name, Permissions: permissions}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := user.SetMembership(sess, "friends", []*user.User{friend}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := user.SetMembership(sess, "keys", []*user.User{keyholder}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, check := range []struct {
+		actor    *user.User
+		target   *user.User
+		expected bool
+	}{
+		{sitter, guest, true},
+		{sitter, friend, true},
+		{sitter, keyholder, false},
+		{sitter, admin, false},
+		{admin, keyholder, true},
+		{guest, friend, false},
+	} {
+		allowed, err := check.actor.CanManageUser(sess, check.target)
+		if err != nil {
+			t.Fatalf("could not check if %s can manage %s: %s", check.actor.Handle, check.target.Handle, err)
+		}
+
+		if allowed != check.expected {
+			t.Errorf("expected %s managing %s to be %v, got %v", check.actor.Handle, check.target.Handle, check.expected, allowed)
+		}
+	}
+}
+
+func TestParsePermission(t *testing.T) {
+	for _, p := range user.Permissions {
+		if parsed, err := user.ParsePermission(string(p)); err != nil || parsed != p {
+			t.Fatalf("could not parse %s: %v", p, err)
+		}
+	}
+
+	if _, err := user.ParsePermission("door:kick"); err == nil {
+		t.Fatalf("expected unknown permissions to fail")
+	}
+}
@@ -0,0 +1,587 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package user
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recurrence is a schedule written as iCalendar (RFC 5545) properties, i.e.
+//
+//	DTSTART:20261020T090000 DURATION:PT4H RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=TU EXDATE:20261117T090000
+//
+// Properties may be separated by spaces or newlines. Times without a timezone
+// are in the house's timezone. Supported properties are DTSTART (required),
+// DURATION or DTEND, RRULE, RDATE and EXDATE, rules support FREQ (DAILY,
+// WEEKLY, MONTHLY or YEARLY), INTERVAL, COUNT, UNTIL, BYDAY, BYMONTHDAY,
+// BYMONTH and WKST
+type recurrence struct {
+	start    icalTime
+	duration time.Duration
+	rules    []*rrule
+	rdates   []icalTime
+	exdates  []icalTime
+}
+
+// icalTime is a DATE or DATE-TIME value, floating ones have no location
+type icalTime struct {
+	year   int
+	month  time.Month
+	day    int
+	hour   int
+	minute int
+	second int
+	loc    *time.Location
+	date   bool
+}
+
+type rrule struct {
+	freq       string
+	interval   int
+	count      int
+	until      *icalTime
+	byDay      []weekdayNum
+	byMonthDay []int
+	byMonth    []time.Month
+	wkst       time.Weekday
+}
+
+// weekdayNum is a BYDAY value, n is the ordinal within the month, or 0 for every such weekday
+type weekdayNum struct {
+	n   int
+	day time.Weekday
+}
+
+var icalWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+var icalDuration = regexp.MustCompile(`^P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// isRecurrence tells if a schedule is written in iCalendar instead of puerta's own grammar
+func isRecurrence(src string) bool {
+	for _, prop := range strings.Fields(src) {
+		name := strings.ToUpper(prop)
+		if strings.HasPrefix(name, "DTSTART") || strings.HasPrefix(name, "RRULE:") {
+			return true
+		}
+	}
+	return false
+}
+
+// in resolves the time, placing floating times in loc
+func (it icalTime) in(loc *time.Location) time.Time {
+	if it.loc != nil {
+		loc = it.loc
+	}
+	return time.Date(it.year, it.month, it.day, it.hour, it.minute, it.second, 0, loc)
+}
+
+func (it icalTime) sameDay(t time.Time) bool {
+	y, m, d := t.Date()
+	return y == it.year && m == it.month && d == it.day
+}
+
+func parseICalTime(value string, params map[string]string) (icalTime, error) {
+	it := icalTime{}
+	if tzid, ok := params["TZID"]; ok {
+		loc, err := time.LoadLocation(tzid)
+		if err != nil {
+			return it, fmt.Errorf("unknown timezone %s", tzid)
+		}
+		it.loc = loc
+	}
+
+	layout := "20060102T150405"
+	switch {
+	case params["VALUE"] == "DATE" || len(value) == 8:
+		layout = "20060102"
+		it.date = true
+	case strings.HasSuffix(value, "Z"):
+		if it.loc != nil {
+			return it, fmt.Errorf("%s is in UTC but also has a TZID", value)
+		}
+		value = strings.TrimSuffix(value, "Z")
+		it.loc = time.UTC
+	}
+
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return it, fmt.Errorf("invalid date %q, expected YYYYMMDD or YYYYMMDDTHHMMSS", value)
+	}
+
+	it.year, it.month, it.day = t.Date()
+	it.hour, it.minute, it.second = t.Clock()
+	return it, nil
+}
+
+func parseICalDuration(value string) (time.Duration, error) {
+	match := icalDuration.FindStringSubmatch(value)
+	if match == nil || value == "P" || strings.HasSuffix(value, "T") {
+		return 0, fmt.Errorf("invalid duration %q, expected something like PT4H or P1DT30M", value)
+	}
+
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	total := time.Duration(0)
+	for i, unit := range units {
+		if match[i+1] != "" {
+			n, _ := strconv.Atoi(match[i+1])
+			total += time.Duration(n) * unit
+		}
+	}
+
+	if total <= 0 {
+		return 0, fmt.Errorf("duration %q is empty", value)
+	}
+	return total, nil
+}
+
+func parseRRule(value string) (*rrule, error) {
+	r := &rrule{interval: 1, wkst: time.Monday}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(value, ";") {
+		key, val, found := strings.Cut(part, "=")
+		if !found || val == "" {
+			return nil, fmt.Errorf("expected KEY=VALUE in rule, got %q", part)
+		}
+
+		key = strings.ToUpper(key)
+		if seen[key] {
+			return nil, fmt.Errorf("%s is set more than once", key)
+		}
+		seen[key] = true
+
+		var err error
+		switch key {
+		case "FREQ":
+			r.freq = strings.ToUpper(val)
+			if r.freq != "DAILY" && r.freq != "WEEKLY" && r.freq != "MONTHLY" && r.freq != "YEARLY" {
+				return nil, fmt.Errorf("unsupported FREQ %s, expected DAILY, WEEKLY, MONTHLY or YEARLY", val)
+			}
+		case "INTERVAL":
+			if r.interval, err = strconv.Atoi(val); err != nil || r.interval < 1 {
+				return nil, fmt.Errorf("invalid INTERVAL %s, expected a positive number", val)
+			}
+		case "COUNT":
+			if r.count, err = strconv.Atoi(val); err != nil || r.count < 1 {
+				return nil, fmt.Errorf("invalid COUNT %s, expected a positive number", val)
+			}
+		case "UNTIL":
+			until, err := parseICalTime(val, map[string]string{})
+			if err != nil {
+				return nil, fmt.Errorf("invalid UNTIL: %w", err)
+			}
+			r.until = &until
+		case "BYDAY":
+			for _, item := range strings.Split(val, ",") {
+				wd, err := parseWeekdayNum(item)
+				if err != nil {
+					return nil, err
+				}
+				r.byDay = append(r.byDay, wd)
+			}
+		case "BYMONTHDAY":
+			for _, item := range strings.Split(val, ",") {
+				n, err := strconv.Atoi(item)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return nil, fmt.Errorf("invalid BYMONTHDAY %s, expected 1 through 31 or -31 through -1", item)
+				}
+				r.byMonthDay = append(r.byMonthDay, n)
+			}
+		case "BYMONTH":
+			for _, item := range strings.Split(val, ",") {
+				n, err := strconv.Atoi(item)
+				if err != nil || n < 1 || n > 12 {
+					return nil, fmt.Errorf("invalid BYMONTH %s, expected 1 through 12", item)
+				}
+				r.byMonth = append(r.byMonth, time.Month(n))
+			}
+		case "WKST":
+			day, ok := icalWeekdays[strings.ToUpper(val)]
+			if !ok {
+				return nil, fmt.Errorf("invalid WKST %s, expected one of MO, TU, WE, TH, FR, SA or SU", val)
+			}
+			r.wkst = day
+		default:
+			return nil, fmt.Errorf("unsupported rule part %s, expected FREQ, INTERVAL, COUNT, UNTIL, BYDAY, BYMONTHDAY, BYMONTH or WKST", key)
+		}
+	}
+
+	if r.freq == "" {
+		return nil, fmt.Errorf("rule has no FREQ")
+	}
+
+	if r.count > 0 && r.until != nil {
+		return nil, fmt.Errorf("rule can't have both COUNT and UNTIL")
+	}
+
+	for _, wd := range r.byDay {
+		if wd.n != 0 && r.freq != "MONTHLY" && r.freq != "YEARLY" {
+			return nil, fmt.Errorf("numbered BYDAY values only work with MONTHLY or YEARLY rules")
+		}
+	}
+
+	if r.freq == "YEARLY" && len(r.byDay) > 0 && len(r.byMonth) == 0 {
+		return nil, fmt.Errorf("YEARLY rules with BYDAY need BYMONTH")
+	}
+
+	return r, nil
+}
+
+func parseWeekdayNum(src string) (weekdayNum, error) {
+	src = strings.ToUpper(src)
+	if len(src) < 2 {
+		return weekdayNum{}, fmt.Errorf("invalid BYDAY %q", src)
+	}
+
+	day, ok := icalWeekdays[src[len(src)-2:]]
+	if !ok {
+		return weekdayNum{}, fmt.Errorf("invalid BYDAY %q, expected weekdays like MO or -1FR", src)
+	}
+
+	wd := weekdayNum{day: day}
+	if prefix := src[:len(src)-2]; prefix != "" {
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return weekdayNum{}, fmt.Errorf("invalid BYDAY %q, ordinals go from -5 to 5", src)
+		}
+		wd.n = n
+	}
+	return wd, nil
+}
+
+// parseRecurrence parses iCalendar properties into a recurrence
+func parseRecurrence(src string) (*recurrence, error) {
+	rec := &recurrence{}
+	var end *icalTime
+	hasStart := false
+
+	for _, prop := range strings.Fields(src) {
+		nameAndParams, value, found := strings.Cut(prop, ":")
+		if !found || value == "" {
+			return nil, fmt.Errorf("expected NAME:VALUE, got %q", prop)
+		}
+
+		params := map[string]string{}
+		parts := strings.Split(nameAndParams, ";")
+		name := strings.ToUpper(parts[0])
+		for _, param := range parts[1:] {
+			k, v, _ := strings.Cut(param, "=")
+			params[strings.ToUpper(k)] = v
+		}
+
+		switch name {
+		case "DTSTART":
+			if hasStart {
+				return nil, fmt.Errorf("DTSTART is set more than once")
+			}
+			start, err := parseICalTime(value, params)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DTSTART: %w", err)
+			}
+			rec.start = start
+			hasStart = true
+		case "DTEND":
+			t, err := parseICalTime(value, params)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DTEND: %w", err)
+			}
+			end = &t
+		case "DURATION":
+			d, err := parseICalDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			rec.duration = d
+		case "RRULE":
+			r, err := parseRRule(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RRULE: %w", err)
+			}
+			rec.rules = append(rec.rules, r)
+		case "RDATE", "EXDATE":
+			for _, item := range strings.Split(value, ",") {
+				t, err := parseICalTime(item, params)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s: %w", name, err)
+				}
+				if name == "RDATE" {
+					rec.rdates = append(rec.rdates, t)
+				} else {
+					rec.exdates = append(rec.exdates, t)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unsupported property %s, expected DTSTART, DTEND, DURATION, RRULE, RDATE or EXDATE", name)
+		}
+	}
+
+	if !hasStart {
+		return nil, fmt.Errorf("DTSTART is required")
+	}
+
+	if end != nil {
+		if rec.duration != 0 {
+			return nil, fmt.Errorf("use either DTEND or DURATION, not both")
+		}
+		rec.duration = end.in(time.UTC).Sub(rec.start.in(time.UTC))
+		if rec.duration <= 0 {
+			return nil, fmt.Errorf("DTEND must be after DTSTART")
+		}
+	}
+
+	if rec.duration == 0 {
+		if !rec.start.date {
+			return nil, fmt.Errorf("DURATION or DTEND is required when DTSTART has a time")
+		}
+		rec.duration = 24 * time.Hour
+	}
+
+	return rec, nil
+}
+
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// monthDays returns the days in a month matched by the rule, sorted
+func (r *rrule) monthDays(year int, month time.Month, fallback int) []int {
+	last := daysIn(year, month)
+	if len(r.byMonthDay) == 0 && len(r.byDay) == 0 {
+		if fallback > last {
+			return nil
+		}
+		return []int{fallback}
+	}
+
+	byMonthDay := map[int]bool{}
+	for _, n := range r.byMonthDay {
+		if n < 0 {
+			n = last + 1 + n
+		}
+		byMonthDay[n] = true
+	}
+
+	byDay := map[int]bool{}
+	for _, wd := range r.byDay {
+		first := int(wd.day-time.Date(year, month, 1, 0, 0, 0, 0, time.UTC).Weekday()+7)%7 + 1
+		matching := []int{}
+		for d := first; d <= last; d += 7 {
+			matching = append(matching, d)
+		}
+
+		switch {
+		case wd.n == 0:
+			for _, d := range matching {
+				byDay[d] = true
+			}
+		case wd.n > 0 && wd.n <= len(matching):
+			byDay[matching[wd.n-1]] = true
+		case wd.n < 0 && -wd.n <= len(matching):
+			byDay[matching[len(matching)+wd.n]] = true
+		}
+	}
+
+	days := []int{}
+	for d := 1; d <= last; d++ {
+		inMonthDays := len(r.byMonthDay) == 0 || byMonthDay[d]
+		inDays := len(r.byDay) == 0 || byDay[d]
+		if inMonthDays && inDays {
+			days = append(days, d)
+		}
+	}
+	return days
+}
+
+func (r *rrule) inMonth(month time.Month) bool {
+	if len(r.byMonth) == 0 {
+		return true
+	}
+	for _, m := range r.byMonth {
+		if m == month {
+			return true
+		}
+	}
+	return false
+}
+
+// period returns the beginning of the nth period since start, and the occurrences in it
+func (r *rrule) period(start time.Time, n int) (time.Time, []time.Time) {
+	loc := start.Location()
+	year, month, day := start.Date()
+	h, m, s := start.Clock()
+	at := func(y int, mo time.Month, d int) time.Time {
+		return time.Date(y, mo, d, h, m, s, 0, loc)
+	}
+
+	occurrences := []time.Time{}
+	switch r.freq {
+	case "DAILY":
+		t := at(year, month, day+n*r.interval)
+		base := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		if !r.inMonth(t.Month()) {
+			return base, nil
+		}
+		if len(r.byMonthDay) > 0 || len(r.byDay) > 0 {
+			if days := r.monthDays(t.Year(), t.Month(), t.Day()); !containsInt(days, t.Day()) {
+				return base, nil
+			}
+		}
+		return base, []time.Time{t}
+	case "WEEKLY":
+		offset := int(start.Weekday()-r.wkst+7) % 7
+		weekStart := time.Date(year, month, day-offset+n*r.interval*7, 0, 0, 0, 0, loc)
+		weekdays := []int{}
+		for _, wd := range r.byDay {
+			weekdays = append(weekdays, int(wd.day-r.wkst+7)%7)
+		}
+		if len(weekdays) == 0 {
+			weekdays = []int{offset}
+		}
+		sort.Ints(weekdays)
+
+		for _, wd := range weekdays {
+			t := at(weekStart.Year(), weekStart.Month(), weekStart.Day()+wd)
+			if r.inMonth(t.Month()) {
+				occurrences = append(occurrences, t)
+			}
+		}
+		return weekStart, occurrences
+	case "MONTHLY":
+		first := time.Date(year, month+time.Month(n*r.interval), 1, 0, 0, 0, 0, loc)
+		if !r.inMonth(first.Month()) {
+			return first, nil
+		}
+		for _, d := range r.monthDays(first.Year(), first.Month(), day) {
+			occurrences = append(occurrences, at(first.Year(), first.Month(), d))
+		}
+		return first, occurrences
+	}
+
+	// YEARLY
+	first := time.Date(year+n*r.interval, time.January, 1, 0, 0, 0, 0, loc)
+	months := r.byMonth
+	if len(months) == 0 {
+		months = []time.Month{month}
+	}
+	sorted := append([]time.Month{}, months...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for _, mo := range sorted {
+		for _, d := range r.monthDays(first.Year(), mo, day) {
+			occurrences = append(occurrences, at(first.Year(), mo, d))
+		}
+	}
+	return first, occurrences
+}
+
+func containsInt(list []int, n int) bool {
+	for _, i := range list {
+		if i == n {
+			return true
+		}
+	}
+	return false
+}
+
+// each calls fn with the rule's occurrences in order, starting at start, until limit
+func (r *rrule) each(start, limit time.Time, fn func(time.Time)) {
+	var until time.Time
+	if r.until != nil {
+		until = r.until.in(start.Location())
+		if r.until.date {
+			until = until.Add(24*time.Hour - time.Second)
+		}
+	}
+
+	count := 0
+	for n := 0; ; n++ {
+		base, occurrences := r.period(start, n)
+		if base.After(limit) || (!until.IsZero() && base.After(until)) {
+			return
+		}
+
+		for _, t := range occurrences {
+			if t.Before(start) {
+				continue
+			}
+
+			if (!until.IsZero() && t.After(until)) || t.After(limit) {
+				return
+			}
+
+			count++
+			if r.count > 0 && count > r.count {
+				return
+			}
+			fn(t)
+		}
+	}
+}
+
+func (rec *recurrence) excluded(t time.Time) bool {
+	for _, ex := range rec.exdates {
+		if ex.date && ex.sameDay(t) {
+			return true
+		}
+		if !ex.date && ex.in(t.Location()).Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// each calls fn with the start of every occurrence until limit, in no particular order
+func (rec *recurrence) each(loc *time.Location, limit time.Time, fn func(time.Time)) {
+	start := rec.start.in(loc)
+	emit := func(t time.Time) {
+		if !rec.excluded(t) {
+			fn(t)
+		}
+	}
+
+	if !start.After(limit) {
+		emit(start)
+	}
+
+	for _, r := range rec.rules {
+		r.each(start, limit, func(t time.Time) {
+			if !t.Equal(start) {
+				emit(t)
+			}
+		})
+	}
+
+	for _, rdate := range rec.rdates {
+		t := rdate.in(loc)
+		if rdate.date {
+			t = time.Date(t.Year(), t.Month(), t.Day(), start.Hour(), start.Minute(), start.Second(), 0, t.Location())
+		}
+		if !t.After(limit) {
+			emit(t)
+		}
+	}
+}
+
+func (rec *recurrence) allowedAt(t time.Time) bool {
+	allowed := false
+	rec.each(t.Location(), t, func(start time.Time) {
+		allowed = allowed || start.Add(rec.duration).After(t)
+	})
+	return allowed
+}
+
+func (rec *recurrence) windows(from, limit time.Time) []Window {
+	windows := []Window{}
+	rec.each(from.Location(), limit, func(start time.Time) {
+		if end := start.Add(rec.duration); end.After(from) {
+			windows = append(windows, Window{Start: start, End: end})
+		}
+	})
+	return windows
+}
@@ -0,0 +1,151 @@
+package user_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/user"
+)
+
+func TestRecurrenceAllowedAt(t *testing.T) {
+	cases := map[string]map[time.Time]bool{
+		// the cleaner, every other tuesday from 9 to 13
+		"DTSTART:20261020T090000 DURATION:PT4H RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=TU": {
+			at(20, "09:00"): true,
+			at(20, "12:59"): true,
+			at(20, "13:00"): false,
+			at(20, "08:59"): false,
+			at(27, "10:00"): false,
+			at(13, "10:00"): false,
+			time.Date(2026, 11, 3, 10, 0, 0, 0, time.UTC): true,
+		},
+		"DTSTART:20261019T220000 DTEND:20261020T020000 RRULE:FREQ=DAILY;BYDAY=MO,FR": {
+			at(19, "23:00"): true,
+			at(20, "01:30"): true,
+			at(20, "23:00"): false,
+			at(24, "01:00"): true,
+		},
+		"DTSTART:20261020T090000 DURATION:PT1H RRULE:FREQ=DAILY;COUNT=3 EXDATE:20261021T090000": {
+			at(20, "09:30"): true,
+			at(21, "09:30"): false,
+			at(22, "09:30"): true,
+			at(23, "09:30"): false,
+		},
+		"DTSTART:20261001T180000 DURATION:PT2H RRULE:FREQ=MONTHLY;BYDAY=-1FR": {
+			at(30, "19:00"): true,
+			at(23, "19:00"): false,
+			time.Date(2026, 11, 27, 19, 0, 0, 0, time.UTC): true,
+		},
+		"DTSTART;VALUE=DATE:20261019 RRULE:FREQ=WEEKLY;UNTIL=20261026 EXDATE;VALUE=DATE:20261026": {
+			at(19, "00:00"): true,
+			at(19, "23:59"): true,
+			at(20, "12:00"): false,
+			at(26, "12:00"): false,
+			time.Date(2026, 11, 2, 12, 0, 0, 0, time.UTC): false,
+		},
+		"DTSTART:20261024T100000 DURATION:PT30M RDATE:20261025T170000": {
+			at(24, "10:15"): true,
+			at(25, "17:15"): true,
+			at(25, "10:15"): false,
+		},
+	}
+
+	for src, checks := range cases {
+		sch, err := user.ParseSchedule(src)
+		if err != nil {
+			t.Fatalf("could not parse %q: %s", src, err)
+		}
+
+		for when, expected := range checks {
+			if got := sch.AllowedAt(when); got != expected {
+				t.Errorf("%q at %s: expected %v, got %v", src, when.Format("Mon 2006-01-02 15:04"), expected, got)
+			}
+		}
+	}
+}
+
+func TestRecurrenceTimezones(t *testing.T) {
+	house, err := time.LoadLocation("America/Mexico_City")
+	if err != nil {
+		t.Skipf("no timezone data: %s", err)
+	}
+
+	floating, _ := user.ParseSchedule("DTSTART:20261020T090000 DURATION:PT4H RRULE:FREQ=DAILY")
+	if !floating.AllowedAt(time.Date(2026, 10, 21, 9, 30, 0, 0, house)) {
+		t.Error("expected floating times to be in the house's timezone")
+	}
+
+	utc, _ := user.ParseSchedule("DTSTART:20261020T150000Z DURATION:PT1H RRULE:FREQ=DAILY")
+	if !utc.AllowedAt(time.Date(2026, 10, 21, 9, 30, 0, 0, house)) || utc.AllowedAt(time.Date(2026, 10, 21, 15, 30, 0, 0, house)) {
+		t.Error("expected utc times to stay in utc")
+	}
+
+	zoned, _ := user.ParseSchedule("DTSTART;TZID=America/Mexico_City:20261020T090000 DURATION:PT1H RRULE:FREQ=DAILY")
+	if !zoned.AllowedAt(time.Date(2026, 10, 21, 15, 30, 0, 0, time.UTC)) {
+		t.Error("expected zoned times to use their timezone")
+	}
+}
+
+func TestRecurrenceParseErrors(t *testing.T) {
+	for src, message := range map[string]string{
+		"RRULE:FREQ=DAILY":                                                              "DTSTART is required",
+		"DTSTART:20261020T090000":                                                       "DURATION or DTEND is required",
+		"DTSTART:20261020T090000 DURATION:PT0H":                                         "empty",
+		"DTSTART:20261020T090000 DURATION:4h":                                           "invalid duration",
+		"DTSTART:2026-10-20 DURATION:PT1H":                                              "invalid date",
+		"DTSTART;TZID=Mars/Olympus:20261020T090000 DURATION:PT1H":                       "unknown timezone",
+		"DTSTART:20261020T090000 DTEND:20261020T080000":                                 "after DTSTART",
+		"DTSTART:20261020T090000 DURATION:PT1H RRULE:INTERVAL=2":                        "no FREQ",
+		"DTSTART:20261020T090000 DURATION:PT1H RRULE:FREQ=HOURLY":                       "unsupported FREQ",
+		"DTSTART:20261020T090000 DURATION:PT1H RRULE:FREQ=DAILY;BYHOUR=9":               "unsupported rule part",
+		"DTSTART:20261020T090000 DURATION:PT1H RRULE:FREQ=WEEKLY;BYDAY=1TU":             "numbered BYDAY",
+		"DTSTART:20261020T090000 DURATION:PT1H RRULE:FREQ=YEARLY;BYDAY=TU":              "need BYMONTH",
+		"DTSTART:20261020T090000 DURATION:PT1H RRULE:FREQ=DAILY;COUNT=2;UNTIL=20261030": "both COUNT and UNTIL",
+		"DTSTART:20261020T090000 DURATION:PT1H SUMMARY:cleaning":                        "unsupported property",
+	} {
+		_, err := user.ParseSchedule(src)
+		if err == nil {
+			t.Errorf("expected %q to fail", src)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), message) {
+			t.Errorf("expected error for %q to mention %q, got: %s", src, message, err)
+		}
+	}
+}
+
+func TestNextWindows(t *testing.T) {
+	cleaner, _ := user.ParseSchedule("DTSTART:20261006T090000 DURATION:PT4H RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=TU EXDATE:20261103T090000")
+	windows := cleaner.NextWindows(at(20, "10:00"), 3)
+	// the window already open starts now
+	expected := []time.Time{at(20, "10:00"), time.Date(2026, 11, 17, 9, 0, 0, 0, time.UTC), time.Date(2026, 12, 1, 9, 0, 0, 0, time.UTC)}
+	if len(windows) != len(expected) {
+		t.Fatalf("expected %d windows, got %v", len(expected), windows)
+	}
+	for i, w := range windows {
+		if !w.Start.Equal(expected[i]) || !w.End.Equal(time.Date(w.Start.Year(), w.Start.Month(), w.Start.Day(), 13, 0, 0, 0, time.UTC)) {
+			t.Errorf("unexpected window %d: %s - %s", i, w.Start, w.End)
+		}
+	}
+
+	grammar, _ := user.ParseSchedule("days=mon,fri hours=22-02; days=tue hours=0-1")
+	windows = grammar.NextWindows(at(19, "12:00"), 2)
+	if len(windows) != 2 {
+		t.Fatalf("expected 2 windows, got %v", windows)
+	}
+	// monday night runs into tuesday's own window
+	if !windows[0].Start.Equal(at(19, "22:00")) || !windows[0].End.Equal(at(20, "02:00")) {
+		t.Errorf("unexpected first window %s - %s", windows[0].Start, windows[0].End)
+	}
+	if !windows[1].Start.Equal(at(23, "22:00")) || !windows[1].End.Equal(at(24, "02:00")) {
+		t.Errorf("unexpected second window %s - %s", windows[1].Start, windows[1].End)
+	}
+
+	always, _ := user.ParseSchedule("")
+	windows = always.NextWindows(at(19, "12:00"), 5)
+	if len(windows) != 1 || !windows[0].Start.Equal(at(19, "12:00")) || !windows[0].End.Equal(at(19, "12:00").Add(user.ScheduleHorizon)) {
+		t.Errorf("expected a single window until the horizon, got %v", windows)
+	}
+}
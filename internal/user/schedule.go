@@ -6,6 +6,8 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -14,31 +16,85 @@ import (
 	"github.com/upper/db/v4"
 )
 
-func parseHour(src string) (float64, error) {
-	hm := strings.Split(src, ":")
-	if len(hm) == 1 {
-		return strconv.ParseFloat(hm[0], 32)
-	}
+// Schedule limits when users may open the door. It's made of windows separated
+// by `;`, each a space separated list of conditions that must all hold:
+//
+//   - `days=mon-fri,sun` weekdays as names (english or spanish) or numbers,
+//     with sunday being 0, ranges may wrap around the week, i.e. `fri-mon`
+//   - `hours=9-13,15:30-19` ranges start inclusive and end exclusive, ranges
+//     ending before they start run overnight, i.e. `22:00-02:00`, and belong to
+//     the day they start in
+//   - `dates=2026-12-20/2027-01-06,2027-02-14` inclusive date ranges or single dates
+//
+// Windows starting with `except` deny access whenever they match. Access is
+// allowed when any other window, or no window at all, matches. For example:
+//
+//	days=mon-fri hours=9-18; days=sat hours=10-14; except dates=2026-12-24/2026-12-25
+//
+// Schedules saved by earlier versions, like `days=1-5 hours=9.5-17`, still
+// parse, with a few differences: ranges used to include the instant they end
+// at, which is now left out, and reversed ones like `days=5-1` or `hours=17-9`
+// used to match nothing, while they now wrap around the week or run overnight.
+// Stored schedules the grammar rejects, i.e. with unknown conditions, are read
+// the way those versions did, see parseLegacy
+//
+// Schedules may also be written as iCalendar recurrence rules, see recurrence
+type Schedule struct {
+	src        string
+	windows    []scheduleWindow
+	exceptions []scheduleWindow
+	recurrence *recurrence
+}
 
-	if len(hm) == 2 {
-		h, err := strconv.ParseFloat(hm[0], 32)
-		if err != nil {
-			return 0.0, err
-		}
-		m, err := strconv.ParseFloat(hm[1], 32)
-		if err != nil {
-			return 0.0, err
-		}
-		return h + (m / 60.0), nil
-	}
+// Window is a span of time users are allowed in
+type Window struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
 
-	return 0.0, fmt.Errorf("unknown format for hour: %s", hm)
+// ScheduleHorizon is how far ahead NextWindows looks
+const ScheduleHorizon = 2 * 366 * 24 * time.Hour
+
+// scheduleWindow matches when all of its conditions do, missing conditions always match
+type scheduleWindow struct {
+	days  *[7]bool
+	hours []hourRange
+	dates []dateRange
 }
 
-type Schedule struct {
-	src   string
-	days  []int
-	hours []float64
+// hourRange spans minutes since midnight
+type hourRange struct {
+	from  int
+	until int
+}
+
+// dateRange spans dates as yyyymmdd integers
+type dateRange struct {
+	from  int
+	until int
+}
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday, "dom": time.Sunday, "domingo": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday, "lun": time.Monday, "lunes": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday, "mar": time.Tuesday, "martes": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday, "mie": time.Wednesday, "mié": time.Wednesday, "miercoles": time.Wednesday, "miércoles": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday, "jue": time.Thursday, "jueves": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday, "vie": time.Friday, "viernes": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday, "sab": time.Saturday, "sáb": time.Saturday, "sabado": time.Saturday, "sábado": time.Saturday,
+}
+
+// ParseSchedule parses a schedule, failing with a description of the first problem it finds
+func ParseSchedule(src string) (*Schedule, error) {
+	sch := &Schedule{src: src}
+	if err := sch.Parse(); err != nil {
+		return nil, err
+	}
+	return sch, nil
+}
+
+func (d Schedule) String() string {
+	return d.src
 }
 
 func (d Schedule) MarshalDB() (any, error) {
@@ -64,10 +120,289 @@ func (d *Schedule) UnmarshalJSON(value []byte) error {
 }
 
 func (d *Schedule) Parse() error {
-	for _, kv := range strings.Split(d.src, " ") {
-		kvSlice := strings.Split(kv, "=")
-		key := kvSlice[0]
-		values := strings.Split(kvSlice[1], "-")
+	d.windows = nil
+	d.exceptions = nil
+	d.recurrence = nil
+
+	if isRecurrence(d.src) {
+		rec, err := parseRecurrence(d.src)
+		if err != nil {
+			return fmt.Errorf("invalid icalendar schedule: %w", err)
+		}
+		d.recurrence = rec
+		return nil
+	}
+
+	for i, src := range strings.Split(d.src, ";") {
+		src = strings.TrimSpace(src)
+		if src == "" {
+			if strings.TrimSpace(d.src) == "" {
+				return nil
+			}
+			return fmt.Errorf("schedule window %d is empty, remove the extra `;`", i+1)
+		}
+
+		except := false
+		if rest, found := strings.CutPrefix(src, "except"); found && (rest == "" || rest[0] == ' ') {
+			except = true
+			src = strings.TrimSpace(rest)
+			if src == "" {
+				return fmt.Errorf("schedule window %d has nothing after `except`", i+1)
+			}
+		}
+
+		window, err := parseWindow(src)
+		if err != nil {
+			return fmt.Errorf("schedule window %d (%s): %w", i+1, src, err)
+		}
+
+		if except {
+			d.exceptions = append(d.exceptions, window)
+		} else {
+			d.windows = append(d.windows, window)
+		}
+	}
+
+	return nil
+}
+
+func parseWindow(src string) (scheduleWindow, error) {
+	window := scheduleWindow{}
+	seen := map[string]bool{}
+	for _, kv := range strings.Fields(src) {
+		key, value, found := strings.Cut(kv, "=")
+		if !found || value == "" {
+			return window, fmt.Errorf("expected key=value, got %q", kv)
+		}
+
+		if seen[key] {
+			return window, fmt.Errorf("%s is set more than once, list values separated by commas instead", key)
+		}
+		seen[key] = true
+
+		var err error
+		switch key {
+		case "days":
+			window.days, err = parseDays(value)
+		case "hours":
+			window.hours, err = parseHours(value)
+		case "dates":
+			window.dates, err = parseDates(value)
+		default:
+			err = fmt.Errorf("unknown condition %q, expected days, hours or dates", key)
+		}
+
+		if err != nil {
+			return window, err
+		}
+	}
+
+	return window, nil
+}
+
+func parseDay(src string) (time.Weekday, error) {
+	if n, err := strconv.Atoi(src); err == nil {
+		if n < 0 || n > 6 {
+			return 0, fmt.Errorf("day %d is out of range, expected 0 (sunday) through 6 (saturday)", n)
+		}
+		return time.Weekday(n), nil
+	}
+
+	if day, ok := dayNames[strings.ToLower(src)]; ok {
+		return day, nil
+	}
+	return 0, fmt.Errorf("unknown day %q, expected a number from 0 to 6 or a name like mon or lun", src)
+}
+
+func parseDays(src string) (*[7]bool, error) {
+	days := &[7]bool{}
+	for _, item := range strings.Split(src, ",") {
+		fromSrc, untilSrc, isRange := strings.Cut(item, "-")
+		from, err := parseDay(fromSrc)
+		if err != nil {
+			return nil, err
+		}
+
+		until := from
+		if isRange {
+			if until, err = parseDay(untilSrc); err != nil {
+				return nil, err
+			}
+		}
+
+		for day := from; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == until {
+				break
+			}
+		}
+	}
+
+	logrus.Debugf("Parsed schedule days %s as %v", src, days)
+	return days, nil
+}
+
+// parseHour returns minutes since midnight for `h` or `h:mm`. Schedules saved
+// before windows existed may also use fractional hours like `9.5` and single
+// digit minutes like `9:5`, which are still accepted
+func parseHour(src string) (int, error) {
+	hSrc, mSrc, hasMinutes := strings.Cut(src, ":")
+	minutes := 0
+	if !hasMinutes && strings.Contains(hSrc, ".") {
+		h, err := strconv.ParseFloat(hSrc, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid hour %q, expected h or h:mm", src)
+		}
+		minutes = int(math.Round(h * 60))
+	} else {
+		h, err := strconv.Atoi(hSrc)
+		if err != nil {
+			return 0, fmt.Errorf("invalid hour %q, expected h or h:mm", src)
+		}
+
+		m := 0
+		if hasMinutes {
+			if len(mSrc) == 0 || len(mSrc) > 2 {
+				return 0, fmt.Errorf("invalid minutes in %q, expected one or two digits", src)
+			}
+			if m, err = strconv.Atoi(mSrc); err != nil || m < 0 || m > 59 {
+				return 0, fmt.Errorf("invalid minutes in %q, expected 00 through 59", src)
+			}
+		}
+		minutes = h*60 + m
+	}
+
+	if minutes < 0 || minutes > 24*60 {
+		return 0, fmt.Errorf("hour %q is out of range, expected 0 through 24", src)
+	}
+	return minutes, nil
+}
+
+func parseHours(src string) ([]hourRange, error) {
+	hours := []hourRange{}
+	for _, item := range strings.Split(src, ",") {
+		fromSrc, untilSrc, found := strings.Cut(item, "-")
+		if !found {
+			return nil, fmt.Errorf("expected a range of hours like 9-17, got %q", item)
+		}
+
+		from, err := parseHour(fromSrc)
+		if err != nil {
+			return nil, err
+		}
+
+		until, err := parseHour(untilSrc)
+		if err != nil {
+			return nil, err
+		}
+
+		if from == until {
+			return nil, fmt.Errorf("hours %q start and end at the same time", item)
+		}
+
+		if from == 24*60 {
+			return nil, fmt.Errorf("hours %q start at 24, use 0 instead", item)
+		}
+
+		if until == 0 {
+			until = 24 * 60
+		}
+
+		hours = append(hours, hourRange{from, until})
+	}
+
+	logrus.Debugf("Parsed schedule hours %s as %v", src, hours)
+	return hours, nil
+}
+
+func dateKey(t time.Time) int {
+	y, m, d := t.Date()
+	return y*10000 + int(m)*100 + d
+}
+
+func parseDate(src string) (int, error) {
+	t, err := time.Parse("2006-01-02", src)
+	if err != nil {
+		return 0, fmt.Errorf("invalid date %q, expected yyyy-mm-dd", src)
+	}
+	return dateKey(t), nil
+}
+
+func parseDates(src string) ([]dateRange, error) {
+	dates := []dateRange{}
+	for _, item := range strings.Split(src, ",") {
+		fromSrc, untilSrc, isRange := strings.Cut(item, "/")
+		from, err := parseDate(fromSrc)
+		if err != nil {
+			return nil, err
+		}
+
+		until := from
+		if isRange {
+			if until, err = parseDate(untilSrc); err != nil {
+				return nil, err
+			}
+		}
+
+		if until < from {
+			return nil, fmt.Errorf("dates %q end before they start", item)
+		}
+
+		dates = append(dates, dateRange{from, until})
+	}
+	return dates, nil
+}
+
+func (d *Schedule) Scan(value any) error {
+	if value == nil {
+		return nil
+	}
+
+	var src string
+	var ok bool
+	if src, ok = value.(string); !ok {
+		raw, isBytes := value.([]byte)
+		if !isBytes {
+			return fmt.Errorf("cannot scan schedule from %T", value)
+		}
+		if err := json.Unmarshal(raw, &src); err != nil {
+			return err
+		}
+	}
+
+	d.src = src
+	if err := d.Parse(); err != nil {
+		// schedules are only validated since windows exist, so stored ones may
+		// not follow the grammar, and failing here keeps their users from loading
+		if legacyErr := d.parseLegacy(); legacyErr != nil {
+			return err
+		}
+		logrus.Warnf("Reading schedule %q as saved by earlier versions: %s", src, err)
+	}
+	return nil
+}
+
+// parseLegacy reads a schedule the way versions before windows did, ignoring
+// unknown conditions. Days and hours are single ranges that include both ends
+// and never wrap, so reversed ones match nothing
+func (d *Schedule) parseLegacy() error {
+	d.windows = nil
+	d.exceptions = nil
+	d.recurrence = nil
+
+	window := scheduleWindow{}
+	never := false
+	for _, kv := range strings.Fields(d.src) {
+		key, value, found := strings.Cut(kv, "=")
+		if !found {
+			return fmt.Errorf("expected key=value, got %q", kv)
+		}
+
+		values := strings.Split(value, "-")
+		if (key == "days" || key == "hours") && len(values) < 2 {
+			return fmt.Errorf("expected %s=from-until, got %q", key, kv)
+		}
+
 		switch key {
 		case "days":
 			from, err := strconv.Atoi(values[0])
@@ -78,66 +413,242 @@ func (d *Schedule) Parse() error {
 			if err != nil {
 				return err
 			}
-			logrus.Debugf("Parsed schedule days from: %d until %d", from, until)
-			d.days = []int{from, until}
+
+			window.days = &[7]bool{}
+			for day := from; day <= until; day++ {
+				if day >= 0 && day < 7 {
+					window.days[day] = true
+				}
+			}
 		case "hours":
-			from, err := parseHour(values[0])
+			from, err := parseLegacyHour(values[0])
 			if err != nil {
 				return err
 			}
-			until, err := parseHour(values[1])
+			until, err := parseLegacyHour(values[1])
 			if err != nil {
 				return err
 			}
-			logrus.Debugf("Parsed schedule hours from: %f until %f", from, until)
-			d.hours = []float64{from, until}
+
+			// a little slack, so float noise in i.e. 9.1 hours does not lose a minute
+			r := hourRange{int(math.Ceil(from*60 - 1e-6)), int(math.Floor(until*60 + 1e-6))}
+			r.from = int(math.Max(float64(r.from), 0))
+			r.until = int(math.Min(float64(r.until), 24*60))
+			never = r.from >= r.until
+			window.hours = []hourRange{r}
 		}
 	}
+
+	if never {
+		window.days = &[7]bool{}
+	}
+	d.windows = []scheduleWindow{window}
 	return nil
 }
 
-func (d *Schedule) Scan(value any) error {
-	if value == nil {
-		return nil
+// parseLegacyHour reads `h` or `h:m` as fractional hours, with h and m possibly fractional too
+func parseLegacyHour(src string) (float64, error) {
+	hSrc, mSrc, hasMinutes := strings.Cut(src, ":")
+	h, err := strconv.ParseFloat(hSrc, 64)
+	if err != nil || !hasMinutes {
+		return h, err
 	}
 
-	var src string
-	var ok bool
-	if src, ok = value.(string); !ok {
-		if err := json.Unmarshal(value.([]byte), &src); err != nil {
-			return err
-		}
+	m, err := strconv.ParseFloat(mSrc, 64)
+	return h + m/60, err
+}
+
+// day tells if the window's days and dates include the day t is in
+func (w *scheduleWindow) day(t time.Time) bool {
+	if w.days != nil && !w.days[t.Weekday()] {
+		return false
 	}
 
-	d.src = src
+	if w.dates == nil {
+		return true
+	}
 
-	// parsed := UserSchedule{src: src}
-	if err := d.Parse(); err != nil {
-		return err
+	key := dateKey(t)
+	for _, r := range w.dates {
+		if key >= r.from && key <= r.until {
+			return true
+		}
 	}
+	return false
+}
 
-	return nil
+func (w *scheduleWindow) matches(t time.Time) bool {
+	if w.hours == nil {
+		return w.day(t)
+	}
+
+	h, m, _ := t.Clock()
+	minute := h*60 + m
+	for _, r := range w.hours {
+		if r.from < r.until {
+			if minute >= r.from && minute < r.until && w.day(t) {
+				return true
+			}
+			continue
+		}
+
+		// overnight ranges belong to the day they start in
+		if minute >= r.from && w.day(t) {
+			return true
+		}
+		if minute < r.until && w.day(t.AddDate(0, 0, -1)) {
+			return true
+		}
+	}
+	return false
 }
 
 func (sch *Schedule) AllowedAt(t time.Time) bool {
-	weekDay := int(t.Weekday())
-	h, m, s := t.Clock()
-	fractionalHour := float64(h) + (float64(m*60.0+s) / 3600.0)
+	logrus.Debugf("Validating access at %s from rules: %s", t.String(), sch.src)
+	return sch.allowedAt(t)
+}
 
-	logrus.Infof("Validating access at weekday %d, hour %f from rules: days=%v hours=%v at %s", weekDay, fractionalHour, sch.days, sch.hours, t.String())
-	if sch.days != nil {
-		if weekDay < sch.days[0] || weekDay > sch.days[1] {
+func (sch *Schedule) allowedAt(t time.Time) bool {
+	if sch.recurrence != nil {
+		return sch.recurrence.allowedAt(t)
+	}
+
+	for _, w := range sch.exceptions {
+		if w.matches(t) {
 			return false
 		}
 	}
 
-	if sch.hours != nil {
-		if fractionalHour < sch.hours[0] || fractionalHour > sch.hours[1] {
-			return false
+	if len(sch.windows) == 0 {
+		return true
+	}
+
+	for _, w := range sch.windows {
+		if w.matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextWindows returns up to n windows of time allowed by the schedule that end
+// after from, in from's location. Windows already open start at from, and
+// those still open at the end of the ScheduleHorizon end there
+func (sch *Schedule) NextWindows(from time.Time, n int) []Window {
+	limit := from.Add(ScheduleHorizon)
+	var windows []Window
+	if sch.recurrence != nil {
+		windows = sch.recurrence.windows(from, limit)
+	} else {
+		windows = sch.scanWindows(from, limit)
+	}
+
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Start.Before(windows[j].Start) })
+	merged := []Window{}
+	for _, w := range windows {
+		if w.Start.Before(from) {
+			w.Start = from
+		}
+		if w.End.After(limit) {
+			w.End = limit
+		}
+
+		if last := len(merged) - 1; last >= 0 && !w.Start.After(merged[last].End) {
+			if w.End.After(merged[last].End) {
+				merged[last].End = w.End
+			}
+			continue
+		}
+
+		if len(merged) == n {
+			break
+		}
+		merged = append(merged, w)
+	}
+	return merged
+}
+
+// WindowStart returns when the window of time t falls in opened, looking back
+// at most a week
+func (sch *Schedule) WindowStart(t time.Time) (time.Time, bool) {
+	if !sch.allowedAt(t) {
+		return time.Time{}, false
+	}
+
+	from := t.AddDate(0, 0, -7)
+	limit := t.Add(time.Minute)
+	var windows []Window
+	if sch.recurrence != nil {
+		windows = sch.recurrence.windows(from, limit)
+	} else {
+		windows = sch.scanWindows(from, limit)
+	}
+
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Start.Before(windows[j].Start) })
+	var current *Window
+	for i := range windows {
+		w := windows[i]
+		if w.Start.After(t) {
+			break
+		}
+
+		if current != nil && !w.Start.After(current.End) {
+			if w.End.After(current.End) {
+				current.End = w.End
+			}
+			continue
 		}
+		current = &w
 	}
 
-	return true
+	if current == nil || !current.End.After(t) {
+		return time.Time{}, false
+	}
+	return current.Start, true
+}
+
+// scanWindows finds windows day by day, checking the schedule once for every
+// span of time between the hours any window starts or ends at
+func (sch *Schedule) scanWindows(from, limit time.Time) []Window {
+	boundaries := map[int]bool{0: true}
+	for _, w := range append(append([]scheduleWindow{}, sch.windows...), sch.exceptions...) {
+		for _, r := range w.hours {
+			boundaries[r.from] = true
+			boundaries[r.until%(24*60)] = true
+		}
+	}
+
+	minutes := []int{}
+	for m := range boundaries {
+		minutes = append(minutes, m)
+	}
+	sort.Ints(minutes)
+
+	windows := []Window{}
+	var open *Window
+	y, mo, d := from.Date()
+	for day := time.Date(y, mo, d-1, 0, 0, 0, 0, from.Location()); day.Before(limit); day = day.AddDate(0, 0, 1) {
+		for _, m := range minutes {
+			t := time.Date(day.Year(), day.Month(), day.Day(), 0, m, 0, 0, day.Location())
+			allowed := sch.allowedAt(t)
+			switch {
+			case allowed && open == nil:
+				open = &Window{Start: t}
+			case !allowed && open != nil:
+				open.End = t
+				if t.After(from) {
+					windows = append(windows, *open)
+				}
+				open = nil
+			}
+		}
+	}
+
+	if open != nil {
+		open.End = limit
+		windows = append(windows, *open)
+	}
+	return windows
 }
 
 var _ sql.Scanner = &Schedule{}
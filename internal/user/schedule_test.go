@@ -0,0 +1,259 @@
+package user_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/testdb"
+	"git.rob.mx/nidito/puerta/internal/user"
+)
+
+// at returns a time in october 2026, where the 19th is a monday
+func at(day int, clock string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", fmt.Sprintf("2026-10-%02d %s", day, clock))
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestScheduleAllowedAt(t *testing.T) {
+	cases := map[string]map[time.Time]bool{
+		"": {
+			at(19, "03:00"): true,
+		},
+		"days=1-5 hours=8-20:35": {
+			at(19, "08:00"): true,
+			at(19, "20:34"): true,
+			at(19, "20:35"): false,
+			at(19, "07:59"): false,
+			at(25, "12:00"): false,
+		},
+		"days=mon,wed,fri": {
+			at(19, "12:00"): true,
+			at(20, "12:00"): false,
+			at(21, "12:00"): true,
+			at(23, "23:59"): true,
+		},
+		"days=fri-mon": {
+			at(23, "12:00"): true,
+			at(25, "12:00"): true,
+			at(26, "12:00"): true,
+			at(27, "12:00"): false,
+		},
+		"days=vie hours=22:00-02:00": {
+			at(23, "22:00"): true,
+			at(24, "01:59"): true,
+			at(24, "02:00"): false,
+			at(23, "01:00"): false,
+			at(24, "22:30"): false,
+		},
+		"days=mon-fri hours=9-13,15-19; days=sat hours=10-14": {
+			at(19, "14:00"): false,
+			at(19, "16:00"): true,
+			at(24, "11:00"): true,
+			at(25, "11:00"): false,
+		},
+		"dates=2026-10-20/2026-10-22 hours=18-24": {
+			at(20, "23:59"): true,
+			at(22, "18:00"): true,
+			at(23, "18:00"): false,
+			at(20, "12:00"): false,
+		},
+		"days=mon-fri; except dates=2026-10-21,2026-10-23 hours=12-24": {
+			at(21, "11:00"): true,
+			at(21, "12:00"): false,
+			at(22, "12:00"): true,
+			at(23, "13:00"): false,
+		},
+		"except days=sun": {
+			at(25, "12:00"): false,
+			at(24, "12:00"): true,
+		},
+	}
+
+	for src, checks := range cases {
+		sch, err := user.ParseSchedule(src)
+		if err != nil {
+			t.Fatalf("could not parse %q: %s", src, err)
+		}
+
+		for when, expected := range checks {
+			if got := sch.AllowedAt(when); got != expected {
+				t.Errorf("%q at %s: expected %v, got %v", src, when.Format("Mon 2006-01-02 15:04"), expected, got)
+			}
+		}
+	}
+}
+
+func TestScheduleParseErrors(t *testing.T) {
+	for src, message := range map[string]string{
+		"days":                        "expected key=value",
+		"days=":                       "expected key=value",
+		"days=1-5 days=6":             "more than once",
+		"weeks=1":                     "unknown condition",
+		"days=7":                      "out of range",
+		"days=mon,":                   "unknown day",
+		"days=someday":                "unknown day",
+		"hours=9":                     "range of hours",
+		"hours=9-25":                  "out of range",
+		"hours=9:005-10":              "two digits",
+		"hours=9.5.5-10":              "invalid hour",
+		"hours=-0.5-10":               "invalid hour",
+		"hours=9:60-10":               "00 through 59",
+		"hours=9-9":                   "same time",
+		"hours=a-b":                   "invalid hour",
+		"dates=2026-02-30":            "invalid date",
+		"dates=2026-10-22/2026-10-20": "end before they start",
+		"days=mon;;days=tue":          "window 2 is empty",
+		"except":                      "nothing after",
+		"days=mon; exceptdays=tue":    "window 2",
+	} {
+		_, err := user.ParseSchedule(src)
+		if err == nil {
+			t.Errorf("expected %q to fail", src)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), message) {
+			t.Errorf("expected error for %q to mention %q, got: %s", src, message, err)
+		}
+	}
+}
+
+// TestScheduleLegacy parses schedules as stored before they had windows, when
+// hours could be fractional and minutes a single digit
+func TestScheduleLegacy(t *testing.T) {
+	cases := map[string]map[time.Time]bool{
+		"days=1-5 hours=9.5-17": {
+			at(19, "09:29"): false,
+			at(19, "09:30"): true,
+			at(19, "16:59"): true,
+			at(19, "17:00"): false,
+			at(24, "12:00"): false,
+		},
+		"hours=9:5-17.75": {
+			at(19, "09:04"): false,
+			at(19, "09:05"): true,
+			at(19, "17:44"): true,
+			at(19, "17:45"): false,
+		},
+		"days=0-6 hours=0.0-24.0": {
+			at(19, "00:00"): true,
+			at(25, "23:59"): true,
+		},
+		// the grammar rejects these, so they are read like earlier versions did
+		"days=1-5 hours=9-17 note=x": {
+			at(19, "10:00"): true,
+			at(19, "17:00"): false,
+			at(24, "10:00"): false,
+		},
+		"days=0-9 hours=9.1-25": {
+			at(19, "09:05"): false,
+			at(19, "09:06"): true,
+			at(25, "23:59"): true,
+		},
+		"days=5-1 hours=9-17 note=x": {
+			at(19, "10:00"): false,
+			at(23, "10:00"): false,
+		},
+		"hours=17-9 note=x": {
+			at(19, "08:00"): false,
+			at(19, "18:00"): false,
+		},
+	}
+
+	for src, checks := range cases {
+		sch := &user.Schedule{}
+		if err := sch.Scan(src); err != nil {
+			t.Fatalf("could not scan legacy schedule %q: %s", src, err)
+		}
+
+		if sch.String() != src {
+			t.Errorf("expected %q to be kept as is, got %q", src, sch.String())
+		}
+
+		for when, expected := range checks {
+			if got := sch.AllowedAt(when); got != expected {
+				t.Errorf("%q at %s: expected %v, got %v", src, when.Format("Mon 2006-01-02 15:04"), expected, got)
+			}
+		}
+	}
+
+	for _, src := range []string{"days", "days=mon-fri note=x", "days=1-5 hours=9", "hours=9:a-17"} {
+		if err := (&user.Schedule{}).Scan(src); err == nil {
+			t.Errorf("expected %q to fail to scan", src)
+		}
+	}
+}
+
+// TestScheduleStoredLegacy loads users whose schedules were stored before the
+// grammar was validated, which must not keep anyone else from loading
+func TestScheduleStoredLegacy(t *testing.T) {
+	sess := testdb.Open(t)
+	for _, handle := range []string{"legacy", "current"} {
+		if _, err := sess.Collection("user").Insert(&user.User{Handle: handle, Name: handle}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := sess.SQL().Exec("UPDATE user SET schedule = ? WHERE handle = ?", []byte(`"days=1-5 hours=9-17 note=x"`), "legacy"); err != nil {
+		t.Fatal(err)
+	}
+
+	users := []*user.User{}
+	if err := sess.Collection("user").Find().OrderBy("handle").All(&users); err != nil {
+		t.Fatalf("could not load users: %s", err)
+	}
+
+	if len(users) != 2 || users[1].Schedule == nil || !users[1].Schedule.AllowedAt(at(19, "10:00")) || users[1].Schedule.AllowedAt(at(24, "10:00")) {
+		t.Fatalf("expected the legacy schedule to load as stored, got %+v", users)
+	}
+}
+
+func TestScheduleRoundTrip(t *testing.T) {
+	src := "days=mon-fri hours=22:00-02:00,9-13; except dates=2026-12-24/2026-12-25"
+	original, err := user.ParseSchedule(src)
+	if err != nil {
+		t.Fatalf("could not parse schedule: %s", err)
+	}
+
+	encoded, err := json.Marshal(original)
+	if err != nil {
+		t.Fatalf("could not marshal schedule: %s", err)
+	}
+
+	fromJSON := &user.Schedule{}
+	if err := json.Unmarshal(encoded, fromJSON); err != nil {
+		t.Fatalf("could not unmarshal schedule: %s", err)
+	}
+
+	stored, err := original.MarshalDB()
+	if err != nil {
+		t.Fatalf("could not marshal schedule for db: %s", err)
+	}
+
+	fromDB := &user.Schedule{}
+	if err := fromDB.Scan(stored); err != nil {
+		t.Fatalf("could not scan schedule: %s", err)
+	}
+
+	for _, sch := range []*user.Schedule{fromJSON, fromDB} {
+		if sch.String() != src {
+			t.Fatalf("expected %q after round trip, got %q", src, sch.String())
+		}
+
+		for _, when := range []time.Time{at(19, "23:00"), at(20, "01:00"), at(20, "12:00"), at(20, "18:00")} {
+			if sch.AllowedAt(when) != original.AllowedAt(when) {
+				t.Errorf("round tripped schedule disagrees at %s", when)
+			}
+		}
+	}
+
+	if err := json.Unmarshal([]byte(`"hours=nope"`), &user.Schedule{}); err == nil {
+		t.Fatal("expected unmarshaling an invalid schedule to fail")
+	}
+}
@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright © 2022 Roberto Hidalgo <nidito@un.rob.mx>
+package user
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/upper/db/v4"
+)
+
+const (
+	// TOTPPeriod is the RFC 6238 time step
+	TOTPPeriod = 30 * time.Second
+	// TOTPDigits is the length of generated codes
+	TOTPDigits = 6
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// sealedPrefix marks encrypted secrets
+const sealedPrefix = "aes-gcm:"
+
+var totpKey []byte
+
+// UseTOTPKey derives the key TOTP secrets are encrypted with from
+// auth.session_key. Without one, secrets can't be stored
+func UseTOTPKey(sessionKey string) {
+	if sessionKey == "" {
+		totpKey = nil
+		return
+	}
+
+	mac := hmac.New(sha256.New, []byte(sessionKey))
+	mac.Write([]byte("puerta totp secret"))
+	totpKey = mac.Sum(nil)
+}
+
+func totpCipher() (cipher.AEAD, error) {
+	if totpKey == nil {
+		return nil, fmt.Errorf("auth.session_key must be set to store totp secrets")
+	}
+
+	block, err := aes.NewCipher(totpKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// TOTPSecret is the base32 shared secret of a TOTP, encrypted with AES-GCM
+// when stored
+type TOTPSecret string
+
+func (s TOTPSecret) MarshalDB() (any, error) {
+	gcm, err := totpCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(s), nil)
+	return sealedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *TOTPSecret) Scan(value any) error {
+	var str string
+	switch v := value.(type) {
+	case string:
+		str = v
+	case []byte:
+		str = string(v)
+	default:
+		return fmt.Errorf("cannot scan totp secret from %T", value)
+	}
+
+	if !strings.HasPrefix(str, sealedPrefix) {
+		return fmt.Errorf("totp secret is not encrypted")
+	}
+
+	gcm, err := totpCipher()
+	if err != nil {
+		return err
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(str, sealedPrefix))
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return fmt.Errorf("could not decode totp secret")
+	}
+
+	secret, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return fmt.Errorf("could not decrypt totp secret, was auth.session_key changed? %w", err)
+	}
+
+	*s = TOTPSecret(secret)
+	return nil
+}
+
+// TOTP is a RFC 6238 second factor. LastCounter holds the time step of the
+// last accepted code, so codes cannot be replayed
+type TOTP struct {
+	UserID      int        `db:"user"`
+	Secret      TOTPSecret `db:"secret"`
+	LastCounter int64      `db:"last_counter"`
+}
+
+// NewTOTP returns a TOTP with a fresh random secret for a user
+func NewTOTP(u *User) (*TOTP, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("could not generate totp secret: %w", err)
+	}
+
+	return &TOTP{UserID: u.ID, Secret: TOTPSecret(b32.EncodeToString(secret))}, nil
+}
+
+func (t *TOTP) Store(sess db.Session) db.Store {
+	return sess.Collection("totp")
+}
+
+// URI returns the otpauth:// uri authenticator apps enroll with
+func (t *TOTP) URI(issuer, account string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	q := url.Values{}
+	q.Set("secret", string(t.Secret))
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprintf("%d", TOTPDigits))
+	q.Set("period", fmt.Sprintf("%d", int(TOTPPeriod.Seconds())))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// Code returns the code for the given time step
+func (t *TOTP) Code(counter int64) (string, error) {
+	key, err := b32.DecodeString(strings.ToUpper(string(t.Secret)))
+	if err != nil {
+		return "", fmt.Errorf("could not decode totp secret: %w", err)
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", TOTPDigits, value%mod), nil
+}
+
+// TOTPCounter returns the time step for t
+func TOTPCounter(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod.Seconds())
+}
+
+// Validate checks code against the time steps around at, allowing for skew
+// steps of clock drift in either direction. It returns the matching time step,
+// and fails for steps at or before LastCounter
+func (t *TOTP) Validate(code string, at time.Time, skew int) (int64, error) {
+	code = strings.TrimSpace(code)
+	if len(code) != TOTPDigits {
+		return 0, fmt.Errorf("invalid totp code length")
+	}
+
+	current := TOTPCounter(at)
+	for i := -skew; i <= skew; i++ {
+		counter := current + int64(i)
+		expected, err := t.Code(counter)
+		if err != nil {
+			return 0, err
+		}
+
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			if counter <= t.LastCounter {
+				return 0, fmt.Errorf("totp code already used")
+			}
+			return counter, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid totp code")
+}
+
+var _ db.Record = &TOTP{}
@@ -0,0 +1,108 @@
+package user_test
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"git.rob.mx/nidito/puerta/internal/testdb"
+	"git.rob.mx/nidito/puerta/internal/user"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238, appendix B, truncated to 6 digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	totp := &user.TOTP{Secret: user.TOTPSecret(secret)}
+
+	cases := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for ts, expected := range cases {
+		code, err := totp.Code(user.TOTPCounter(time.Unix(ts, 0)))
+		if err != nil {
+			t.Fatalf("could not generate code for %d: %s", ts, err)
+		}
+
+		if code != expected {
+			t.Fatalf("bad code for %d, expected %s, got %s", ts, expected, code)
+		}
+	}
+}
+
+func TestTOTPValidate(t *testing.T) {
+	totp, err := user.NewTOTP(&user.User{})
+	if err != nil {
+		t.Fatalf("could not create totp: %s", err)
+	}
+
+	now := time.Now()
+	previous, _ := totp.Code(user.TOTPCounter(now) - 1)
+	if _, err := totp.Validate(previous, now, 0); err == nil {
+		t.Fatalf("accepted code outside of skew window")
+	}
+
+	counter, err := totp.Validate(previous, now, 1)
+	if err != nil {
+		t.Fatalf("rejected code within skew window: %s", err)
+	}
+
+	totp.LastCounter = counter
+	if _, err := totp.Validate(previous, now, 1); err == nil {
+		t.Fatalf("accepted replayed code")
+	}
+}
+
+func TestTOTPSecretEncryption(t *testing.T) {
+	sess := testdb.Open(t)
+	user.UseTOTPKey("")
+	if _, err := sess.Collection("totp").Insert(&user.TOTP{UserID: 1, Secret: "JBSWY3DPEHPK3PXP"}); err == nil {
+		t.Fatalf("expected secrets not to be stored without a key")
+	}
+
+	user.UseTOTPKey("key")
+	defer user.UseTOTPKey("")
+	if _, err := sess.Collection("totp").Insert(&user.TOTP{UserID: 1, Secret: "GEZDGNBVGY3TQOJQ"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var raw []struct {
+		Secret string `db:"secret"`
+	}
+	if err := sess.SQL().Select("secret").From("totp").All(&raw); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range raw {
+		if !strings.HasPrefix(row.Secret, "aes-gcm:") {
+			t.Errorf("expected an encrypted secret, got %s", row.Secret)
+		}
+	}
+
+	u := &user.User{ID: 1, AllowTOTP: true}
+	if err := u.FetchTOTP(sess); err != nil || !u.HasTOTP() {
+		t.Fatalf("could not fetch totp: %v", err)
+	}
+
+	code, _ := (&user.TOTP{Secret: "GEZDGNBVGY3TQOJQ"}).Code(user.TOTPCounter(time.Now()))
+	if err := u.ValidateTOTP(sess, code, time.Now(), 0); err != nil {
+		t.Errorf("expected the decrypted secret to validate: %s", err)
+	}
+
+	// secrets are only ever stored encrypted, so anything else was tampered with
+	if _, err := sess.SQL().InsertInto("totp").Values(2, "JBSWY3DPEHPK3PXP", 0).Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&user.User{ID: 2}).FetchTOTP(sess); err == nil {
+		t.Errorf("expected a plaintext secret to be rejected")
+	}
+
+	user.UseTOTPKey("other key")
+	if err := (&user.User{ID: 1}).FetchTOTP(sess); err == nil {
+		t.Errorf("expected secrets not to decrypt with another key")
+	}
+}
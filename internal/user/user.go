@@ -10,10 +10,10 @@ import (
 
 	"git.rob.mx/nidito/puerta/internal/constants"
 	"git.rob.mx/nidito/puerta/internal/errors"
+	"git.rob.mx/nidito/puerta/internal/i18n"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/sirupsen/logrus"
 	"github.com/upper/db/v4"
-	"golang.org/x/crypto/bcrypt"
 )
 
 func FromContext(req *http.Request) *User {
@@ -26,19 +26,42 @@ func FromContext(req *http.Request) *User {
 }
 
 type User struct {
-	ID          int       `db:"id,omitempty" json:"-"`
-	Expires     *UTCTime  `db:"expires,omitempty" json:"expires,omitempty"`
-	Greeting    string    `db:"greeting" json:"greeting"`
-	Handle      string    `db:"handle" json:"handle"`
-	IsAdmin     bool      `db:"is_admin" json:"is_admin"`
-	Name        string    `db:"name" json:"name"`
-	Password    string    `db:"password" json:"password"`
-	Require2FA  bool      `db:"second_factor" json:"second_factor"`
-	Schedule    *Schedule `db:"schedule,omitempty" json:"schedule,omitempty"`
-	TTL         *TTL      `db:"max_ttl,omitempty" json:"max_ttl,omitempty"`
-	IsNotified  bool      `db:"receives_notifications" json:"receives_notifications"`
+	ID         int       `db:"id,omitempty" json:"-"`
+	Expires    *UTCTime  `db:"expires,omitempty" json:"expires,omitempty"`
+	Greeting   string    `db:"greeting" json:"greeting"`
+	Handle     string    `db:"handle" json:"handle"`
+	Name       string    `db:"name" json:"name"`
+	Password   string    `db:"password" json:"password"`
+	Require2FA bool      `db:"second_factor" json:"second_factor"`
+	Role       string    `db:"role" json:"role"`
+	Schedule   *Schedule `db:"schedule,omitempty" json:"schedule,omitempty"`
+	TTL        *TTL      `db:"max_ttl,omitempty" json:"max_ttl,omitempty"`
+	IsNotified bool      `db:"receives_notifications" json:"receives_notifications"`
+	AllowTOTP  bool      `db:"allow_totp" json:"allow_totp"`
+	// MaxSessions is the number of devices a user can be logged in at once, 0 means no limit
+	MaxSessions int `db:"max_sessions" json:"max_sessions"`
+	// MaxEntries limits how many times the user can open the door, 0 means no limit
+	MaxEntries int `db:"max_entries" json:"max_entries"`
+	// MaxDailyEntries limits entries per day in the user's timezone, 0 means no limit
+	MaxDailyEntries int `db:"max_daily_entries" json:"max_daily_entries"`
+	// MaxWindowEntries limits entries during each window of the user's schedule, 0 means no limit
+	MaxWindowEntries int `db:"max_window_entries" json:"max_window_entries"`
+	// SingleUse users expire right after they first come in
+	SingleUse bool `db:"single_use" json:"single_use"`
+	// AskApproval lets the user ask to be let in outside of their schedule
+	AskApproval bool `db:"ask_approval" json:"ask_approval"`
+	// Timezone evaluates the user's schedule, the house's is used when empty
+	Timezone string `db:"timezone" json:"timezone,omitempty"`
+	// Locale picks the language of messages shown to the user, see i18n.Languages
+	Locale string `db:"locale" json:"locale,omitempty"`
+	// OIDCIssuer and OIDCSubject identify the user at an oidc provider once they sign in with it
+	OIDCIssuer  string `db:"oidc_issuer" json:"oidc_issuer,omitempty"`
+	OIDCSubject string `db:"oidc_subject" json:"oidc_subject,omitempty"`
 	subs        []*Subscription
 	credentials []*Credential
+	totp        *TOTP
+	role        *Role
+	groups      []*Group
 }
 
 func (u *User) WebAuthnID() []byte {
@@ -99,9 +122,94 @@ func (u *User) DeleteCredentials(sess db.Session) error {
 	return nil
 }
 
+// Passkeys lists the credentials fetched for the user
+func (u *User) Passkeys() []*Passkey {
+	res := []*Passkey{}
+	for _, c := range u.credentials {
+		res = append(res, c.Passkey())
+	}
+	return res
+}
+
+// DeleteCredential deletes one of the user's fetched credentials by its id
+func (u *User) DeleteCredential(sess db.Session, id string) error {
+	for i, c := range u.credentials {
+		if c.ID() != id {
+			continue
+		}
+
+		err := sess.Collection("credential").Find(db.Cond{"user": u.ID, "data": c.Data}).Delete()
+		if err != nil {
+			return err
+		}
+		u.credentials = append(u.credentials[:i], u.credentials[i+1:]...)
+		logrus.Debugf("deleted credential %s for %d", id, u.ID)
+		return nil
+	}
+
+	return db.ErrNoMoreRows
+}
+
+func (u *User) FetchTOTP(sess db.Session) error {
+	totp := &TOTP{}
+	err := sess.Collection("totp").Find(db.Cond{"user": u.ID}).One(totp)
+	if err != nil {
+		if err == db.ErrNoMoreRows {
+			u.totp = nil
+			return nil
+		}
+		logrus.Errorf("could not fetch totp: %s", err)
+		return err
+	}
+	u.totp = totp
+
+	return nil
+}
+
+func (u *User) DeleteTOTP(sess db.Session) error {
+	err := sess.Collection("totp").Find(db.Cond{"user": u.ID}).Delete()
+	if err != nil {
+		return err
+	}
+	u.totp = nil
+	logrus.Debugf("deleted totp for %d", u.ID)
+
+	return nil
+}
+
+// ValidateTOTP checks a code against the user's TOTP, and records its time step
+// so it can't be used again
+func (u *User) ValidateTOTP(sess db.Session, code string, at time.Time, skew int) error {
+	if u.totp == nil {
+		return fmt.Errorf("user has no totp configured")
+	}
+
+	counter, err := u.totp.Validate(code, at, skew)
+	if err != nil {
+		return err
+	}
+
+	// only update if no other request consumed this or a later step in the meantime
+	res, err := sess.SQL().
+		Update("totp").
+		Set("last_counter", counter).
+		Where(db.Cond{"user": u.ID, "last_counter <": counter}).
+		Exec()
+	if err != nil {
+		return err
+	}
+
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return fmt.Errorf("totp code already used")
+	}
+	u.totp.LastCounter = counter
+
+	return nil
+}
+
 func (o *User) UnmarshalJSON(b []byte) error {
 	type alias User
-	xo := &alias{TTL: &DefaultTTL}
+	xo := &alias{TTL: &DefaultTTL, MaxSessions: 1, Role: RoleGuest}
 	if err := json.Unmarshal(b, xo); err != nil {
 		return err
 	}
@@ -117,24 +225,142 @@ func (u *User) MarshalJSON() ([]byte, error) {
 	return json.Marshal(x)
 }
 
+// Location returns the user's timezone, or fallback when they have none
+func (user *User) Location(fallback *time.Location) *time.Location {
+	if user.Timezone == "" {
+		return fallback
+	}
+
+	loc, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		logrus.Errorf("unknown timezone %s for %s, using %s", user.Timezone, user.Handle, fallback)
+		return fallback
+	}
+	return loc
+}
+
+// Language returns the language to show messages in for a request, preferring
+// the locale of its user over the Accept-Language header
+func Language(req *http.Request) string {
+	locale := ""
+	if u := FromContext(req); u != nil {
+		locale = u.Locale
+	}
+	return i18n.Negotiate(locale, req.Header.Get("Accept-Language"))
+}
+
+// ValidateLocale normalizes a user's timezone and locale, failing for unknown ones
+func (user *User) ValidateLocale() error {
+	if user.Timezone != "" {
+		if _, err := time.LoadLocation(user.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q", user.Timezone)
+		}
+	}
+
+	if user.Locale != "" {
+		lang, err := i18n.Parse(user.Locale)
+		if err != nil {
+			return err
+		}
+		user.Locale = lang
+	}
+	return nil
+}
+
 func (user *User) Expired() bool {
 	return user.Expires != nil && user.Expires.Before(time.Now())
 }
 
-func (user *User) IsAllowed(t time.Time) error {
+// PruneExpired deletes users that expired longer than grace ago
+func PruneExpired(sess db.Session, grace time.Duration) (int64, error) {
+	users := []*User{}
+	if err := sess.Collection("user").Find(db.Cond{"expires IS NOT": nil}).All(&users); err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-grace)
+	ids := []int{}
+	for _, u := range users {
+		if u.Expires != nil && !u.Expires.Time().IsZero() && u.Expires.Before(cutoff) {
+			logrus.Infof("pruning user %s, expired at %s", u.Handle, u.Expires.Time())
+			ids = append(ids, u.ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	res, err := sess.SQL().DeleteFrom("user").Where(db.Cond{"id IN": ids}).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// IsAllowed tells if the user may come in at t, checking the house's calendar
+// of blackouts and overrides before their schedule
+func (user *User) IsAllowed(sess db.Session, t time.Time) error {
 	if user.Expired() {
-		return fmt.Errorf("usuario expirado, avísale a Roberto")
+		return i18n.Errorf(i18n.UserExpired)
+	}
+
+	calendar, err := HouseCalendarAt(sess, t)
+	if err != nil {
+		logrus.Errorf("could not read the house calendar: %s", err)
+		return i18n.Errorf(i18n.CalendarFailed)
+	}
+
+	if len(calendar) > 0 {
+		exempt, err := user.Can(sess, PermissionManageAdmins)
+		if err != nil {
+			return err
+		}
+
+		if overridden, err := calendar.Check(user, exempt, t); err != nil || overridden {
+			return err
+		}
 	}
 
 	if user.Schedule != nil && !user.Schedule.AllowedAt(t) {
-		return fmt.Errorf("accesso denegado, intente nuevamente en otro momento")
+		return ErrOutsideSchedule
 	}
 
 	return nil
 }
 
-func (user *User) Login(password string) error {
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+// NextWindows returns up to n windows the user's schedule allows them in after
+// from, ending when the user expires
+func (user *User) NextWindows(from time.Time, n int) []Window {
+	if user.Expired() {
+		return []Window{}
+	}
+
+	schedule := user.Schedule
+	if schedule == nil {
+		schedule = &Schedule{}
+	}
+
+	windows := []Window{}
+	for _, w := range schedule.NextWindows(from, n) {
+		if user.Expires != nil && !user.Expires.Time().IsZero() {
+			expires := user.Expires.Time().In(from.Location())
+			if !w.Start.Before(expires) {
+				break
+			}
+			if w.End.After(expires) {
+				w.End = expires
+			}
+		}
+		windows = append(windows, w)
+	}
+	return windows
+}
+
+// Login checks the user's password, storing it hashed with the current
+// parameters when it was hashed with outdated ones
+func (user *User) Login(sess db.Session, password string) error {
+	if !user.MatchesPassword(password) {
 		reason := fmt.Sprintf("Incorrect password for %s", user.Name)
 		return &errors.InvalidCredentials{Status: http.StatusForbidden, Reason: reason}
 	}
@@ -144,6 +370,12 @@ func (user *User) Login(password string) error {
 		return &errors.InvalidCredentials{Status: http.StatusForbidden, Reason: reason}
 	}
 
+	if user.NeedsRehash() {
+		if err := user.rehash(sess, password); err != nil {
+			logrus.Errorf("could not rehash the password of %s: %s", user.Handle, err)
+		}
+	}
+
 	return nil
 }
 
@@ -151,6 +383,11 @@ func (user *User) HasCredentials() bool {
 	return len(user.credentials) > 0
 }
 
+// HasTOTP tells if the user has a TOTP enrolled and is allowed to use it
+func (user *User) HasTOTP() bool {
+	return user.AllowTOTP && user.totp != nil
+}
+
 // implement interfaces
 var _ db.Record = &User{}
 var _ webauthn.User = &User{}
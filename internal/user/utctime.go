@@ -21,6 +21,12 @@ var _ db.Marshaler = &UTCTime{}
 var _ json.Marshaler = &UTCTime{}
 var _ json.Unmarshaler = &UTCTime{}
 
+// NewUTCTime wraps a time, i.e. to set a user's expiration
+func NewUTCTime(t time.Time) *UTCTime {
+	t = t.UTC().Truncate(time.Second)
+	return &UTCTime{src: t.Format(time.RFC3339), time: t}
+}
+
 func (t *UTCTime) Parse() (err error) {
 	if t.src == "" {
 		return fmt.Errorf("could not parse empty ttl")
@@ -53,6 +59,10 @@ func (t *UTCTime) Scan(value any) error {
 	return nil
 }
 
+func (t *UTCTime) Time() time.Time {
+	return t.time
+}
+
 func (t *UTCTime) Before(other time.Time) bool {
 	return t.time.Before(other)
 }
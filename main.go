@@ -36,6 +36,25 @@ func main() {
 	chinampa.Register(
 		admin.UserAddCommand,
 		admin.UserReset2faCommand,
+		admin.UserSessionsCommand,
+		admin.UserRevokeCommand,
+		admin.UserListCommand,
+		admin.UserShowCommand,
+		admin.UserUpdateCommand,
+		admin.UserDeleteCommand,
+		admin.UserExpireCommand,
+		admin.UserSetPasswordCommand,
+		admin.UserPromoteCommand,
+		admin.UserDemoteCommand,
+		admin.UserExportCommand,
+		admin.UserImportCommand,
+		admin.JobsRunCommand,
+		admin.RoleListCommand,
+		admin.RoleSetCommand,
+		admin.TokenCreateCommand,
+		admin.TokenListCommand,
+		admin.TokenRevokeCommand,
+		admin.BookingImportCommand,
 		hue.SetupHueCommand,
 		hue.TestHueCommand,
 		server.ServerCommand,
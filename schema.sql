@@ -9,12 +9,29 @@ CREATE TABLE user(
   max_ttl TEXT DEFAULT "30d", -- golang auth.TTL
   schedule TEXT, -- golang auth.UserSchedule
   second_factor BOOLEAN DEFAULT 1,
-  is_admin BOOLEAN DEFAULT 0 NOT NULL,
-  receives_notifications BOOLEAN DEFAULT 0 NOT NULL
+  receives_notifications BOOLEAN DEFAULT 0 NOT NULL,
+  allow_totp BOOLEAN DEFAULT 0 NOT NULL,
+  max_sessions INTEGER DEFAULT 1 NOT NULL, -- 0 means unlimited
+  role TEXT DEFAULT "guest" NOT NULL,
+  max_entries INTEGER DEFAULT 0 NOT NULL,
+  max_daily_entries INTEGER DEFAULT 0 NOT NULL,
+  max_window_entries INTEGER DEFAULT 0 NOT NULL,
+  single_use BOOLEAN DEFAULT 0 NOT NULL, -- expires after the first entry
+  entries INTEGER DEFAULT 0 NOT NULL, -- times the user came in
+  day_entries INTEGER DEFAULT 0 NOT NULL, -- since day_start
+  day_start TEXT DEFAULT "" NOT NULL, -- datetime
+  window_entries INTEGER DEFAULT 0 NOT NULL, -- since window_start
+  window_start TEXT DEFAULT "" NOT NULL, -- datetime of the schedule window's start
+  ask_approval BOOLEAN DEFAULT 0 NOT NULL,
+  timezone VARCHAR(64) DEFAULT "" NOT NULL,
+  locale VARCHAR(16) DEFAULT "" NOT NULL,
+  oidc_issuer TEXT DEFAULT "" NOT NULL,
+  oidc_subject TEXT DEFAULT "" NOT NULL -- unique per oidc_issuer once set
 );
 
 CREATE INDEX user_id ON user(id);
 CREATE INDEX user_handle ON user(handle);
+CREATE UNIQUE INDEX user_oidc ON user(oidc_issuer, oidc_subject) WHERE oidc_subject != "";
 
 CREATE TABLE credential(
   user INTEGER NOT NULL,
@@ -24,15 +41,46 @@ CREATE TABLE credential(
 
 CREATE INDEX credential_user ON credential(user);
 
+CREATE TABLE totp(
+  user INTEGER NOT NULL UNIQUE,
+  secret TEXT NOT NULL,
+  last_counter INTEGER DEFAULT 0 NOT NULL,
+  FOREIGN KEY(user) REFERENCES user(id) ON DELETE CASCADE
+);
+
+CREATE INDEX totp_user ON totp(user);
+
+CREATE TABLE recovery_code(
+  user INTEGER NOT NULL,
+  hash TEXT NOT NULL,
+  FOREIGN KEY(user) REFERENCES user(id) ON DELETE CASCADE
+);
+
+CREATE INDEX recovery_code_user ON recovery_code(user);
+
 
 CREATE TABLE session(
-  token TEXT PRIMARY KEY,
+  hash TEXT PRIMARY KEY,
+  id TEXT NOT NULL UNIQUE,
   user INTEGER NOT NULL,
-  expires TEXT NOT NULL, -- datetime
+  expires DATETIME NOT NULL,
+  created DATETIME NOT NULL,
+  last_seen DATETIME NOT NULL,
+  ip_address VARCHAR(255) DEFAULT "" NOT NULL,
+  user_agent VARCHAR(255) DEFAULT "" NOT NULL,
+  legacy BOOLEAN DEFAULT 0 NOT NULL, -- hash holds a plain text token until migrated
   FOREIGN KEY(user) REFERENCES user(id) ON DELETE CASCADE
 );
 
-CREATE INDEX session_token ON session(token);
+CREATE INDEX session_user ON session(user);
+
+CREATE TABLE challenge(
+  token TEXT PRIMARY KEY,
+  data BLOB NOT NULL,
+  expiry DATETIME NOT NULL
+);
+
+CREATE INDEX challenge_expiry ON challenge(expiry);
 
 CREATE TABLE log(
   timestamp TEXT PRIMARY KEY,
@@ -41,7 +89,10 @@ CREATE TABLE log(
   failure VARCHAR(255),
   error TEXT,
   ip_address varchar(255) NOT NULL,
-  user_agent varchar(255) NOT NULL
+  user_agent varchar(255) NOT NULL,
+  event VARCHAR(255) DEFAULT "rex" NOT NULL,
+  token TEXT DEFAULT "" NOT NULL, -- api token id
+  detail TEXT DEFAULT "" NOT NULL -- what a successful event did
 );
 
 CREATE TABLE subscription(
@@ -60,3 +111,132 @@ CREATE TABLE migrations (
   name TEXT NOT NULL,
   applied TEXT NOT NULL
 );
+
+CREATE TABLE api_token(
+  id TEXT PRIMARY KEY,
+  hash TEXT NOT NULL UNIQUE,
+  user INTEGER NOT NULL,
+  name TEXT DEFAULT "" NOT NULL,
+  kind VARCHAR(16) DEFAULT "personal" NOT NULL, -- personal or service
+  scopes TEXT NOT NULL, -- comma separated, see auth.Scope
+  skip_second_factor BOOLEAN DEFAULT 0 NOT NULL,
+  created_by VARCHAR(255) NOT NULL,
+  created DATETIME NOT NULL,
+  expires DATETIME,
+  last_used DATETIME,
+  FOREIGN KEY(user) REFERENCES user(id) ON DELETE CASCADE
+);
+
+CREATE INDEX api_token_user ON api_token(user);
+
+CREATE TABLE role(
+  name TEXT PRIMARY KEY,
+  description TEXT DEFAULT "" NOT NULL
+);
+
+CREATE TABLE role_permission(
+  role TEXT NOT NULL,
+  permission TEXT NOT NULL,
+  PRIMARY KEY(role, permission),
+  FOREIGN KEY(role) REFERENCES role(name) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+INSERT INTO role (name, description) VALUES
+  ("admin", "Manages everything"),
+  ("house-sitter", "Manages guests while the house is away"),
+  ("guest", "Opens the door within their schedule");
+
+INSERT INTO role_permission (role, permission) VALUES
+  ("admin", "door:open"),
+  ("admin", "log:view"),
+  ("admin", "users:guests"),
+  ("admin", "users:admins"),
+  ("admin", "devices:manage"),
+  ("house-sitter", "door:open"),
+  ("house-sitter", "log:view"),
+  ("house-sitter", "users:guests"),
+  ("guest", "door:open");
+
+CREATE TABLE booking(
+  uid TEXT PRIMARY KEY, -- the event's UID in its calendar
+  source VARCHAR(255) NOT NULL, -- the calendar it was imported from
+  user INTEGER NOT NULL,
+  summary TEXT DEFAULT "" NOT NULL,
+  check_in DATETIME NOT NULL,
+  check_out DATETIME NOT NULL,
+  cancelled BOOLEAN DEFAULT 0 NOT NULL,
+  updated DATETIME NOT NULL,
+  FOREIGN KEY(user) REFERENCES user(id) ON DELETE CASCADE
+);
+
+CREATE INDEX booking_user ON booking(user);
+CREATE INDEX booking_source ON booking(source);
+
+CREATE TABLE house_event(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  kind VARCHAR(16) NOT NULL, -- blackout or override
+  starts DATETIME NOT NULL,
+  ends DATETIME NOT NULL,
+  reason TEXT DEFAULT "" NOT NULL,
+  handles TEXT DEFAULT "" NOT NULL, -- comma separated, who the event applies to
+  roles TEXT DEFAULT "" NOT NULL, -- comma separated, who the event applies to
+  created_by VARCHAR(255) NOT NULL,
+  created DATETIME NOT NULL
+);
+
+CREATE INDEX house_event_ends ON house_event(ends);
+
+CREATE INDEX log_user_event ON log(user, event, timestamp);
+
+CREATE TABLE approval(
+  id TEXT PRIMARY KEY,
+  user INTEGER NOT NULL,
+  handle VARCHAR(255) NOT NULL,
+  status VARCHAR(16) NOT NULL, -- pending, approved, denied or expired
+  created DATETIME NOT NULL,
+  expires DATETIME NOT NULL,
+  decided_by VARCHAR(255) DEFAULT "" NOT NULL,
+  decided DATETIME,
+  FOREIGN KEY(user) REFERENCES user(id) ON DELETE CASCADE
+);
+
+CREATE INDEX approval_status ON approval(status, expires);
+
+CREATE TABLE user_group(
+  name TEXT PRIMARY KEY,
+  description TEXT DEFAULT "" NOT NULL,
+  schedule TEXT, -- golang user.Schedule
+  max_ttl TEXT, -- golang user.TTL
+  expires TEXT, -- datetime
+  receives_notifications BOOLEAN DEFAULT 0 NOT NULL
+);
+
+CREATE TABLE user_group_permission(
+  group_name TEXT NOT NULL,
+  permission TEXT NOT NULL,
+  PRIMARY KEY(group_name, permission),
+  FOREIGN KEY(group_name) REFERENCES user_group(name) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE user_group_member(
+  group_name TEXT NOT NULL,
+  user INTEGER NOT NULL,
+  PRIMARY KEY(group_name, user),
+  FOREIGN KEY(group_name) REFERENCES user_group(name) ON DELETE CASCADE ON UPDATE CASCADE,
+  FOREIGN KEY(user) REFERENCES user(id) ON DELETE CASCADE
+);
+
+CREATE INDEX user_group_member_user ON user_group_member(user);
+
+CREATE TABLE admin_log(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  timestamp TEXT NOT NULL,
+  actor TEXT NOT NULL, -- a handle, or cli:<system user>
+  action VARCHAR(64) NOT NULL, -- see audit.Action
+  target TEXT DEFAULT "" NOT NULL,
+  changes TEXT DEFAULT "[]" NOT NULL, -- json list of audit.Change
+  ip_address VARCHAR(255) DEFAULT "" NOT NULL
+);
+
+CREATE INDEX admin_log_timestamp ON admin_log(timestamp);
+CREATE INDEX admin_log_target ON admin_log(target, timestamp);